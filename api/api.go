@@ -0,0 +1,250 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/calibration"
+	"github.com/mlipscombe/boiler-mate/consumption"
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/history"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/units"
+	log "github.com/sirupsen/logrus"
+)
+
+const Prefix = "/api/v1"
+
+// Server exposes the monitor caches and settings writes over HTTP as JSON.
+// If History is set, the history endpoints are served from it, and if
+// Confirmer is set, dangerous writes must be sent with "confirm": true.
+// If AugerCalibration is set, the auger calibration can be run over HTTP,
+// and if Cost is set, what the pellets used cost is served.
+// Values are read and written as Format publishes them, which defaults to
+// the metric values the controller reports. Writes are refused unless Token
+// is set, and must then carry it as a bearer token. The stream can only
+// be opened by pages from the same host, or from AllowedOrigins, given as
+// scheme://host[:port], or "*" for any.
+type Server struct {
+	Format         units.Formatter
+	Token          string
+	AllowedOrigins []string
+	History        *history.Store
+	Confirmer      *control.Confirmer
+
+	AugerCalibration *calibration.AugerCalibration
+	Cost             *consumption.Cost
+
+	boiler   nbe.Boiler
+	writer   *control.Writer
+	monitors map[string]*monitor.Monitor
+	hub      *hub
+}
+
+type setRequest struct {
+	Value   interface{} `json:"value"`
+	Confirm bool        `json:"confirm"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func NewServer(boiler nbe.Boiler, writer *control.Writer, monitors map[string]*monitor.Monitor, events *bus.Bus) *Server {
+	s := &Server{
+		boiler:   boiler,
+		writer:   writer,
+		monitors: monitors,
+		hub:      newHub(),
+	}
+	events.OnChange(s.hub.broadcast)
+	return s
+}
+
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc(Prefix+"/operating_data", s.handleData("operating_data"))
+	mux.HandleFunc(Prefix+"/advanced_data", s.handleData("advanced_data"))
+	mux.HandleFunc(Prefix+"/settings/", s.handleSettings)
+	mux.HandleFunc(Prefix+"/dump", s.handleDump)
+	mux.HandleFunc(Prefix+"/consumption", s.handleConsumption)
+	mux.HandleFunc(Prefix+"/cost", s.handleCost)
+	mux.HandleFunc(Prefix+"/history/", s.handleHistory)
+	mux.HandleFunc(Prefix+"/stream", s.handleStream)
+	mux.HandleFunc(Prefix+"/events", s.handleEvents)
+	mux.HandleFunc(Prefix+"/calibration/auger", s.handleAugerCalibration)
+}
+
+func (s *Server) handleData(category string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		m, ok := s.monitors[category]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown category: %s", category))
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Format.FormatValues(category, m.Values()))
+	}
+}
+
+func (s *Server) handleDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	dump, err := nbe.DumpSettings(s.boiler)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, dump)
+}
+
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix+"/settings/"), "/"), "/")
+
+	if len(parts) == 2 && parts[0]+"."+parts[1] == control.PowerSwitch && r.Method == http.MethodPut {
+		if s.authorizeWrite(w, r) {
+			s.handleSet(w, r, parts[0], parts[1])
+		}
+		return
+	}
+
+	m, ok := s.monitors[parts[0]]
+	if !ok || !isSetting(parts[0]) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown category: %s", parts[0]))
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Format.FormatValues(parts[0], m.Values()))
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		val, ok := m.Get(parts[1])
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown key: %s.%s", parts[0], parts[1]))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{parts[1]: s.Format.Format(parts[0], parts[1], val)})
+	case len(parts) == 2 && r.Method == http.MethodPut:
+		if s.authorizeWrite(w, r) {
+			s.handleSet(w, r, parts[0], parts[1])
+		}
+	case len(parts) <= 2:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found: %s", r.URL.Path))
+	}
+}
+
+func (s *Server) handleSet(w http.ResponseWriter, r *http.Request, category string, key string) {
+	var req setRequest
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+	if req.Value == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing value"))
+		return
+	}
+
+	value, err := s.Format.Parse(category, key, []byte(valueString(req.Value)))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	path, value := control.Command(fmt.Sprintf("%s.%s", category, key), value)
+	if s.Confirmer != nil && s.Confirmer.Required(path) && !req.Confirm {
+		writeError(w, http.StatusPreconditionRequired, fmt.Errorf("%s must be confirmed, send again with \"confirm\": true", path))
+		return
+	}
+	response, err := s.writer.Set(control.SourceAPI, path, value)
+	if refused, ok := err.(*control.RefusedError); ok {
+		writeError(w, http.StatusForbidden, refused)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	log.Infof("Set %s to %s via API: %v", path, value, response)
+	if response.Status != 0 {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("controller rejected %s=%s (status %d)", path, value, response.Status))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"key":    path,
+		"value":  req.Value,
+		"status": response.Status,
+	})
+}
+
+// valueString formats a decoded request value as it would be written over
+// MQTT, spelling numbers out in full rather than in exponent notation.
+func valueString(v interface{}) string {
+	if n, ok := v.(json.Number); ok {
+		if f, err := n.Float64(); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// authorizeWrite writes an error and returns false unless writes are
+// enabled and r carries the token.
+func (s *Server) authorizeWrite(w http.ResponseWriter, r *http.Request) bool {
+	if s.Token == "" {
+		writeError(w, http.StatusForbidden, fmt.Errorf("writes are disabled, set -api-token to enable them"))
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="boiler-mate"`)
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid bearer token"))
+		return false
+	}
+	return true
+}
+
+func isSetting(category string) bool {
+	return contains(nbe.Settings, category)
+}
+
+func writeJSON(w http.ResponseWriter, status int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(val); err != nil {
+		log.Errorf("Failed to encode API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
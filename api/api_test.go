@@ -0,0 +1,191 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+const testToken = "s3cret"
+
+// newTestServer serves the API for a MockBoiler, once its operating data
+// and boiler settings have been polled, taking writes with token.
+func newTestServer(t *testing.T, token string) (*httptest.Server, *nbe.MockBoiler) {
+	t.Helper()
+	boiler := nbe.NewMockBoiler("12345")
+	events := bus.New()
+	writer := control.NewWriter(boiler, 0, 0)
+	writer.Start()
+
+	monitors := map[string]*monitor.Monitor{
+		"operating_data": monitor.NewMonitor(boiler, events, "operating_data", nbe.GetOperatingDataFunction, "*", time.Hour),
+		"boiler":         monitor.NewMonitor(boiler, events, "boiler", nbe.GetSetupFunction, "boiler.*", time.Hour),
+	}
+	for _, m := range monitors {
+		m.Start()
+		t.Cleanup(m.Stop)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for _, m := range monitors {
+		for m.LastPoll().IsZero() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	s := NewServer(boiler, writer, monitors, events)
+	s.Token = token
+	mux := http.NewServeMux()
+	s.Register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, boiler
+}
+
+func request(t *testing.T, method string, url string, token string, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	var decoded map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		t.Fatalf("decoding %s %s: %v", method, url, err)
+	}
+	return resp.StatusCode, decoded
+}
+
+func TestGet(t *testing.T) {
+	server, _ := newTestServer(t, testToken)
+
+	tests := []struct {
+		path   string
+		status int
+		key    string
+		want   interface{}
+	}{
+		{"/operating_data", http.StatusOK, "power_pct", 42.0},
+		{"/settings/boiler", http.StatusOK, "diff_over", 15.0},
+		{"/settings/boiler/temp", http.StatusOK, "temp", 65.0},
+		{"/settings/boiler/nope", http.StatusNotFound, "", nil},
+		{"/settings/nope/temp", http.StatusNotFound, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			status, body := request(t, http.MethodGet, server.URL+Prefix+tt.path, "", "")
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d (%v)", status, tt.status, body)
+			}
+			if tt.key != "" && body[tt.key] != tt.want {
+				t.Errorf("%s = %v, want %v", tt.key, body[tt.key], tt.want)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		body   string
+		status int
+		key    string
+		want   string
+	}{
+		{"no token", "/settings/boiler/temp", "", `{"value": 70}`, http.StatusUnauthorized, "boiler.temp", "65"},
+		{"wrong token", "/settings/boiler/temp", "wrong", `{"value": 70}`, http.StatusUnauthorized, "boiler.temp", "65"},
+		{"number", "/settings/boiler/temp", testToken, `{"value": 70}`, http.StatusOK, "boiler.temp", "70"},
+		{"string", "/settings/boiler/temp", testToken, `{"value": "71"}`, http.StatusOK, "boiler.temp", "71"},
+		{"no exponent", "/settings/boiler/diff_under", testToken, `{"value": 1e-7}`, http.StatusOK, "boiler.diff_under", "0.0000001"},
+		{"large number", "/settings/boiler/diff_under", testToken, `{"value": 12345678}`, http.StatusOK, "boiler.diff_under", "12345678"},
+		{"missing value", "/settings/boiler/temp", testToken, `{}`, http.StatusBadRequest, "boiler.temp", "65"},
+		{"unknown key", "/settings/boiler/nope", testToken, `{"value": 1}`, http.StatusUnprocessableEntity, "boiler.temp", "65"},
+		{"power off", "/settings/device/power_switch", testToken, `{"value": "OFF"}`, http.StatusOK, "misc.stop", "1"},
+		{"power on", "/settings/device/power_switch", testToken, `{"value": "ON"}`, http.StatusOK, "misc.start", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, boiler := newTestServer(t, testToken)
+			status, body := request(t, http.MethodPut, server.URL+Prefix+tt.path, tt.token, tt.body)
+			if status != tt.status {
+				t.Errorf("status = %d, want %d (%v)", status, tt.status, body)
+			}
+			if got, _ := boiler.Value(nbe.GetSetupFunction, tt.key); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetDisabledWithoutToken(t *testing.T) {
+	server, boiler := newTestServer(t, "")
+	status, _ := request(t, http.MethodPut, server.URL+Prefix+"/settings/device/power_switch", testToken, `{"value": "OFF"}`)
+	if status != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", status, http.StatusForbidden)
+	}
+	if got, _ := boiler.Value(nbe.GetSetupFunction, "misc.stop"); got != "0" {
+		t.Errorf("misc.stop = %q, want it unchanged", got)
+	}
+}
+
+func TestStreamOrigin(t *testing.T) {
+	tests := []struct {
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"", nil, true},
+		{"http://boiler.local:2112", nil, true},
+		{"http://BOILER.local:2112", nil, true},
+		{"http://boiler.local", nil, false},
+		{"https://evil.example.com", nil, false},
+		{"null", nil, false},
+		{"http://dashboard.local:8080", []string{"https://ha.example.com", " http://dashboard.local:8080/"}, true},
+		{"http://dashboard.local:8081", []string{"http://dashboard.local:8080"}, false},
+		{"https://dashboard.local:8080", []string{"http://dashboard.local:8080"}, false},
+		{"https://evil.example.com", []string{"*"}, true},
+	}
+	for _, tt := range tests {
+		s := &Server{AllowedOrigins: tt.allowed}
+		r := httptest.NewRequest(http.MethodGet, "http://boiler.local:2112"+Prefix+"/stream", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := s.checkOrigin(r); got != tt.want {
+			t.Errorf("origin %q allowing %q: got %v, want %v", tt.origin, tt.allowed, got, tt.want)
+		}
+	}
+}
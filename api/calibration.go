@@ -0,0 +1,78 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mlipscombe/boiler-mate/calibration"
+	"github.com/mlipscombe/boiler-mate/control"
+)
+
+type weightRequest struct {
+	Grams *float64 `json:"grams"`
+}
+
+// handleAugerCalibration reports the auger calibration on GET, starts a
+// calibration run on POST, and accepts the weight of the pellets fed on PUT.
+func (s *Server) handleAugerCalibration(w http.ResponseWriter, r *http.Request) {
+	if s.AugerCalibration == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("auger calibration is not available"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.AugerCalibration.Status())
+	case http.MethodPost:
+		if !s.authorizeWrite(w, r) {
+			return
+		}
+		if err := s.AugerCalibration.Start(control.SourceAPI); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, s.AugerCalibration.Status())
+	case http.MethodPut:
+		if !s.authorizeWrite(w, r) {
+			return
+		}
+		var req weightRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+			return
+		}
+		if req.Grams == nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("missing grams"))
+			return
+		}
+		err := s.AugerCalibration.Submit(control.SourceAPI, *req.Grams)
+		if err == calibration.ErrNotWeighing {
+			writeError(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.AugerCalibration.Status())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
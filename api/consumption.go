@@ -0,0 +1,157 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/consumption"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleConsumption exports consumption history as JSON or CSV, from the
+// history store if there is one, or else the latest data reported by the
+// controller. Supported query parameters are period (hours, days, months,
+// years), type (total, dhw), from and to (YYYY-MM-DD or RFC3339) and format
+// (json, csv).
+func (s *Server) handleConsumption(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	query := r.URL.Query()
+	period := query.Get("period")
+	if period == "" {
+		period = "days"
+	}
+	if !contains(consumption.Periods, period) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid period: %s", period))
+		return
+	}
+	t := query.Get("type")
+	if t != "" && !contains(consumption.Types, t) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid type: %s", t))
+		return
+	}
+	from, err := parseDate(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %v", err))
+		return
+	}
+	to, err := parseDate(query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %v", err))
+		return
+	}
+
+	var buckets []consumption.Bucket
+	if s.History != nil {
+		buckets, err = s.History.Consumption(period, t, from, to)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		m, ok := s.monitors["consumption_data"]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("consumption data is not being polled"))
+			return
+		}
+		buckets = consumption.Filter(consumption.Buckets(m.Values(), time.Now()), period, t, from, to)
+	}
+	if buckets == nil {
+		buckets = []consumption.Bucket{}
+	}
+
+	switch query.Get("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"consumption-%s.csv\"", period))
+		if err := consumption.WriteCSV(w, buckets); err != nil {
+			log.Errorf("Failed to write consumption CSV: %v", err)
+		}
+	case "", "json":
+		writeJSON(w, http.StatusOK, buckets)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid format: %s", query.Get("format")))
+	}
+}
+
+// costTotal is the consumption of a period and what it cost.
+type costTotal struct {
+	Kg   float64 `json:"kg"`
+	Cost float64 `json:"cost"`
+}
+
+type costResponse struct {
+	Currency   string               `json:"currency"`
+	PricePerKg float64              `json:"price_per_kg"`
+	Totals     map[string]costTotal `json:"totals"`
+}
+
+// handleCost serves the consumption and cost of today, yesterday, this week
+// and this month, from the latest data reported by the controller.
+func (s *Server) handleCost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if s.Cost == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no pellet price is configured"))
+		return
+	}
+	m, ok := s.monitors["consumption_data"]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("consumption data is not being polled"))
+		return
+	}
+
+	now := time.Now()
+	resp := costResponse{
+		Currency:   s.Cost.Currency,
+		PricePerKg: s.Cost.PricePerKg(),
+		Totals:     make(map[string]costTotal),
+	}
+	for key, kg := range consumption.Totals(consumption.Buckets(m.Values(), now), now) {
+		resp.Totals[key] = costTotal{Kg: math.Round(kg*10) / 10, Cost: s.Cost.Of(kg)}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleEvents serves the change stream as Server-Sent Events. Clients may
+// restrict the stream with one or more category query parameters, e.g.
+// ?category=operating_data&category=boiler or ?category=operating_data,boiler.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	categories := make(map[string]bool)
+	for _, param := range r.URL.Query()["category"] {
+		for _, category := range strings.Split(param, ",") {
+			if category = strings.TrimSpace(category); category != "" {
+				categories[category] = true
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stop nginx and friends from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := s.hub.subscribe()
+	defer s.hub.unsubscribe(events)
+
+	log.Debugf("Event client connected from %s", r.RemoteAddr)
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case change := <-events:
+			if len(categories) > 0 && !categories[change.Category] {
+				continue
+			}
+			change.Value = s.Format.Format(change.Category, change.Key, change.Value)
+			change.Previous = s.Format.Format(change.Category, change.Key, change.Previous)
+			data, err := json.Marshal(change)
+			if err != nil {
+				log.Errorf("Failed to marshal change event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: change\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			log.Debugf("Event client disconnected from %s", r.RemoteAddr)
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleHistory serves the recorded values of a single key as JSON or CSV,
+// at /api/v1/history/<category>/<key>?from=...&to=...&format=csv.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if s.History == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("history is not enabled"))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix+"/history/"), "/"), "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found: %s", r.URL.Path))
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := parseDate(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %v", err))
+		return
+	}
+	to, err := parseDate(query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %v", err))
+		return
+	}
+
+	points, err := s.History.History(parts[0], parts[1], from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range points {
+		points[i].Value = s.Format.Format(parts[0], parts[1], points[i].Value)
+	}
+
+	switch query.Get("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s.csv\"", parts[0], parts[1]))
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"timestamp", "value"})
+		for _, p := range points {
+			writer.Write([]string{p.Timestamp.Format(time.RFC3339), fmt.Sprintf("%v", p.Value)})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			log.Errorf("Failed to write history CSV: %v", err)
+		}
+	case "", "json":
+		writeJSON(w, http.StatusOK, points)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid format: %s", query.Get("format")))
+	}
+}
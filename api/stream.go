@@ -0,0 +1,148 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mlipscombe/boiler-mate/bus"
+	log "github.com/sirupsen/logrus"
+)
+
+const streamBufferSize = 256
+
+// hub fans out change events from the monitors to every connected stream
+// client. Slow clients have events dropped rather than blocking the monitors.
+type hub struct {
+	clients map[chan bus.Change]struct{}
+	mutex   sync.RWMutex
+}
+
+func newHub() *hub {
+	return &hub{
+		clients: make(map[chan bus.Change]struct{}),
+	}
+}
+
+func (h *hub) subscribe() chan bus.Change {
+	ch := make(chan bus.Change, streamBufferSize)
+	h.mutex.Lock()
+	h.clients[ch] = struct{}{}
+	h.mutex.Unlock()
+	return ch
+}
+
+func (h *hub) unsubscribe(ch chan bus.Change) {
+	h.mutex.Lock()
+	delete(h.clients, ch)
+	h.mutex.Unlock()
+}
+
+func (h *hub) broadcast(change bus.Change) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for ch := range h.clients {
+		select {
+		case ch <- change:
+		default:
+			log.Debugf("Stream client is too slow, dropping %s.%s", change.Category, change.Key)
+		}
+	}
+}
+
+// checkOrigin accepts requests without an Origin, which don't come from a
+// browser, and requests from pages served by the same host or from
+// AllowedOrigins. Otherwise any page a user visits could open the stream.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(strings.TrimSpace(allowed), "/"), origin) {
+			return true
+		}
+	}
+	log.Debugf("Refusing stream connection from %s with origin %s", r.RemoteAddr, origin)
+	return false
+}
+
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     s.checkOrigin,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("Failed to upgrade stream connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	events := s.hub.subscribe()
+	defer s.hub.unsubscribe(events)
+
+	log.Debugf("Stream client connected from %s", r.RemoteAddr)
+
+	// Drain incoming messages so that close frames and pongs are processed.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case change := <-events:
+			change.Value = s.Format.Format(change.Category, change.Key, change.Value)
+			change.Previous = s.Format.Format(change.Category, change.Key, change.Previous)
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(change); err != nil {
+				log.Debugf("Stream client %s went away: %v", r.RemoteAddr, err)
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			log.Debugf("Stream client disconnected from %s", r.RemoteAddr)
+			return
+		}
+	}
+}
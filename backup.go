@@ -0,0 +1,65 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// runBackup writes every setting, with its range and the controller's
+// info, to a JSON file that restore can read.
+func runBackup(args []string) error {
+	var controllerUrlOpt, logLevel, output string
+
+	flags := newCommandFlags("backup", &controllerUrlOpt, &logLevel)
+	flags.StringVar(&output, "output", "", "file to write the backup to, or - for stdout (default boiler-<serial>-<timestamp>.json)")
+	flags.Parse(args)
+
+	boiler, err := connectController(controllerUrlOpt, logLevel)
+	if err != nil {
+		return err
+	}
+	defer boiler.Close()
+
+	backup, err := nbe.BackupSettings(boiler)
+	if err != nil {
+		return err
+	}
+	for category, msg := range backup.Errors {
+		log.Warnf("Failed to read %s: %s", category, msg)
+	}
+
+	if output == "" {
+		output = fmt.Sprintf("boiler-%s-%s.json", backup.Serial, backup.Timestamp.Format("20060102-150405"))
+	}
+	if err := writeJSONOutput(output, backup); err != nil {
+		return err
+	}
+	if output != "-" {
+		count := 0
+		for _, values := range backup.Settings {
+			count += len(values)
+		}
+		fmt.Fprintf(os.Stderr, "Backed up %d settings in %d categories to %s\n", count, len(backup.Settings), output)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package bus passes events between the parts of boiler-mate in-process.
+// The monitors publish what they see, and outputs such as MQTT, Prometheus,
+// webhooks and the rules engine subscribe to what they need, so neither
+// side has to know about the other.
+package bus
+
+import (
+	"sync"
+	"time"
+)
+
+// Topic names a kind of event.
+type Topic string
+
+const (
+	// ChangeTopic events are Change values.
+	ChangeTopic Topic = "change"
+	// AlarmTopic events are Alarm values.
+	AlarmTopic Topic = "alarm"
+	// ConnectivityTopic events are Connectivity values.
+	ConnectivityTopic Topic = "connectivity"
+)
+
+// Change describes a single value that changed between two polls.
+// Previous is nil the first time a key is seen. Retained is set if, the
+// first time a key is seen, its value is what was already published to
+// MQTT and retained before a restart, so doesn't need publishing again.
+type Change struct {
+	Category  string      `json:"category"`
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value"`
+	Previous  interface{} `json:"previous,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+	Retained  bool        `json:"-"`
+}
+
+// Alarm is published when the boiler enters an alarm state, with Active
+// set, and again when it leaves it. Text is the name of the alarm state,
+// and Description explains it.
+type Alarm struct {
+	Timestamp   time.Time `json:"timestamp"`
+	State       int64     `json:"state"`
+	Text        string    `json:"text"`
+	Description string    `json:"description"`
+	Active      bool      `json:"active"`
+}
+
+// Connectivity is published when the connection to the controller or the
+// MQTT broker is lost or restored.
+type Connectivity struct {
+	Timestamp time.Time `json:"timestamp"`
+	Component string    `json:"component"`
+	Connected bool      `json:"connected"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Handler is called with every event published on the topics it is
+// subscribed to.
+type Handler func(event interface{})
+
+// Bus delivers events to subscribers. Handlers are called in the
+// publisher's goroutine, in the order they subscribed, so they must not
+// block; anything slow should queue the event and return. It is safe for
+// concurrent use.
+type Bus struct {
+	mutex    sync.RWMutex
+	handlers map[Topic][]Handler
+}
+
+func New() *Bus {
+	return &Bus{handlers: make(map[Topic][]Handler)}
+}
+
+// Subscribe calls handler with every event published on topic.
+func (b *Bus) Subscribe(topic Topic, handler Handler) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers[topic] = append(b.handlers[topic], handler)
+}
+
+// Publish delivers an event to everything subscribed to topic.
+func (b *Bus) Publish(topic Topic, event interface{}) {
+	b.mutex.RLock()
+	handlers := b.handlers[topic]
+	b.mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// OnChange subscribes to changes.
+func (b *Bus) OnChange(handler func(Change)) {
+	b.Subscribe(ChangeTopic, func(event interface{}) {
+		handler(event.(Change))
+	})
+}
+
+// OnAlarm subscribes to alarms being raised and cleared.
+func (b *Bus) OnAlarm(handler func(Alarm)) {
+	b.Subscribe(AlarmTopic, func(event interface{}) {
+		handler(event.(Alarm))
+	})
+}
+
+// OnConnectivity subscribes to connections being lost and restored.
+func (b *Bus) OnConnectivity(handler func(Connectivity)) {
+	b.Subscribe(ConnectivityTopic, func(event interface{}) {
+		handler(event.(Connectivity))
+	})
+}
@@ -0,0 +1,51 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package bus
+
+import (
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// Published remembers the values that were last published of values that
+// are computed rather than polled, such as totals, so that only those that
+// change are published again. It isn't safe for concurrent use.
+type Published map[string]interface{}
+
+// Changes returns a change for each of values of category that differs
+// from what was last published, with that as Previous, and remembers them.
+// Values are compared as the monitors compare them, so a RoundedFloat only
+// changes when it does to two decimal places.
+func (p Published) Changes(category string, values map[string]interface{}, now time.Time) []Change {
+	var changes []Change
+	for key, value := range values {
+		name := category + "." + key
+		previous, seen := p[name]
+		if seen && cmp.Equal(previous, value) {
+			continue
+		}
+		p[name] = value
+		change := Change{Category: category, Key: key, Value: value, Timestamp: now}
+		if seen {
+			change.Previous = previous
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
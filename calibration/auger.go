@@ -0,0 +1,185 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package calibration
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// The controller runs the auger for six minutes when AugerKey is set, and
+// clears it again afterwards. The pellets fed are then weighed, and the
+// weight in grams is the capacity, in g/6min, written to CapacityKey.
+const (
+	AugerKey    = "auger.start_calibrate"
+	CapacityKey = "auger.capacity"
+)
+
+// Weighing is published while the auger calibration waits for the pellets
+// it fed to be weighed.
+const Weighing = "weighing"
+
+const (
+	augerRunDuration = 6 * time.Minute
+	augerTimeout     = 10 * time.Minute
+
+	// Weights outside this range are surely a mistake, such as kg given
+	// instead of g.
+	minCapacity = 50
+	maxCapacity = 10000
+)
+
+var ErrNotWeighing = errors.New("the auger calibration is not waiting for a weight")
+
+// AugerCalibration guides the auger capacity calibration: starting the
+// controller's calibration run with the boiler off, following it until the
+// auger stops, and then waiting for the weight of the pellets fed to write
+// it back as the capacity.
+type AugerCalibration struct {
+	writer     *control.Writer
+	mqttClient *mqtt.Client
+	monitors   map[string]*monitor.Monitor
+	status     Status
+	mutex      sync.Mutex
+}
+
+func NewAuger(writer *control.Writer, mqttClient *mqtt.Client, monitors map[string]*monitor.Monitor) *AugerCalibration {
+	c := &AugerCalibration{
+		writer:     writer,
+		mqttClient: mqttClient,
+		monitors:   monitors,
+	}
+	c.publish(Status{Status: Idle, Message: "No auger calibration has been run"})
+	return c
+}
+
+// Status returns the current state of the calibration.
+func (c *AugerCalibration) Status() Status {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.status
+}
+
+// Start begins a calibration run requested by source.
+func (c *AugerCalibration) Start(source string) error {
+	c.mutex.Lock()
+	if c.status.Status == Running || c.status.Status == Weighing {
+		c.mutex.Unlock()
+		return ErrRunning
+	}
+	c.status.Status = Running
+	c.mutex.Unlock()
+
+	if value, ok := c.monitors["operating_data"].Get("state"); ok {
+		if state, _ := value.(int64); state != stateOff {
+			c.finish(Status{Status: Failed, Message: fmt.Sprintf("The boiler must be off to calibrate the auger, but is %q", nbe.PowerStateText(state))})
+			return nil
+		}
+	}
+
+	started := time.Now()
+	c.publish(Status{Status: Running, Message: "Starting the auger, put a container under it", Started: started})
+	response, err := c.writer.Set(source, AugerKey, []byte("1"))
+	if err != nil {
+		c.finish(Status{Status: Failed, Message: fmt.Sprintf("Failed to start the auger: %v", err), Started: started})
+		return nil
+	}
+	if response.Status != 0 {
+		c.finish(Status{Status: Failed, Message: fmt.Sprintf("The controller refused to start the auger (status %d)", response.Status), Started: started})
+		return nil
+	}
+
+	go c.follow(started)
+	return nil
+}
+
+func (c *AugerCalibration) follow(started time.Time) {
+	auger := c.monitors["auger"]
+	seen := false
+	for time.Since(started) < augerTimeout {
+		time.Sleep(checkInterval)
+
+		value, _ := auger.Get("start_calibrate")
+		flag, _ := value.(int64)
+		if flag != 0 {
+			seen = true
+		} else if seen || time.Since(started) > augerRunDuration+checkInterval {
+			c.publish(Status{Status: Weighing, Progress: 100, Message: "Weigh the pellets fed and enter their weight in grams", Started: started})
+			return
+		}
+
+		progress := int(math.Min(99, 100*time.Since(started).Seconds()/augerRunDuration.Seconds()))
+		c.publish(Status{Status: Running, Progress: progress, Message: "Feeding pellets", Started: started})
+	}
+	c.finish(Status{Status: Failed, Message: fmt.Sprintf("The auger did not stop within %s", augerTimeout), Started: started})
+}
+
+// Submit writes the weight, in grams, of the pellets fed by the last run
+// as the auger capacity.
+func (c *AugerCalibration) Submit(source string, grams float64) error {
+	status := c.Status()
+	if status.Status != Weighing {
+		return ErrNotWeighing
+	}
+	if grams < minCapacity || grams > maxCapacity {
+		return fmt.Errorf("%g g is not a plausible weight, expected %d to %d g", grams, minCapacity, maxCapacity)
+	}
+
+	value := strconv.FormatFloat(math.Round(grams), 'f', 0, 64)
+	response, err := c.writer.Set(source, CapacityKey, []byte(value))
+	if err != nil {
+		return fmt.Errorf("writing capacity: %v", err)
+	}
+	if response.Status != 0 {
+		return fmt.Errorf("the controller refused the capacity (status %d)", response.Status)
+	}
+	c.finish(Status{Status: Success, Progress: 100, Message: fmt.Sprintf("Auger capacity set to %s g/6min", value), Started: status.Started})
+	return nil
+}
+
+func (c *AugerCalibration) finish(status Status) {
+	if status.Status == Failed {
+		log.Errorf("Auger calibration failed: %s", status.Message)
+	} else {
+		log.Infof("Auger calibration: %s", status.Message)
+	}
+	c.publish(status)
+}
+
+func (c *AugerCalibration) publish(status Status) {
+	c.mutex.Lock()
+	c.status = status
+	c.mutex.Unlock()
+
+	go c.mqttClient.PublishMany("auger_calibration", map[string]interface{}{
+		"status":     status.Status,
+		"progress":   status.Progress,
+		"message":    status.Message,
+		"attributes": status,
+	})
+}
@@ -0,0 +1,188 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package calibration
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Key is the setting that starts a calibration. The controller clears it
+// again once the calibration has finished.
+const Key = "oxygen.start_calibrate"
+
+// Statuses published on <prefix>/calibration/status.
+const (
+	Idle    = "idle"
+	Running = "running"
+	Success = "success"
+	Failed  = "failed"
+)
+
+const (
+	// The controller doesn't report progress, so it is estimated from the
+	// time a calibration usually takes.
+	expectedDuration = 3 * time.Minute
+	timeout          = 10 * time.Minute
+	checkInterval    = 5 * time.Second
+
+	// The sensor is calibrated in air, so a good calibration reads close
+	// to the oxygen content of the atmosphere.
+	airOxygen = 20.9
+	tolerance = 1.0
+
+	stateOff = 14
+)
+
+var ErrRunning = errors.New("a calibration is already running")
+
+// Status is published as JSON on <prefix>/calibration.
+type Status struct {
+	Status   string    `json:"status"`
+	Progress int       `json:"progress"`
+	Message  string    `json:"message"`
+	Started  time.Time `json:"started"`
+}
+
+// Calibration guides the O2 sensor calibration, checking the boiler is off
+// before starting, following the controller until it has finished, and
+// checking the sensor reads air correctly afterwards.
+type Calibration struct {
+	writer     *control.Writer
+	mqttClient *mqtt.Client
+	monitors   map[string]*monitor.Monitor
+	running    bool
+	mutex      sync.Mutex
+}
+
+func New(writer *control.Writer, mqttClient *mqtt.Client, monitors map[string]*monitor.Monitor) *Calibration {
+	c := &Calibration{
+		writer:     writer,
+		mqttClient: mqttClient,
+		monitors:   monitors,
+	}
+	c.publish(Status{Status: Idle, Message: "No calibration has been run"})
+	return c
+}
+
+// Start begins a calibration requested by source.
+func (c *Calibration) Start(source string) error {
+	c.mutex.Lock()
+	if c.running {
+		c.mutex.Unlock()
+		return ErrRunning
+	}
+	c.running = true
+	c.mutex.Unlock()
+
+	if value, ok := c.monitors["operating_data"].Get("state"); ok {
+		if state, _ := value.(int64); state != stateOff {
+			c.finish(Status{Status: Failed, Message: fmt.Sprintf("The boiler must be off to calibrate, but is %q", nbe.PowerStateText(state))})
+			return nil
+		}
+	}
+
+	started := time.Now()
+	c.publish(Status{Status: Running, Message: "Starting calibration", Started: started})
+	response, err := c.writer.Set(source, Key, []byte("1"))
+	if err != nil {
+		c.finish(Status{Status: Failed, Message: fmt.Sprintf("Failed to start calibration: %v", err), Started: started})
+		return nil
+	}
+	if response.Status != 0 {
+		c.finish(Status{Status: Failed, Message: fmt.Sprintf("The controller refused to start calibration (status %d)", response.Status), Started: started})
+		return nil
+	}
+
+	go c.follow(started)
+	return nil
+}
+
+func (c *Calibration) follow(started time.Time) {
+	oxygen := c.monitors["oxygen"]
+	seen := false
+	for elapsed := time.Duration(0); elapsed < timeout; elapsed = time.Since(started) {
+		time.Sleep(checkInterval)
+
+		// Wait to see the flag set before waiting for it to clear, as the
+		// settings are only polled every few seconds.
+		value, _ := oxygen.Get("start_calibrate")
+		flag, _ := value.(int64)
+		if flag != 0 {
+			seen = true
+		} else if seen || time.Since(started) > expectedDuration {
+			c.check(started)
+			return
+		}
+
+		progress := int(math.Min(99, 100*time.Since(started).Seconds()/expectedDuration.Seconds()))
+		c.publish(Status{Status: Running, Progress: progress, Message: "Calibrating", Started: started})
+	}
+	c.finish(Status{Status: Failed, Message: fmt.Sprintf("Calibration did not finish within %s", timeout), Started: started})
+}
+
+func (c *Calibration) check(started time.Time) {
+	value, _ := c.monitors["operating_data"].Get("oxygen")
+	var reading float64
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		reading = float64(v)
+	case int64:
+		reading = float64(v)
+	default:
+		c.finish(Status{Status: Failed, Progress: 100, Message: "Calibration finished, but there is no oxygen reading to check", Started: started})
+		return
+	}
+
+	if math.Abs(reading-airOxygen) > tolerance {
+		c.finish(Status{Status: Failed, Progress: 100, Message: fmt.Sprintf("Calibration finished, but the sensor reads %.1f%% in air rather than %.1f%%", reading, airOxygen), Started: started})
+		return
+	}
+	c.finish(Status{Status: Success, Progress: 100, Message: fmt.Sprintf("Calibration succeeded, the sensor reads %.1f%% in air", reading), Started: started})
+}
+
+func (c *Calibration) finish(status Status) {
+	if status.Status == Failed {
+		log.Errorf("O2 calibration failed: %s", status.Message)
+	} else {
+		log.Infof("O2 calibration: %s", status.Message)
+	}
+	c.publish(status)
+
+	c.mutex.Lock()
+	c.running = false
+	c.mutex.Unlock()
+}
+
+func (c *Calibration) publish(status Status) {
+	go c.mqttClient.PublishMany("calibration", map[string]interface{}{
+		"status":     status.Status,
+		"progress":   status.Progress,
+		"message":    status.Message,
+		"attributes": status,
+	})
+}
@@ -0,0 +1,27 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+// deriveCleaning adds the time of the next compressor cleaning, from the
+// countdown in minutes reported by the controller, to changes of the
+// cleaning category.
+func deriveCleaning(key string, value interface{}, changeSet map[string]interface{}) {
+	if v, ok := value.(int64); ok && key == "countdown" {
+		changeSet["next_clean"] = countdownTime(v)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// nbe-simulator serves a fake NBE controller over UDP, for trying out
+// boiler-mate and developing dashboards without a boiler.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/simulator"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	var listen string
+	var serial string
+	var pin string
+	var interval time.Duration
+	var scenarioName string
+	var speed float64
+	var logLevel string
+
+	flag.StringVar(&listen, "listen", "0.0.0.0:8483", "address to listen for requests on")
+	flag.StringVar(&serial, "serial", "12345", "serial number of the simulated controller")
+	flag.StringVar(&pin, "pin", "0123456789", "password required to write settings")
+	flag.DurationVar(&interval, "interval", time.Second, "interval between changes to the simulated values, or 0 to keep them fixed")
+	flag.StringVar(&scenarioName, "scenario", "", fmt.Sprintf("scenario to play instead of random changes, either a YAML file or one of: %s", strings.Join(simulator.Scenarios(), ", ")))
+	flag.Float64Var(&speed, "speed", 1, "how many times faster than real time to play the scenario")
+	flag.StringVar(&logLevel, "log-level", "INFO", "logging level")
+	flag.Parse()
+
+	ll, err := log.ParseLevel(logLevel)
+	if err != nil {
+		ll = log.InfoLevel
+	}
+	log.SetLevel(ll)
+
+	boiler := nbe.NewMockBoiler(serial)
+	server, err := simulator.NewServer(boiler, pin)
+	if err != nil {
+		log.Fatalf("Failed to create simulator: %v", err)
+	}
+
+	stop := make(chan struct{})
+	if scenarioName != "" {
+		scenario, err := simulator.LoadScenario(scenarioName)
+		if err != nil {
+			log.Fatalf("Failed to load scenario: %v", err)
+		}
+		log.Infof("Playing scenario %s", scenario.Name)
+		go scenario.Run(boiler, speed, stop)
+	} else if interval > 0 {
+		go simulator.Jitter(boiler, interval, stop)
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		close(stop)
+		server.Close()
+	}()
+
+	log.Infof("Simulating controller %s on %s (pin %s)", serial, listen, pin)
+	if err := server.ListenAndServe(listen); err != nil {
+		log.Fatalf("Simulator failed: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/consumption"
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/degreedays"
+	"github.com/mlipscombe/boiler-mate/forecast"
+	"github.com/mlipscombe/boiler-mate/fouling"
+	"github.com/mlipscombe/boiler-mate/hooks"
+	"github.com/mlipscombe/boiler-mate/ignition"
+	"github.com/mlipscombe/boiler-mate/incident"
+	"github.com/mlipscombe/boiler-mate/knx"
+	"github.com/mlipscombe/boiler-mate/names"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/notify"
+	"github.com/mlipscombe/boiler-mate/price"
+	"github.com/mlipscombe/boiler-mate/rules"
+	"github.com/mlipscombe/boiler-mate/schedule"
+	"github.com/mlipscombe/boiler-mate/thermostat"
+	"github.com/mlipscombe/boiler-mate/units"
+	"github.com/mlipscombe/boiler-mate/webhook"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the options that are too structured to be given as flags.
+// Everything else is configured with flags or environment variables.
+type Config struct {
+	Webhooks    []webhook.Config         `yaml:"webhooks"`
+	Rules       []rules.Rule             `yaml:"rules"`
+	Hooks       []hooks.Config           `yaml:"hooks"`
+	Thermostat  *thermostat.Config       `yaml:"thermostat"`
+	Forecast    *forecast.Config         `yaml:"forecast"`
+	Schedule    *schedule.Config         `yaml:"schedule"`
+	Price       *price.Config            `yaml:"price"`
+	Interlock   *control.InterlockConfig `yaml:"interlock"`
+	Access      *control.AccessConfig    `yaml:"access"`
+	Confirm     *control.ConfirmConfig   `yaml:"confirm"`
+	KNX         *knx.Config              `yaml:"knx"`
+	Notify      *notify.Config           `yaml:"notifications"`
+	Incidents   *incident.Config         `yaml:"incidents"`
+	Cost        *consumption.Cost        `yaml:"cost"`
+	Emissions   *consumption.Emissions   `yaml:"emissions"`
+	DegreeDays  *degreedays.Config       `yaml:"degree_days"`
+	Ignitions   *ignition.Config         `yaml:"ignitions"`
+	Fouling     *fouling.Config          `yaml:"fouling"`
+	Precision   units.Precisions         `yaml:"precision"`
+	PowerStates map[int64]string         `yaml:"power_states"`
+	Language    string                   `yaml:"language"`
+	AlarmTexts  map[int64]string         `yaml:"alarm_texts"`
+	Rename      names.Renames            `yaml:"rename"`
+	Booleans    []string                 `yaml:"booleans"`
+	Timeouts    map[string]time.Duration `yaml:"timeouts"`
+}
+
+// Load reads a YAML config file. An empty path returns an empty config.
+func Load(path string) (*Config, error) {
+	var cfg Config
+	if path == "" {
+		return &cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	for i, w := range cfg.Webhooks {
+		if err := w.Validate(); err != nil {
+			return nil, fmt.Errorf("webhook %d: %v", i+1, err)
+		}
+	}
+
+	for i, r := range cfg.Rules {
+		if err := r.Validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+	}
+
+	for i, h := range cfg.Hooks {
+		if err := h.Validate(); err != nil {
+			return nil, fmt.Errorf("hook %d: %v", i+1, err)
+		}
+	}
+
+	if cfg.Thermostat != nil {
+		if err := cfg.Thermostat.Validate(); err != nil {
+			return nil, fmt.Errorf("thermostat: %v", err)
+		}
+	}
+
+	if cfg.Forecast != nil {
+		if err := cfg.Forecast.Validate(); err != nil {
+			return nil, fmt.Errorf("forecast: %v", err)
+		}
+	}
+
+	if cfg.Schedule != nil {
+		if err := cfg.Schedule.Validate(); err != nil {
+			return nil, fmt.Errorf("schedule: %v", err)
+		}
+	}
+
+	if cfg.Price != nil {
+		if err := cfg.Price.Validate(); err != nil {
+			return nil, fmt.Errorf("price: %v", err)
+		}
+	}
+
+	if cfg.Interlock != nil {
+		if err := cfg.Interlock.Validate(); err != nil {
+			return nil, fmt.Errorf("interlock: %v", err)
+		}
+	}
+
+	if cfg.Access != nil {
+		if err := cfg.Access.Validate(); err != nil {
+			return nil, fmt.Errorf("access: %v", err)
+		}
+	}
+
+	if cfg.Confirm != nil {
+		if err := cfg.Confirm.Validate(); err != nil {
+			return nil, fmt.Errorf("confirm: %v", err)
+		}
+	}
+
+	if cfg.KNX != nil {
+		if err := cfg.KNX.Validate(); err != nil {
+			return nil, fmt.Errorf("knx: %v", err)
+		}
+	}
+
+	if cfg.Notify != nil {
+		if err := cfg.Notify.Validate(); err != nil {
+			return nil, fmt.Errorf("notifications: %v", err)
+		}
+	}
+
+	if cfg.Incidents != nil {
+		if err := cfg.Incidents.Validate(); err != nil {
+			return nil, fmt.Errorf("incidents: %v", err)
+		}
+	}
+
+	if cfg.Cost != nil {
+		if err := cfg.Cost.Validate(); err != nil {
+			return nil, fmt.Errorf("cost: %v", err)
+		}
+	}
+
+	if cfg.Emissions != nil {
+		if err := cfg.Emissions.Validate(); err != nil {
+			return nil, fmt.Errorf("emissions: %v", err)
+		}
+	}
+
+	if cfg.DegreeDays != nil {
+		if err := cfg.DegreeDays.Validate(); err != nil {
+			return nil, fmt.Errorf("degree_days: %v", err)
+		}
+	}
+
+	if cfg.Ignitions != nil {
+		if err := cfg.Ignitions.Validate(); err != nil {
+			return nil, fmt.Errorf("ignitions: %v", err)
+		}
+	}
+
+	if cfg.Fouling != nil {
+		if err := cfg.Fouling.Validate(); err != nil {
+			return nil, fmt.Errorf("fouling: %v", err)
+		}
+	}
+
+	if err := cfg.Precision.Validate(); err != nil {
+		return nil, fmt.Errorf("precision: %v", err)
+	}
+
+	for state, text := range cfg.PowerStates {
+		if state < 0 || text == "" {
+			return nil, fmt.Errorf("power state %d: needs a code of 0 or more and some text", state)
+		}
+	}
+
+	if err := units.ValidateBooleans(cfg.Booleans); err != nil {
+		return nil, fmt.Errorf("booleans: %v", err)
+	}
+
+	if err := cfg.Rename.Validate(); err != nil {
+		return nil, fmt.Errorf("rename: %v", err)
+	}
+
+	for function, timeout := range cfg.Timeouts {
+		if _, ok := nbe.FunctionNames[function]; !ok {
+			return nil, fmt.Errorf("timeouts: unknown function %q", function)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("timeouts: %s must be more than 0", function)
+		}
+	}
+
+	if cfg.Language == "" {
+		cfg.Language = "en"
+	} else if _, ok := nbe.AlarmTexts[cfg.Language]; !ok && len(cfg.AlarmTexts) == 0 {
+		return nil, fmt.Errorf("language %q has no alarm texts, give them with alarm_texts", cfg.Language)
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,148 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package consumption
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// The controller reports consumption as comma separated lists of kg per
+// bucket, ordered oldest to newest, with the last entry being the bucket
+// currently in progress. Keys are <type>_<period>, e.g. total_days.
+var Types = []string{"total", "dhw"}
+var Periods = []string{"hours", "days", "months", "years"}
+
+// Bucket is the pellet consumption over a single period.
+type Bucket struct {
+	Start  time.Time `json:"start"`
+	Period string    `json:"period"`
+	Type   string    `json:"type"`
+	Kg     float64   `json:"kg"`
+}
+
+// Buckets converts the consumption data reported by the controller into
+// timestamped buckets, relative to now.
+func Buckets(data map[string]interface{}, now time.Time) []Bucket {
+	var buckets []Bucket
+	for _, t := range Types {
+		for _, period := range Periods {
+			values, err := parseList(data[fmt.Sprintf("%s_%s", t, period)])
+			if err != nil {
+				continue
+			}
+			for i, kg := range values {
+				buckets = append(buckets, Bucket{
+					Start:  bucketStart(now, period, len(values)-1-i),
+					Period: period,
+					Type:   t,
+					Kg:     kg,
+				})
+			}
+		}
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets
+}
+
+// Filter returns the buckets of the given period (and type, if not empty)
+// starting within [from, to). Zero times are treated as unbounded.
+func Filter(buckets []Bucket, period string, t string, from time.Time, to time.Time) []Bucket {
+	var filtered []Bucket
+	for _, b := range buckets {
+		if period != "" && b.Period != period {
+			continue
+		}
+		if t != "" && b.Type != t {
+			continue
+		}
+		if !from.IsZero() && b.Start.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !b.Start.Before(to) {
+			continue
+		}
+		filtered = append(filtered, b)
+	}
+	return filtered
+}
+
+// WriteCSV writes buckets as CSV with a header row.
+func WriteCSV(w io.Writer, buckets []Bucket) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"start", "period", "type", "kg"})
+	for _, b := range buckets {
+		writer.Write([]string{
+			b.Start.Format(time.RFC3339),
+			b.Period,
+			b.Type,
+			strconv.FormatFloat(b.Kg, 'f', 2, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func bucketStart(now time.Time, period string, ago int) time.Time {
+	y, m, d := now.Date()
+	switch period {
+	case "hours":
+		// Hours are counted back from the start of the local hour, which
+		// isn't on the hour in UTC in every zone, in elapsed time so that
+		// DST changes don't repeat or skip one.
+		start := time.Date(y, m, d, now.Hour(), 0, 0, 0, now.Location())
+		return start.Add(-time.Duration(ago) * time.Hour)
+	case "days":
+		return time.Date(y, m, d-ago, 0, 0, 0, 0, now.Location())
+	case "months":
+		return time.Date(y, m-time.Month(ago), 1, 0, 0, 0, 0, now.Location())
+	default:
+		return time.Date(y-ago, 1, 1, 0, 0, 0, 0, now.Location())
+	}
+}
+
+func parseList(value interface{}) ([]float64, error) {
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		return []float64{float64(v)}, nil
+	case int64:
+		return []float64{float64(v)}, nil
+	case string:
+		parts := strings.Split(v, ",")
+		values := make([]float64, 0, len(parts))
+		for _, part := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid consumption value %q", part)
+			}
+			values = append(values, f)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("no consumption data")
+	}
+}
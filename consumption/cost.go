@@ -0,0 +1,65 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package consumption
+
+import (
+	"fmt"
+	"math"
+)
+
+// DefaultBagKg is the weight of a bag of pellets, if not given.
+const DefaultBagKg = 15
+
+// Cost is the price paid for pellets, either per kg or per bag, which turns
+// consumption into what it cost. Currency is an ISO 4217 code, e.g. EUR.
+type Cost struct {
+	Currency string  `yaml:"currency"`
+	PerKg    float64 `yaml:"per_kg"`
+	PerBag   float64 `yaml:"per_bag"`
+	BagKg    float64 `yaml:"bag_kg"`
+}
+
+func (c *Cost) Validate() error {
+	if c.Currency == "" {
+		return fmt.Errorf("no currency configured")
+	}
+	if (c.PerKg > 0) == (c.PerBag > 0) {
+		return fmt.Errorf("needs either per_kg or per_bag")
+	}
+	if c.PerKg < 0 || c.PerBag < 0 || c.BagKg < 0 {
+		return fmt.Errorf("prices and weights can't be negative")
+	}
+	return nil
+}
+
+// PricePerKg returns the price of a kg of pellets.
+func (c *Cost) PricePerKg() float64 {
+	if c.PerKg > 0 {
+		return c.PerKg
+	}
+	bag := c.BagKg
+	if bag == 0 {
+		bag = DefaultBagKg
+	}
+	return c.PerBag / bag
+}
+
+// Of returns what kg of pellets cost, to the cent.
+func (c *Cost) Of(kg float64) float64 {
+	return math.Round(kg*c.PricePerKg()*100) / 100
+}
@@ -0,0 +1,41 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package consumption
+
+import (
+	"fmt"
+	"math"
+)
+
+// Emissions is the CO2, or CO2 equivalent, emitted per kg of pellets
+// burned, as given by whatever scheme it is reported to.
+type Emissions struct {
+	Factor float64 `yaml:"factor"`
+}
+
+func (e *Emissions) Validate() error {
+	if e.Factor <= 0 {
+		return fmt.Errorf("needs a positive factor, in kg CO2e per kg of pellets")
+	}
+	return nil
+}
+
+// Of returns the kg of CO2e emitted burning kg of pellets, to ten grams.
+func (e *Emissions) Of(kg float64) float64 {
+	return math.Round(kg*e.Factor*100) / 100
+}
@@ -0,0 +1,113 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package consumption
+
+import "time"
+
+// The totals published alongside the raw consumption, matching what the
+// StokerCloud app shows.
+const (
+	Today     = "today"
+	Yesterday = "yesterday"
+	ThisWeek  = "this_week"
+	ThisMonth = "this_month"
+)
+
+// Totals adds up the total consumption, in kg, of today, yesterday, the
+// week so far (from Monday) and the month so far, from buckets relative to
+// now.
+func Totals(buckets []Bucket, now time.Time) map[string]float64 {
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	yesterday := time.Date(y, m, d-1, 0, 0, 0, 0, now.Location())
+	week := time.Date(y, m, d-(int(now.Weekday())+6)%7, 0, 0, 0, 0, now.Location())
+	month := time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+
+	totals := map[string]float64{
+		Today:     0,
+		Yesterday: 0,
+		ThisWeek:  0,
+		ThisMonth: 0,
+	}
+	var haveMonths bool
+	var daysThisMonth float64
+	for _, b := range buckets {
+		if b.Type != "total" {
+			continue
+		}
+		switch b.Period {
+		case "days":
+			if b.Start.Equal(today) {
+				totals[Today] = b.Kg
+			} else if b.Start.Equal(yesterday) {
+				totals[Yesterday] = b.Kg
+			}
+			if !b.Start.Before(week) {
+				totals[ThisWeek] += b.Kg
+			}
+			if !b.Start.Before(month) {
+				daysThisMonth += b.Kg
+			}
+		case "months":
+			if b.Start.Equal(month) {
+				totals[ThisMonth] = b.Kg
+				haveMonths = true
+			}
+		}
+	}
+	// Without months, the month is summed from as many days as there are.
+	if !haveMonths {
+		totals[ThisMonth] = daysThisMonth
+	}
+	return totals
+}
+
+// Rate returns the average total consumption, in kg per day, over the last
+// days complete days, or over the last 24 complete hours if the controller
+// doesn't report days. It is 0 if there is neither.
+func Rate(buckets []Bucket, now time.Time, days int) float64 {
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	hour := time.Date(y, m, d, now.Hour(), 0, 0, 0, now.Location())
+	var dayKg, hourKg float64
+	var dayCount, hourCount int
+	for _, b := range buckets {
+		if b.Type != "total" {
+			continue
+		}
+		switch b.Period {
+		case "days":
+			if b.Start.Before(today) && !b.Start.Before(today.AddDate(0, 0, -days)) {
+				dayKg += b.Kg
+				dayCount++
+			}
+		case "hours":
+			if b.Start.Before(hour) && !b.Start.Before(hour.Add(-24*time.Hour)) {
+				hourKg += b.Kg
+				hourCount++
+			}
+		}
+	}
+	if dayCount > 0 {
+		return dayKg / float64(dayCount)
+	}
+	if hourCount > 0 {
+		return hourKg / float64(hourCount) * 24
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"fmt"
+	"path"
+)
+
+// AccessConfig restricts the settings that can be written over MQTT and
+// the HTTP API to category.key patterns, e.g. boiler.temp or hot_water.*.
+// If Allow is empty everything not denied may be written.
+type AccessConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+func (c *AccessConfig) Validate() error {
+	for _, pattern := range append(append([]string{}, c.Allow...), c.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// Access enforces the allow and deny lists on remote writes. Automations
+// configured in the config file are trusted and not restricted.
+func Access(config AccessConfig) Policy {
+	return func(source string, key string, _ []byte) error {
+		if source != SourceMQTT && source != SourceAPI {
+			return nil
+		}
+		if matchAny(config.Deny, key) {
+			return fmt.Errorf("%s is denied", key)
+		}
+		if len(config.Allow) > 0 && !matchAny(config.Allow, key) {
+			return fmt.Errorf("%s is not allowed", key)
+		}
+		return nil
+	}
+}
+
+func matchAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
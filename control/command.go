@@ -0,0 +1,35 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package control
+
+// PowerSwitch is the key of the switch that turns the boiler on and off. It
+// isn't a setting, and is written as the controller's start or stop command.
+const PowerSwitch = "device.power_switch"
+
+// Command maps a write to the setting the controller takes for it, so that
+// the power switch starts and stops the boiler wherever it is written from.
+// Other keys are returned unchanged.
+func Command(key string, value []byte) (string, []byte) {
+	if key != PowerSwitch {
+		return key, value
+	}
+	if v := string(value); v == "ON" || v == "1" {
+		return "misc.start", []byte("1")
+	}
+	return "misc.stop", []byte("1")
+}
@@ -0,0 +1,209 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfirmAll confirms every pending command.
+const ConfirmAll = "CONFIRM"
+
+var ignitionStates = map[int64]bool{1: true, 2: true, 3: true, 4: true}
+
+// ConfirmConfig lists the commands that must be confirmed within Timeout
+// before they are sent: settings matching Keys, and stopping the boiler
+// while it is igniting if StopDuringIgnition is set.
+type ConfirmConfig struct {
+	Keys               []string      `yaml:"keys"`
+	StopDuringIgnition bool          `yaml:"stop_during_ignition"`
+	Timeout            time.Duration `yaml:"timeout"`
+}
+
+func (c *ConfirmConfig) Validate() error {
+	for _, pattern := range c.Keys {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+type held struct {
+	value   []byte
+	expires time.Time
+	timer   *time.Timer
+}
+
+// Confirmer holds dangerous commands received over MQTT until they are
+// confirmed by publishing the key, or CONFIRM, to <prefix>/confirm/set.
+// Pending commands are published on <prefix>/confirm/pending.
+type Confirmer struct {
+	ConfirmConfig
+
+	writer        *Writer
+	mqttClient    *mqtt.Client
+	operatingData *monitor.Monitor
+	pending       map[string]*held
+	mutex         sync.Mutex
+}
+
+func NewConfirmer(config ConfirmConfig, writer *Writer, mqttClient *mqtt.Client, operatingData *monitor.Monitor) *Confirmer {
+	if config.Timeout == 0 {
+		config.Timeout = 30 * time.Second
+	}
+	return &Confirmer{
+		ConfirmConfig: config,
+		writer:        writer,
+		mqttClient:    mqttClient,
+		operatingData: operatingData,
+		pending:       make(map[string]*held),
+	}
+}
+
+func (c *Confirmer) Start() error {
+	c.publishPending()
+	return c.mqttClient.Subscribe("confirm/set", 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		c.confirm(strings.TrimSpace(string(msg.Payload())))
+	})
+}
+
+// Required reports whether a command must be confirmed before it is sent.
+func (c *Confirmer) Required(key string) bool {
+	if matchAny(c.Keys, key) {
+		return true
+	}
+	if c.StopDuringIgnition && key == "misc.stop" {
+		if value, ok := c.operatingData.Get("state"); ok {
+			state, _ := value.(int64)
+			return ignitionStates[state]
+		}
+	}
+	return false
+}
+
+// Hold keeps a command until it is confirmed or times out. A second command
+// for the same key replaces the first.
+func (c *Confirmer) Hold(key string, value []byte) {
+	c.mutex.Lock()
+	if h, ok := c.pending[key]; ok {
+		h.timer.Stop()
+	}
+	h := &held{value: value, expires: time.Now().Add(c.Timeout)}
+	h.timer = time.AfterFunc(c.Timeout, func() {
+		c.mutex.Lock()
+		if c.pending[key] == h {
+			delete(c.pending, key)
+			log.Warnf("Command %s=%s was not confirmed within %s", key, value, c.Timeout)
+		}
+		c.mutex.Unlock()
+		c.publishPending()
+	})
+	c.pending[key] = h
+	c.mutex.Unlock()
+
+	log.Infof("Command %s=%s needs confirming within %s", key, value, c.Timeout)
+	c.publishPending()
+}
+
+func (c *Confirmer) confirm(key string) {
+	c.mutex.Lock()
+	confirmed := make(map[string][]byte)
+	for k, h := range c.pending {
+		if key == ConfirmAll || key == k {
+			h.timer.Stop()
+			confirmed[k] = h.value
+			delete(c.pending, k)
+		}
+	}
+	c.mutex.Unlock()
+
+	if len(confirmed) == 0 {
+		log.Warnf("Nothing pending to confirm for %s", key)
+		return
+	}
+	c.publishPending()
+
+	for k, v := range confirmed {
+		key, value := k, v
+		err := c.writer.SetAsync(SourceMQTT, key, value, func(response *nbe.NBEResponse) {
+			log.Infof("Set %s to %s after confirmation: %v", key, value, response)
+		})
+		if err != nil {
+			log.Errorf("Failed to set %s: %v", key, err)
+		}
+	}
+}
+
+func (c *Confirmer) publishPending() {
+	c.mutex.Lock()
+	commands := make([]string, 0, len(c.pending))
+	for k, h := range c.pending {
+		commands = append(commands, fmt.Sprintf("%s=%s (until %s)", k, h.value, h.expires.Format("15:04:05")))
+	}
+	c.mutex.Unlock()
+
+	sort.Strings(commands)
+	pending := "none"
+	if len(commands) > 0 {
+		pending = strings.Join(commands, ", ")
+	}
+	go c.mqttClient.PublishMany("confirm", map[string]interface{}{"pending": pending})
+}
+
+// PublishDiscovery announces the pending commands and a button to confirm
+// them to Home Assistant, as entities of the boiler's device.
+func (c *Confirmer) PublishDiscovery(serial string) {
+	prefix := c.mqttClient.Prefix
+	dev := map[string]interface{}{
+		"ids": []string{fmt.Sprintf("nbe_%s", serial)},
+	}
+	entities := map[string]map[string]interface{}{
+		"sensor/confirm_pending": {
+			"name":   "Pending Command",
+			"icon":   "mdi:alert-decagram",
+			"stat_t": fmt.Sprintf("%s/confirm/pending", prefix),
+		},
+		"button/confirm": {
+			"name":          "Confirm Pending Command",
+			"icon":          "mdi:check-decagram",
+			"cmd_t":         fmt.Sprintf("%s/confirm/set", prefix),
+			"payload_press": ConfirmAll,
+		},
+	}
+	for k, e := range entities {
+		component, id, _ := strings.Cut(k, "/")
+		e["uniq_id"] = fmt.Sprintf("nbe_%s_%s", serial, id)
+		e["avty_t"] = fmt.Sprintf("%s/device/status", prefix)
+		e["dev"] = dev
+		err := c.mqttClient.PublishDiscovery(fmt.Sprintf("homeassistant/%s/nbe_%s/%s/config", component, serial, id), e)
+		if err != nil {
+			log.Errorf("Error publishing discovery message for %s: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// DefaultInterlockCategories are the settings that are locked while the
+// boiler is in a fault state if the interlock isn't configured.
+var DefaultInterlockCategories = []string{"ignition", "fan", "auger"}
+
+// InterlockConfig locks the settings of Categories while the boiler is in
+// one of States, which defaults to the alarm states, and while it is
+// cooling down unless Cooldown is false.
+type InterlockConfig struct {
+	Categories []string `yaml:"categories"`
+	States     []int64  `yaml:"states"`
+	Cooldown   *bool    `yaml:"cooldown"`
+}
+
+func (c *InterlockConfig) Validate() error {
+	for _, category := range c.Categories {
+		found := false
+		for _, s := range nbe.Settings {
+			if s == category {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown category %q", category)
+		}
+	}
+	return nil
+}
+
+// Interlock refuses writes to the configured categories while the state
+// reported by the operating data monitor is locked, so that automations
+// can't fight a fault condition or the burner cooling down. Cooling down
+// isn't a state of its own, but any stop with a substate, so it is told by
+// the state and substate together.
+func Interlock(config InterlockConfig, operatingData *monitor.Monitor) Policy {
+	locked := make(map[int64]bool)
+	if len(config.States) == 0 {
+		for state := range nbe.AlarmStates {
+			locked[state] = true
+		}
+	}
+	for _, state := range config.States {
+		locked[state] = true
+	}
+	cooldown := config.Cooldown == nil || *config.Cooldown
+
+	return func(_ string, key string, _ []byte) error {
+		category, _, _ := strings.Cut(key, ".")
+		found := false
+		for _, c := range config.Categories {
+			if c == category {
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+
+		value, ok := operatingData.Get("state")
+		if !ok {
+			return nil
+		}
+		state, ok := value.(int64)
+		if !ok {
+			return nil
+		}
+		if locked[state] {
+			return fmt.Errorf("%s settings are locked while the boiler is in state %q", category, nbe.PowerStateText(state))
+		}
+		if cooldown {
+			value, _ := operatingData.Get("substate")
+			substate, _ := value.(int64)
+			if nbe.Phase(state, substate) == nbe.PhaseCooldown {
+				return fmt.Errorf("%s settings are locked while the boiler is cooling down (%s)", category, nbe.SubstateText(state, substate))
+			}
+		}
+		return nil
+	}
+}
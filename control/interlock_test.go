@@ -0,0 +1,75 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// operatingData returns a monitor that has polled state and substate.
+func operatingData(t *testing.T, state int64, substate int64) *monitor.Monitor {
+	t.Helper()
+	boiler := nbe.NewMockBoiler("1234")
+	boiler.SetValue(nbe.GetOperatingDataFunction, "state", strconv.FormatInt(state, 10))
+	boiler.SetValue(nbe.GetOperatingDataFunction, "substate", strconv.FormatInt(substate, 10))
+	m := monitor.NewMonitor(boiler, bus.New(), "operating_data", nbe.GetOperatingDataFunction, "*", time.Hour)
+	m.Start()
+	t.Cleanup(m.Stop)
+	deadline := time.Now().Add(2 * time.Second)
+	for m.LastPoll().IsZero() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return m
+}
+
+func TestInterlock(t *testing.T) {
+	off := false
+	tests := []struct {
+		name            string
+		config          InterlockConfig
+		state, substate int64
+		key             string
+		locked          bool
+	}{
+		{"running", InterlockConfig{}, 5, 0, "fan.speed", false},
+		{"alarm", InterlockConfig{}, 26, 0, "fan.speed", true},
+		{"alarm, other category", InterlockConfig{}, 26, 0, "boiler.temp", false},
+		{"burning out", InterlockConfig{}, 9, 1, "auger.auger_capacity", true},
+		{"fan cooling", InterlockConfig{}, 23, 2, "ignition.power", true},
+		{"stopped", InterlockConfig{}, 9, 0, "fan.speed", false},
+		{"modulating", InterlockConfig{}, 5, 1, "fan.speed", false},
+		{"cooldown unlocked", InterlockConfig{Cooldown: &off}, 9, 1, "fan.speed", false},
+		{"configured state", InterlockConfig{States: []int64{9}}, 9, 0, "fan.speed", true},
+		{"alarm not configured", InterlockConfig{States: []int64{9}}, 26, 0, "fan.speed", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Categories = DefaultInterlockCategories
+			policy := Interlock(tt.config, operatingData(t, tt.state, tt.substate))
+			if err := policy(SourceMQTT, tt.key, []byte("1")); (err != nil) != tt.locked {
+				t.Errorf("got %v, want locked %v", err, tt.locked)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sources of writes. Automations identify themselves by name.
+const (
+	SourceMQTT = "mqtt"
+	SourceAPI  = "api"
+)
+
+// Policy decides whether a setting may be written by a source, returning
+// the reason if it may not.
+type Policy func(source string, key string, value []byte) error
+
+// RefusedError is returned when a policy refuses a write.
+type RefusedError struct {
+	Key    string
+	Reason string
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("writing %s refused: %s", e.Key, e.Reason)
+}
+
+// Refusal describes a refused write to the OnRefuse handlers.
+type Refusal struct {
+	Timestamp time.Time `json:"ts"`
+	Source    string    `json:"source"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason"`
+}
+
+type RefuseHandler func(refusal Refusal)
+
+type result func(*nbe.NBEResponse, error)
+
+// rateWindow is the period PerMinute counts writes over.
+var rateWindow = time.Minute
+
+// pending is a queued write. Writes to a key that is already queued replace
+// its value, and every caller is told the result of the final write.
+type pending struct {
+	source  string
+	key     string
+	value   []byte
+	results []result
+}
+
+// Writer is the single path for writing settings to the controller, so
+// that every write, whether from MQTT, the API or an automation, is subject
+// to the same policies. Writes are sent one at a time, at least Spacing
+// apart and no more than PerMinute a minute, so that a runaway automation
+// can't hammer the controller's flash and regulation loop. As that can hold
+// a write back for a while, the policies are checked again just before it
+// is sent, in case the boiler has since gone into an alarm state.
+type Writer struct {
+	Spacing   time.Duration
+	PerMinute int
+
+	boiler   nbe.Boiler
+	policies []Policy
+	handlers []RefuseHandler
+	queue    []*pending
+	signal   chan struct{}
+	mutex    sync.RWMutex
+}
+
+func NewWriter(boiler nbe.Boiler, spacing time.Duration, perMinute int) *Writer {
+	return &Writer{
+		Spacing:   spacing,
+		PerMinute: perMinute,
+		boiler:    boiler,
+		signal:    make(chan struct{}, 1),
+	}
+}
+
+// AddPolicy adds a policy that every write must pass.
+func (w *Writer) AddPolicy(policy Policy) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.policies = append(w.policies, policy)
+}
+
+// OnRefuse registers a handler that is called for every refused write.
+func (w *Writer) OnRefuse(handler RefuseHandler) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.handlers = append(w.handlers, handler)
+}
+
+// QueueLength returns the number of writes waiting to be sent.
+func (w *Writer) QueueLength() int {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return len(w.queue)
+}
+
+func (w *Writer) check(source string, key string, value []byte) error {
+	w.mutex.RLock()
+	policies := w.policies
+	handlers := w.handlers
+	w.mutex.RUnlock()
+
+	for _, policy := range policies {
+		err := policy(source, key, value)
+		if err == nil {
+			continue
+		}
+		log.Warnf("Refusing to set %s to %s from %s: %v", key, value, source, err)
+		refusal := Refusal{
+			Timestamp: time.Now(),
+			Source:    source,
+			Key:       key,
+			Value:     string(value),
+			Reason:    err.Error(),
+		}
+		for _, handler := range handlers {
+			handler(refusal)
+		}
+		return &RefusedError{Key: key, Reason: err.Error()}
+	}
+	return nil
+}
+
+func (w *Writer) enqueue(source string, key string, value []byte, done result) error {
+	if err := w.check(source, key, value); err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	queued := false
+	for _, p := range w.queue {
+		if p.key == key {
+			log.Debugf("Collapsing queued write of %s=%s into %s", key, p.value, value)
+			p.source = source
+			p.value = value
+			p.results = append(p.results, done)
+			queued = true
+			break
+		}
+	}
+	if !queued {
+		w.queue = append(w.queue, &pending{source: source, key: key, value: value, results: []result{done}})
+	}
+	w.mutex.Unlock()
+
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start sends queued writes until the process exits.
+func (w *Writer) Start() {
+	go func() {
+		var last time.Time
+		var sent []time.Time
+		for range w.signal {
+			for {
+				w.mutex.Lock()
+				if len(w.queue) == 0 {
+					w.mutex.Unlock()
+					break
+				}
+				w.mutex.Unlock()
+
+				if wait := w.Spacing - time.Since(last); wait > 0 {
+					time.Sleep(wait)
+				}
+				for len(sent) > 0 && time.Since(sent[0]) >= rateWindow {
+					sent = sent[1:]
+				}
+				if w.PerMinute > 0 && len(sent) >= w.PerMinute {
+					wait := rateWindow - time.Since(sent[0])
+					log.Warnf("More than %d writes in a minute, delaying writes for %s", w.PerMinute, wait.Round(time.Second))
+					time.Sleep(wait)
+					continue
+				}
+
+				w.mutex.Lock()
+				p := w.queue[0]
+				w.queue = w.queue[1:]
+				w.mutex.Unlock()
+
+				if err := w.check(p.source, p.key, p.value); err != nil {
+					for _, done := range p.results {
+						done(nil, err)
+					}
+					continue
+				}
+
+				last = time.Now()
+				sent = append(sent, last)
+				response, err := w.boiler.Set(p.key, p.value)
+				if err != nil {
+					log.Errorf("Failed to set %s to %s from %s: %v", p.key, p.value, p.source, err)
+				}
+				for _, done := range p.results {
+					done(response, err)
+				}
+			}
+		}
+	}()
+}
+
+// Set queues a write and waits for the controller's response.
+func (w *Writer) Set(source string, key string, value []byte) (*nbe.NBEResponse, error) {
+	type reply struct {
+		response *nbe.NBEResponse
+		err      error
+	}
+	replies := make(chan reply, 1)
+	err := w.enqueue(source, key, value, func(response *nbe.NBEResponse, err error) {
+		replies <- reply{response, err}
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := <-replies
+	return r.response, r.err
+}
+
+// SetAsync queues a write, calling cb with the controller's response. If
+// the write fails cb is not called, and the error is logged.
+func (w *Writer) SetAsync(source string, key string, value []byte, cb func(*nbe.NBEResponse)) error {
+	return w.enqueue(source, key, value, func(response *nbe.NBEResponse, err error) {
+		if err == nil {
+			cb(response)
+		}
+	})
+}
+
+// SetResult queues a write, calling cb with the controller's response, or
+// the error if the write failed or was refused once it reached the front
+// of the queue.
+func (w *Writer) SetResult(source string, key string, value []byte, cb func(*nbe.NBEResponse, error)) error {
+	return w.enqueue(source, key, value, cb)
+}
@@ -0,0 +1,271 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+type write struct {
+	key   string
+	value string
+	at    time.Time
+}
+
+// recordingBoiler records every write, and holds the first one until
+// release is closed, so that writes queue up behind it.
+type recordingBoiler struct {
+	*nbe.MockBoiler
+
+	release chan struct{}
+	once    sync.Once
+	mutex   sync.Mutex
+	writes  []write
+}
+
+func newRecordingBoiler(hold bool) *recordingBoiler {
+	b := &recordingBoiler{MockBoiler: nbe.NewMockBoiler("1234"), release: make(chan struct{})}
+	if !hold {
+		close(b.release)
+	}
+	return b
+}
+
+func (b *recordingBoiler) Set(path string, value []byte) (*nbe.NBEResponse, error) {
+	b.mutex.Lock()
+	b.writes = append(b.writes, write{path, string(value), time.Now()})
+	b.mutex.Unlock()
+	b.once.Do(func() { <-b.release })
+	return b.MockBoiler.Set(path, value)
+}
+
+func (b *recordingBoiler) recorded() []write {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]write(nil), b.writes...)
+}
+
+type outcome struct {
+	response *nbe.NBEResponse
+	err      error
+}
+
+// queue queues a write, returning where its result is sent.
+func queue(t *testing.T, w *Writer, source string, key string, value string) <-chan outcome {
+	t.Helper()
+	results := make(chan outcome, 1)
+	err := w.enqueue(source, key, []byte(value), func(response *nbe.NBEResponse, err error) {
+		results <- outcome{response, err}
+	})
+	if err != nil {
+		t.Fatalf("queueing %s=%s: %v", key, value, err)
+	}
+	return results
+}
+
+func await(t *testing.T, results <-chan outcome) outcome {
+	t.Helper()
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a write")
+	}
+	return outcome{}
+}
+
+// waitFor waits until the boiler has received n writes.
+func waitFor(t *testing.T, boiler *recordingBoiler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(boiler.recorded()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d writes, got %v", n, boiler.recorded())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriterCollapses(t *testing.T) {
+	boiler := newRecordingBoiler(true)
+	w := NewWriter(boiler, 0, 0)
+	w.Start()
+
+	first := queue(t, w, SourceMQTT, "hopper.content", "100")
+	waitFor(t, boiler, 1)
+	// Queued while the first write is in flight, so they collapse into
+	// one write of the last value.
+	var results []<-chan outcome
+	for _, value := range []string{"60", "61", "62"} {
+		results = append(results, queue(t, w, SourceMQTT, "boiler.temp", value))
+	}
+	queued := queue(t, w, "schedule", "hot_water.temp", "55")
+	if n := w.QueueLength(); n != 2 {
+		t.Errorf("QueueLength() = %d, want 2", n)
+	}
+	close(boiler.release)
+
+	if r := await(t, first); r.err != nil || r.response.Status != 0 {
+		t.Errorf("hopper.content: %+v", r)
+	}
+	for i, results := range results {
+		if r := await(t, results); r.err != nil || r.response.Status != 0 {
+			t.Errorf("boiler.temp write %d: %+v", i, r)
+		}
+	}
+	await(t, queued)
+
+	want := []write{{"hopper.content", "100", time.Time{}}, {"boiler.temp", "62", time.Time{}}, {"hot_water.temp", "55", time.Time{}}}
+	got := boiler.recorded()
+	if len(got) != len(want) {
+		t.Fatalf("wrote %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].key != want[i].key || got[i].value != want[i].value {
+			t.Errorf("write %d is %s=%s, want %s=%s", i, got[i].key, got[i].value, want[i].key, want[i].value)
+		}
+	}
+}
+
+func TestWriterSpacing(t *testing.T) {
+	boiler := newRecordingBoiler(false)
+	w := NewWriter(boiler, 50*time.Millisecond, 0)
+	w.Start()
+
+	var results []<-chan outcome
+	for _, key := range []string{"boiler.temp", "hot_water.temp", "hopper.content"} {
+		results = append(results, queue(t, w, SourceAPI, key, "1"))
+	}
+	for _, r := range results {
+		await(t, r)
+	}
+	writes := boiler.recorded()
+	for i := 1; i < len(writes); i++ {
+		if gap := writes[i].at.Sub(writes[i-1].at); gap < 50*time.Millisecond {
+			t.Errorf("write %d sent %s after the last, want at least 50ms", i, gap)
+		}
+	}
+}
+
+func TestWriterRate(t *testing.T) {
+	defer func(window time.Duration) { rateWindow = window }(rateWindow)
+	rateWindow = 200 * time.Millisecond
+
+	boiler := newRecordingBoiler(false)
+	w := NewWriter(boiler, 0, 2)
+	w.Start()
+
+	var results []<-chan outcome
+	for _, key := range []string{"boiler.temp", "hot_water.temp", "hopper.content", "boiler.diff_under"} {
+		results = append(results, queue(t, w, SourceAPI, key, "1"))
+	}
+	for _, r := range results {
+		await(t, r)
+	}
+	writes := boiler.recorded()
+	if len(writes) != 4 {
+		t.Fatalf("wrote %v", writes)
+	}
+	// Only two writes fit in any window.
+	for i := 2; i < len(writes); i++ {
+		if gap := writes[i].at.Sub(writes[i-2].at); gap < rateWindow {
+			t.Errorf("write %d sent %s after write %d, want at least %s", i, gap, i-2, rateWindow)
+		}
+	}
+}
+
+func TestWriterRefuses(t *testing.T) {
+	boiler := newRecordingBoiler(false)
+	w := NewWriter(boiler, 0, 0)
+	w.AddPolicy(Access(AccessConfig{Deny: []string{"misc.*"}}))
+	var refusals []Refusal
+	w.OnRefuse(func(refusal Refusal) {
+		refusals = append(refusals, refusal)
+	})
+	w.Start()
+
+	_, err := w.Set(SourceMQTT, "misc.start", []byte("1"))
+	var refused *RefusedError
+	if !errors.As(err, &refused) || refused.Key != "misc.start" {
+		t.Errorf("Set() = %v, want a RefusedError", err)
+	}
+	if len(refusals) != 1 || refusals[0].Source != SourceMQTT || refusals[0].Key != "misc.start" || refusals[0].Value != "1" {
+		t.Errorf("refusals %+v", refusals)
+	}
+	called := false
+	if err := w.SetAsync(SourceAPI, "misc.stop", []byte("1"), func(*nbe.NBEResponse) { called = true }); err == nil {
+		t.Errorf("SetAsync() wasn't refused")
+	}
+
+	// Automations aren't restricted by the access lists.
+	if response, err := w.Set("schedule", "misc.start", []byte("1")); err != nil || response.Status != 0 {
+		t.Errorf("Set() from schedule = %+v, %v", response, err)
+	}
+	if writes := boiler.recorded(); len(writes) != 1 || called {
+		t.Errorf("wrote %v", writes)
+	}
+}
+
+// TestWriterRechecks refuses a write whose policy changes while it is
+// queued, as when the boiler goes into an alarm state.
+func TestWriterRechecks(t *testing.T) {
+	boiler := newRecordingBoiler(true)
+	w := NewWriter(boiler, 0, 0)
+	var alarm atomic.Bool
+	w.AddPolicy(func(_ string, key string, _ []byte) error {
+		if alarm.Load() && key == "misc.start" {
+			return fmt.Errorf("boiler is in an alarm state")
+		}
+		return nil
+	})
+	var refusals atomic.Int32
+	w.OnRefuse(func(Refusal) { refusals.Add(1) })
+	w.Start()
+
+	first := queue(t, w, SourceMQTT, "boiler.temp", "70")
+	waitFor(t, boiler, 1)
+	start := queue(t, w, SourceMQTT, "misc.start", "1")
+	other := queue(t, w, SourceMQTT, "hot_water.temp", "55")
+	alarm.Store(true)
+	close(boiler.release)
+
+	await(t, first)
+	r := await(t, start)
+	var refused *RefusedError
+	if !errors.As(r.err, &refused) || r.response != nil {
+		t.Errorf("misc.start: %+v, want a RefusedError", r)
+	}
+	if r := await(t, other); r.err != nil {
+		t.Errorf("hot_water.temp: %v", r.err)
+	}
+	for _, write := range boiler.recorded() {
+		if write.key == "misc.start" {
+			t.Errorf("misc.start was sent")
+		}
+	}
+	if n := refusals.Load(); n != 1 {
+		t.Errorf("%d refusals, want 1", n)
+	}
+}
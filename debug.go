@@ -0,0 +1,70 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+type monitorStats struct {
+	LastPoll   time.Time `json:"last_poll"`
+	AgeSeconds float64   `json:"age_seconds"`
+	Keys       int       `json:"keys"`
+}
+
+// registerDebugHandlers exposes the pprof profiles and an expvar document
+// with internal stats on mux. These are only registered on request, as
+// they should not be reachable on an untrusted network.
+func registerDebugHandlers(mux *http.ServeMux, boiler nbe.Boiler, writer *control.Writer, monitors map[string]*monitor.Monitor) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("nbe_queue_length", expvar.Func(func() interface{} {
+		return boiler.QueueLength()
+	}))
+	expvar.Publish("write_queue_length", expvar.Func(func() interface{} {
+		return writer.QueueLength()
+	}))
+	expvar.Publish("monitors", expvar.Func(func() interface{} {
+		stats := make(map[string]monitorStats, len(monitors))
+		for category, m := range monitors {
+			lastPoll := m.LastPoll()
+			stats[category] = monitorStats{
+				LastPoll:   lastPoll,
+				AgeSeconds: time.Since(lastPoll).Seconds(),
+				Keys:       len(m.Values()),
+			}
+		}
+		return stats
+	}))
+	mux.Handle("/debug/vars", expvar.Handler())
+}
@@ -0,0 +1,288 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package degreedays counts heating degree days from the outdoor
+// temperature, and divides the pellets used by them, so that consumption
+// can be compared between colder and milder periods.
+package degreedays
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/consumption"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sources of the outdoor temperature.
+const (
+	Controller = "controller"
+	MQTT       = "mqtt"
+)
+
+const (
+	// DefaultBase is the base temperature, in °C, commonly used for
+	// heating degree days.
+	DefaultBase = 15.5
+
+	// Categories the degree days and the consumption per degree day are
+	// published in, with the same keys as the consumption totals.
+	Category           = "degree_days"
+	NormalizedCategory = "consumption_per_degree_day"
+
+	stateKey       = "degree_days"
+	dateFormat     = "2006-01-02"
+	sampleInterval = time.Minute
+	saveInterval   = 10 * time.Minute
+
+	// A temperature older than maxAge is too old to count.
+	maxAge = time.Hour
+
+	// keepDays is how long daily degree days are kept, a little over a
+	// year so that a month can be compared with the same month last year.
+	keepDays = 400
+
+	// minDegreeDays is the fewest degree days consumption is divided by,
+	// as mild periods would otherwise give meaningless figures.
+	minDegreeDays = 1
+)
+
+// Config takes the outdoor temperature, in °C, from a controller value
+// given as category.key, or from an MQTT topic published by another device,
+// optionally at a JSON field. Base is the temperature below which heating
+// is needed.
+type Config struct {
+	Source string  `yaml:"source"`
+	Key    string  `yaml:"key"`
+	Topic  string  `yaml:"topic"`
+	Field  string  `yaml:"field"`
+	Base   float64 `yaml:"base"`
+}
+
+func (c *Config) Validate() error {
+	switch c.Source {
+	case Controller:
+		if !strings.Contains(c.Key, ".") {
+			return fmt.Errorf("key is required for %s, as category.key", Controller)
+		}
+	case MQTT:
+		if c.Topic == "" {
+			return fmt.Errorf("topic is required for %s", MQTT)
+		}
+	default:
+		return fmt.Errorf("unknown source %q, expected %s or %s", c.Source, Controller, MQTT)
+	}
+	return nil
+}
+
+// Meter counts degree days by integrating how far the outdoor temperature
+// is below the base over each day, which copes with days that are only cold
+// at night better than the daily mean does. Daily degree days are kept in
+// the state store so that they survive restarts.
+type Meter struct {
+	Config
+
+	events     *bus.Bus
+	mqttClient *mqtt.Client
+	store      *state.Store
+
+	mutex     sync.Mutex
+	days      map[string]float64
+	temp      float64
+	tempTime  time.Time
+	lastTick  time.Time
+	kg        map[string]float64
+	published bus.Published
+}
+
+func NewMeter(config Config, events *bus.Bus, mqttClient *mqtt.Client, store *state.Store) *Meter {
+	if config.Base == 0 {
+		config.Base = DefaultBase
+	}
+	m := &Meter{
+		Config:     config,
+		events:     events,
+		mqttClient: mqttClient,
+		store:      store,
+		days:       make(map[string]float64),
+		kg:         make(map[string]float64),
+		published:  make(bus.Published),
+	}
+	store.Get(stateKey, &m.days)
+	return m
+}
+
+func (m *Meter) Start() error {
+	m.events.OnChange(m.handle)
+	if m.Source == MQTT {
+		err := m.mqttClient.SubscribeRaw(m.Topic, 1, func(_ *mqtt.Client, msg mqtt.Message) {
+			temp, err := mqtt.ParseFloat(msg.Payload(), m.Field)
+			if err != nil {
+				log.Warnf("Ignoring outdoor temperature from %s: %v", msg.Topic(), err)
+				return
+			}
+			m.setTemp(temp)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		sample := time.NewTicker(sampleInterval)
+		defer sample.Stop()
+		save := time.NewTicker(saveInterval)
+		defer save.Stop()
+		for {
+			select {
+			case now := <-sample.C:
+				m.sample(now)
+				m.publish()
+			case <-save.C:
+				m.Save()
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *Meter) handle(change bus.Change) {
+	if m.Source == Controller && change.Category+"."+change.Key == m.Key {
+		switch v := change.Value.(type) {
+		case nbe.RoundedFloat:
+			m.setTemp(float64(v))
+		case int64:
+			m.setTemp(float64(v))
+		}
+		return
+	}
+	if change.Category != "consumption" {
+		return
+	}
+	kg, ok := change.Value.(nbe.RoundedFloat)
+	if !ok {
+		return
+	}
+	m.mutex.Lock()
+	m.kg[change.Key] = float64(kg)
+	m.mutex.Unlock()
+	m.publish()
+}
+
+func (m *Meter) setTemp(temp float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.temp, m.tempTime = temp, time.Now()
+}
+
+// sample adds how far the temperature is below the base over the time since
+// the last sample to today's degree days, and forgets days that are too old
+// to be wanted.
+func (m *Meter) sample(now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	elapsed := now.Sub(m.lastTick)
+	m.lastTick = now
+	if elapsed > 2*sampleInterval || now.Sub(m.tempTime) > maxAge {
+		return
+	}
+	today := now.Format(dateFormat)
+	m.days[today] += math.Max(0, m.Base-m.temp) * elapsed.Hours() / 24
+
+	oldest := now.AddDate(0, 0, -keepDays).Format(dateFormat)
+	for day := range m.days {
+		if day < oldest {
+			delete(m.days, day)
+		}
+	}
+}
+
+// totals returns the degree days of today so far, yesterday, this week
+// (from Monday) and this month, like the consumption totals.
+func (m *Meter) totals(now time.Time) map[string]float64 {
+	y, mo, d := now.Date()
+	today := now.Format(dateFormat)
+	yesterday := time.Date(y, mo, d-1, 0, 0, 0, 0, now.Location()).Format(dateFormat)
+	week := time.Date(y, mo, d-(int(now.Weekday())+6)%7, 0, 0, 0, 0, now.Location()).Format(dateFormat)
+	month := time.Date(y, mo, 1, 0, 0, 0, 0, now.Location()).Format(dateFormat)
+
+	totals := map[string]float64{
+		consumption.Today:     m.days[today],
+		consumption.Yesterday: m.days[yesterday],
+		consumption.ThisWeek:  0,
+		consumption.ThisMonth: 0,
+	}
+	for day, dd := range m.days {
+		if day > today {
+			continue
+		}
+		if day >= week {
+			totals[consumption.ThisWeek] += dd
+		}
+		if day >= month {
+			totals[consumption.ThisMonth] += dd
+		}
+	}
+	return totals
+}
+
+// publish publishes the degree days, and the kg of pellets used per degree
+// day, of each period that have changed. Consumption per degree day isn't
+// published for periods with too few degree days for it to mean anything.
+func (m *Meter) publish() {
+	now := time.Now()
+	m.mutex.Lock()
+	degreeDays := make(map[string]interface{})
+	normalized := make(map[string]interface{})
+	for key, dd := range m.totals(now) {
+		degreeDays[key] = round(dd)
+		if kg, ok := m.kg[key]; ok && dd >= minDegreeDays {
+			normalized[key] = round(kg / dd)
+		}
+	}
+	changes := append(m.published.Changes(Category, degreeDays, now), m.published.Changes(NormalizedCategory, normalized, now)...)
+	m.mutex.Unlock()
+
+	for _, change := range changes {
+		m.events.Publish(bus.ChangeTopic, change)
+	}
+}
+
+// Save stores the daily degree days.
+func (m *Meter) Save() {
+	m.mutex.Lock()
+	days := make(map[string]float64, len(m.days))
+	for day, dd := range m.days {
+		days[day] = dd
+	}
+	m.mutex.Unlock()
+	if err := m.store.Set(stateKey, days); err != nil {
+		log.Errorf("Failed to save degree days: %v", err)
+	}
+}
+
+func round(v float64) nbe.RoundedFloat {
+	return nbe.RoundedFloat(math.Round(v*100) / 100)
+}
@@ -0,0 +1,143 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/units"
+)
+
+// runDiff reports the settings that differ between a backup and the
+// controller, or between two backups, such as before and after a service
+// visit or firmware update.
+func runDiff(args []string) error {
+	var controllerUrlOpt, logLevel, categories, format string
+
+	flags := newCommandFlags("diff", &controllerUrlOpt, &logLevel)
+	flags.StringVar(&categories, "category", "", "comma separated categories to compare, or empty for all")
+	flags.StringVar(&format, "format", "table", "output format, table or json")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: boiler-mate diff [flags] <backup.json> [other.json]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return fmt.Errorf("expected one or two backup files")
+	}
+	if format != "table" && format != "json" {
+		return fmt.Errorf("invalid format: %s", format)
+	}
+	only, err := parseCategories(categories)
+	if err != nil {
+		return err
+	}
+
+	before, err := readBackup(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var after *nbe.SettingsDump
+	afterName := flags.Arg(1)
+	if afterName != "" {
+		backup, err := readBackup(afterName)
+		if err != nil {
+			return err
+		}
+		after = &backup.SettingsDump
+	} else {
+		boiler, err := connectController(controllerUrlOpt, logLevel)
+		if err != nil {
+			return err
+		}
+		defer boiler.Close()
+		if after, err = nbe.DumpSettings(boiler); err != nil {
+			return err
+		}
+	}
+
+	// A category that couldn't be read would otherwise show every one of
+	// its settings as added or removed.
+	skip := make(map[string]bool)
+	for _, dump := range []*nbe.SettingsDump{&before.SettingsDump, after} {
+		for category := range dump.Errors {
+			if !isSetting(category) {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Skipping %s, which couldn't be read from controller %s at %s\n", category, dump.Serial, dump.Timestamp.Local().Format("2006-01-02 15:04:05"))
+			skip[category] = true
+		}
+	}
+	changes := []settingChange{}
+	for _, change := range diffSettings(before.Settings, after.Settings) {
+		switch {
+		case skip[change.Category], len(only) > 0 && !only[change.Category]:
+		case units.IsCommand(change.String()):
+		default:
+			changes = append(changes, change)
+		}
+	}
+
+	if format == "json" {
+		return writeJSONOutput("-", changes)
+	}
+
+	fmt.Printf("Before: %s\n", describeDump(flags.Arg(0), &before.SettingsDump))
+	fmt.Printf("After:  %s\n\n", describeDump(afterName, after))
+	if len(changes) == 0 {
+		fmt.Println("No settings differ")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tBEFORE\tAFTER\t")
+	for _, change := range changes {
+		note := ""
+		switch {
+		case change.From == "":
+			note = "added"
+		case change.To == "":
+			note = "removed"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", change, orDash(change.From), orDash(change.To), note)
+	}
+	tw.Flush()
+	fmt.Printf("\n%d settings differ\n", len(changes))
+	return nil
+}
+
+// describeDump names a backup, or the controller if it has no file name.
+func describeDump(name string, dump *nbe.SettingsDump) string {
+	taken := dump.Timestamp.Local().Format("2006-01-02 15:04:05")
+	if name == "" {
+		return fmt.Sprintf("controller %s, now (%s)", dump.Serial, taken)
+	}
+	return fmt.Sprintf("%s, controller %s at %s", name, dump.Serial, taken)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,64 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// runDiscover broadcasts a discovery request and lists the controllers that
+// answer, for finding the serial and address to put in -controller.
+func runDiscover(args []string) error {
+	var address, format string
+	var wait time.Duration
+
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	flags.StringVar(&address, "address", nbe.DiscoveryAddress, "address to send the discovery request to, e.g. a subnet's broadcast address")
+	flags.DurationVar(&wait, "wait", 3*time.Second, "how long to wait for controllers to answer")
+	flags.StringVar(&format, "format", "table", "output format, table or json")
+	flags.Parse(args)
+
+	if format != "table" && format != "json" {
+		return fmt.Errorf("invalid format: %s", format)
+	}
+
+	controllers, err := nbe.Discover(address, wait)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return writeJSONOutput("-", controllers)
+	}
+	if len(controllers) == 0 {
+		fmt.Fprintln(os.Stderr, "No controllers answered")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERIAL\tIP\tMODEL\tFIRMWARE")
+	for _, c := range controllers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Serial, c.IP, c.Model, c.Firmware)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,101 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// Siegert coefficients commonly used for wood pellets.
+const (
+	siegertA = 0.65
+	siegertB = 0.008
+)
+
+// combustion keeps the operating data that combustion efficiency is
+// estimated from. It is used by the operating_data monitor's Derive, which
+// the monitor's mutex serializes.
+type combustion struct {
+	state, substate int64
+	smoke, oxygen   float64
+	ret             float64
+	seen            int
+}
+
+const (
+	seenSmoke = 1 << iota
+	seenOxygen
+	seenReturn
+)
+
+// derive adds combustion_efficiency, in %, to changes of the smoke
+// temperature, oxygen or return temperature while the burner is running.
+// It is 100% less the flue gas loss by the Siegert formula. The temperature
+// of the air the burner draws in isn't known, so the return temperature
+// stands in for it: the flue gas can't be cooled below it, which leaves the
+// loss that cleaning and tuning can do something about. It is an estimate,
+// best used to compare the boiler with itself.
+func (c *combustion) derive(key string, value interface{}, changeSet map[string]interface{}) {
+	var v float64
+	switch t := value.(type) {
+	case nbe.RoundedFloat:
+		v = float64(t)
+	case int64:
+		v = float64(t)
+	default:
+		return
+	}
+	switch key {
+	case "state":
+		c.state = int64(v)
+		return
+	case "substate":
+		c.substate = int64(v)
+		return
+	case "smoke_temp":
+		c.smoke = v
+		c.seen |= seenSmoke
+	case "oxygen":
+		c.oxygen = v
+		c.seen |= seenOxygen
+	case "return_temp":
+		c.ret = v
+		c.seen |= seenReturn
+	default:
+		return
+	}
+
+	// The state and substate may have changed in the same response, and
+	// be derived after this key.
+	if state, ok := changeSet["state"].(int64); ok {
+		c.state = state
+	}
+	if substate, ok := changeSet["substate"].(int64); ok {
+		c.substate = substate
+	}
+
+	// Without a flame the oxygen is that of air, and the loss meaningless.
+	if c.seen != seenSmoke|seenOxygen|seenReturn || nbe.Phase(c.state, c.substate) != nbe.PhaseRunning || c.oxygen >= 20 {
+		return
+	}
+	loss := (c.smoke - c.ret) * (siegertA/(21-c.oxygen) + siegertB)
+	efficiency := math.Max(0, math.Min(100, 100-loss))
+	changeSet["combustion_efficiency"] = nbe.RoundedFloat(math.Round(efficiency*10) / 10)
+}
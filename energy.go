@@ -0,0 +1,152 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/state"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	energyStateKey = "energy_kwh"
+
+	// The power is sampled more often than it is saved, to spare SD cards.
+	energySampleInterval = 10 * time.Second
+	energySaveInterval   = time.Minute
+
+	// energyMaxGap is the longest the power can go unpolled before the
+	// gap is left out rather than bridged.
+	energyMaxGap = time.Minute
+)
+
+// energyMeter integrates operating_data.power_kw over time into the energy
+// produced, in kWh, kept in the state store so that it survives restarts.
+type energyMeter struct {
+	monitor *monitor.Monitor
+	store   *state.Store
+
+	mutex    sync.Mutex
+	kWh      float64
+	saved    float64
+	lastKW   float64
+	lastTime time.Time
+}
+
+// publishEnergy publishes the energy produced as energy.produced whenever
+// it grows by a tenth of a kWh, and exports it as the
+// boiler_mate_energy_produced_kwh_total counter.
+func publishEnergy(events *bus.Bus, m *monitor.Monitor, store *state.Store, serial string) *energyMeter {
+	e := &energyMeter{monitor: m, store: store}
+	store.Get(energyStateKey, &e.kWh)
+	e.saved = e.kWh
+
+	counter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   "boiler_mate",
+		Subsystem:   "energy",
+		Name:        "produced_kwh_total",
+		Help:        "Heat energy produced, integrated from the burner power.",
+		ConstLabels: prometheus.Labels{"serial": serial},
+	}, e.total)
+	if err := prometheus.Register(counter); err != nil {
+		log.Errorf("Failed to register energy counter: %v", err)
+	}
+
+	// The total is published at startup, so that it is known before the
+	// burner next runs.
+	published := make(bus.Published)
+	publish := func() {
+		value := nbe.RoundedFloat(math.Floor(e.total()*10) / 10)
+		for _, change := range published.Changes("energy", map[string]interface{}{"produced": value}, time.Now()) {
+			events.Publish(bus.ChangeTopic, change)
+		}
+	}
+
+	go func() {
+		publish()
+		sample := time.NewTicker(energySampleInterval)
+		defer sample.Stop()
+		save := time.NewTicker(energySaveInterval)
+		defer save.Stop()
+		for {
+			select {
+			case now := <-sample.C:
+				e.sample(now)
+				publish()
+			case <-save.C:
+				e.save()
+			}
+		}
+	}()
+	return e
+}
+
+// sample adds the energy produced since the last sample, assuming the power
+// changed linearly between them.
+func (e *energyMeter) sample(now time.Time) {
+	value, _ := e.monitor.Get("power_kw")
+	var kW float64
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		kW = float64(v)
+	case int64:
+		kW = float64(v)
+	default:
+		return
+	}
+	fresh := now.Sub(e.monitor.LastPoll()) < energyMaxGap
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if fresh && !e.lastTime.IsZero() && now.Sub(e.lastTime) < energyMaxGap {
+		e.kWh += (e.lastKW + kW) / 2 * now.Sub(e.lastTime).Hours()
+	}
+	if fresh {
+		e.lastKW, e.lastTime = kW, now
+	} else {
+		e.lastTime = time.Time{}
+	}
+}
+
+func (e *energyMeter) total() float64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.kWh
+}
+
+// save stores the total if it has grown since it was last saved.
+func (e *energyMeter) save() {
+	e.mutex.Lock()
+	kWh := e.kWh
+	changed := kWh != e.saved
+	e.saved = kWh
+	e.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if err := e.store.Set(energyStateKey, kWh); err != nil {
+		log.Errorf("Failed to save energy produced: %v", err)
+	}
+}
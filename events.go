@@ -0,0 +1,209 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/names"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/units"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	changesTopic          = "events/changes"
+	controllerStatusTopic = "controller/status"
+)
+
+// changeEvent is published on <prefix>/events/changes for every change, so
+// that flows can subscribe to one topic rather than one per key.
+type changeEvent struct {
+	Timestamp time.Time   `json:"ts"`
+	Category  string      `json:"category"`
+	Key       string      `json:"key"`
+	Old       interface{} `json:"old"`
+	New       interface{} `json:"new"`
+}
+
+// publishValues publishes every changed value, retained, on
+// <prefix>/<category>/<key> as named by topics, converted and rounded by
+// formatter.
+func publishValues(mqttClient *mqtt.Client, events *bus.Bus, formatter units.Formatter, topics *names.Names) {
+	events.OnChange(func(change bus.Change) {
+		if change.Retained {
+			return
+		}
+		topic := fmt.Sprintf("%s/%s", mqttClient.Prefix, topics.Topic(change.Category, change.Key))
+		value := formatter.Format(change.Category, change.Key, change.Value)
+		if err := mqttClient.PublishRaw(topic, value); err != nil {
+			log.Errorf("Failed to publish %s.%s: %v", change.Category, change.Key, err)
+		}
+	})
+}
+
+func publishChangeEvents(mqttClient *mqtt.Client, events *bus.Bus, formatter units.Formatter) {
+	events.OnChange(func(change bus.Change) {
+		if change.Retained {
+			return
+		}
+		err := mqttClient.PublishEvent(changesTopic, changeEvent{
+			Timestamp: change.Timestamp,
+			Category:  change.Category,
+			Key:       change.Key,
+			Old:       formatter.Format(change.Category, change.Key, change.Previous),
+			New:       formatter.Format(change.Category, change.Key, change.Value),
+		})
+		if err != nil {
+			log.Errorf("Failed to publish change event: %v", err)
+		}
+	})
+}
+
+// publishAlarms turns changes of state into alarms being raised and
+// cleared, described in language. The state seen at startup is never an
+// alarm, as it may have been raised long ago.
+func publishAlarms(events *bus.Bus, language string) {
+	events.OnChange(func(change bus.Change) {
+		if change.Category != "operating_data" || change.Key != "state" || change.Previous == nil {
+			return
+		}
+		cur, _ := change.Value.(int64)
+		prev, _ := change.Previous.(int64)
+		if nbe.AlarmStates[cur] && !nbe.AlarmStates[prev] {
+			events.Publish(bus.AlarmTopic, bus.Alarm{
+				Timestamp:   change.Timestamp,
+				State:       cur,
+				Text:        nbe.PowerStateText(cur),
+				Description: nbe.AlarmText(language, cur),
+				Active:      true,
+			})
+		} else if !nbe.AlarmStates[cur] && nbe.AlarmStates[prev] {
+			events.Publish(bus.AlarmTopic, bus.Alarm{
+				Timestamp:   change.Timestamp,
+				State:       prev,
+				Text:        nbe.PowerStateText(prev),
+				Description: nbe.AlarmText(language, prev),
+			})
+		}
+	})
+}
+
+// alarmAttributes are published on <prefix>/alarm/attributes whenever
+// the state changes, with the code and text of the alarm if there is one.
+type alarmAttributes struct {
+	Code        int64  `json:"code,omitempty"`
+	Text        string `json:"text,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// publishAlarmState publishes whether the boiler is in an alarm state, as
+// ON or OFF on <prefix>/alarm/state, and its code and description on
+// <prefix>/alarm/attributes. Unlike publishAlarms, the state seen at
+// startup is published, so that the alarm is shown however old it is,
+// unless it is what was retained before a warm start.
+func publishAlarmState(mqttClient *mqtt.Client, events *bus.Bus, language string) {
+	events.OnChange(func(change bus.Change) {
+		if change.Category != "operating_data" || change.Key != "state" || change.Retained {
+			return
+		}
+		state, ok := change.Value.(int64)
+		if !ok {
+			return
+		}
+		status := "OFF"
+		attributes := alarmAttributes{}
+		if nbe.AlarmStates[state] {
+			status = "ON"
+			attributes = alarmAttributes{
+				Code:        state,
+				Text:        nbe.PowerStateText(state),
+				Description: nbe.AlarmText(language, state),
+			}
+		}
+		if err := mqttClient.PublishRaw(fmt.Sprintf("%s/alarm/state", mqttClient.Prefix), status); err != nil {
+			log.Errorf("Failed to publish alarm state: %v", err)
+		}
+		if err := mqttClient.PublishJSON(fmt.Sprintf("%s/alarm/attributes", mqttClient.Prefix), attributes); err != nil {
+			log.Errorf("Failed to publish alarm attributes: %v", err)
+		}
+	})
+}
+
+// watchController publishes the controller connection being lost when m
+// stops getting answers to its polls, and restored when they start again.
+func watchController(events *bus.Bus, m *monitor.Monitor) {
+	go func() {
+		connected := true
+		for {
+			time.Sleep(m.Interval)
+			err := m.Healthz()
+			if (err == nil) == connected {
+				continue
+			}
+			connected = err == nil
+			event := bus.Connectivity{
+				Timestamp: time.Now(),
+				Component: "controller",
+				Connected: connected,
+			}
+			if err != nil {
+				event.Error = err.Error()
+				log.Warnf("Lost connection to controller: %v", err)
+			} else {
+				log.Infof("Connection to controller restored")
+			}
+			events.Publish(bus.ConnectivityTopic, event)
+		}
+	}()
+}
+
+// publishControllerStatus publishes, retained, "online" on
+// <prefix>/controller/status while the controller answers, and "offline"
+// while it doesn't, so that entities can go unavailable when the boiler is
+// unreachable even though the bridge is connected to the broker.
+func publishControllerStatus(mqttClient *mqtt.Client, events *bus.Bus) {
+	topic := fmt.Sprintf("%s/%s", mqttClient.Prefix, controllerStatusTopic)
+	mqttClient.PublishRaw(topic, "online")
+	events.OnConnectivity(func(c bus.Connectivity) {
+		if c.Component != "controller" {
+			return
+		}
+		status := "offline"
+		if c.Connected {
+			status = "online"
+		}
+		if err := mqttClient.PublishRaw(topic, status); err != nil {
+			log.Errorf("Failed to publish controller status: %v", err)
+		}
+	})
+}
+
+// availability is the availability of discovered entities showing values
+// from the controller: both the bridge's own status, which is offline when
+// it loses the broker, and the controller's status must be online.
+func availability(prefix string) []map[string]string {
+	return []map[string]string{
+		{"t": fmt.Sprintf("%s/device/status", prefix)},
+		{"t": fmt.Sprintf("%s/%s", prefix, controllerStatusTopic)},
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package eventsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// eventSchema is the Avro schema of an Event. Values are a union of the
+// types the controller and the derived values produce.
+const eventSchema = `{
+  "type": "record",
+  "name": "Event",
+  "namespace": "com.github.mlipscombe.boilermate",
+  "fields": [
+    {"name": "type", "type": "string"},
+    {"name": "serial", "type": "string"},
+    {"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "category", "type": ["null", "string"], "default": null},
+    {"name": "key", "type": ["null", "string"], "default": null},
+    {"name": "value", "type": ["null", "boolean", "long", "double", "string"], "default": null},
+    {"name": "values", "type": ["null", {"type": "map", "values": {"type": "map", "values": ["null", "boolean", "long", "double", "string"]}}], "default": null}
+  ]
+}`
+
+// avroEncoder encodes events in the Confluent wire format: a zero byte, the
+// schema ID in the registry, and the Avro binary encoding.
+type avroEncoder struct {
+	codec  *goavro.Codec
+	header []byte
+}
+
+// newAvroEncoder registers the event schema under subject in the schema
+// registry at registry, and returns an encoder for it.
+func newAvroEncoder(registry *url.URL, subject string) (*avroEncoder, error) {
+	codec, err := goavro.NewCodec(eventSchema)
+	if err != nil {
+		return nil, err
+	}
+	id, err := registerSchema(registry, subject, codec.Schema())
+	if err != nil {
+		return nil, fmt.Errorf("schema registry: %w", err)
+	}
+
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(id))
+	return &avroEncoder{codec: codec, header: header}, nil
+}
+
+func (e *avroEncoder) Encode(event Event) ([]byte, error) {
+	datum := map[string]interface{}{
+		"type":      event.Type,
+		"serial":    event.Serial,
+		"timestamp": event.Timestamp,
+		"category":  avroString(event.Category),
+		"key":       avroString(event.Key),
+		"value":     avroValue(event.Value),
+		"values":    nil,
+	}
+	if event.Values != nil {
+		values := make(map[string]interface{}, len(event.Values))
+		for category, m := range event.Values {
+			converted := make(map[string]interface{}, len(m))
+			for key, value := range m {
+				converted[key] = avroValue(value)
+			}
+			values[category] = converted
+		}
+		datum["values"] = goavro.Union("map", values)
+	}
+
+	buf := append([]byte(nil), e.header...)
+	return e.codec.BinaryFromNative(buf, datum)
+}
+
+func avroString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return goavro.Union("string", s)
+}
+
+// avroValue wraps a value as a branch of the value union.
+func avroValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Bool:
+		return goavro.Union("boolean", v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return goavro.Union("long", v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return goavro.Union("long", int64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return goavro.Union("double", v.Float())
+	case reflect.String:
+		return goavro.Union("string", v.String())
+	}
+	return goavro.Union("string", fmt.Sprint(value))
+}
+
+// registerSchema registers schema under subject, or finds the ID it was
+// already registered with.
+func registerSchema(registry *url.URL, subject string, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	endpoint := registry.JoinPath("subjects", subject, "versions")
+
+	req, err := http.NewRequest(http.MethodPost, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var registered struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&registered); err != nil {
+		return 0, err
+	}
+	return registered.ID, nil
+}
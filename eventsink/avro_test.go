@@ -0,0 +1,184 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package eventsink
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// newRegistry starts a schema registry that assigns id to every schema,
+// recording the subject and schema registered.
+func newRegistry(t *testing.T, id int) (*url.URL, *string, *string) {
+	t.Helper()
+	var subject, schema string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Schema string `json:"schema"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		subject, schema = r.URL.Path, body.Schema
+		json.NewEncoder(w).Encode(map[string]int{"id": id})
+	}))
+	t.Cleanup(server.Close)
+	uri, _ := url.Parse(server.URL)
+	return uri, &subject, &schema
+}
+
+func TestAvroEncoder(t *testing.T) {
+	registry, subject, schema := newRegistry(t, 42)
+	encoder, err := newAvroEncoder(registry, "boiler-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *subject != "/subjects/boiler-value/versions" {
+		t.Errorf("registered under %s", *subject)
+	}
+	codec, err := goavro.NewCodec(*schema)
+	if err != nil {
+		t.Fatalf("registered schema: %v", err)
+	}
+
+	ts := time.UnixMilli(1700000000123).UTC()
+	tests := []struct {
+		name  string
+		event Event
+		want  map[string]interface{}
+	}{
+		{
+			name:  "change",
+			event: Event{Type: "change", Serial: "1234", Timestamp: ts, Category: "boiler", Key: "temp", Value: nbe.RoundedFloat(70.5)},
+			want: map[string]interface{}{
+				"category": map[string]interface{}{"string": "boiler"},
+				"key":      map[string]interface{}{"string": "temp"},
+				"value":    map[string]interface{}{"double": 70.5},
+			},
+		},
+		{
+			name:  "integer",
+			event: Event{Type: "change", Serial: "1234", Timestamp: ts, Category: "boiler", Key: "state", Value: int64(5)},
+			want:  map[string]interface{}{"value": map[string]interface{}{"long": int64(5)}},
+		},
+		{
+			name:  "boolean",
+			event: Event{Type: "change", Serial: "1234", Timestamp: ts, Category: "hopper", Key: "empty", Value: true},
+			want:  map[string]interface{}{"value": map[string]interface{}{"boolean": true}},
+		},
+		{
+			name: "snapshot",
+			event: Event{Type: "snapshot", Serial: "1234", Timestamp: ts, Values: map[string]map[string]interface{}{
+				"boiler": {"temp": nbe.RoundedFloat(70.5), "mode": "auto"},
+			}},
+			want: map[string]interface{}{
+				"category": nil,
+				"value":    nil,
+				"values": map[string]interface{}{"map": map[string]interface{}{
+					"boiler": map[string]interface{}{
+						"temp": map[string]interface{}{"double": 70.5},
+						"mode": map[string]interface{}{"string": "auto"},
+					},
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := encoder.Encode(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf[0] != 0 || binary.BigEndian.Uint32(buf[1:5]) != 42 {
+				t.Fatalf("header = % x, want magic 0 and schema 42", buf[:5])
+			}
+			native, rest, err := codec.NativeFromBinary(buf[5:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rest) != 0 {
+				t.Errorf("%d trailing bytes", len(rest))
+			}
+			got := native.(map[string]interface{})
+			if got["type"] != tt.event.Type || got["serial"] != "1234" {
+				t.Errorf("type, serial = %v, %v", got["type"], got["serial"])
+			}
+			if stamp, _ := got["timestamp"].(time.Time); !stamp.Equal(ts) {
+				t.Errorf("timestamp = %v, want %v", got["timestamp"], ts)
+			}
+			for field, want := range tt.want {
+				gotJSON, _ := json.Marshal(got[field])
+				wantJSON, _ := json.Marshal(want)
+				if string(gotJSON) != string(wantJSON) {
+					t.Errorf("%s = %s, want %s", field, gotJSON, wantJSON)
+				}
+			}
+		})
+	}
+}
+
+func TestAvroEncoderRegistryError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error_code":409,"message":"incompatible schema"}`, http.StatusConflict)
+	}))
+	defer server.Close()
+	registry, _ := url.Parse(server.URL)
+	if _, err := newAvroEncoder(registry, "boiler-value"); err == nil {
+		t.Error("newAvroEncoder succeeded with an incompatible schema")
+	}
+}
+
+func TestNewSinkSchemaRegistry(t *testing.T) {
+	registry, subject, _ := newRegistry(t, 1)
+	broker := newFakeBroker(t, 1)
+	uri, _ := url.Parse("kafka://" + broker.listener.Addr().String() + "/boiler?schema_registry=" + url.QueryEscape(registry.String()))
+	sink, err := NewSink(uri, "1234", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.publisher.Close()
+	if *subject != "/subjects/boiler-value/versions" {
+		t.Errorf("registered under %s", *subject)
+	}
+
+	sink.publish(Event{Type: "change", Serial: "1234", Timestamp: time.Now(), Category: "boiler", Key: "temp", Value: 70})
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	records := broker.produced[0]
+	if len(records) != 1 || records[0].Value[0] != 0 || string(records[0].Key) != "1234.boiler.temp" {
+		t.Errorf("produced %+v", records)
+	}
+
+	rest, _ := url.Parse("kafka+http://localhost:8082/boiler?schema_registry=http://localhost:8081")
+	if _, err := NewSink(rest, "1234", 0); err == nil {
+		t.Error("NewSink accepted a schema registry for the REST proxy")
+	}
+}
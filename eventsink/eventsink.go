@@ -0,0 +1,174 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package eventsink
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	log "github.com/sirupsen/logrus"
+)
+
+const queueSize = 1024
+
+// Publisher delivers a single message to a topic or subject.
+type Publisher interface {
+	Publish(key string, payload []byte) error
+	Close() error
+}
+
+// Event is the JSON document published for changes and snapshots.
+type Event struct {
+	Type      string                            `json:"type"`
+	Serial    string                            `json:"serial"`
+	Timestamp time.Time                         `json:"timestamp"`
+	Category  string                            `json:"category,omitempty"`
+	Key       string                            `json:"key,omitempty"`
+	Value     interface{}                       `json:"value,omitempty"`
+	Values    map[string]map[string]interface{} `json:"values,omitempty"`
+}
+
+// Sink publishes every change event, and a periodic snapshot of all values,
+// to a message broker.
+type Sink struct {
+	Serial   string
+	Interval time.Duration
+
+	publisher Publisher
+	encode    func(Event) ([]byte, error)
+	queue     chan Event
+}
+
+// NewSink creates a sink for a nats://<host>:<port>/<subject>,
+// kafka[+tls]://<host>:<port>/<topic> or kafka+http[s]://<host>:<port>/<topic>
+// URI. The kafka schemes produce to the brokers directly, and the
+// kafka+http schemes through a Kafka REST Proxy. Events are JSON, unless a
+// kafka URI has a schema_registry=<url> parameter, when they are Avro with
+// the schema registered under <topic>-value.
+func NewSink(uri *url.URL, serial string, interval time.Duration) (*Sink, error) {
+	var publisher Publisher
+	var err error
+
+	registry := uri.Query().Get("schema_registry")
+	switch uri.Scheme {
+	case "nats", "tls":
+		publisher, err = newNATSPublisher(uri)
+	case "kafka", "kafka+tls":
+		publisher, err = newKafkaPublisher(uri)
+	case "kafka+http", "kafka+https":
+		publisher, err = newKafkaRESTPublisher(uri)
+	default:
+		return nil, fmt.Errorf("unsupported event sink scheme: %s", uri.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &Sink{
+		Serial:    serial,
+		Interval:  interval,
+		publisher: publisher,
+		encode:    func(event Event) ([]byte, error) { return json.Marshal(event) },
+		queue:     make(chan Event, queueSize),
+	}
+	if registry != "" {
+		if uri.Scheme != "kafka" && uri.Scheme != "kafka+tls" {
+			publisher.Close()
+			return nil, fmt.Errorf("schema_registry is only supported by the kafka and kafka+tls schemes")
+		}
+		registryURI, err := url.Parse(registry)
+		if err != nil {
+			publisher.Close()
+			return nil, fmt.Errorf("invalid schema_registry: %w", err)
+		}
+		encoder, err := newAvroEncoder(registryURI, strings.Trim(uri.Path, "/")+"-value")
+		if err != nil {
+			publisher.Close()
+			return nil, err
+		}
+		sink.encode = encoder.Encode
+	}
+	return sink, nil
+}
+
+func (s *Sink) Start(events *bus.Bus, monitors map[string]*monitor.Monitor) {
+	events.OnChange(func(change bus.Change) {
+		s.enqueue(Event{
+			Type:      "change",
+			Serial:    s.Serial,
+			Timestamp: change.Timestamp,
+			Category:  change.Category,
+			Key:       change.Key,
+			Value:     change.Value,
+		})
+	})
+
+	go func() {
+		for event := range s.queue {
+			s.publish(event)
+		}
+	}()
+
+	if s.Interval > 0 {
+		go func() {
+			ticker := time.NewTicker(s.Interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				values := make(map[string]map[string]interface{}, len(monitors))
+				for category, m := range monitors {
+					values[category] = m.Values()
+				}
+				s.enqueue(Event{
+					Type:      "snapshot",
+					Serial:    s.Serial,
+					Timestamp: time.Now(),
+					Values:    values,
+				})
+			}
+		}()
+	}
+}
+
+func (s *Sink) enqueue(event Event) {
+	select {
+	case s.queue <- event:
+	default:
+		log.Warnf("Event sink queue is full, dropping %s event", event.Type)
+	}
+}
+
+func (s *Sink) publish(event Event) {
+	payload, err := s.encode(event)
+	if err != nil {
+		log.Errorf("Failed to encode %s event: %v", event.Type, err)
+		return
+	}
+
+	key := s.Serial
+	if event.Type == "change" {
+		key = fmt.Sprintf("%s.%s.%s", s.Serial, event.Category, event.Key)
+	}
+	if err := s.publisher.Publish(key, payload); err != nil {
+		log.Errorf("Failed to publish %s event: %v", event.Type, err)
+	}
+}
@@ -0,0 +1,367 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package eventsink
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// The protocol versions used: the oldest that every broker since Kafka 1.0
+// still accepts, so that neither side needs the flexible encodings.
+const (
+	kafkaMetadataVersion = 4
+	kafkaProduceVersion  = 3
+)
+
+const (
+	kafkaTimeout         = 10 * time.Second
+	kafkaMetadataRefresh = 5 * time.Minute
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaPublisher produces records straight to the brokers, leading each
+// partition, that it learns of from a bootstrap broker. Records are sent
+// one at a time with acks from all in-sync replicas, as the sink publishes
+// a change at a time, and are partitioned by key the way the Java client
+// does, so that the changes to a key stay in order.
+type kafkaPublisher struct {
+	topic     string
+	bootstrap string
+	tls       *tls.Config
+	formatter *kmsg.RequestFormatter
+
+	mutex         sync.Mutex
+	correlationID int32
+	brokers       map[int32]string
+	leaders       []int32
+	refreshed     time.Time
+	conns         map[string]net.Conn
+}
+
+func newKafkaPublisher(uri *url.URL) (*kafkaPublisher, error) {
+	topic := strings.Trim(uri.Path, "/")
+	if topic == "" || strings.Contains(topic, "/") {
+		return nil, fmt.Errorf("Kafka URI must include a /<topic>")
+	}
+	host := uri.Host
+	if uri.Port() == "" {
+		host = net.JoinHostPort(uri.Hostname(), "9092")
+	}
+
+	p := &kafkaPublisher{
+		topic:     topic,
+		bootstrap: host,
+		formatter: kmsg.NewRequestFormatter(kmsg.FormatterClientID("boiler-mate")),
+		conns:     make(map[string]net.Conn),
+	}
+	if uri.Scheme == "kafka+tls" {
+		p.tls = &tls.Config{ServerName: uri.Hostname()}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.refresh(); err != nil {
+		p.closeConns()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *kafkaPublisher) Publish(key string, payload []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if time.Since(p.refreshed) > kafkaMetadataRefresh {
+		if err := p.refresh(); err != nil {
+			return err
+		}
+	}
+	err := p.produce(key, payload)
+	if err != nil {
+		// The leader may have moved, so start again from the bootstrap
+		// broker next time.
+		p.closeConns()
+		p.refreshed = time.Time{}
+	}
+	return err
+}
+
+func (p *kafkaPublisher) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closeConns()
+	return nil
+}
+
+func (p *kafkaPublisher) closeConns() {
+	for addr, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// refresh fetches the brokers and the leader of each partition of the topic.
+func (p *kafkaPublisher) refresh() error {
+	req := kmsg.NewPtrMetadataRequest()
+	req.SetVersion(kafkaMetadataVersion)
+	req.AllowAutoTopicCreation = true
+	topic := kmsg.NewMetadataRequestTopic()
+	topic.Topic = &p.topic
+	req.Topics = append(req.Topics, topic)
+
+	addr := p.bootstrap
+	for _, broker := range p.brokers {
+		// Once known, any broker can answer.
+		addr = broker
+		break
+	}
+	var resp kmsg.MetadataResponse
+	if err := p.request(addr, req, &resp); err != nil {
+		return err
+	}
+
+	brokers := make(map[int32]string, len(resp.Brokers))
+	for _, b := range resp.Brokers {
+		brokers[b.NodeID] = net.JoinHostPort(b.Host, strconv.Itoa(int(b.Port)))
+	}
+	if len(resp.Topics) != 1 {
+		return fmt.Errorf("metadata for %d topics, expected %s", len(resp.Topics), p.topic)
+	}
+	t := resp.Topics[0]
+	if t.ErrorCode != 0 {
+		return fmt.Errorf("metadata for %s: %w", p.topic, kafkaError(t.ErrorCode))
+	}
+	if len(t.Partitions) == 0 {
+		return fmt.Errorf("%s has no partitions", p.topic)
+	}
+	leaders := make([]int32, len(t.Partitions))
+	for _, partition := range t.Partitions {
+		if partition.Partition < 0 || int(partition.Partition) >= len(leaders) {
+			return fmt.Errorf("%s has an unexpected partition %d", p.topic, partition.Partition)
+		}
+		leaders[partition.Partition] = partition.Leader
+	}
+
+	p.brokers = brokers
+	p.leaders = leaders
+	p.refreshed = time.Now()
+	return nil
+}
+
+// produce sends a single record to the leader of its partition.
+func (p *kafkaPublisher) produce(key string, payload []byte) error {
+	partition := kafkaPartition([]byte(key), len(p.leaders))
+	leader, ok := p.brokers[p.leaders[partition]]
+	if !ok {
+		return fmt.Errorf("%s partition %d has no leader", p.topic, partition)
+	}
+
+	req := kmsg.NewPtrProduceRequest()
+	req.SetVersion(kafkaProduceVersion)
+	req.Acks = -1
+	req.TimeoutMillis = int32(kafkaTimeout / time.Millisecond)
+	topic := kmsg.NewProduceRequestTopic()
+	topic.Topic = p.topic
+	part := kmsg.NewProduceRequestTopicPartition()
+	part.Partition = int32(partition)
+	part.Records = recordBatch(time.Now(), []byte(key), payload)
+	topic.Partitions = append(topic.Partitions, part)
+	req.Topics = append(req.Topics, topic)
+
+	var resp kmsg.ProduceResponse
+	if err := p.request(leader, req, &resp); err != nil {
+		return err
+	}
+	for _, t := range resp.Topics {
+		for _, part := range t.Partitions {
+			if part.ErrorCode != 0 {
+				return fmt.Errorf("producing to %s partition %d: %w", t.Topic, part.Partition, kafkaError(part.ErrorCode))
+			}
+		}
+	}
+	return nil
+}
+
+// request sends req to the broker at addr and reads its response into resp.
+func (p *kafkaPublisher) request(addr string, req kmsg.Request, resp kmsg.Response) error {
+	conn, err := p.conn(addr)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		conn.Close()
+		delete(p.conns, addr)
+		return fmt.Errorf("kafka broker %s: %w", addr, err)
+	}
+
+	p.correlationID++
+	conn.SetDeadline(time.Now().Add(kafkaTimeout + 5*time.Second))
+	if _, err := conn.Write(p.formatter.AppendRequest(nil, req, p.correlationID)); err != nil {
+		return fail(err)
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fail(err)
+	}
+	size := int32(binary.BigEndian.Uint32(header[0:4]))
+	if size < 4 || size > 16<<20 {
+		return fail(fmt.Errorf("invalid response size %d", size))
+	}
+	if id := int32(binary.BigEndian.Uint32(header[4:8])); id != p.correlationID {
+		return fail(fmt.Errorf("response to request %d, expected %d", id, p.correlationID))
+	}
+	body := make([]byte, size-4)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return fail(err)
+	}
+	resp.SetVersion(req.GetVersion())
+	if err := resp.ReadFrom(body); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+func (p *kafkaPublisher) conn(addr string) (net.Conn, error) {
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+	dialer := &net.Dialer{Timeout: kafkaTimeout}
+	var conn net.Conn
+	var err error
+	if p.tls != nil {
+		config := p.tls.Clone()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config.ServerName = host
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kafka broker %s: %w", addr, err)
+	}
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+// recordBatch encodes a batch of a single uncompressed record, in the v2
+// format introduced by Kafka 0.11.
+func recordBatch(ts time.Time, key []byte, value []byte) []byte {
+	record := kmsg.NewRecord()
+	record.Key = key
+	record.Value = value
+	encoded := record.AppendTo(nil)
+	// The length prefixes the rest of the record, as a varint.
+	record.Length = int32(len(encoded) - 1)
+	records := record.AppendTo(nil)
+
+	batch := kmsg.NewRecordBatch()
+	batch.PartitionLeaderEpoch = -1
+	batch.Magic = 2
+	batch.FirstTimestamp = ts.UnixMilli()
+	batch.MaxTimestamp = batch.FirstTimestamp
+	batch.ProducerID = -1
+	batch.ProducerEpoch = -1
+	batch.FirstSequence = -1
+	batch.NumRecords = 1
+	batch.Records = records
+	buf := batch.AppendTo(nil)
+
+	// The length covers everything after itself, and the CRC everything
+	// after itself, both of which are only known once encoded.
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(buf)-12))
+	binary.BigEndian.PutUint32(buf[17:21], crc32.Checksum(buf[21:], crc32c))
+	return buf
+}
+
+// kafkaPartition picks a partition for key as the Java client's default
+// partitioner does, from the murmur2 hash of the key.
+func kafkaPartition(key []byte, partitions int) int {
+	return int(murmur2(key)&0x7fffffff) % partitions
+}
+
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaError describes a Kafka error code.
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	switch e {
+	case 3:
+		return "unknown topic or partition"
+	case 5:
+		return "leader not available"
+	case 6:
+		return "not leader for partition"
+	case 7:
+		return "request timed out"
+	case 10:
+		return "message too large"
+	case 19:
+		return "not enough replicas"
+	case 29:
+		return "topic authorization failed"
+	}
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
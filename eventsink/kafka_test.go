@@ -0,0 +1,265 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package eventsink
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func TestMurmur2(t *testing.T) {
+	// The values the Java client's Utils.murmur2 is tested against.
+	tests := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, want := range tests {
+		if got := murmur2([]byte(key)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestRecordBatch(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	buf := recordBatch(ts, []byte("1234.boiler.temp"), []byte(`{"value":70}`))
+
+	var batch kmsg.RecordBatch
+	if err := batch.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if int(batch.Length) != len(buf)-12 {
+		t.Errorf("Length = %d, want %d", batch.Length, len(buf)-12)
+	}
+	if want := int32(crc32.Checksum(buf[21:], crc32c)); batch.CRC != want {
+		t.Errorf("CRC = %#x, want %#x", batch.CRC, want)
+	}
+	if batch.Magic != 2 || batch.NumRecords != 1 || batch.ProducerID != -1 {
+		t.Errorf("unexpected batch header %+v", batch)
+	}
+	if batch.FirstTimestamp != ts.UnixMilli() {
+		t.Errorf("FirstTimestamp = %d, want %d", batch.FirstTimestamp, ts.UnixMilli())
+	}
+
+	var record kmsg.Record
+	if err := record.ReadFrom(batch.Records); err != nil {
+		t.Fatal(err)
+	}
+	if int(record.Length) != len(batch.Records)-1 {
+		t.Errorf("record Length = %d, want %d", record.Length, len(batch.Records)-1)
+	}
+	if string(record.Key) != "1234.boiler.temp" || string(record.Value) != `{"value":70}` {
+		t.Errorf("record = %q: %q", record.Key, record.Value)
+	}
+}
+
+// fakeBroker answers metadata and produce requests for a topic on a single
+// broker, recording the records produced.
+type fakeBroker struct {
+	listener   net.Listener
+	partitions int32
+
+	mutex    sync.Mutex
+	produced map[int32][]kmsg.Record
+}
+
+func newFakeBroker(t *testing.T, partitions int32) *fakeBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{
+		listener:   listener,
+		partitions: partitions,
+		produced:   make(map[int32][]kmsg.Record),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(t, conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		key := int16(binary.BigEndian.Uint16(buf[0:2]))
+		version := int16(binary.BigEndian.Uint16(buf[2:4]))
+		correlationID := binary.BigEndian.Uint32(buf[4:8])
+		clientID := int(binary.BigEndian.Uint16(buf[8:10]))
+		body := buf[10+clientID:]
+
+		req := kmsg.RequestForKey(key)
+		req.SetVersion(version)
+		if err := req.ReadFrom(body); err != nil {
+			t.Errorf("reading request %d: %v", key, err)
+			return
+		}
+
+		var resp kmsg.Response
+		switch req := req.(type) {
+		case *kmsg.MetadataRequest:
+			resp = b.metadata(req)
+		case *kmsg.ProduceRequest:
+			resp = b.produce(t, req)
+		default:
+			t.Errorf("unexpected request %d", key)
+			return
+		}
+		resp.SetVersion(version)
+
+		out := binary.BigEndian.AppendUint32(make([]byte, 4), correlationID)
+		out = resp.AppendTo(out)
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) metadata(req *kmsg.MetadataRequest) kmsg.Response {
+	host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	resp := kmsg.NewPtrMetadataResponse()
+	broker := kmsg.NewMetadataResponseBroker()
+	broker.NodeID = 1
+	broker.Host = host
+	broker.Port = int32(portNum)
+	resp.Brokers = append(resp.Brokers, broker)
+	for _, rt := range req.Topics {
+		topic := kmsg.NewMetadataResponseTopic()
+		topic.Topic = rt.Topic
+		for i := int32(0); i < b.partitions; i++ {
+			partition := kmsg.NewMetadataResponseTopicPartition()
+			partition.Partition = i
+			partition.Leader = 1
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		resp.Topics = append(resp.Topics, topic)
+	}
+	return resp
+}
+
+func (b *fakeBroker) produce(t *testing.T, req *kmsg.ProduceRequest) kmsg.Response {
+	resp := kmsg.NewPtrProduceResponse()
+	for _, rt := range req.Topics {
+		topic := kmsg.NewProduceResponseTopic()
+		topic.Topic = rt.Topic
+		for _, rp := range rt.Partitions {
+			var batch kmsg.RecordBatch
+			if err := batch.ReadFrom(rp.Records); err != nil {
+				t.Errorf("reading batch: %v", err)
+			}
+			var record kmsg.Record
+			if err := record.ReadFrom(batch.Records); err != nil {
+				t.Errorf("reading record: %v", err)
+			}
+			b.mutex.Lock()
+			b.produced[rp.Partition] = append(b.produced[rp.Partition], record)
+			b.mutex.Unlock()
+
+			partition := kmsg.NewProduceResponseTopicPartition()
+			partition.Partition = rp.Partition
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		resp.Topics = append(resp.Topics, topic)
+	}
+	return resp
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	broker := newFakeBroker(t, 4)
+	uri, _ := url.Parse("kafka://" + broker.listener.Addr().String() + "/boiler")
+	p, err := newKafkaPublisher(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	keys := []string{"1234.boiler.temp", "1234.hopper.content", "1234.boiler.temp"}
+	for i, key := range keys {
+		if err := p.Publish(key, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	temp := broker.produced[int32(kafkaPartition([]byte(keys[0]), 4))]
+	var values []string
+	for _, record := range temp {
+		if string(record.Key) == keys[0] {
+			values = append(values, string(record.Value))
+		}
+	}
+	if len(values) != 2 || values[0] != "0" || values[1] != "2" {
+		t.Errorf("records for %s = %v, want [0 2] on partition %d", keys[0], values, kafkaPartition([]byte(keys[0]), 4))
+	}
+	total := 0
+	for _, records := range broker.produced {
+		total += len(records)
+	}
+	if total != len(keys) {
+		t.Errorf("produced %d records, want %d", total, len(keys))
+	}
+}
+
+func TestKafkaPublisherError(t *testing.T) {
+	broker := newFakeBroker(t, 1)
+	uri, _ := url.Parse("kafka://" + broker.listener.Addr().String() + "/boiler")
+	p, err := newKafkaPublisher(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	broker.listener.Close()
+	p.closeConns()
+	if err := p.Publish("1234", []byte("{}")); err == nil {
+		t.Error("Publish to a stopped broker succeeded")
+	}
+}
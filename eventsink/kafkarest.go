@@ -0,0 +1,100 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package eventsink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// kafkaRESTPublisher produces records through a Kafka REST Proxy (v2 API),
+// which avoids linking a native Kafka client.
+type kafkaRESTPublisher struct {
+	endpoint string
+	uri      *url.URL
+	client   *http.Client
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+func newKafkaRESTPublisher(uri *url.URL) (*kafkaRESTPublisher, error) {
+	topic := strings.Trim(uri.Path, "/")
+	if topic == "" || strings.Contains(topic, "/") {
+		return nil, fmt.Errorf("Kafka URI must include a /<topic>")
+	}
+
+	endpoint := url.URL{
+		Scheme: strings.TrimPrefix(uri.Scheme, "kafka+"),
+		Host:   uri.Host,
+		Path:   fmt.Sprintf("/topics/%s", topic),
+	}
+
+	return &kafkaRESTPublisher{
+		endpoint: endpoint.String(),
+		uri:      uri,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *kafkaRESTPublisher) Publish(key string, payload []byte) error {
+	body, err := json.Marshal(kafkaRecords{
+		Records: []kafkaRecord{{Key: key, Value: payload}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if password, ok := p.uri.User.Password(); ok {
+		req.SetBasicAuth(p.uri.User.Username(), password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (p *kafkaRESTPublisher) Close() error {
+	return nil
+}
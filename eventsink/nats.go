@@ -0,0 +1,67 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package eventsink
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+type natsPublisher struct {
+	subject string
+	conn    *nats.Conn
+}
+
+func newNATSPublisher(uri *url.URL) (*natsPublisher, error) {
+	subject := strings.Trim(uri.Path, "/")
+	if subject == "" {
+		return nil, fmt.Errorf("NATS URI must include a /<subject>")
+	}
+
+	server := url.URL{Scheme: uri.Scheme, User: uri.User, Host: uri.Host}
+	conn, err := nats.Connect(server.String(),
+		nats.Name("boiler-mate"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Errorf("nats connection lost: %v", err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			log.Warn("nats reconnected")
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsPublisher{
+		subject: strings.ReplaceAll(subject, "/", "."),
+		conn:    conn,
+	}, nil
+}
+
+func (p *natsPublisher) Publish(_ string, payload []byte) error {
+	return p.conn.Publish(p.subject, payload)
+}
+
+func (p *natsPublisher) Close() error {
+	return p.conn.Drain()
+}
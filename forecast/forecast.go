@@ -0,0 +1,192 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package forecast
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Forecast sources.
+const (
+	OpenMeteo = "open-meteo"
+	MQTT      = "mqtt"
+)
+
+// Config pre-heats ahead of cold spells. When the coldest temperature
+// forecast within Lookahead falls below Threshold, Key is set to Base plus
+// Gain degrees per degree below, up to MaxAdjustment.
+type Config struct {
+	Source        string        `yaml:"source"`
+	Latitude      float64       `yaml:"latitude"`
+	Longitude     float64       `yaml:"longitude"`
+	Topic         string        `yaml:"topic"`
+	Field         string        `yaml:"field"`
+	Interval      time.Duration `yaml:"interval"`
+	Lookahead     time.Duration `yaml:"lookahead"`
+	Threshold     float64       `yaml:"threshold"`
+	Key           string        `yaml:"key"`
+	Base          float64       `yaml:"base"`
+	Gain          float64       `yaml:"gain"`
+	MaxAdjustment float64       `yaml:"max_adjustment"`
+}
+
+func (c *Config) Validate() error {
+	switch c.Source {
+	case OpenMeteo:
+		if c.Latitude == 0 && c.Longitude == 0 {
+			return fmt.Errorf("latitude and longitude are required for %s", OpenMeteo)
+		}
+	case MQTT:
+		if c.Topic == "" {
+			return fmt.Errorf("topic is required for %s", MQTT)
+		}
+	default:
+		return fmt.Errorf("unknown source %q, expected %s or %s", c.Source, OpenMeteo, MQTT)
+	}
+	if c.Gain <= 0 {
+		return fmt.Errorf("gain must be positive")
+	}
+	if c.MaxAdjustment <= 0 {
+		return fmt.Errorf("max_adjustment must be positive")
+	}
+	return nil
+}
+
+// Adjustment is published under <prefix>/forecast whenever the forecast is
+// updated.
+type Adjustment struct {
+	MinTemp    float64 `json:"min_temp"`
+	Adjustment float64 `json:"adjustment"`
+	Setpoint   float64 `json:"setpoint"`
+	Reason     string  `json:"reason"`
+}
+
+// Preheater shifts a setpoint according to the forecast.
+type Preheater struct {
+	Config
+
+	writer     *control.Writer
+	mqttClient *mqtt.Client
+	last       string
+	mutex      sync.Mutex
+}
+
+func NewPreheater(config Config, writer *control.Writer, mqttClient *mqtt.Client) *Preheater {
+	if config.Key == "" {
+		config.Key = "boiler.temp"
+	}
+	if config.Interval == 0 {
+		config.Interval = 30 * time.Minute
+	}
+	if config.Lookahead == 0 {
+		config.Lookahead = 12 * time.Hour
+	}
+	return &Preheater{
+		Config:     config,
+		writer:     writer,
+		mqttClient: mqttClient,
+	}
+}
+
+func (p *Preheater) Start() error {
+	if p.Source == MQTT {
+		return p.mqttClient.SubscribeRaw(p.Topic, 1, func(_ *mqtt.Client, msg mqtt.Message) {
+			temp, err := mqtt.ParseFloat(msg.Payload(), p.Field)
+			if err != nil {
+				log.Warnf("Ignoring forecast from %s: %v", msg.Topic(), err)
+				return
+			}
+			p.update(temp)
+		})
+	}
+
+	go func() {
+		for {
+			temp, err := fetchOpenMeteo(p.Latitude, p.Longitude, p.Lookahead)
+			if err != nil {
+				log.Errorf("Failed to fetch forecast: %v", err)
+			} else {
+				p.update(temp)
+			}
+			time.Sleep(p.Interval)
+		}
+	}()
+	return nil
+}
+
+func (p *Preheater) update(minTemp float64) {
+	adjustment := 0.0
+	reason := fmt.Sprintf("forecast minimum %.1f is not below %.1f", minTemp, p.Threshold)
+	if minTemp < p.Threshold {
+		adjustment = math.Min(p.MaxAdjustment, math.Round(p.Gain*(p.Threshold-minTemp)))
+		reason = fmt.Sprintf("forecast minimum %.1f within %s is below %.1f", minTemp, p.Lookahead, p.Threshold)
+	}
+	setpoint := p.Base + adjustment
+
+	go p.mqttClient.PublishRaw(fmt.Sprintf("%s/forecast", p.mqttClient.Prefix), Adjustment{
+		MinTemp:    minTemp,
+		Adjustment: adjustment,
+		Setpoint:   setpoint,
+		Reason:     reason,
+	})
+
+	value := strconv.FormatFloat(setpoint, 'f', -1, 64)
+	p.mutex.Lock()
+	if value == p.last {
+		p.mutex.Unlock()
+		return
+	}
+	p.last = value
+	p.mutex.Unlock()
+
+	log.Infof("Setting %s to %s: %s", p.Key, value, reason)
+	// A failed write is retried with the next forecast.
+	err := p.writer.SetResult("forecast", p.Key, []byte(value), func(response *nbe.NBEResponse, err error) {
+		if err == nil && response.Status == 0 {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("%v", response.Payload)
+		}
+		log.Errorf("Failed to set %s to %s: %v", p.Key, value, err)
+		p.forget(value)
+	})
+	if err != nil {
+		log.Errorf("Failed to set %s to %s: %v", p.Key, value, err)
+		p.forget(value)
+	}
+}
+
+// forget clears the last setpoint written if it was value, so that it is
+// written again.
+func (p *Preheater) forget(value string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.last == value {
+		p.last = ""
+	}
+}
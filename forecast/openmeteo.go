@@ -0,0 +1,79 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package forecast
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const openMeteoURL = "https://api.open-meteo.com/v1/forecast"
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+type openMeteoResponse struct {
+	Hourly struct {
+		Temperature []*float64 `json:"temperature_2m"`
+	} `json:"hourly"`
+}
+
+// fetchOpenMeteo returns the coldest hourly temperature forecast within the
+// lookahead.
+func fetchOpenMeteo(latitude float64, longitude float64, lookahead time.Duration) (float64, error) {
+	hours := int(math.Ceil(lookahead.Hours()))
+	if hours < 1 {
+		hours = 1
+	}
+	query := url.Values{
+		"latitude":       {strconv.FormatFloat(latitude, 'f', -1, 64)},
+		"longitude":      {strconv.FormatFloat(longitude, 'f', -1, 64)},
+		"hourly":         {"temperature_2m"},
+		"forecast_hours": {strconv.Itoa(hours)},
+		"timezone":       {"UTC"},
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%s?%s", openMeteoURL, query.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s", resp.Status)
+	}
+
+	var forecast openMeteoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&forecast); err != nil {
+		return 0, err
+	}
+
+	min := math.Inf(1)
+	for _, t := range forecast.Hourly.Temperature {
+		if t != nil && *t < min {
+			min = *t
+		}
+	}
+	if math.IsInf(min, 1) {
+		return 0, fmt.Errorf("no temperatures in forecast")
+	}
+	return min, nil
+}
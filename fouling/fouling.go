@@ -0,0 +1,314 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package fouling watches the smoke temperature for the slow rise that soot
+// and ash on the heat exchanger and in the chimney cause, so that cleaning
+// can be recommended before efficiency suffers much.
+package fouling
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// Category the statistics and recommendation are published in.
+const Category = "fouling"
+
+const (
+	DefaultThreshold = 25
+	DefaultBaseline  = 7 * 24 * time.Hour
+	DefaultRecent    = 7 * 24 * time.Hour
+
+	stateKey       = "fouling"
+	dateFormat     = "2006-01-02"
+	sampleInterval = time.Minute
+	saveInterval   = 10 * time.Minute
+	reviewInterval = time.Hour
+
+	// The smoke temperature takes a while to settle after ignition.
+	settleTime = 15 * time.Minute
+
+	// bandWidth is the width, in % of power, of the bands that the smoke
+	// temperature is compared within.
+	bandWidth = 10
+
+	// minSamples is the fewest minutes a band needs in both the baseline
+	// and recent periods to be compared.
+	minSamples = 30
+)
+
+// Config recommends cleaning when the smoke temperature over the Recent
+// period is Threshold °C or more above the Baseline period that followed the
+// last cleaning, at comparable power.
+type Config struct {
+	Threshold float64       `yaml:"threshold"`
+	Baseline  time.Duration `yaml:"baseline"`
+	Recent    time.Duration `yaml:"recent"`
+}
+
+func (c *Config) Validate() error {
+	if c.Threshold < 0 {
+		return fmt.Errorf("threshold can't be negative")
+	}
+	if c.Baseline < 0 || c.Recent < 0 {
+		return fmt.Errorf("baseline and recent can't be negative")
+	}
+	if c.Baseline > 0 && c.Baseline < 24*time.Hour || c.Recent > 0 && c.Recent < 24*time.Hour {
+		return fmt.Errorf("baseline and recent must be at least a day")
+	}
+	return nil
+}
+
+// stat is the sum of a number of smoke temperature samples.
+type stat struct {
+	Sum float64 `json:"sum"`
+	N   int     `json:"n"`
+}
+
+func (s stat) mean() float64 {
+	return s.Sum / float64(s.N)
+}
+
+// record is what is kept in the state store. Stats are by power band.
+type record struct {
+	Since    time.Time               `json:"since"`
+	Baseline map[int]stat            `json:"baseline,omitempty"`
+	Days     map[string]map[int]stat `json:"days"`
+}
+
+// Detector samples the smoke temperature every minute while the burner has
+// been running for a while, in bands of power so that a colder spell that
+// keeps the burner at high power isn't mistaken for fouling. The baseline
+// is learnt over the Baseline period after a reset, which should follow each
+// cleaning, and kept in the state store with the daily samples.
+type Detector struct {
+	Config
+
+	events  *bus.Bus
+	monitor *monitor.Monitor
+	store   *state.Store
+
+	mutex        sync.Mutex
+	record       record
+	runningSince time.Time
+	published    bus.Published
+}
+
+func NewDetector(config Config, events *bus.Bus, m *monitor.Monitor, store *state.Store) *Detector {
+	if config.Threshold == 0 {
+		config.Threshold = DefaultThreshold
+	}
+	if config.Baseline == 0 {
+		config.Baseline = DefaultBaseline
+	}
+	if config.Recent == 0 {
+		config.Recent = DefaultRecent
+	}
+	d := &Detector{
+		Config:    config,
+		events:    events,
+		monitor:   m,
+		store:     store,
+		published: make(bus.Published),
+	}
+	store.Get(stateKey, &d.record)
+	if d.record.Since.IsZero() {
+		d.record.Since = time.Now()
+	}
+	if d.record.Days == nil {
+		d.record.Days = make(map[string]map[int]stat)
+	}
+	return d
+}
+
+func (d *Detector) Start() {
+	go func() {
+		d.publish()
+		sample := time.NewTicker(sampleInterval)
+		defer sample.Stop()
+		save := time.NewTicker(saveInterval)
+		defer save.Stop()
+		review := time.NewTicker(reviewInterval)
+		defer review.Stop()
+		for {
+			select {
+			case now := <-sample.C:
+				d.sample(now)
+			case <-save.C:
+				d.Save()
+			case <-review.C:
+				d.publish()
+			}
+		}
+	}()
+}
+
+// Reset forgets the baseline and samples, to learn a new baseline after the
+// boiler has been cleaned.
+func (d *Detector) Reset() {
+	d.mutex.Lock()
+	d.record = record{Since: time.Now(), Days: make(map[string]map[int]stat)}
+	d.mutex.Unlock()
+	log.Infof("Learning a new smoke temperature baseline for fouling detection")
+	d.Save()
+	d.publish()
+}
+
+func (d *Detector) sample(now time.Time) {
+	value, _ := d.monitor.Get("state")
+	s, _ := value.(int64)
+	power, ok := float(d.monitor.Get("power_pct"))
+	smoke, ok2 := float(d.monitor.Get("smoke_temp"))
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !ok || !ok2 || now.Sub(d.monitor.LastPoll()) > 2*sampleInterval || nbe.Phase(s, 0) != nbe.PhaseRunning {
+		d.runningSince = time.Time{}
+		return
+	}
+	if d.runningSince.IsZero() {
+		d.runningSince = now
+	}
+	if now.Sub(d.runningSince) < settleTime {
+		return
+	}
+
+	today := now.Format(dateFormat)
+	if d.record.Days[today] == nil {
+		d.record.Days[today] = make(map[int]stat)
+	}
+	band := int(math.Round(power/bandWidth)) * bandWidth
+	st := d.record.Days[today][band]
+	st.Sum += smoke
+	st.N++
+	d.record.Days[today][band] = st
+
+	oldest := now.Add(-d.Baseline - d.Recent - 24*time.Hour).Format(dateFormat)
+	for day := range d.record.Days {
+		if day < oldest {
+			delete(d.record.Days, day)
+		}
+	}
+}
+
+// since sums the samples of the days from t.
+func (d *Detector) since(t time.Time) map[int]stat {
+	from := t.Format(dateFormat)
+	sums := make(map[int]stat)
+	for day, bands := range d.record.Days {
+		if day < from {
+			continue
+		}
+		for band, st := range bands {
+			sum := sums[band]
+			sum.Sum += st.Sum
+			sum.N += st.N
+			sums[band] = sum
+		}
+	}
+	return sums
+}
+
+// publish learns the baseline once the Baseline period has passed, and
+// publishes the recent and baseline smoke temperatures, both averaged over
+// the bands of power the burner recently ran at, how far the first is above
+// the second, whether cleaning is recommended and when the baseline was
+// reset, where they have changed.
+func (d *Detector) publish() {
+	now := time.Now()
+	d.mutex.Lock()
+	if d.record.Baseline == nil && now.Sub(d.record.Since) >= d.Baseline {
+		baseline := d.since(d.record.Since)
+		for band, st := range baseline {
+			if st.N < minSamples {
+				delete(baseline, band)
+			}
+		}
+		if len(baseline) > 0 {
+			d.record.Baseline = baseline
+			log.Infof("Learnt a smoke temperature baseline for fouling detection")
+		}
+	}
+
+	values := map[string]interface{}{
+		"baseline_since": d.record.Since.Format(time.RFC3339),
+	}
+	recommended := "OFF"
+	var weight, recent, baseline float64
+	for band, st := range d.since(now.Add(-d.Recent)) {
+		base, ok := d.record.Baseline[band]
+		if !ok || st.N < minSamples {
+			continue
+		}
+		w := float64(st.N)
+		weight += w
+		recent += w * st.mean()
+		baseline += w * base.mean()
+	}
+	if weight > 0 {
+		recent, baseline = recent/weight, baseline/weight
+		values["recent_smoke_temp"] = round(recent)
+		values["baseline_smoke_temp"] = round(baseline)
+		values["smoke_temp_rise"] = round(recent - baseline)
+		if recent-baseline >= d.Threshold {
+			recommended = "ON"
+		}
+	}
+	values["cleaning_recommended"] = recommended
+
+	changes := d.published.Changes(Category, values, now)
+	d.mutex.Unlock()
+
+	for _, change := range changes {
+		if change.Key == "cleaning_recommended" && change.Value == "ON" {
+			log.Warnf("The smoke temperature is %.0f°C above its baseline at comparable power. Cleaning the heat exchanger and chimney is recommended.", recent-baseline)
+		}
+		d.events.Publish(bus.ChangeTopic, change)
+	}
+}
+
+// Save stores the baseline and daily samples.
+func (d *Detector) Save() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.store.Set(stateKey, d.record); err != nil {
+		log.Errorf("Failed to save fouling detection: %v", err)
+	}
+}
+
+func float(value interface{}, ok bool) (float64, bool) {
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		return float64(v), ok
+	case int64:
+		return float64(v), ok
+	}
+	return 0, false
+}
+
+func round(v float64) nbe.RoundedFloat {
+	return nbe.RoundedFloat(math.Round(v*10) / 10)
+}
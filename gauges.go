@@ -0,0 +1,92 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/names"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportGauges keeps a prometheus gauge, boiler_mate_<subsystem>_<key>, up
+// to date for every numeric value, as named by metrics. The subsystem is the
+// category unless subsystems says otherwise.
+func exportGauges(events *bus.Bus, metrics *names.Names, serial string, subsystems map[string]string) {
+	var mutex sync.Mutex
+	gauges := make(map[string]*prometheus.GaugeVec)
+
+	events.OnChange(func(change bus.Change) {
+		if counterValues[change.Category+"."+change.Key] {
+			return
+		}
+		var value float64
+		switch t := change.Value.(type) {
+		case nbe.RoundedFloat:
+			value = float64(t)
+		case int64:
+			value = float64(t)
+		default:
+			return
+		}
+
+		subsystem, key := gaugeName(metrics, subsystems, change.Category, change.Key)
+		name := subsystem + "_" + key
+
+		mutex.Lock()
+		gauge := gauges[name]
+		if gauge == nil {
+			gauge = prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: "boiler_mate",
+					Subsystem: subsystem,
+					Name:      key,
+				},
+				[]string{"serial"},
+			)
+			if err := prometheus.Register(gauge); err != nil {
+				log.Errorf("Failed to register metric for %s.%s: %v", change.Category, change.Key, err)
+			}
+			gauges[name] = gauge
+		}
+		mutex.Unlock()
+
+		gauge.WithLabelValues(serial).Set(value)
+	})
+}
+
+// counterValues are exported as counters of their own rather than gauges.
+var counterValues = map[string]bool{"energy.produced": true}
+
+// gaugeSubsystems exports advanced_data alongside the operating_data it
+// extends.
+var gaugeSubsystems = map[string]string{"advanced_data": "operating_data"}
+
+// gaugeName returns the subsystem and name of the gauge category.key is
+// exported as.
+func gaugeName(metrics *names.Names, subsystems map[string]string, category string, key string) (string, string) {
+	category, key = metrics.Name(category, key)
+	subsystem, ok := subsystems[category]
+	if !ok {
+		subsystem = category
+	}
+	return subsystem, key
+}
@@ -0,0 +1,262 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/api"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// dataFunctions are the categories other than settings that can be read,
+// and the function that reads each of them.
+var dataFunctions = map[string]nbe.Function{
+	"operating_data":   nbe.GetOperatingDataFunction,
+	"advanced_data":    nbe.GetAdvancedDataFunction,
+	"consumption_data": nbe.GetConsumptionDataFunction,
+}
+
+// query is a category.key, or category.* for the whole category.
+type query struct {
+	category string
+	key      string
+}
+
+func parseQuery(arg string) (query, error) {
+	category, key, ok := strings.Cut(arg, ".")
+	if !ok {
+		key = "*"
+	}
+	if _, data := dataFunctions[category]; !data && !isSetting(category) {
+		return query{}, fmt.Errorf("unknown category: %s", category)
+	}
+	if key == "" {
+		return query{}, fmt.Errorf("missing key: %s", arg)
+	}
+	return query{category: category, key: strings.ToLower(key)}, nil
+}
+
+func isSetting(category string) bool {
+	for _, c := range nbe.Settings {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (q query) String() string {
+	return q.category + "." + q.key
+}
+
+// values holds what was read, by category and key.
+type values map[string]map[string]interface{}
+
+func (v values) add(category string, key string, value interface{}) {
+	if v[category] == nil {
+		v[category] = make(map[string]interface{})
+	}
+	v[category][key] = value
+}
+
+// runGet prints settings or data, read from the controller or, with -api,
+// from a running boiler-mate, which answers from its cache and doesn't
+// compete with it for the controller's attention.
+func runGet(args []string) error {
+	var controllerUrlOpt, logLevel, apiUrl, format string
+
+	flags := newCommandFlags("get", &controllerUrlOpt, &logLevel)
+	flags.StringVar(&apiUrl, "api", lookupEnvOrString("BOILER_MATE_API", ""), "URL of a running boiler-mate's HTTP API to read from instead of the controller, e.g. http://localhost:2112")
+	flags.StringVar(&format, "format", "table", "output format, table or json")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: boiler-mate get [flags] <category.key|category.*>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("nothing to get")
+	}
+	if format != "table" && format != "json" {
+		return fmt.Errorf("invalid format: %s", format)
+	}
+	queries := make([]query, 0, flags.NArg())
+	for _, arg := range flags.Args() {
+		q, err := parseQuery(arg)
+		if err != nil {
+			return err
+		}
+		queries = append(queries, q)
+	}
+
+	var read values
+	var err error
+	if apiUrl != "" {
+		read, err = getFromAPI(apiUrl, queries)
+	} else {
+		var boiler nbe.Boiler
+		boiler, err = connectController(controllerUrlOpt, logLevel)
+		if err != nil {
+			return err
+		}
+		defer boiler.Close()
+		read, err = getFromController(boiler, queries)
+	}
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		return writeJSONOutput("-", read)
+	}
+	return writeTable(os.Stdout, read)
+}
+
+func getFromController(boiler nbe.Boiler, queries []query) (values, error) {
+	read := make(values)
+	for _, q := range queries {
+		function, data := dataFunctions[q.category]
+		path := "*"
+		if !data {
+			function = nbe.GetSetupFunction
+			path = q.String()
+		}
+		response, err := boiler.Get(function, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", q, err)
+		}
+		if response.Status != 0 {
+			return nil, fmt.Errorf("%s: controller answered with status %d", q, response.Status)
+		}
+		if err := pick(read, q, response.Payload); err != nil {
+			return nil, err
+		}
+	}
+	return read, nil
+}
+
+func getFromAPI(apiUrl string, queries []query) (values, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	base := strings.TrimSuffix(apiUrl, "/") + api.Prefix
+
+	read := make(values)
+	for _, q := range queries {
+		url := fmt.Sprintf("%s/settings/%s", base, q.category)
+		switch {
+		case q.category == "consumption_data":
+			return nil, fmt.Errorf("%s can't be read over the API, read it from the controller", q.category)
+		case dataFunctions[q.category] != 0:
+			url = fmt.Sprintf("%s/%s", base, q.category)
+		case q.key != "*":
+			url = fmt.Sprintf("%s/%s", url, q.key)
+		}
+
+		var payload map[string]interface{}
+		if err := getJSON(client, url, &payload); err != nil {
+			return nil, fmt.Errorf("%s: %v", q, err)
+		}
+		if err := pick(read, q, payload); err != nil {
+			return nil, err
+		}
+	}
+	return read, nil
+}
+
+// getJSON decodes a response from the API, keeping numbers as they were
+// sent rather than turning them into floats.
+func getJSON(client *http.Client, url string, val interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiError struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiError) == nil && apiError.Error != "" {
+			return fmt.Errorf("%s", apiError.Error)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	return decoder.Decode(val)
+}
+
+// pick adds what q asked for from a category's payload.
+func pick(read values, q query, payload map[string]interface{}) error {
+	if q.key == "*" {
+		for k, v := range payload {
+			read.add(q.category, k, v)
+		}
+		return nil
+	}
+	v, ok := payload[q.key]
+	if !ok {
+		return fmt.Errorf("unknown key: %s", q)
+	}
+	read.add(q.category, q.key, v)
+	return nil
+}
+
+// writeTable prints one category.key and its value per line, in order.
+func writeTable(w io.Writer, read values) error {
+	var names []string
+	for category, keys := range read {
+		for key := range keys {
+			names = append(names, category+"."+key)
+		}
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		category, key, _ := strings.Cut(name, ".")
+		fmt.Fprintf(tw, "%s\t%s\n", name, formatCell(read[category][key]))
+	}
+	return tw.Flush()
+}
+
+func formatCell(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(b)
+}
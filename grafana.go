@@ -0,0 +1,187 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/labels"
+	"github.com/mlipscombe/boiler-mate/names"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// dashboardDatasource is the data source of every panel, chosen when the
+// dashboard is imported.
+var dashboardDatasource = map[string]interface{}{"type": "prometheus", "uid": "${datasource}"}
+
+// dashboard builds a Grafana dashboard from the metrics this instance
+// exports, named as exportGauges names them.
+type dashboard struct {
+	metrics *names.Names
+	panels  []interface{}
+}
+
+// metric returns the name of the gauge category.key is exported as.
+func (d *dashboard) metric(category string, key string) string {
+	subsystem, name := gaugeName(d.metrics, gaugeSubsystems, category, key)
+	return fmt.Sprintf("boiler_mate_%s_%s", subsystem, name)
+}
+
+// gauge selects the gauge category.key is exported as for the controller
+// chosen on the dashboard.
+func (d *dashboard) gauge(category string, key string) string {
+	return d.metric(category, key) + `{serial="$serial"}`
+}
+
+func (d *dashboard) add(kind string, title string, unit string, x int, y int, w int, h int, targets ...map[string]interface{}) map[string]interface{} {
+	for i, target := range targets {
+		target["refId"] = string(rune('A' + i))
+		target["datasource"] = dashboardDatasource
+	}
+	panel := map[string]interface{}{
+		"id":         len(d.panels) + 1,
+		"type":       kind,
+		"title":      title,
+		"datasource": dashboardDatasource,
+		"gridPos":    map[string]int{"x": x, "y": y, "w": w, "h": h},
+		"fieldConfig": map[string]interface{}{
+			"defaults":  map[string]interface{}{"unit": unit},
+			"overrides": []interface{}{},
+		},
+		"targets": targets,
+	}
+	d.panels = append(d.panels, panel)
+	return panel
+}
+
+func target(expr string, legend string) map[string]interface{} {
+	return map[string]interface{}{"expr": expr, "legendFormat": legend}
+}
+
+// stateMappings maps power states to their descriptions, as labelled by
+// the bundled labels and the config.
+func stateMappings(cfg *config.Config) []interface{} {
+	options := make(map[string]interface{})
+	add := func(state int64, text string) {
+		options[strconv.FormatInt(state, 10)] = map[string]interface{}{"text": text}
+	}
+	for state, text := range nbe.PowerStates {
+		add(int64(state), text)
+	}
+	for state, text := range labels.Bundled().Labels("operating_data", "state") {
+		add(state, text)
+	}
+	for state, text := range cfg.PowerStates {
+		add(state, text)
+	}
+	return []interface{}{map[string]interface{}{"type": "value", "options": options}}
+}
+
+func buildDashboard(cfg *config.Config, title string) map[string]interface{} {
+	d := &dashboard{metrics: names.New(cfg.Rename)}
+
+	state := d.add("stat", "State", "none", 0, 0, 8, 4, target(d.gauge("operating_data", "state"), ""))
+	state["fieldConfig"].(map[string]interface{})["defaults"].(map[string]interface{})["mappings"] = stateMappings(cfg)
+	state["options"] = map[string]interface{}{"colorMode": "none", "graphMode": "none", "textMode": "value"}
+	d.add("stat", "Boiler", "celsius", 8, 0, 4, 4, target(d.gauge("operating_data", "boiler_temp"), ""))
+	d.add("stat", "Power", "kwatt", 12, 0, 4, 4, target(d.gauge("operating_data", "power_kw"), ""))
+	d.add("stat", "Modulation", "percent", 16, 0, 4, 4, target(d.gauge("operating_data", "power_pct"), ""))
+	d.add("stat", "Oxygen", "percent", 20, 0, 4, 4, target(d.gauge("operating_data", "oxygen"), ""))
+
+	d.add("timeseries", "Temperatures", "celsius", 0, 4, 24, 9,
+		target(d.gauge("operating_data", "boiler_temp"), "Boiler"),
+		target(d.gauge("operating_data", "boiler_ref"), "Boiler target"),
+		target(d.gauge("operating_data", "return_temp"), "Return"),
+		target(d.gauge("operating_data", "dhw_temp"), "Hot water"),
+		target(d.gauge("operating_data", "dhw_ref"), "Hot water target"),
+		target(d.gauge("operating_data", "shaft_temp"), "Shaft"),
+	)
+	d.add("timeseries", "Smoke", "celsius", 0, 13, 8, 8, target(d.gauge("operating_data", "smoke_temp"), "Smoke"))
+	d.add("timeseries", "Power", "kwatt", 8, 13, 8, 8, target(d.gauge("operating_data", "power_kw"), "Power"))
+	d.add("timeseries", "Oxygen", "percent", 16, 13, 8, 8,
+		target(d.gauge("operating_data", "oxygen"), "Oxygen"),
+		target(d.gauge("operating_data", "oxygen_ref"), "Oxygen target"),
+	)
+
+	timeline := d.add("state-timeline", "State history", "none", 0, 21, 24, 5, target(d.gauge("operating_data", "state"), "State"))
+	timeline["fieldConfig"].(map[string]interface{})["defaults"].(map[string]interface{})["mappings"] = stateMappings(cfg)
+
+	// The bridge's own metrics describe the process rather than a
+	// controller, so carry no serial.
+	d.add("timeseries", "Controller requests", "short", 0, 26, 12, 8,
+		target("boiler_mate_controller_requests_in_flight", "In flight"),
+		target("boiler_mate_controller_oldest_request_age_seconds", "Oldest age (s)"),
+	)
+	d.add("timeseries", "MQTT queue", "short", 12, 26, 12, 8,
+		target("boiler_mate_mqtt_queued", "Queued"),
+		target("rate(boiler_mate_mqtt_dropped_total[5m])", "Dropped/s"),
+	)
+
+	serials := fmt.Sprintf("label_values(%s, serial)", d.metric("operating_data", "state"))
+	return map[string]interface{}{
+		"title":         title,
+		"uid":           "boiler-mate",
+		"tags":          []string{"boiler-mate"},
+		"timezone":      "browser",
+		"schemaVersion": 39,
+		"editable":      true,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{
+					"name":  "datasource",
+					"label": "Data source",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+				map[string]interface{}{
+					"name":       "serial",
+					"label":      "Controller",
+					"type":       "query",
+					"datasource": dashboardDatasource,
+					"definition": serials,
+					"query":      map[string]string{"query": serials, "refId": "serial"},
+					"refresh":    2,
+				},
+			},
+		},
+		"panels": d.panels,
+	}
+}
+
+// runGrafanaDashboard writes a Grafana dashboard of the metrics exported,
+// named as they are with the renames in the config, ready to import.
+func runGrafanaDashboard(args []string) error {
+	var configPath, title, output string
+
+	flags := flag.NewFlagSet("grafana-dashboard", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", lookupEnvOrString("BOILER_MATE_CONFIG", ""), "path to the YAML config file, whose renames change the metric names")
+	flags.StringVar(&title, "title", "boiler-mate", "title of the dashboard")
+	flags.StringVar(&output, "output", "", "file to write the dashboard to, or stdout if empty")
+	flags.Parse(args)
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	return writeJSONOutput(output, buildDashboard(cfg, title))
+}
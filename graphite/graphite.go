@@ -0,0 +1,94 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package graphite
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Emitter periodically sends every numeric value to Graphite using the
+// plaintext protocol, as <prefix>.<serial>.<category>.<key>.
+type Emitter struct {
+	Address  string
+	Prefix   string
+	Serial   string
+	Interval time.Duration
+}
+
+// NewEmitter creates an emitter from a URI in the format
+// tcp://<host>:<port>[/<prefix>].
+func NewEmitter(uri *url.URL, serial string, interval time.Duration) *Emitter {
+	prefix := strings.ReplaceAll(strings.Trim(uri.Path, "/"), "/", ".")
+	if prefix == "" {
+		prefix = "boiler_mate"
+	}
+	return &Emitter{
+		Address:  uri.Host,
+		Prefix:   prefix,
+		Serial:   serial,
+		Interval: interval,
+	}
+}
+
+func (e *Emitter) Start(monitors map[string]*monitor.Monitor) {
+	go func() {
+		ticker := time.NewTicker(e.Interval)
+		defer ticker.Stop()
+		for ts := range ticker.C {
+			if err := e.flush(monitors, ts); err != nil {
+				log.Errorf("Failed to send to Graphite: %v", err)
+			}
+		}
+	}()
+}
+
+func (e *Emitter) flush(monitors map[string]*monitor.Monitor, ts time.Time) error {
+	conn, err := net.DialTimeout("tcp", e.Address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+
+	w := bufio.NewWriter(conn)
+	for category, m := range monitors {
+		for k, v := range m.Values() {
+			var value float64
+			switch t := v.(type) {
+			case nbe.RoundedFloat:
+				value = float64(t)
+			case int64:
+				value = float64(t)
+			default:
+				continue
+			}
+			fmt.Fprintf(w, "%s.%s.%s.%s %s %d\n", e.Prefix, e.Serial, category, k, strconv.FormatFloat(value, 'f', -1, 64), ts.Unix())
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,178 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const healthTopic = "bridge/health"
+
+type componentHealth struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+type controllerHealth struct {
+	componentHealth
+	PendingRequests int     `json:"pending_requests"`
+	OldestPending   float64 `json:"oldest_pending"`
+	Timeouts        int64   `json:"timeouts"`
+	Mismatches      int64   `json:"mismatches"`
+}
+
+type brokerHealth struct {
+	componentHealth
+	PublishErrors int64 `json:"publish_errors"`
+	Queued        int   `json:"queued"`
+	Dropped       int64 `json:"dropped"`
+}
+
+type categoryHealth struct {
+	componentHealth
+	LastPollAge *float64 `json:"last_poll_age"`
+	PollErrors  int64    `json:"poll_errors"`
+}
+
+// bridgeHealth is published on <prefix>/bridge/health so that a sick
+// bridge can be diagnosed by someone who can only reach the broker. Ages
+// are in seconds, and last_poll_age is null until the first poll succeeds.
+type bridgeHealth struct {
+	Timestamp  time.Time                 `json:"ts"`
+	Healthy    bool                      `json:"healthy"`
+	Version    string                    `json:"version"`
+	Uptime     float64                   `json:"uptime"`
+	Controller controllerHealth          `json:"controller"`
+	MQTT       brokerHealth              `json:"mqtt"`
+	WriteQueue int                       `json:"write_queue"`
+	Categories map[string]categoryHealth `json:"categories"`
+}
+
+func newComponentHealth(err error) componentHealth {
+	if err != nil {
+		return componentHealth{Healthy: false, Error: err.Error()}
+	}
+	return componentHealth{Healthy: true}
+}
+
+func collectHealth(boiler nbe.Boiler, mqttClient *mqtt.Client, writer *control.Writer, monitors map[string]*monitor.Monitor, started time.Time) bridgeHealth {
+	now := time.Now()
+	health := bridgeHealth{
+		Timestamp: now,
+		Version:   version,
+		Uptime:    now.Sub(started).Round(time.Second).Seconds(),
+		Controller: controllerHealth{
+			componentHealth: newComponentHealth(boiler.Stalled(controllerStallTimeout)),
+			PendingRequests: boiler.QueueLength(),
+			OldestPending:   boiler.OldestPending().Round(time.Millisecond).Seconds(),
+			Timeouts:        boiler.Timeouts(),
+			Mismatches:      boiler.Mismatches(),
+		},
+		MQTT: brokerHealth{
+			componentHealth: newComponentHealth(mqttClient.Healthz()),
+			PublishErrors:   mqttClient.PublishErrors(),
+			Queued:          mqttClient.QueueLength(),
+			Dropped:         mqttClient.Dropped(),
+		},
+		WriteQueue: writer.QueueLength(),
+		Categories: make(map[string]categoryHealth, len(monitors)),
+	}
+	health.Healthy = health.Controller.Healthy && health.MQTT.Healthy
+
+	for category, m := range monitors {
+		c := categoryHealth{
+			componentHealth: newComponentHealth(m.Healthz()),
+			PollErrors:      m.PollErrors(),
+		}
+		if last := m.LastPoll(); !last.IsZero() {
+			age := now.Sub(last).Round(100 * time.Millisecond).Seconds()
+			c.LastPollAge = &age
+		}
+		health.Healthy = health.Healthy && c.Healthy
+		health.Categories[category] = c
+	}
+	return health
+}
+
+// publishHealth publishes the bridge's health every interval, retained so
+// that the last report is still there if boiler-mate dies.
+func publishHealth(boiler nbe.Boiler, mqttClient *mqtt.Client, writer *control.Writer, monitors map[string]*monitor.Monitor, interval time.Duration) {
+	started := time.Now()
+	go func() {
+		for {
+			time.Sleep(interval)
+			health := collectHealth(boiler, mqttClient, writer, monitors, started)
+			if err := mqttClient.PublishRaw(mqttClient.Prefix+"/"+healthTopic, health); err != nil {
+				log.Errorf("Failed to publish bridge health: %v", err)
+			}
+		}
+	}()
+}
+
+// registerMQTTMetrics exports the state of the MQTT outbound queue, so that
+// a broker that can't keep up shows on the dashboards.
+func registerMQTTMetrics(mqttClient *mqtt.Client) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "boiler_mate",
+			Subsystem: "mqtt",
+			Name:      "queued",
+			Help:      "Messages waiting to be sent to the broker.",
+		},
+		func() float64 { return float64(mqttClient.QueueLength()) },
+	))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: "boiler_mate",
+			Subsystem: "mqtt",
+			Name:      "dropped_total",
+			Help:      "Messages dropped because too many were waiting to be sent to the broker.",
+		},
+		func() float64 { return float64(mqttClient.Dropped()) },
+	))
+}
+
+// registerControllerMetrics exports the requests waiting for the controller
+// to answer, so that a controller falling behind shows on the dashboards.
+func registerControllerMetrics(boiler nbe.Boiler) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "boiler_mate",
+			Subsystem: "controller",
+			Name:      "requests_in_flight",
+			Help:      "Requests waiting for the controller to answer.",
+		},
+		func() float64 { return float64(boiler.QueueLength()) },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "boiler_mate",
+			Subsystem: "controller",
+			Name:      "oldest_request_age_seconds",
+			Help:      "How long the oldest request waiting for the controller to answer has been waiting.",
+		},
+		func() float64 { return boiler.OldestPending().Seconds() },
+	))
+}
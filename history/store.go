@@ -0,0 +1,273 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/consumption"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The database has two top level buckets. "values" holds a nested bucket
+// per category.key with every change keyed by timestamp, and "consumption"
+// holds a nested bucket per type_period with the kg used keyed by the start
+// of the period. Timestamps are big endian so that keys sort by time.
+var (
+	valuesBucket      = []byte("values")
+	consumptionBucket = []byte("consumption")
+)
+
+const (
+	queueSize     = 4096
+	flushInterval = 5 * time.Second
+)
+
+// Point is a single recorded value.
+type Point struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Value     interface{} `json:"value"`
+}
+
+// Store records every change, and the consumption reported by the
+// controller, in a local bbolt database so that history is kept across
+// restarts and broker outages.
+type Store struct {
+	Retention time.Duration
+
+	db    *bolt.DB
+	queue chan bus.Change
+}
+
+func Open(path string, retention time.Duration) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(valuesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(consumptionBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{
+		Retention: retention,
+		db:        db,
+		queue:     make(chan bus.Change, queueSize),
+	}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) Start(events *bus.Bus) {
+	events.OnChange(func(change bus.Change) {
+		select {
+		case s.queue <- change:
+		default:
+			log.Warnf("History queue is full, dropping %s.%s", change.Category, change.Key)
+		}
+	})
+
+	go func() {
+		// Changes are written in batches to spare SD cards a sync per value.
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		var pending []bus.Change
+		for {
+			select {
+			case change := <-s.queue:
+				pending = append(pending, change)
+			case <-ticker.C:
+				if len(pending) == 0 {
+					continue
+				}
+				if err := s.write(pending); err != nil {
+					log.Errorf("Failed to write history: %v", err)
+				}
+				pending = nil
+			}
+		}
+	}()
+
+	if s.Retention > 0 {
+		go func() {
+			for {
+				if err := s.prune(time.Now().Add(-s.Retention)); err != nil {
+					log.Errorf("Failed to prune history: %v", err)
+				}
+				time.Sleep(time.Hour)
+			}
+		}()
+	}
+}
+
+func (s *Store) write(changes []bus.Change) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		values := tx.Bucket(valuesBucket)
+		for _, change := range changes {
+			b, err := values.CreateBucketIfNotExists([]byte(fmt.Sprintf("%s.%s", change.Category, change.Key)))
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(change.Value)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(timeKey(change.Timestamp), data); err != nil {
+				return err
+			}
+
+			if change.Category == "consumption_data" {
+				if err := putConsumption(tx.Bucket(consumptionBucket), change); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func putConsumption(root *bolt.Bucket, change bus.Change) error {
+	buckets := consumption.Buckets(map[string]interface{}{change.Key: change.Value}, change.Timestamp)
+	for _, bucket := range buckets {
+		b, err := root.CreateBucketIfNotExists([]byte(fmt.Sprintf("%s_%s", bucket.Type, bucket.Period)))
+		if err != nil {
+			return err
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, math.Float64bits(bucket.Kg))
+		if err := b.Put(timeKey(bucket.Start), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// History returns the recorded values of category.key within [from, to).
+// Zero times are treated as unbounded.
+func (s *Store) History(category string, key string, from time.Time, to time.Time) ([]Point, error) {
+	points := []Point{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(valuesBucket).Bucket([]byte(fmt.Sprintf("%s.%s", category, key)))
+		if b == nil {
+			return nil
+		}
+		return scan(b, from, to, func(ts time.Time, v []byte) error {
+			var value interface{}
+			if err := json.Unmarshal(v, &value); err != nil {
+				return err
+			}
+			points = append(points, Point{Timestamp: ts, Value: value})
+			return nil
+		})
+	})
+	return points, err
+}
+
+// Consumption returns the recorded consumption buckets of a period, and
+// type if not empty, starting within [from, to).
+func (s *Store) Consumption(period string, t string, from time.Time, to time.Time) ([]consumption.Bucket, error) {
+	var buckets []consumption.Bucket
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, typ := range consumption.Types {
+			if t != "" && t != typ {
+				continue
+			}
+			b := tx.Bucket(consumptionBucket).Bucket([]byte(fmt.Sprintf("%s_%s", typ, period)))
+			if b == nil {
+				continue
+			}
+			err := scan(b, from, to, func(ts time.Time, v []byte) error {
+				buckets = append(buckets, consumption.Bucket{
+					Start:  ts.Local(),
+					Period: period,
+					Type:   typ,
+					Kg:     math.Float64frombits(binary.BigEndian.Uint64(v)),
+				})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	sort.SliceStable(buckets, func(i, j int) bool {
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets, err
+}
+
+func (s *Store) prune(before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(valuesBucket).ForEachBucket(func(name []byte) error {
+			c := tx.Bucket(valuesBucket).Bucket(name).Cursor()
+			for k, _ := c.First(); k != nil && parseTimeKey(k).Before(before); k, _ = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func scan(b *bolt.Bucket, from time.Time, to time.Time, fn func(time.Time, []byte) error) error {
+	c := b.Cursor()
+	var k, v []byte
+	if from.IsZero() {
+		k, v = c.First()
+	} else {
+		k, v = c.Seek(timeKey(from))
+	}
+	for ; k != nil; k, v = c.Next() {
+		ts := parseTimeKey(k)
+		if !to.IsZero() && !ts.Before(to) {
+			break
+		}
+		if err := fn(ts, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+func parseTimeKey(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key)))
+}
@@ -0,0 +1,221 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Status codes of characteristic reads and writes.
+const (
+	statusOK                = 0
+	statusInsufficientPriv  = -70401
+	statusCommunication     = -70402
+	statusReadOnly          = -70404
+	statusWriteOnly         = -70405
+	statusNotifyUnsupported = -70406
+	statusNotFound          = -70409
+	statusInvalidValue      = -70410
+)
+
+// Apple defined types, in their short form.
+const (
+	serviceAccessoryInformation = "3E"
+	serviceProtocolInformation  = "A2"
+	serviceThermostat           = "4A"
+	serviceTemperatureSensor    = "8A"
+
+	charIdentify                   = "14"
+	charManufacturer               = "20"
+	charModel                      = "21"
+	charName                       = "23"
+	charSerialNumber               = "30"
+	charFirmwareRevision           = "52"
+	charVersion                    = "37"
+	charCurrentHeatingCoolingState = "F"
+	charTargetHeatingCoolingState  = "33"
+	charCurrentTemperature         = "11"
+	charTargetTemperature          = "35"
+	charTemperatureDisplayUnits    = "36"
+)
+
+// Permissions.
+const (
+	permRead   = "pr"
+	permWrite  = "pw"
+	permEvents = "ev"
+)
+
+// The accessory is the only one the server has.
+const aid = 1
+
+// characteristic is a value of a service. Writes are passed to write,
+// which may reject them.
+type characteristic struct {
+	iid         int
+	typ         string
+	format      string
+	perms       []string
+	unit        string
+	minValue    *float64
+	maxValue    *float64
+	minStep     *float64
+	validValues []int
+	value       interface{}
+	write       func(value interface{}) error
+}
+
+func (c *characteristic) can(perm string) bool {
+	for _, p := range c.perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *characteristic) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{
+		"iid":    c.iid,
+		"type":   c.typ,
+		"format": c.format,
+		"perms":  c.perms,
+	}
+	if c.can(permRead) {
+		m["value"] = c.value
+	}
+	if c.unit != "" {
+		m["unit"] = c.unit
+	}
+	if c.minValue != nil {
+		m["minValue"] = *c.minValue
+	}
+	if c.maxValue != nil {
+		m["maxValue"] = *c.maxValue
+	}
+	if c.minStep != nil {
+		m["minStep"] = *c.minStep
+	}
+	if c.validValues != nil {
+		m["valid-values"] = c.validValues
+	}
+	return json.Marshal(m)
+}
+
+// convert checks that a written value suits the characteristic's format,
+// returning it as the type values of that format are kept as.
+func (c *characteristic) convert(value interface{}) (interface{}, error) {
+	switch c.format {
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case float64:
+			return v != 0, nil
+		}
+	case "uint8":
+		v, ok := value.(float64)
+		if !ok || v != float64(int(v)) {
+			break
+		}
+		if c.validValues != nil {
+			for _, valid := range c.validValues {
+				if int(v) == valid {
+					return int(v), nil
+				}
+			}
+			return nil, fmt.Errorf("%v is not a valid value", v)
+		}
+		if v >= 0 && v <= 255 {
+			return int(v), nil
+		}
+	case "float":
+		v, ok := value.(float64)
+		if !ok {
+			break
+		}
+		if (c.minValue != nil && v < *c.minValue) || (c.maxValue != nil && v > *c.maxValue) {
+			return nil, fmt.Errorf("%v is out of range", v)
+		}
+		return v, nil
+	case "string":
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("%v is not a valid %s", value, c.format)
+}
+
+type service struct {
+	IID             int               `json:"iid"`
+	Type            string            `json:"type"`
+	Primary         bool              `json:"primary,omitempty"`
+	Characteristics []*characteristic `json:"characteristics"`
+}
+
+// accessory assigns instance ids to services and characteristics in the
+// order they are added.
+type accessory struct {
+	AID      int        `json:"aid"`
+	Services []*service `json:"services"`
+
+	characteristics map[int]*characteristic
+	next            int
+}
+
+func newAccessory() *accessory {
+	return &accessory{
+		AID:             aid,
+		characteristics: make(map[int]*characteristic),
+		next:            1,
+	}
+}
+
+func (a *accessory) addService(typ string, primary bool, characteristics ...*characteristic) {
+	s := &service{IID: a.next, Type: typ, Primary: primary}
+	a.next++
+	for _, c := range characteristics {
+		c.iid = a.next
+		a.next++
+		a.characteristics[c.iid] = c
+		s.Characteristics = append(s.Characteristics, c)
+	}
+	a.Services = append(a.Services, s)
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func stringCharacteristic(typ string, value string) *characteristic {
+	return &characteristic{typ: typ, format: "string", perms: []string{permRead}, value: value}
+}
+
+func temperatureCharacteristic(typ string, perms ...string) *characteristic {
+	return &characteristic{
+		typ:      typ,
+		format:   "float",
+		perms:    perms,
+		unit:     "celsius",
+		minValue: float(-50),
+		maxValue: float(1000),
+		minStep:  float(0.1),
+		value:    0.0,
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	serviceType       = "_hap._tcp.local."
+	servicesEnum      = "_services._dns-sd._udp.local."
+	hostTTL           = 120
+	serviceTTL        = 4500
+	legacyUnicastTTL  = 10
+	mdnsPort          = 5353
+	cacheFlush        = 0x8000
+	maxLabelLength    = 63
+	announcementCount = 2
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// responder advertises the accessory over multicast DNS, as _hap._tcp,
+// which is how controllers find it. It only answers for its own names, so
+// it can run alongside a system responder such as Avahi.
+type responder struct {
+	instance string
+	host     string
+	port     int
+	txt      func() []string
+
+	conn   *net.UDPConn
+	mutex  sync.Mutex
+	closed bool
+}
+
+func newResponder(name string, id string, port int, txt func() []string) (*responder, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	// Dots would split the instance name into labels.
+	label := strings.ReplaceAll(name, ".", " ")
+	if len(label) > maxLabelLength {
+		label = label[:maxLabelLength]
+	}
+	r := &responder{
+		instance: fmt.Sprintf("%s.%s", label, serviceType),
+		host:     fmt.Sprintf("boiler-mate-%s.local.", strings.ReplaceAll(id, ":", "")),
+		port:     port,
+		txt:      txt,
+		conn:     conn,
+	}
+	go r.serve()
+	go r.announce()
+	return r, nil
+}
+
+func (r *responder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			r.mutex.Lock()
+			closed := r.closed
+			r.mutex.Unlock()
+			if !closed {
+				log.Errorf("mDNS responder stopped: %v", err)
+			}
+			return
+		}
+
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil || header.Response {
+			continue
+		}
+		questions, err := p.AllQuestions()
+		if err != nil {
+			continue
+		}
+		var answers, additionals []dnsmessage.Resource
+		for _, q := range questions {
+			a, b := r.answer(q)
+			answers = append(answers, a...)
+			additionals = append(additionals, b...)
+		}
+		if len(answers) == 0 {
+			continue
+		}
+
+		// Queries that don't come from the mDNS port are from simple
+		// resolvers, which expect a unicast DNS response.
+		if from.Port != mdnsPort {
+			for _, records := range [][]dnsmessage.Resource{answers, additionals} {
+				for i := range records {
+					records[i].Header.Class &^= cacheFlush
+					records[i].Header.TTL = min(records[i].Header.TTL, legacyUnicastTTL)
+				}
+			}
+			r.send(dnsmessage.Message{
+				Header:      dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true},
+				Questions:   questions,
+				Answers:     answers,
+				Additionals: additionals,
+			}, from)
+			continue
+		}
+		r.send(dnsmessage.Message{
+			Header:      dnsmessage.Header{Response: true, Authoritative: true},
+			Answers:     answers,
+			Additionals: additionals,
+		}, mdnsGroup)
+	}
+}
+
+// answer returns the records that answer a question, and those the
+// asker will want next.
+func (r *responder) answer(q dnsmessage.Question) ([]dnsmessage.Resource, []dnsmessage.Resource) {
+	ptr, srv, txt, addresses := r.records(1)
+	name := strings.ToLower(q.Name.String())
+	all := q.Type == dnsmessage.TypeALL
+	switch {
+	case name == servicesEnum && (q.Type == dnsmessage.TypePTR || all):
+		return []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(servicesEnum), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: serviceTTL},
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(serviceType)},
+		}}, nil
+	case name == serviceType && (q.Type == dnsmessage.TypePTR || all):
+		return []dnsmessage.Resource{ptr}, append([]dnsmessage.Resource{srv, txt}, addresses...)
+	case name == strings.ToLower(r.instance) && (q.Type == dnsmessage.TypeSRV || all):
+		if all {
+			return []dnsmessage.Resource{srv, txt}, addresses
+		}
+		return []dnsmessage.Resource{srv}, addresses
+	case name == strings.ToLower(r.instance) && q.Type == dnsmessage.TypeTXT:
+		return []dnsmessage.Resource{txt}, nil
+	case name == strings.ToLower(r.host) && (q.Type == dnsmessage.TypeA || all):
+		return addresses, nil
+	}
+	return nil, nil
+}
+
+// records returns the accessory's records, with their TTLs multiplied by
+// ttl, so that 0 says goodbye.
+func (r *responder) records(ttl uint32) (dnsmessage.Resource, dnsmessage.Resource, dnsmessage.Resource, []dnsmessage.Resource) {
+	instance := dnsmessage.MustNewName(r.instance)
+	host := dnsmessage.MustNewName(r.host)
+	ptr := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(serviceType), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: serviceTTL * ttl},
+		Body:   &dnsmessage.PTRResource{PTR: instance},
+	}
+	srv := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: instance, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET | cacheFlush, TTL: hostTTL * ttl},
+		Body:   &dnsmessage.SRVResource{Target: host, Port: uint16(r.port)},
+	}
+	txt := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: instance, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET | cacheFlush, TTL: serviceTTL * ttl},
+		Body:   &dnsmessage.TXTResource{TXT: r.txt()},
+	}
+	var addresses []dnsmessage.Resource
+	for _, ip := range localAddresses() {
+		var a [4]byte
+		copy(a[:], ip)
+		addresses = append(addresses, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET | cacheFlush, TTL: hostTTL * ttl},
+			Body:   &dnsmessage.AResource{A: a},
+		})
+	}
+	return ptr, srv, txt, addresses
+}
+
+// localAddresses returns the IPv4 addresses of the interfaces that can
+// multicast.
+func localAddresses() []net.IP {
+	var ips []net.IP
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, i := range interfaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagMulticast == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil {
+				ips = append(ips, n.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+func (r *responder) send(m dnsmessage.Message, to *net.UDPAddr) {
+	b, err := m.Pack()
+	if err != nil {
+		log.Errorf("Failed to pack mDNS response: %v", err)
+		return
+	}
+	if _, err := r.conn.WriteToUDP(b, to); err != nil {
+		log.Debugf("Failed to send mDNS response: %v", err)
+	}
+}
+
+// announce sends the records unasked, so that controllers notice the
+// accessory, or that its TXT record changed, straight away.
+func (r *responder) announce() {
+	for i := 0; i < announcementCount; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		r.mutex.Lock()
+		closed := r.closed
+		r.mutex.Unlock()
+		if closed {
+			return
+		}
+		r.broadcast(1)
+	}
+}
+
+func (r *responder) broadcast(ttl uint32) {
+	ptr, srv, txt, addresses := r.records(ttl)
+	r.send(dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: append([]dnsmessage.Resource{ptr, srv, txt}, addresses...),
+	}, mdnsGroup)
+}
+
+// close says goodbye, so that controllers forget the accessory rather
+// than waiting for its records to expire.
+func (r *responder) close() {
+	r.mutex.Lock()
+	r.closed = true
+	r.mutex.Unlock()
+	r.broadcast(0)
+	r.conn.Close()
+}
@@ -0,0 +1,179 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestResponder() *responder {
+	return &responder{
+		instance: "Boiler._hap._tcp.local.",
+		host:     "boiler-mate-AABBCCDDEEFF.local.",
+		port:     DefaultPort,
+		txt:      func() []string { return []string{"c#=1", "sf=1"} },
+	}
+}
+
+func question(name string, typ dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}
+}
+
+func types(records []dnsmessage.Resource) []dnsmessage.Type {
+	var types []dnsmessage.Type
+	for _, r := range records {
+		if r.Header.Type != dnsmessage.TypeA {
+			types = append(types, r.Header.Type)
+		}
+	}
+	return types
+}
+
+func equalTypes(a, b []dnsmessage.Type) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestResponderAnswer(t *testing.T) {
+	r := newTestResponder()
+	tests := []struct {
+		name        string
+		question    dnsmessage.Question
+		answers     []dnsmessage.Type
+		additionals []dnsmessage.Type
+	}{
+		{"services", question(servicesEnum, dnsmessage.TypePTR), []dnsmessage.Type{dnsmessage.TypePTR}, nil},
+		{"browse", question(serviceType, dnsmessage.TypePTR), []dnsmessage.Type{dnsmessage.TypePTR}, []dnsmessage.Type{dnsmessage.TypeSRV, dnsmessage.TypeTXT}},
+		{"resolve", question("boiler._HAP._tcp.local.", dnsmessage.TypeSRV), []dnsmessage.Type{dnsmessage.TypeSRV}, nil},
+		{"txt", question(r.instance, dnsmessage.TypeTXT), []dnsmessage.Type{dnsmessage.TypeTXT}, nil},
+		{"any", question(r.instance, dnsmessage.TypeALL), []dnsmessage.Type{dnsmessage.TypeSRV, dnsmessage.TypeTXT}, nil},
+		{"host", question(r.host, dnsmessage.TypeAAAA), nil, nil},
+		{"other service", question("_airplay._tcp.local.", dnsmessage.TypePTR), nil, nil},
+		{"other instance", question("Other._hap._tcp.local.", dnsmessage.TypeSRV), nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answers, additionals := r.answer(tt.question)
+			if got := types(answers); !equalTypes(got, tt.answers) {
+				t.Errorf("answers %v, want %v", got, tt.answers)
+			}
+			if got := types(additionals); !equalTypes(got, tt.additionals) {
+				t.Errorf("additionals %v, want %v", got, tt.additionals)
+			}
+		})
+	}
+}
+
+func TestResponderRecords(t *testing.T) {
+	r := newTestResponder()
+	ptr, srv, txt, _ := r.records(1)
+	if got := ptr.Body.(*dnsmessage.PTRResource).PTR.String(); got != r.instance {
+		t.Errorf("PTR points at %s", got)
+	}
+	if ptr.Header.Class != dnsmessage.ClassINET {
+		t.Error("shared PTR record has the cache flush bit set")
+	}
+	body := srv.Body.(*dnsmessage.SRVResource)
+	if body.Target.String() != r.host || body.Port != DefaultPort {
+		t.Errorf("SRV is %s:%d", body.Target, body.Port)
+	}
+	if srv.Header.Class != dnsmessage.ClassINET|cacheFlush || srv.Header.TTL != hostTTL {
+		t.Errorf("SRV class %v, TTL %d", srv.Header.Class, srv.Header.TTL)
+	}
+	if got := txt.Body.(*dnsmessage.TXTResource).TXT; len(got) != 2 || got[0] != "c#=1" {
+		t.Errorf("TXT is %q", got)
+	}
+
+	// A goodbye has a TTL of 0.
+	ptr, srv, txt, _ = r.records(0)
+	for _, record := range []dnsmessage.Resource{ptr, srv, txt} {
+		if record.Header.TTL != 0 {
+			t.Errorf("goodbye %v has TTL %d", record.Header.Type, record.Header.TTL)
+		}
+	}
+}
+
+// TestResponderLegacyUnicast checks that a query from a port other than
+// 5353 gets a unicast DNS response, as RFC 6762 section 6.7 asks.
+func TestResponderLegacyUnicast(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestResponder()
+	r.conn = conn
+	go r.serve()
+	defer func() {
+		r.mutex.Lock()
+		r.closed = true
+		r.mutex.Unlock()
+		conn.Close()
+	}()
+
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x1234},
+		Questions: []dnsmessage.Question{question(r.instance, dnsmessage.TypeSRV)},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write(query); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 9000)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.ID != 0x1234 || !m.Header.Response || !m.Header.Authoritative {
+		t.Errorf("header %+v", m.Header)
+	}
+	if len(m.Questions) != 1 || m.Questions[0].Name.String() != r.instance {
+		t.Errorf("questions %v aren't repeated", m.Questions)
+	}
+	if len(m.Answers) != 1 || m.Answers[0].Header.Type != dnsmessage.TypeSRV {
+		t.Fatalf("answers %v", m.Answers)
+	}
+	for _, record := range append(m.Answers, m.Additionals...) {
+		if record.Header.Class&cacheFlush != 0 || record.Header.TTL > legacyUnicastTTL {
+			t.Errorf("%v has class %v, TTL %d", record.Header.Type, record.Header.Class, record.Header.TTL)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pairing methods.
+const (
+	methodAddPairing    = 3
+	methodRemovePairing = 4
+	methodListPairings  = 5
+)
+
+func tlvResponse(t tlv8) response {
+	return response{status: http.StatusOK, contentType: contentTypeTLV8, body: t.encode()}
+}
+
+func pairingError(state byte, code byte) response {
+	var t tlv8
+	t.addByte(tlvState, state)
+	t.addByte(tlvError, code)
+	return tlvResponse(t)
+}
+
+// pairSetup exchanges long term keys with a new controller once it has
+// proven it knows the setup code. Only one controller can pair at a time,
+// and only while the accessory isn't paired.
+func (s *Server) pairSetup(c *conn, body []byte) response {
+	request, err := decodeTLV8(body)
+	if err != nil {
+		return response{status: http.StatusBadRequest}
+	}
+	state, _ := request.getByte(tlvState)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch state {
+	case 1:
+		if len(s.identity.Pairings) > 0 {
+			return pairingError(2, errUnavailable)
+		}
+		if s.failures >= maxPairAttempts {
+			return pairingError(2, errMaxTries)
+		}
+		if s.setupConn != nil && s.setupConn != c {
+			return pairingError(2, errBusy)
+		}
+		srp, err := newSRPServer(s.identity.PIN)
+		if err != nil {
+			log.Errorf("Failed to start HomeKit pair setup: %v", err)
+			return pairingError(2, errUnknown)
+		}
+		s.setup = srp
+		s.setupConn = c
+		var t tlv8
+		t.addByte(tlvState, 2)
+		t.add(tlvSalt, srp.salt)
+		t.add(tlvPublicKey, srp.B)
+		return tlvResponse(t)
+
+	case 3:
+		if s.setupConn != c {
+			return pairingError(4, errUnknown)
+		}
+		proof, err := s.setup.verify(request.get(tlvPublicKey), request.get(tlvProof))
+		if err != nil {
+			s.failures++
+			s.setup = nil
+			s.setupConn = nil
+			log.Warnf("HomeKit pairing from %s failed: %v", c.RemoteAddr(), err)
+			return pairingError(4, errAuthentication)
+		}
+		var t tlv8
+		t.addByte(tlvState, 4)
+		t.add(tlvProof, proof)
+		return tlvResponse(t)
+
+	case 5:
+		if s.setupConn != c || s.setup.K == nil {
+			return pairingError(6, errUnknown)
+		}
+		K := s.setup.K
+		s.setup = nil
+		s.setupConn = nil
+
+		key := deriveKey(K, "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+		data, err := open(key, "PS-Msg05", request.get(tlvEncryptedData))
+		if err != nil {
+			return pairingError(6, errAuthentication)
+		}
+		sub, err := decodeTLV8(data)
+		if err != nil {
+			return pairingError(6, errUnknown)
+		}
+		id := sub.get(tlvIdentifier)
+		ltpk := sub.get(tlvPublicKey)
+		controllerX := deriveKey(K, "Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info")
+		info := append(append(append([]byte{}, controllerX...), id...), ltpk...)
+		if len(ltpk) != ed25519.PublicKeySize || !ed25519.Verify(ltpk, info, sub.get(tlvSignature)) {
+			return pairingError(6, errAuthentication)
+		}
+
+		s.identity.Pairings[string(id)] = pairing{PublicKey: ltpk, Admin: true}
+		if err := s.save(); err != nil {
+			log.Errorf("Failed to save HomeKit pairing: %v", err)
+			delete(s.identity.Pairings, string(id))
+			return pairingError(6, errUnknown)
+		}
+
+		accessoryX := deriveKey(K, "Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info")
+		public := s.key.Public().(ed25519.PublicKey)
+		info = append(append(append([]byte{}, accessoryX...), s.identity.ID...), public...)
+		var reply tlv8
+		reply.add(tlvIdentifier, []byte(s.identity.ID))
+		reply.add(tlvPublicKey, public)
+		reply.add(tlvSignature, ed25519.Sign(s.key, info))
+		encrypted, err := seal(key, "PS-Msg06", reply.encode())
+		if err != nil {
+			return pairingError(6, errUnknown)
+		}
+		log.Infof("Paired with HomeKit controller %s", id)
+		go s.responder.announce()
+
+		var t tlv8
+		t.addByte(tlvState, 6)
+		t.add(tlvEncryptedData, encrypted)
+		return tlvResponse(t)
+	}
+	return pairingError(state+1, errUnknown)
+}
+
+// verifySession is a pair verify in progress.
+type verifySession struct {
+	shared           []byte
+	key              []byte
+	controllerPublic []byte
+	accessoryPublic  []byte
+}
+
+// pairVerify agrees a key for the connection with a paired controller,
+// each side proving who it is with its long term key.
+func (c *conn) pairVerify(body []byte) response {
+	s := c.server
+	request, err := decodeTLV8(body)
+	if err != nil {
+		return response{status: http.StatusBadRequest}
+	}
+	state, _ := request.getByte(tlvState)
+
+	switch state {
+	case 1:
+		controllerPublic, err := ecdh.X25519().NewPublicKey(request.get(tlvPublicKey))
+		if err != nil {
+			return pairingError(2, errUnknown)
+		}
+		private, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return pairingError(2, errUnknown)
+		}
+		shared, err := private.ECDH(controllerPublic)
+		if err != nil {
+			return pairingError(2, errUnknown)
+		}
+		v := &verifySession{
+			shared:           shared,
+			key:              deriveKey(shared, "Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info"),
+			controllerPublic: controllerPublic.Bytes(),
+			accessoryPublic:  private.PublicKey().Bytes(),
+		}
+
+		info := append(append(append([]byte{}, v.accessoryPublic...), s.identity.ID...), v.controllerPublic...)
+		var sub tlv8
+		sub.add(tlvIdentifier, []byte(s.identity.ID))
+		sub.add(tlvSignature, ed25519.Sign(s.key, info))
+		encrypted, err := seal(v.key, "PV-Msg02", sub.encode())
+		if err != nil {
+			return pairingError(2, errUnknown)
+		}
+		c.verify = v
+
+		var t tlv8
+		t.addByte(tlvState, 2)
+		t.add(tlvPublicKey, v.accessoryPublic)
+		t.add(tlvEncryptedData, encrypted)
+		return tlvResponse(t)
+
+	case 3:
+		v := c.verify
+		c.verify = nil
+		if v == nil {
+			return pairingError(4, errUnknown)
+		}
+		data, err := open(v.key, "PV-Msg03", request.get(tlvEncryptedData))
+		if err != nil {
+			return pairingError(4, errAuthentication)
+		}
+		sub, err := decodeTLV8(data)
+		if err != nil {
+			return pairingError(4, errUnknown)
+		}
+		id := string(sub.get(tlvIdentifier))
+		s.mutex.Lock()
+		p, ok := s.identity.Pairings[id]
+		s.mutex.Unlock()
+		if !ok {
+			log.Warnf("HomeKit controller %s from %s isn't paired", id, c.RemoteAddr())
+			return pairingError(4, errAuthentication)
+		}
+		info := append(append(append([]byte{}, v.controllerPublic...), id...), v.accessoryPublic...)
+		if !ed25519.Verify(p.PublicKey, info, sub.get(tlvSignature)) {
+			return pairingError(4, errAuthentication)
+		}
+
+		var t tlv8
+		t.addByte(tlvState, 4)
+		r := tlvResponse(t)
+		// The response is the last thing sent in the clear.
+		r.after = func() bool {
+			c.mutex.Lock()
+			c.secure = newSecureConn(c.Conn, v.shared)
+			c.mutex.Unlock()
+			s.mutex.Lock()
+			c.controller = id
+			s.mutex.Unlock()
+			log.Debugf("HomeKit controller %s verified from %s", id, c.RemoteAddr())
+			return true
+		}
+		return r
+	}
+	return pairingError(state+1, errUnknown)
+}
+
+// pairings adds, removes and lists pairings for admin controllers.
+func (s *Server) pairings(c *conn, body []byte) response {
+	request, err := decodeTLV8(body)
+	if err != nil {
+		return response{status: http.StatusBadRequest}
+	}
+	method, _ := request.getByte(tlvMethod)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.identity.Pairings[c.controller].Admin {
+		return pairingError(2, errAuthentication)
+	}
+
+	switch method {
+	case methodAddPairing:
+		id := string(request.get(tlvIdentifier))
+		ltpk := request.get(tlvPublicKey)
+		permissions, _ := request.getByte(tlvPermissions)
+		if existing, ok := s.identity.Pairings[id]; ok && !bytes.Equal(existing.PublicKey, ltpk) {
+			return pairingError(2, errUnknown)
+		}
+		if id == "" || len(ltpk) != ed25519.PublicKeySize {
+			return pairingError(2, errUnknown)
+		}
+		s.identity.Pairings[id] = pairing{PublicKey: ltpk, Admin: permissions&0x01 != 0}
+		if err := s.save(); err != nil {
+			log.Errorf("Failed to save HomeKit pairing: %v", err)
+			return pairingError(2, errUnknown)
+		}
+		log.Infof("Added HomeKit controller %s", id)
+
+	case methodRemovePairing:
+		id := string(request.get(tlvIdentifier))
+		delete(s.identity.Pairings, id)
+		if err := s.save(); err != nil {
+			log.Errorf("Failed to save HomeKit pairing: %v", err)
+			return pairingError(2, errUnknown)
+		}
+		log.Infof("Removed HomeKit controller %s", id)
+		var removed []*conn
+		for other := range s.conns {
+			if other.controller == id {
+				removed = append(removed, other)
+			}
+		}
+		unpaired := len(s.identity.Pairings) == 0
+		var t tlv8
+		t.addByte(tlvState, 2)
+		r := tlvResponse(t)
+		// The controller's connections are closed once it has its
+		// response, and a controller that removed itself is done.
+		r.after = func() bool {
+			for _, other := range removed {
+				if other != c {
+					other.Close()
+				}
+			}
+			if unpaired {
+				go s.responder.announce()
+			}
+			return c.controller != id
+		}
+		return r
+
+	case methodListPairings:
+		var t tlv8
+		t.addByte(tlvState, 2)
+		first := true
+		for id, p := range s.identity.Pairings {
+			if !first {
+				t.add(tlvSeparator, nil)
+			}
+			first = false
+			t.add(tlvIdentifier, []byte(id))
+			t.add(tlvPublicKey, p.PublicKey)
+			var permissions byte
+			if p.Admin {
+				permissions = 1
+			}
+			t.addByte(tlvPermissions, permissions)
+		}
+		return tlvResponse(t)
+
+	default:
+		return pairingError(2, errUnknown)
+	}
+
+	var t tlv8
+	t.addByte(tlvState, 2)
+	return tlvResponse(t)
+}
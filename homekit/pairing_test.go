@@ -0,0 +1,387 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/state"
+)
+
+const testPIN = "031-45-154"
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	store, err := state.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := control.NewWriter(nbe.NewMockBoiler("1234"), 0, 0)
+	s, err := New(Config{PIN: testPIN, Name: "Boiler", Serial: "1234", MinSetpoint: 40, MaxSetpoint: 85}, store, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server isn't started, so there is nothing to announce.
+	s.responder = &responder{closed: true}
+	return s
+}
+
+// testController talks to the server over a connection of its own, in the
+// clear until pair verify has finished.
+type testController struct {
+	t      *testing.T
+	conn   net.Conn
+	rw     io.ReadWriter
+	reader *bufio.Reader
+	id     string
+	key    ed25519.PrivateKey
+}
+
+func newTestController(t *testing.T, s *Server, id string) *testController {
+	t.Helper()
+	client, server := net.Pipe()
+	go s.serve(server)
+	t.Cleanup(func() { client.Close() })
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	c := &testController{t: t, conn: client, rw: client, id: id, key: key}
+	c.reader = bufio.NewReader(client)
+	return c
+}
+
+func (c *testController) request(method, path, contentType string, body []byte) (*http.Response, []byte) {
+	c.t.Helper()
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: boiler\r\nContent-Length: %d\r\n", method, path, len(body))
+	if contentType != "" {
+		req += "Content-Type: " + contentType + "\r\n"
+	}
+	if _, err := c.rw.Write(append([]byte(req+"\r\n"), body...)); err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	resp, err := http.ReadResponse(c.reader, nil)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp, data
+}
+
+func (c *testController) pairing(path string, request tlv8) tlv8 {
+	c.t.Helper()
+	resp, body := c.request(http.MethodPost, path, contentTypeTLV8, request.encode())
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != contentTypeTLV8 {
+		c.t.Fatalf("%s: %s %s", path, resp.Status, resp.Header.Get("Content-Type"))
+	}
+	t, err := decodeTLV8(body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return t
+}
+
+// setup runs pair setup with pin, returning the error code, if any.
+func (c *testController) setup(pin string) byte {
+	c.t.Helper()
+	var m1 tlv8
+	m1.addByte(tlvState, 1)
+	m1.addByte(tlvMethod, 0)
+	m2 := c.pairing("/pair-setup", m1)
+	if code, ok := m2.getByte(tlvError); ok {
+		return code
+	}
+	if state, _ := m2.getByte(tlvState); state != 2 {
+		c.t.Fatalf("M2 state %d", state)
+	}
+
+	a, _ := rand.Int(rand.Reader, srp3072.N)
+	salt, B := m2.get(tlvSalt), m2.get(tlvPublicKey)
+	A, M1, K := srpClient(srp3072, srpUsername, pin, salt, B, a)
+	var m3 tlv8
+	m3.addByte(tlvState, 3)
+	m3.add(tlvPublicKey, A)
+	m3.add(tlvProof, M1)
+	m4 := c.pairing("/pair-setup", m3)
+	if code, ok := m4.getByte(tlvError); ok {
+		return code
+	}
+	if !bytes.Equal(m4.get(tlvProof), srp3072.H(A, M1, K)) {
+		c.t.Fatal("M4 has the wrong accessory proof")
+	}
+
+	key := deriveKey(K, "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+	controllerX := deriveKey(K, "Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info")
+	public := c.key.Public().(ed25519.PublicKey)
+	var sub tlv8
+	sub.add(tlvIdentifier, []byte(c.id))
+	sub.add(tlvPublicKey, public)
+	sub.add(tlvSignature, ed25519.Sign(c.key, append(append(append([]byte{}, controllerX...), c.id...), public...)))
+	encrypted, _ := seal(key, "PS-Msg05", sub.encode())
+	var m5 tlv8
+	m5.addByte(tlvState, 5)
+	m5.add(tlvEncryptedData, encrypted)
+	m6 := c.pairing("/pair-setup", m5)
+	if code, ok := m6.getByte(tlvError); ok {
+		return code
+	}
+
+	data, err := open(key, "PS-Msg06", m6.get(tlvEncryptedData))
+	if err != nil {
+		c.t.Fatalf("M6: %v", err)
+	}
+	reply, _ := decodeTLV8(data)
+	accessoryX := deriveKey(K, "Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info")
+	ltpk := reply.get(tlvPublicKey)
+	info := append(append(append([]byte{}, accessoryX...), reply.get(tlvIdentifier)...), ltpk...)
+	if len(ltpk) != ed25519.PublicKeySize || !ed25519.Verify(ltpk, info, reply.get(tlvSignature)) {
+		c.t.Fatal("M6 has an invalid accessory signature")
+	}
+	return 0
+}
+
+// verify runs pair verify, switching the connection to the secure session
+// once it has finished.
+func (c *testController) verify(accessoryLTPK ed25519.PublicKey) byte {
+	c.t.Helper()
+	private, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	var m1 tlv8
+	m1.addByte(tlvState, 1)
+	m1.add(tlvPublicKey, private.PublicKey().Bytes())
+	m2 := c.pairing("/pair-verify", m1)
+	if code, ok := m2.getByte(tlvError); ok {
+		return code
+	}
+
+	accessoryPublic, err := ecdh.X25519().NewPublicKey(m2.get(tlvPublicKey))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	shared, _ := private.ECDH(accessoryPublic)
+	key := deriveKey(shared, "Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info")
+	data, err := open(key, "PV-Msg02", m2.get(tlvEncryptedData))
+	if err != nil {
+		c.t.Fatalf("M2: %v", err)
+	}
+	sub, _ := decodeTLV8(data)
+	info := append(append(append([]byte{}, accessoryPublic.Bytes()...), sub.get(tlvIdentifier)...), private.PublicKey().Bytes()...)
+	if !ed25519.Verify(accessoryLTPK, info, sub.get(tlvSignature)) {
+		c.t.Fatal("M2 has an invalid accessory signature")
+	}
+
+	info = append(append(append([]byte{}, private.PublicKey().Bytes()...), c.id...), accessoryPublic.Bytes()...)
+	var reply tlv8
+	reply.add(tlvIdentifier, []byte(c.id))
+	reply.add(tlvSignature, ed25519.Sign(c.key, info))
+	encrypted, _ := seal(key, "PV-Msg03", reply.encode())
+	var m3 tlv8
+	m3.addByte(tlvState, 3)
+	m3.add(tlvEncryptedData, encrypted)
+	m4 := c.pairing("/pair-verify", m3)
+	if code, ok := m4.getByte(tlvError); ok {
+		return code
+	}
+
+	readKey, writeKey := controllerKeys(shared)
+	secure := &secureConn{Conn: c.conn, readKey: readKey, writeKey: writeKey}
+	c.rw = secure
+	c.reader = bufio.NewReader(secure)
+	return 0
+}
+
+func TestPairing(t *testing.T) {
+	s := newTestServer(t)
+	accessoryLTPK := s.key.Public().(ed25519.PublicKey)
+
+	c := newTestController(t, s, "controller-1")
+	if resp, _ := c.request(http.MethodGet, "/accessories", "", nil); resp.StatusCode != statusConnectionAuthorizationRequired {
+		t.Errorf("unverified GET /accessories: %s", resp.Status)
+	}
+	if code := c.setup(testPIN); code != 0 {
+		t.Fatalf("pair setup failed with %d", code)
+	}
+	if !s.Paired() {
+		t.Fatal("not paired after pair setup")
+	}
+
+	key := c.key
+	c = newTestController(t, s, "controller-1")
+	c.key = key
+	if code := c.verify(accessoryLTPK); code != 0 {
+		t.Fatalf("pair verify failed with %d", code)
+	}
+	resp, body := c.request(http.MethodGet, "/accessories", "", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != contentTypeJSON {
+		t.Fatalf("GET /accessories: %s", resp.Status)
+	}
+	var accessories struct {
+		Accessories []struct {
+			AID int `json:"aid"`
+		} `json:"accessories"`
+	}
+	if err := json.Unmarshal(body, &accessories); err != nil || len(accessories.Accessories) != 1 {
+		t.Errorf("GET /accessories = %s: %v", body, err)
+	}
+
+	// Once paired, a second controller can't pair, and an unknown one
+	// can't verify.
+	if code := newTestController(t, s, "controller-2").setup(testPIN); code != errUnavailable {
+		t.Errorf("second pair setup: error %d, want %d", code, errUnavailable)
+	}
+	if code := newTestController(t, s, "controller-2").verify(accessoryLTPK); code != errAuthentication {
+		t.Errorf("unpaired pair verify: error %d, want %d", code, errAuthentication)
+	}
+}
+
+func TestPairSetupWrongPIN(t *testing.T) {
+	s := newTestServer(t)
+	if code := newTestController(t, s, "controller-1").setup("031-45-155"); code != errAuthentication {
+		t.Errorf("pair setup with the wrong PIN: error %d, want %d", code, errAuthentication)
+	}
+	if s.Paired() {
+		t.Error("paired with the wrong PIN")
+	}
+	if s.failures != 1 {
+		t.Errorf("%d failures counted", s.failures)
+	}
+
+	// The failure doesn't hold up a retry with the right PIN.
+	if code := newTestController(t, s, "controller-1").setup(testPIN); code != 0 {
+		t.Errorf("pair setup failed with %d", code)
+	}
+}
+
+func TestPairVerifyInvalidKey(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestController(t, s, "controller-1")
+	var m1 tlv8
+	m1.addByte(tlvState, 1)
+	m1.add(tlvPublicKey, new(big.Int).Bytes())
+	if code, _ := c.pairing("/pair-verify", m1).getByte(tlvError); code != errUnknown {
+		t.Errorf("pair verify with an invalid key: error %d, want %d", code, errUnknown)
+	}
+}
+
+func TestPairSetupBusy(t *testing.T) {
+	s := newTestServer(t)
+	var m1 tlv8
+	m1.addByte(tlvState, 1)
+	m1.addByte(tlvMethod, 0)
+	newTestController(t, s, "controller-1").pairing("/pair-setup", m1)
+	if code := newTestController(t, s, "controller-2").setup(testPIN); code != errBusy {
+		t.Errorf("pair setup during another: error %d, want %d", code, errBusy)
+	}
+}
+
+func TestPairSetupMaxTries(t *testing.T) {
+	s := newTestServer(t)
+	s.failures = maxPairAttempts
+	if code := newTestController(t, s, "controller-1").setup(testPIN); code != errMaxTries {
+		t.Errorf("pair setup after %d failures: error %d, want %d", maxPairAttempts, code, errMaxTries)
+	}
+}
+
+func TestPairings(t *testing.T) {
+	s := newTestServer(t)
+	accessoryLTPK := s.key.Public().(ed25519.PublicKey)
+	setup := newTestController(t, s, "admin")
+	if code := setup.setup(testPIN); code != 0 {
+		t.Fatalf("pair setup failed with %d", code)
+	}
+	verified := func(id string, key ed25519.PrivateKey) *testController {
+		t.Helper()
+		c := newTestController(t, s, id)
+		c.key = key
+		if code := c.verify(accessoryLTPK); code != 0 {
+			t.Fatalf("pair verify as %s failed with %d", id, code)
+		}
+		return c
+	}
+	add := func(c *testController, id string, key ed25519.PrivateKey) byte {
+		t.Helper()
+		var request tlv8
+		request.addByte(tlvState, 1)
+		request.addByte(tlvMethod, methodAddPairing)
+		request.add(tlvIdentifier, []byte(id))
+		request.add(tlvPublicKey, key.Public().(ed25519.PublicKey))
+		request.addByte(tlvPermissions, 0)
+		code, _ := c.pairing("/pairings", request).getByte(tlvError)
+		return code
+	}
+
+	// An unverified connection can't manage pairings.
+	if resp, _ := newTestController(t, s, "admin").request(http.MethodPost, "/pairings", contentTypeTLV8, nil); resp.StatusCode != statusConnectionAuthorizationRequired {
+		t.Errorf("unverified POST /pairings: %s", resp.Status)
+	}
+
+	admin := verified("admin", setup.key)
+	_, userKey, _ := ed25519.GenerateKey(rand.Reader)
+	if code := add(admin, "user", userKey); code != 0 {
+		t.Fatalf("adding a pairing failed with %d", code)
+	}
+	if p := s.identity.Pairings["user"]; p.Admin {
+		t.Error("pairing added without admin permission is an admin")
+	}
+
+	// A controller that isn't an admin can't add others.
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	if code := add(verified("user", userKey), "other", otherKey); code != errAuthentication {
+		t.Errorf("adding a pairing as a user: error %d, want %d", code, errAuthentication)
+	}
+
+	var list tlv8
+	list.addByte(tlvState, 1)
+	list.addByte(tlvMethod, methodListPairings)
+	var ids []string
+	for _, item := range admin.pairing("/pairings", list) {
+		if item.typ == tlvIdentifier {
+			ids = append(ids, string(item.value))
+		}
+	}
+	if len(ids) != 2 {
+		t.Errorf("listed pairings %q, want admin and user", ids)
+	}
+
+	var remove tlv8
+	remove.addByte(tlvState, 1)
+	remove.addByte(tlvMethod, methodRemovePairing)
+	remove.add(tlvIdentifier, []byte("user"))
+	if code, ok := admin.pairing("/pairings", remove).getByte(tlvError); ok {
+		t.Fatalf("removing a pairing failed with %d", code)
+	}
+	c := newTestController(t, s, "user")
+	c.key = userKey
+	if code := c.verify(accessoryLTPK); code != errAuthentication {
+		t.Errorf("pair verify after removal: error %d, want %d", code, errAuthentication)
+	}
+}
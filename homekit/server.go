@@ -0,0 +1,743 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package homekit serves the boiler as a HomeKit accessory, a thermostat
+// for the boiler temperature with sensors for the other temperatures, so
+// that it can be seen and controlled from the Home app without a hub.
+//
+// The HomeKit Accessory Protocol is implemented here rather than with a
+// library such as github.com/brutella/hap, which brings its own storage,
+// mDNS responder and accessory model, none of which fit the state file,
+// the Writer or a responder that can run alongside Avahi. Only the protocol
+// framing is ours: SRP is checked against RFC 5054, and the key exchange,
+// signatures, HKDF and ChaCha20-Poly1305 come from the standard library and
+// golang.org/x/crypto. The package has not had an independent security
+// review, so it is experimental and off unless asked for.
+package homekit
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/state"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPort is the port the accessory listens on.
+	DefaultPort = 51826
+
+	stateKey = "homekit"
+
+	// categoryThermostat is advertised so that the Home app shows the
+	// right icon while pairing.
+	categoryThermostat = 9
+
+	// maxPairAttempts is how many times pair setup may fail before the
+	// accessory refuses to try again until it is restarted.
+	maxPairAttempts = 100
+)
+
+var pinPattern = regexp.MustCompile(`^\d{3}-\d{2}-\d{3}$`)
+
+// Setup codes that HomeKit refuses.
+var trivialPINs = map[string]bool{
+	"000-00-000": true, "111-11-111": true, "222-22-222": true, "333-33-333": true,
+	"444-44-444": true, "555-55-555": true, "666-66-666": true, "777-77-777": true,
+	"888-88-888": true, "999-99-999": true, "123-45-678": true, "876-54-321": true,
+}
+
+// ValidatePIN checks a setup code, given as XXX-XX-XXX.
+func ValidatePIN(pin string) error {
+	if !pinPattern.MatchString(pin) {
+		return fmt.Errorf("setup code %q must be given as XXX-XX-XXX", pin)
+	}
+	if trivialPINs[pin] {
+		return fmt.Errorf("setup code %s is too simple for HomeKit", pin)
+	}
+	return nil
+}
+
+// Config describes the accessory. The setpoint range is that of the boiler
+// temperature setting.
+type Config struct {
+	Port        int
+	PIN         string
+	Name        string
+	Serial      string
+	Version     string
+	MinSetpoint float64
+	MaxSetpoint float64
+}
+
+// pairing is a controller paired with the accessory, by its long term
+// public key.
+type pairing struct {
+	PublicKey []byte `json:"public_key"`
+	Admin     bool   `json:"admin"`
+}
+
+// identity is kept in the state store, as controllers only know the
+// accessory by its id and long term key. The config number must increase
+// whenever the accessory's services change, so the hash of them is kept to
+// notice.
+type identity struct {
+	ID           string             `json:"id"`
+	Seed         []byte             `json:"seed"`
+	PIN          string             `json:"pin"`
+	ConfigNumber int                `json:"config_number"`
+	ConfigHash   string             `json:"config_hash"`
+	Pairings     map[string]pairing `json:"pairings"`
+}
+
+// binding updates a characteristic from a value reported by the
+// controller.
+type binding struct {
+	char    *characteristic
+	convert func(value interface{}) (interface{}, bool)
+}
+
+// Server is a HomeKit accessory server.
+type Server struct {
+	Config
+
+	store     *state.Store
+	writer    *control.Writer
+	key       ed25519.PrivateKey
+	accessory *accessory
+	bindings  map[string][]binding
+	responder *responder
+	listener  net.Listener
+
+	mutex     sync.Mutex
+	identity  identity
+	conns     map[*conn]bool
+	setup     *srpServer
+	setupConn *conn
+	failures  int
+}
+
+func New(config Config, store *state.Store, writer *control.Writer) (*Server, error) {
+	if config.Port == 0 {
+		config.Port = DefaultPort
+	}
+	s := &Server{
+		Config:   config,
+		store:    store,
+		writer:   writer,
+		bindings: make(map[string][]binding),
+		conns:    make(map[*conn]bool),
+	}
+	s.buildAccessory()
+
+	store.Get(stateKey, &s.identity)
+	if s.identity.ID == "" {
+		id := make([]byte, 6)
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		s.identity.ID = strings.ToUpper(strings.TrimSuffix(strings.Replace(fmt.Sprintf("% x", id), " ", ":", -1), ":"))
+		s.identity.Seed = seed
+	}
+	if len(s.identity.Seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid HomeKit key in state")
+	}
+	s.key = ed25519.NewKeyFromSeed(s.identity.Seed)
+	if s.identity.Pairings == nil {
+		s.identity.Pairings = make(map[string]pairing)
+	}
+	switch {
+	case config.PIN != "":
+		s.identity.PIN = config.PIN
+	case s.identity.PIN == "":
+		pin, err := randomPIN()
+		if err != nil {
+			return nil, err
+		}
+		s.identity.PIN = pin
+	}
+
+	services, err := json.Marshal(s.accessory)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(services)
+	if hash := hex.EncodeToString(sum[:]); hash != s.identity.ConfigHash {
+		s.identity.ConfigHash = hash
+		s.identity.ConfigNumber++
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func randomPIN() (string, error) {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+		if err != nil {
+			return "", err
+		}
+		digits := fmt.Sprintf("%08d", n.Int64())
+		pin := fmt.Sprintf("%s-%s-%s", digits[:3], digits[3:5], digits[5:])
+		if ValidatePIN(pin) == nil {
+			return pin, nil
+		}
+	}
+}
+
+// save must be called with the mutex held, or before the server starts.
+func (s *Server) save() error {
+	return s.store.Set(stateKey, s.identity)
+}
+
+// PIN returns the setup code to pair with.
+func (s *Server) PIN() string {
+	return s.identity.PIN
+}
+
+// Paired returns whether any controller is paired with the accessory.
+func (s *Server) Paired() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.identity.Pairings) > 0
+}
+
+func (s *Server) buildAccessory() {
+	a := newAccessory()
+	identify := &characteristic{typ: charIdentify, format: "bool", perms: []string{permWrite}, write: func(interface{}) error {
+		log.Infof("HomeKit asked %s to identify itself", s.Name)
+		return nil
+	}}
+	a.addService(serviceAccessoryInformation, false,
+		identify,
+		stringCharacteristic(charManufacturer, "NBE"),
+		stringCharacteristic(charModel, "boiler-mate"),
+		stringCharacteristic(charName, s.Name),
+		stringCharacteristic(charSerialNumber, s.Serial),
+		stringCharacteristic(charFirmwareRevision, firmwareRevision(s.Version)),
+	)
+	a.addService(serviceProtocolInformation, false, stringCharacteristic(charVersion, "1.1.0"))
+
+	currentState := &characteristic{typ: charCurrentHeatingCoolingState, format: "uint8", perms: []string{permRead, permEvents}, validValues: []int{0, 1}, value: 0}
+	targetState := &characteristic{typ: charTargetHeatingCoolingState, format: "uint8", perms: []string{permRead, permWrite, permEvents}, validValues: []int{0, 1}, value: 0,
+		write: func(value interface{}) error {
+			key := "misc.stop"
+			if value.(int) == 1 {
+				key = "misc.start"
+			}
+			return s.set(key, "1")
+		},
+	}
+	currentTemp := temperatureCharacteristic(charCurrentTemperature, permRead, permEvents)
+	targetTemp := &characteristic{typ: charTargetTemperature, format: "float", perms: []string{permRead, permWrite, permEvents}, unit: "celsius",
+		minValue: float(s.MinSetpoint), maxValue: float(s.MaxSetpoint), minStep: float(1), value: s.MinSetpoint,
+		write: func(value interface{}) error {
+			return s.set("boiler.temp", strconv.FormatFloat(value.(float64), 'f', -1, 64))
+		},
+	}
+	// The controller only knows Celsius, so the display units are
+	// remembered but change nothing.
+	units := &characteristic{typ: charTemperatureDisplayUnits, format: "uint8", perms: []string{permRead, permWrite, permEvents}, validValues: []int{0, 1}, value: 0,
+		write: func(interface{}) error { return nil },
+	}
+	a.addService(serviceThermostat, true, currentState, targetState, currentTemp, targetTemp, units, stringCharacteristic(charName, "Boiler"))
+
+	s.bind("operating_data.state", currentState, func(v interface{}) (interface{}, bool) {
+		state, ok := v.(int64)
+		if !ok {
+			return nil, false
+		}
+		if phase := nbe.Phase(state, 0); phase == nbe.PhaseIgnition || phase == nbe.PhaseRunning {
+			return 1, true
+		}
+		return 0, true
+	})
+	s.bind("operating_data.state", targetState, func(v interface{}) (interface{}, bool) {
+		state, ok := v.(int64)
+		if !ok {
+			return nil, false
+		}
+		// 14 is off, and anything else is the boiler being allowed
+		// to run.
+		if state == 14 {
+			return 0, true
+		}
+		return 1, true
+	})
+	s.bind("operating_data.boiler_temp", currentTemp, toFloat)
+	s.bind("boiler.temp", targetTemp, toFloat)
+
+	for _, sensor := range []struct{ key, name string }{
+		{"operating_data.dhw_temp", "Hot Water"},
+		{"operating_data.return_temp", "Return"},
+		{"operating_data.smoke_temp", "Flue Gas"},
+	} {
+		temp := temperatureCharacteristic(charCurrentTemperature, permRead, permEvents)
+		a.addService(serviceTemperatureSensor, false, temp, stringCharacteristic(charName, sensor.name))
+		s.bind(sensor.key, temp, toFloat)
+	}
+	s.accessory = a
+}
+
+// firmwareRevision returns the x.y.z that HomeKit expects from a version
+// such as v1.2.3-4-gabcdef, or 0.0.0 for development builds.
+func firmwareRevision(version string) string {
+	match := regexp.MustCompile(`^v?(\d+\.\d+\.\d+)`).FindStringSubmatch(version)
+	if match == nil {
+		return "0.0.0"
+	}
+	return match[1]
+}
+
+func (s *Server) bind(key string, char *characteristic, convert func(interface{}) (interface{}, bool)) {
+	s.bindings[key] = append(s.bindings[key], binding{char: char, convert: convert})
+}
+
+func toFloat(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		// The controller's values are parsed as float32, so round off the
+		// noise rather than showing it in the Home app.
+		return math.Round(float64(v)*100) / 100, true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return nil, false
+}
+
+func (s *Server) set(key string, value string) error {
+	log.Infof("HomeKit setting %s to %s", key, value)
+	return s.writer.SetAsync("homekit", key, []byte(value), func(response *nbe.NBEResponse) {
+		if response.Status != 0 {
+			log.Errorf("HomeKit failed to set %s to %s: %v", key, value, response.Payload)
+		}
+	})
+}
+
+// Start listens for controllers, advertises the accessory and keeps its
+// characteristics up to date.
+func (s *Server) Start(events *bus.Bus) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	s.responder, err = newResponder(s.Name, s.identity.ID, s.Port, s.txt)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("starting mDNS responder: %v", err)
+	}
+
+	events.OnChange(func(change bus.Change) {
+		bindings, ok := s.bindings[fmt.Sprintf("%s.%s", change.Category, change.Key)]
+		if !ok {
+			return
+		}
+		var changed []*characteristic
+		s.mutex.Lock()
+		for _, b := range bindings {
+			value, ok := b.convert(change.Value)
+			if ok && value != b.char.value {
+				b.char.value = value
+				changed = append(changed, b.char)
+			}
+		}
+		s.mutex.Unlock()
+		s.notify(nil, changed)
+	})
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return nil
+}
+
+// txt is the TXT record of the accessory's service.
+func (s *Server) txt() []string {
+	paired := 1
+	if s.Paired() {
+		paired = 0
+	}
+	return []string{
+		fmt.Sprintf("c#=%d", s.identity.ConfigNumber),
+		"ff=0",
+		fmt.Sprintf("id=%s", s.identity.ID),
+		"md=boiler-mate",
+		"pv=1.1",
+		"s#=1",
+		fmt.Sprintf("sf=%d", paired),
+		fmt.Sprintf("ci=%d", categoryThermostat),
+	}
+}
+
+// notify sends an event for characteristics that changed to every
+// connection that subscribed to them, except the one that changed them.
+func (s *Server) notify(from *conn, changed []*characteristic) {
+	if len(changed) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	type value struct {
+		AID   int         `json:"aid"`
+		IID   int         `json:"iid"`
+		Value interface{} `json:"value"`
+	}
+	events := make(map[*conn][]value)
+	for c := range s.conns {
+		if c == from {
+			continue
+		}
+		for _, char := range changed {
+			if c.events[char.iid] {
+				events[c] = append(events[c], value{AID: aid, IID: char.iid, Value: char.value})
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	for c, values := range events {
+		body, _ := json.Marshal(map[string]interface{}{"characteristics": values})
+		c.event(body)
+	}
+}
+
+// Close stops advertising the accessory and closes every connection.
+func (s *Server) Close() {
+	if s.responder != nil {
+		s.responder.close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// conn is a connection from a controller. It is in the clear until pair
+// verify finishes, after which it is encrypted and the controller can use
+// the accessory.
+type conn struct {
+	net.Conn
+
+	server     *Server
+	reader     *bufio.Reader
+	secure     *secureConn
+	controller string
+	verify     *verifySession
+	events     map[int]bool
+	mutex      sync.Mutex
+}
+
+func (s *Server) serve(raw net.Conn) {
+	c := &conn{Conn: raw, server: s, events: make(map[int]bool)}
+	c.reader = bufio.NewReader(readerFunc(c.read))
+	s.mutex.Lock()
+	s.conns[c] = true
+	s.mutex.Unlock()
+	log.Debugf("HomeKit connection from %s", raw.RemoteAddr())
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, c)
+		if s.setupConn == c {
+			s.setup = nil
+			s.setupConn = nil
+		}
+		s.mutex.Unlock()
+		c.Close()
+		log.Debugf("HomeKit connection from %s closed", raw.RemoteAddr())
+	}()
+
+	for {
+		req, err := http.ReadRequest(c.reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("HomeKit connection from %s: %v", raw.RemoteAddr(), err)
+			}
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(req.Body, 1<<16))
+		if err != nil {
+			return
+		}
+		r := c.handle(req, body)
+		if err := c.respond(r.status, r.contentType, r.body); err != nil {
+			return
+		}
+		if r.after != nil && !r.after() {
+			return
+		}
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+// read is only called from the connection's own goroutine, which is also
+// the only one to set secure.
+func (c *conn) read(b []byte) (int, error) {
+	if c.secure != nil {
+		return c.secure.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *conn) write(b []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var err error
+	if c.secure != nil {
+		_, err = c.secure.Write(b)
+	} else {
+		_, err = c.Conn.Write(b)
+	}
+	return err
+}
+
+// response is what a request is answered with. after, if set, is called
+// once the response has been sent, and closes the connection if it
+// returns false.
+type response struct {
+	status      int
+	contentType string
+	body        []byte
+	after       func() bool
+}
+
+const (
+	contentTypeJSON = "application/hap+json"
+	contentTypeTLV8 = "application/pairing+tlv8"
+
+	statusConnectionAuthorizationRequired = 470
+)
+
+func (c *conn) respond(status int, contentType string, body []byte) error {
+	text := http.StatusText(status)
+	if status == statusConnectionAuthorizationRequired {
+		text = "Connection Authorization Required"
+	}
+	header := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, text)
+	if contentType != "" {
+		header += fmt.Sprintf("Content-Type: %s\r\n", contentType)
+	}
+	header += fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body))
+	return c.write(append([]byte(header), body...))
+}
+
+// event sends an event to a verified connection.
+func (c *conn) event(body []byte) {
+	message := fmt.Sprintf("EVENT/1.0 200 OK\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", contentTypeJSON, len(body))
+	if err := c.write(append([]byte(message), body...)); err != nil {
+		log.Debugf("Failed to send HomeKit event to %s: %v", c.RemoteAddr(), err)
+	}
+}
+
+func jsonResponse(status int, v interface{}) response {
+	body, _ := json.Marshal(v)
+	return response{status: status, contentType: contentTypeJSON, body: body}
+}
+
+func (c *conn) handle(req *http.Request, body []byte) response {
+	switch {
+	case req.URL.Path == "/pair-setup" && req.Method == http.MethodPost:
+		return c.server.pairSetup(c, body)
+	case req.URL.Path == "/pair-verify" && req.Method == http.MethodPost:
+		return c.pairVerify(body)
+	case req.URL.Path == "/identify" && req.Method == http.MethodPost:
+		if c.server.Paired() {
+			return jsonResponse(http.StatusBadRequest, map[string]int{"status": statusInsufficientPriv})
+		}
+		log.Infof("HomeKit asked %s to identify itself", c.server.Name)
+		return response{status: http.StatusNoContent}
+	}
+
+	if c.controller == "" {
+		return jsonResponse(statusConnectionAuthorizationRequired, map[string]int{"status": statusInsufficientPriv})
+	}
+	switch {
+	case req.URL.Path == "/accessories" && req.Method == http.MethodGet:
+		c.server.mutex.Lock()
+		defer c.server.mutex.Unlock()
+		return jsonResponse(http.StatusOK, map[string]interface{}{"accessories": []*accessory{c.server.accessory}})
+	case req.URL.Path == "/characteristics" && req.Method == http.MethodGet:
+		return c.readCharacteristics(req.URL.Query().Get("id"))
+	case req.URL.Path == "/characteristics" && req.Method == http.MethodPut:
+		return c.writeCharacteristics(body)
+	case req.URL.Path == "/pairings" && req.Method == http.MethodPost:
+		return c.server.pairings(c, body)
+	}
+	return response{status: http.StatusNotFound}
+}
+
+type characteristicStatus struct {
+	AID    int         `json:"aid"`
+	IID    int         `json:"iid"`
+	Value  interface{} `json:"value,omitempty"`
+	Status *int        `json:"status,omitempty"`
+}
+
+// readCharacteristics answers a read of ids given as aid.iid,aid.iid.
+// Errors need a 207 with the status of every characteristic.
+func (c *conn) readCharacteristics(ids string) response {
+	var results []characteristicStatus
+	failed := false
+	c.server.mutex.Lock()
+	for _, id := range strings.Split(ids, ",") {
+		a, i, _ := strings.Cut(id, ".")
+		aid, _ := strconv.Atoi(a)
+		iid, _ := strconv.Atoi(i)
+		result := characteristicStatus{AID: aid, IID: iid}
+		status := statusOK
+		char, ok := c.server.accessory.characteristics[iid]
+		switch {
+		case aid != c.server.accessory.AID || !ok:
+			status = statusNotFound
+		case !char.can(permRead):
+			status = statusWriteOnly
+		default:
+			result.Value = char.value
+		}
+		if status != statusOK {
+			failed = true
+		}
+		result.Status = &status
+		results = append(results, result)
+	}
+	c.server.mutex.Unlock()
+
+	if !failed {
+		for i := range results {
+			results[i].Status = nil
+		}
+		return jsonResponse(http.StatusOK, map[string]interface{}{"characteristics": results})
+	}
+	return jsonResponse(http.StatusMultiStatus, map[string]interface{}{"characteristics": results})
+}
+
+// writeCharacteristics writes values and subscribes to or unsubscribes
+// from events.
+func (c *conn) writeCharacteristics(body []byte) response {
+	var request struct {
+		Characteristics []struct {
+			AID   int         `json:"aid"`
+			IID   int         `json:"iid"`
+			Value interface{} `json:"value"`
+			Event *bool       `json:"ev"`
+		} `json:"characteristics"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]int{"status": statusInvalidValue})
+	}
+
+	var results []characteristicStatus
+	var changed []*characteristic
+	failed := false
+	for _, w := range request.Characteristics {
+		status := c.writeCharacteristic(w.AID, w.IID, w.Value, w.Event, &changed)
+		if status != statusOK {
+			failed = true
+		}
+		results = append(results, characteristicStatus{AID: w.AID, IID: w.IID, Status: &status})
+	}
+	c.server.notify(c, changed)
+
+	if !failed {
+		return response{status: http.StatusNoContent}
+	}
+	return jsonResponse(http.StatusMultiStatus, map[string]interface{}{"characteristics": results})
+}
+
+func (c *conn) writeCharacteristic(aid int, iid int, value interface{}, event *bool, changed *[]*characteristic) int {
+	s := c.server
+	s.mutex.Lock()
+	char, ok := s.accessory.characteristics[iid]
+	s.mutex.Unlock()
+	if aid != s.accessory.AID || !ok {
+		return statusNotFound
+	}
+
+	if event != nil {
+		if !char.can(permEvents) {
+			return statusNotifyUnsupported
+		}
+		s.mutex.Lock()
+		c.events[iid] = *event
+		s.mutex.Unlock()
+	}
+	if value == nil {
+		return statusOK
+	}
+
+	if !char.can(permWrite) {
+		return statusReadOnly
+	}
+	v, err := char.convert(value)
+	if err != nil {
+		log.Warnf("Ignoring HomeKit write of %v to %s: %v", value, char.typ, err)
+		return statusInvalidValue
+	}
+	if err := char.write(v); err != nil {
+		log.Errorf("HomeKit write of %v to %s failed: %v", value, char.typ, err)
+		return statusCommunication
+	}
+	// Shown straight away, and corrected by the next poll if the
+	// controller didn't take it.
+	if char.can(permRead) {
+		s.mutex.Lock()
+		char.value = v
+		s.mutex.Unlock()
+		*changed = append(*changed, char)
+	}
+	return statusOK
+}
@@ -0,0 +1,142 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// maxFrameSize is the most plaintext in a frame of a secure session.
+const maxFrameSize = 1024
+
+func deriveKey(secret []byte, salt string, info string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	io.ReadFull(hkdf.New(sha512.New, secret, []byte(salt), []byte(info)), key)
+	return key
+}
+
+// nonce pads a pairing message's nonce, e.g. "PS-Msg05", or a frame
+// counter, to the 12 bytes ChaCha20-Poly1305 needs.
+func nonce(n []byte) []byte {
+	b := make([]byte, chacha20poly1305.NonceSize)
+	copy(b[chacha20poly1305.NonceSize-len(n):], n)
+	return b
+}
+
+func seal(key []byte, n string, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce([]byte(n)), plaintext, nil), nil
+}
+
+func open(key []byte, n string, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce([]byte(n)), ciphertext, nil)
+}
+
+// secureConn encrypts a connection once pair verify has finished. Each
+// frame is a little endian length, which is also the additional data, the
+// encrypted data and its tag. Each direction has its own key and counts
+// its frames for the nonce.
+type secureConn struct {
+	net.Conn
+
+	readKey    []byte
+	writeKey   []byte
+	readCount  uint64
+	writeCount uint64
+	pending    []byte
+	writeMutex sync.Mutex
+}
+
+func newSecureConn(conn net.Conn, shared []byte) *secureConn {
+	return &secureConn{
+		Conn:     conn,
+		readKey:  deriveKey(shared, "Control-Salt", "Control-Write-Encryption-Key"),
+		writeKey: deriveKey(shared, "Control-Salt", "Control-Read-Encryption-Key"),
+	}
+}
+
+func frameNonce(count uint64) []byte {
+	return nonce(binary.LittleEndian.AppendUint64(nil, count))
+}
+
+func (c *secureConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		size := int(binary.LittleEndian.Uint16(header))
+		if size > maxFrameSize {
+			return 0, fmt.Errorf("frame of %d bytes is too large", size)
+		}
+		frame := make([]byte, size+chacha20poly1305.Overhead)
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			return 0, err
+		}
+		aead, err := chacha20poly1305.New(c.readKey)
+		if err != nil {
+			return 0, err
+		}
+		plaintext, err := aead.Open(nil, frameNonce(c.readCount), frame, header)
+		if err != nil {
+			return 0, fmt.Errorf("decrypting frame: %v", err)
+		}
+		c.readCount++
+		c.pending = plaintext
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	aead, err := chacha20poly1305.New(c.writeKey)
+	if err != nil {
+		return 0, err
+	}
+	var out []byte
+	for rest := b; len(rest) > 0; {
+		n := min(len(rest), maxFrameSize)
+		header := binary.LittleEndian.AppendUint16(nil, uint16(n))
+		out = append(out, header...)
+		out = aead.Seal(out, frameNonce(c.writeCount), rest[:n], header)
+		c.writeCount++
+		rest = rest[n:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,159 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestNonce(t *testing.T) {
+	if got, want := hex.EncodeToString(nonce([]byte("PS-Msg05"))), "00000000"+hex.EncodeToString([]byte("PS-Msg05")); got != want {
+		t.Errorf("nonce(PS-Msg05) = %s, want %s", got, want)
+	}
+	if got, want := hex.EncodeToString(frameNonce(0x0102)), "00000000"+"0201000000000000"; got != want {
+		t.Errorf("frameNonce(0x0102) = %s, want %s", got, want)
+	}
+}
+
+// TestDeriveKey checks the keys HAP derives against HKDF-SHA512 worked
+// through by hand from RFC 5869, for each of the salts and infos it uses.
+func TestDeriveKey(t *testing.T) {
+	hkdf := func(secret []byte, salt, info string) []byte {
+		extract := hmac.New(sha512.New, []byte(salt))
+		extract.Write(secret)
+		expand := hmac.New(sha512.New, extract.Sum(nil))
+		expand.Write([]byte(info))
+		expand.Write([]byte{1})
+		return expand.Sum(nil)[:chacha20poly1305.KeySize]
+	}
+
+	secret := bytes.Repeat([]byte{0x0b}, 64)
+	for _, tt := range []struct{ salt, info string }{
+		{"Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info"},
+		{"Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info"},
+		{"Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info"},
+		{"Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info"},
+		{"Control-Salt", "Control-Read-Encryption-Key"},
+		{"Control-Salt", "Control-Write-Encryption-Key"},
+	} {
+		if got, want := deriveKey(secret, tt.salt, tt.info), hkdf(secret, tt.salt, tt.info); !bytes.Equal(got, want) {
+			t.Errorf("deriveKey(%s, %s) = %x, want %x", tt.salt, tt.info, got, want)
+		}
+	}
+}
+
+// controllerKeys are the keys the controller's side of a session uses.
+func controllerKeys(shared []byte) (read, write []byte) {
+	return deriveKey(shared, "Control-Salt", "Control-Read-Encryption-Key"),
+		deriveKey(shared, "Control-Salt", "Control-Write-Encryption-Key")
+}
+
+func TestSecureConnWrite(t *testing.T) {
+	shared := bytes.Repeat([]byte{7}, 32)
+	accessory, controller := net.Pipe()
+	defer accessory.Close()
+	defer controller.Close()
+	c := newSecureConn(accessory, shared)
+
+	plaintext := make([]byte, 2*maxFrameSize+100)
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+	go c.Write(plaintext)
+
+	// The frames are built here from the specification rather than with
+	// secureConn.
+	readKey, _ := controllerKeys(shared)
+	aead, _ := chacha20poly1305.New(readKey)
+	var got []byte
+	for count, size := range []int{maxFrameSize, maxFrameSize, 100} {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(controller, header); err != nil {
+			t.Fatal(err)
+		}
+		if n := binary.LittleEndian.Uint16(header); int(n) != size {
+			t.Fatalf("frame %d is %d bytes, want %d", count, n, size)
+		}
+		frame := make([]byte, size+chacha20poly1305.Overhead)
+		if _, err := io.ReadFull(controller, frame); err != nil {
+			t.Fatal(err)
+		}
+		n := make([]byte, 12)
+		binary.LittleEndian.PutUint64(n[4:], uint64(count))
+		opened, err := aead.Open(nil, n, frame, header)
+		if err != nil {
+			t.Fatalf("frame %d: %v", count, err)
+		}
+		got = append(got, opened...)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Error("frames don't join up to what was written")
+	}
+}
+
+func TestSecureConnRead(t *testing.T) {
+	shared := bytes.Repeat([]byte{9}, 32)
+	_, writeKey := controllerKeys(shared)
+	aead, _ := chacha20poly1305.New(writeKey)
+	frame := func(count uint64, plaintext []byte) []byte {
+		header := binary.LittleEndian.AppendUint16(nil, uint16(len(plaintext)))
+		return aead.Seal(header, frameNonce(count), plaintext, header)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+		ok    bool
+	}{
+		{"frames", append(frame(0, []byte("GET /accessories ")), frame(1, []byte("HTTP/1.1\r\n"))...), "GET /accessories HTTP/1.1\r\n", true},
+		{"replayed", append(frame(0, []byte("GET ")), frame(0, []byte("GET "))...), "GET ", false},
+		{"tampered", func() []byte { f := frame(0, []byte("GET ")); f[3] ^= 1; return f }(), "", false},
+		{"too large", binary.LittleEndian.AppendUint16(nil, maxFrameSize+1), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accessory, controller := net.Pipe()
+			defer accessory.Close()
+			go func() {
+				controller.Write(tt.input)
+				controller.Close()
+			}()
+			c := newSecureConn(accessory, shared)
+			got, err := io.ReadAll(c)
+			if string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+			if tt.ok && err != nil {
+				t.Errorf("read failed: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("read succeeded")
+			}
+		})
+	}
+}
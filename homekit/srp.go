@@ -0,0 +1,152 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// srpGroup is the group and hash an SRP exchange uses.
+type srpGroup struct {
+	N    *big.Int
+	g    *big.Int
+	hash func() hash.Hash
+}
+
+// srp3072 is the 3072 bit group of RFC 5054, which HomeKit uses with
+// SHA-512.
+var srp3072 = &srpGroup{
+	N: mustHex("" +
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74" +
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437" +
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05" +
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB" +
+		"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718" +
+		"3995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33" +
+		"A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7" +
+		"ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864" +
+		"D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E2" +
+		"08E24FA074E5AB3143DB5BFCE0FD108E4B82D120A93AD2CAFFFFFFFFFFFFFFFF"),
+	g:    big.NewInt(5),
+	hash: sha512.New,
+}
+
+func mustHex(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid hex number " + s)
+	}
+	return n
+}
+
+const srpUsername = "Pair-Setup"
+
+// srpServer is the accessory's side of the SRP-6a exchange of pair setup,
+// in which the controller proves it knows the setup code.
+type srpServer struct {
+	group    *srpGroup
+	username string
+	salt     []byte
+	v        *big.Int
+	b        *big.Int
+	// B is sent padded to the length of N.
+	B []byte
+	K []byte
+}
+
+func (g *srpGroup) H(parts ...[]byte) []byte {
+	h := g.hash()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func (g *srpGroup) pad(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, len(g.N.Bytes())))
+}
+
+func newSRPServer(pin string) (*srpServer, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return newSRPServerWith(srp3072, srpUsername, pin, salt, secret), nil
+}
+
+// newSRPServerWith starts an exchange with a given salt and secret b.
+func newSRPServerWith(group *srpGroup, username string, password string, salt []byte, secret []byte) *srpServer {
+	s := &srpServer{
+		group:    group,
+		username: username,
+		salt:     salt,
+		b:        new(big.Int).SetBytes(secret),
+	}
+	N, g := group.N, group.g
+
+	x := new(big.Int).SetBytes(group.H(salt, group.H([]byte(username+":"+password))))
+	s.v = new(big.Int).Exp(g, x, N)
+
+	// B = k*v + g^b
+	k := new(big.Int).SetBytes(group.H(N.Bytes(), group.pad(g)))
+	B := new(big.Int).Mul(k, s.v)
+	B.Add(B, new(big.Int).Exp(g, s.b, N))
+	B.Mod(B, N)
+	s.B = group.pad(B)
+	return s
+}
+
+// verify checks the controller's proof M1 of its public key A, returning
+// the accessory's proof M2. The session key K is set once it has.
+func (s *srpServer) verify(A []byte, M1 []byte) ([]byte, error) {
+	group, N := s.group, s.group.N
+	a := new(big.Int).SetBytes(A)
+	if new(big.Int).Mod(a, N).Sign() == 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	// S = (A * v^u)^b
+	u := new(big.Int).SetBytes(group.H(group.pad(a), s.B))
+	S := new(big.Int).Exp(s.v, u, N)
+	S.Mul(S, a)
+	S.Exp(S, s.b, N)
+	K := group.H(group.pad(S))
+
+	hN := group.H(N.Bytes())
+	hG := group.H(group.g.Bytes())
+	for i := range hN {
+		hN[i] ^= hG[i]
+	}
+	expected := group.H(hN, group.H([]byte(s.username)), s.salt, A, s.B, K)
+	if subtle.ConstantTimeCompare(expected, M1) != 1 {
+		return nil, fmt.Errorf("incorrect setup code")
+	}
+	s.K = K
+	return group.H(A, M1, K), nil
+}
@@ -0,0 +1,165 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func fromHex(s string) *big.Int {
+	return mustHex(strings.ReplaceAll(s, " ", ""))
+}
+
+// srpClient is the controller's side of the exchange, computing its public
+// key A, its proof M1 and the session key K from the secret a.
+func srpClient(group *srpGroup, username, password string, salt, B []byte, a *big.Int) (A, M1, K []byte) {
+	N, g := group.N, group.g
+	A = group.pad(new(big.Int).Exp(g, a, N))
+	u := new(big.Int).SetBytes(group.H(A, B))
+	k := new(big.Int).SetBytes(group.H(N.Bytes(), group.pad(g)))
+	x := new(big.Int).SetBytes(group.H(salt, group.H([]byte(username+":"+password))))
+
+	// S = (B - k*g^x)^(a + u*x)
+	base := new(big.Int).Mul(k, new(big.Int).Exp(g, x, N))
+	base.Sub(new(big.Int).SetBytes(B), base)
+	base.Mod(base, N)
+	exp := new(big.Int).Add(a, new(big.Int).Mul(u, x))
+	S := new(big.Int).Exp(base, exp, N)
+	K = group.H(group.pad(S))
+
+	hN := group.H(N.Bytes())
+	hG := group.H(g.Bytes())
+	for i := range hN {
+		hN[i] ^= hG[i]
+	}
+	M1 = group.H(hN, group.H([]byte(username)), salt, A, B, K)
+	return A, M1, K
+}
+
+// TestSRPRFC5054 checks the server against the test vectors of RFC 5054,
+// appendix B, which use the 1024 bit group and SHA-1.
+func TestSRPRFC5054(t *testing.T) {
+	group := &srpGroup{
+		N: fromHex("EEAF0AB9 ADB38DD6 9C33F80A FA8FC5E8 60726187 75FF3C0B 9EA2314C 9C256576" +
+			"D674DF74 96EA81D3 383B4813 D692C6E0 E0D5D8E2 50B98BE4 8E495C1D 6089DAD1" +
+			"5DC7D7B4 6154D6B6 CE8EF4AD 69B15D49 82559B29 7BCF1885 C529F566 660E57EC" +
+			"68EDBC3C 05726CC0 2FD4CBF4 976EAA9A FD5138FE 8376435B 9FC61D2F C0EB06E3"),
+		g:    big.NewInt(2),
+		hash: sha1.New,
+	}
+	salt := fromHex("BEB25379 D1A8581E B5A72767 3A2441EE").Bytes()
+	a := fromHex("60975527 035CF2AD 1989806F 0407210B C81EDC04 E2762A56 AFD529DD DA2D4393")
+	b := fromHex("E487CB59 D31AC550 471E81F0 0F6928E0 1DDA08E9 74A004F4 9E61F5D1 05284D20")
+
+	wantV := fromHex("7E273DE8 696FFC4F 4E337D05 B4B375BE B0DDE156 9E8FA00A 9886D812 9BADA1F1" +
+		"822223CA 1A605B53 0E379BA4 729FDC59 F105B478 7E5186F5 C671085A 1447B52A" +
+		"48CF1970 B4FB6F84 00BBF4CE BFBB1681 52E08AB5 EA53D15C 1AFF87B2 B9DA6E04" +
+		"E058AD51 CC72BFC9 033B564E 26480D78 E955A5E2 9E7AB245 DB2BE315 E2099AFB")
+	wantA := fromHex("61D5E490 F6F1B795 47B0704C 436F523D D0E560F0 C64115BB 72557EC4 4352E890" +
+		"3211C046 92272D8B 2D1A5358 A2CF1B6E 0BFCF99F 921530EC 8E393561 79EAE45E" +
+		"42BA92AE ACED8251 71E1E8B9 AF6D9C03 E1327F44 BE087EF0 6530E69F 66615261" +
+		"EEF54073 CA11CF58 58F0EDFD FE15EFEA B349EF5D 76988A36 72FAC47B 0769447B")
+	wantB := fromHex("BD0C6151 2C692C0C B6D041FA 01BB152D 4916A1E7 7AF46AE1 05393011 BAF38964" +
+		"DC46A067 0DD125B9 5A981652 236F99D9 B681CBF8 7837EC99 6C6DA044 53728610" +
+		"D0C6DDB5 8B318885 D7D82C7F 8DEB75CE 7BD4FBAA 37089E6F 9C6059F3 88838E7A" +
+		"00030B33 1EB76840 910440B1 B27AAEAE EB4012B7 D7665238 A8E3FB00 4B117B58")
+	wantS := fromHex("B0DC82BA BCF30674 AE450C02 87745E79 90A3381F 63B387AA F271A10D 233861E3" +
+		"59B48220 F7C4693C 9AE12B0A 6F67809F 0876E2D0 13800D6C 41BB59B6 D5979B5C" +
+		"00A172B4 A2A5903A 0BDCAF8A 709585EB 2AFAFA8F 3499B200 210DCC1F 10EB3394" +
+		"3CD67FC8 8A2F39A4 BE5BEC4E C0A3212D C346D7E4 74B29EDE 8A469FFE CA686E5A")
+
+	s := newSRPServerWith(group, "alice", "password123", salt, b.Bytes())
+	if s.v.Cmp(wantV) != 0 {
+		t.Errorf("v = %X, want %X", s.v, wantV)
+	}
+	if !bytes.Equal(s.B, group.pad(wantB)) {
+		t.Errorf("B = %X, want %X", s.B, wantB)
+	}
+
+	A, M1, K := srpClient(group, "alice", "password123", salt, s.B, a)
+	if !bytes.Equal(A, group.pad(wantA)) {
+		t.Fatalf("A = %X, want %X", A, wantA)
+	}
+	M2, err := s.verify(A, M1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantK := group.H(group.pad(wantS)); !bytes.Equal(s.K, wantK) || !bytes.Equal(K, wantK) {
+		t.Errorf("K = %X, want H(S) = %X", s.K, wantK)
+	}
+	if want := group.H(A, M1, K); !bytes.Equal(M2, want) {
+		t.Errorf("M2 = %X, want %X", M2, want)
+	}
+}
+
+func TestSRPPairSetup(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		pin  string
+		ok   bool
+	}{
+		{"correct", "031-45-154", true},
+		{"incorrect", "031-45-155", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSRPServer("031-45-154")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(s.B) != 384 || len(s.salt) != 16 {
+				t.Errorf("B is %d bytes and the salt %d, want 384 and 16", len(s.B), len(s.salt))
+			}
+			a, _ := rand.Int(rand.Reader, srp3072.N)
+			A, M1, K := srpClient(srp3072, srpUsername, tt.pin, s.salt, s.B, a)
+			M2, err := s.verify(A, M1)
+			if !tt.ok {
+				if err == nil || s.K != nil {
+					t.Error("verified with the wrong setup code")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(s.K, K) || len(K) != 64 {
+				t.Errorf("K = %X, controller has %X", s.K, K)
+			}
+			if !bytes.Equal(M2, srp3072.H(A, M1, K)) {
+				t.Errorf("M2 = %X", M2)
+			}
+		})
+	}
+}
+
+func TestSRPInvalidPublicKey(t *testing.T) {
+	s, err := newSRPServer("031-45-154")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A of 0 or N would make the session key 0, whatever the setup code.
+	for _, A := range [][]byte{make([]byte, 384), srp3072.N.Bytes(), new(big.Int).Lsh(srp3072.N, 1).Bytes()} {
+		if _, err := s.verify(A, make([]byte, 64)); err == nil {
+			t.Errorf("verified with A = %X", A)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import "fmt"
+
+// TLV types used by pairing.
+const (
+	tlvMethod        = 0x00
+	tlvIdentifier    = 0x01
+	tlvSalt          = 0x02
+	tlvPublicKey     = 0x03
+	tlvProof         = 0x04
+	tlvEncryptedData = 0x05
+	tlvState         = 0x06
+	tlvError         = 0x07
+	tlvSignature     = 0x0a
+	tlvPermissions   = 0x0b
+	tlvSeparator     = 0xff
+)
+
+// Pairing errors.
+const (
+	errUnknown        = 0x01
+	errAuthentication = 0x02
+	errMaxTries       = 0x05
+	errUnavailable    = 0x06
+	errBusy           = 0x07
+)
+
+type tlvItem struct {
+	typ   byte
+	value []byte
+}
+
+// tlv8 is an ordered list of items, as the pairing list needs repeated
+// types separated by separators.
+type tlv8 []tlvItem
+
+func (t *tlv8) add(typ byte, value []byte) {
+	*t = append(*t, tlvItem{typ: typ, value: value})
+}
+
+func (t *tlv8) addByte(typ byte, value byte) {
+	t.add(typ, []byte{value})
+}
+
+func (t tlv8) get(typ byte) []byte {
+	for _, item := range t {
+		if item.typ == typ {
+			return item.value
+		}
+	}
+	return nil
+}
+
+func (t tlv8) getByte(typ byte) (byte, bool) {
+	v := t.get(typ)
+	if len(v) != 1 {
+		return 0, false
+	}
+	return v[0], true
+}
+
+// encode splits values longer than 255 bytes into consecutive items of the
+// same type.
+func (t tlv8) encode() []byte {
+	var b []byte
+	for _, item := range t {
+		value := item.value
+		for {
+			n := min(len(value), 255)
+			b = append(b, item.typ, byte(n))
+			b = append(b, value[:n]...)
+			value = value[n:]
+			if len(value) == 0 {
+				break
+			}
+		}
+	}
+	return b
+}
+
+// decodeTLV8 joins consecutive items of the same type back together.
+func decodeTLV8(b []byte) (tlv8, error) {
+	var t tlv8
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, fmt.Errorf("truncated TLV")
+		}
+		typ, value := b[0], b[2:2+int(b[1])]
+		b = b[2+int(b[1]):]
+		// Only a full item can be continued.
+		if n := len(t); n > 0 && t[n-1].typ == typ && len(t[n-1].value) > 0 && len(t[n-1].value)%255 == 0 {
+			t[n-1].value = append(t[n-1].value, value...)
+			continue
+		}
+		t = append(t, tlvItem{typ: typ, value: append([]byte{}, value...)})
+	}
+	return t, nil
+}
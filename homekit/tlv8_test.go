@@ -0,0 +1,121 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestTLV8(t *testing.T) {
+	long := bytes.Repeat([]byte{0xab}, 300)
+	full := bytes.Repeat([]byte{0xcd}, 255)
+	tests := []struct {
+		name    string
+		tlv     tlv8
+		encoded string
+	}{
+		{
+			name:    "state",
+			tlv:     tlv8{{typ: tlvState, value: []byte{1}}},
+			encoded: "060101",
+		},
+		{
+			// The example in the HAP specification.
+			name:    "state and identifier",
+			tlv:     tlv8{{typ: tlvState, value: []byte{3}}, {typ: tlvIdentifier, value: []byte("hello")}},
+			encoded: "060103" + "010568656c6c6f",
+		},
+		{
+			name:    "empty",
+			tlv:     tlv8{{typ: tlvState, value: []byte{2}}, {typ: tlvSeparator, value: []byte{}}, {typ: tlvState, value: []byte{4}}},
+			encoded: "060102" + "ff00" + "060104",
+		},
+		{
+			name:    "fragmented",
+			tlv:     tlv8{{typ: tlvPublicKey, value: long}, {typ: tlvState, value: []byte{2}}},
+			encoded: "03ff" + hex.EncodeToString(long[:255]) + "032d" + hex.EncodeToString(long[255:]) + "060102",
+		},
+		{
+			name:    "exactly one fragment",
+			tlv:     tlv8{{typ: tlvPublicKey, value: full}, {typ: tlvState, value: []byte{2}}},
+			encoded: "03ff" + hex.EncodeToString(full) + "060102",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(tt.tlv.encode()); got != tt.encoded {
+				t.Errorf("encode = %s, want %s", got, tt.encoded)
+			}
+			raw, _ := hex.DecodeString(tt.encoded)
+			decoded, err := decodeTLV8(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(tt.tlv) {
+				t.Fatalf("decoded %d items, want %d", len(decoded), len(tt.tlv))
+			}
+			for i, item := range decoded {
+				if item.typ != tt.tlv[i].typ || !bytes.Equal(item.value, tt.tlv[i].value) {
+					t.Errorf("item %d = %#x %x, want %#x %x", i, item.typ, item.value, tt.tlv[i].typ, tt.tlv[i].value)
+				}
+			}
+		})
+	}
+}
+
+func TestTLV8Pairings(t *testing.T) {
+	// A list of pairings repeats types, separated by separators.
+	var list tlv8
+	list.addByte(tlvState, 2)
+	list.add(tlvIdentifier, []byte("A"))
+	list.addByte(tlvPermissions, 1)
+	list.add(tlvSeparator, nil)
+	list.add(tlvIdentifier, []byte("B"))
+	list.addByte(tlvPermissions, 0)
+
+	if got, want := hex.EncodeToString(list.encode()), "060102"+"010141"+"0b0101"+"ff00"+"010142"+"0b0100"; got != want {
+		t.Errorf("encode = %s, want %s", got, want)
+	}
+	decoded, err := decodeTLV8(list.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, item := range decoded {
+		if item.typ == tlvIdentifier {
+			ids = append(ids, string(item.value))
+		}
+	}
+	if len(ids) != 2 || ids[0] != "A" || ids[1] != "B" {
+		t.Errorf("identifiers = %q", ids)
+	}
+	if permissions, ok := decoded.getByte(tlvPermissions); !ok || permissions != 1 {
+		t.Errorf("first permissions = %d, %v", permissions, ok)
+	}
+}
+
+func TestTLV8Truncated(t *testing.T) {
+	for _, encoded := range []string{"06", "0602", "060201", "03ff00"} {
+		raw, _ := hex.DecodeString(encoded)
+		if _, err := decodeTLV8(raw); err == nil {
+			t.Errorf("decoded truncated %s", encoded)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Event types that hooks can subscribe to.
+const (
+	ChangeEvent       = "change"
+	AlarmEvent        = "alarm"
+	ConnectivityEvent = "connectivity"
+)
+
+var eventTypes = []string{ChangeEvent, AlarmEvent, ConnectivityEvent}
+
+const (
+	queueSize      = 32
+	defaultTimeout = 10 * time.Second
+	maxOutput      = 4096
+)
+
+// Config is a single hook: a command run with an event as JSON on stdin.
+// Keys are category.key patterns, e.g. operating_data.* or boiler.temp,
+// which restrict change events. Interval is the minimum time between runs;
+// events arriving faster than that are queued, and dropped once the queue
+// is full.
+type Config struct {
+	Command  []string          `yaml:"command"`
+	Env      map[string]string `yaml:"env"`
+	Events   []string          `yaml:"events"`
+	Keys     []string          `yaml:"keys"`
+	Interval time.Duration     `yaml:"interval"`
+	Timeout  time.Duration     `yaml:"timeout"`
+}
+
+func (c *Config) Validate() error {
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return fmt.Errorf("no command configured")
+	}
+	if len(c.Events) == 0 {
+		return fmt.Errorf("no events configured")
+	}
+	for _, e := range c.Events {
+		if !contains(eventTypes, e) {
+			return fmt.Errorf("unknown event %q, expected one of %s", e, strings.Join(eventTypes, ", "))
+		}
+	}
+	for _, k := range c.Keys {
+		if _, err := path.Match(k, ""); err != nil {
+			return fmt.Errorf("invalid key pattern %q", k)
+		}
+	}
+	if c.Interval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("interval and timeout can't be negative")
+	}
+	return nil
+}
+
+// Event is written to a hook's stdin as a single line of JSON. Which fields
+// are set depends on the type.
+type Event struct {
+	Type      string      `json:"type"`
+	Serial    string      `json:"serial"`
+	Timestamp time.Time   `json:"timestamp"`
+	Category  string      `json:"category,omitempty"`
+	Key       string      `json:"key,omitempty"`
+	Value     interface{} `json:"value,omitempty"`
+	Previous  interface{} `json:"previous,omitempty"`
+	State     int64       `json:"state,omitempty"`
+	Active    *bool       `json:"active,omitempty"`
+	Component string      `json:"component,omitempty"`
+	Connected *bool       `json:"connected,omitempty"`
+	Text      string      `json:"text,omitempty"`
+}
+
+type hook struct {
+	Config
+	queue chan Event
+}
+
+func (h *hook) matches(event Event) bool {
+	if !contains(h.Events, event.Type) {
+		return false
+	}
+	if event.Type != ChangeEvent || len(h.Keys) == 0 {
+		return true
+	}
+	name := fmt.Sprintf("%s.%s", event.Category, event.Key)
+	for _, pattern := range h.Keys {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// run starts the hook's command for each queued event, one at a time and
+// no more often than the hook's interval.
+func (h *hook) run() {
+	var last time.Time
+	for event := range h.queue {
+		if wait := h.Interval - time.Since(last); wait > 0 {
+			time.Sleep(wait)
+		}
+		last = time.Now()
+		if err := h.exec(event); err != nil {
+			log.Errorf("Hook %s failed for %s event: %v", h.Command[0], event.Type, err)
+			continue
+		}
+		log.Debugf("Hook %s ran for %s event", h.Command[0], event.Type)
+	}
+}
+
+func (h *hook) exec(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(append(payload, '\n'))
+	cmd.Env = append(os.Environ(), "BOILER_MATE_EVENT="+event.Type)
+	for k, v := range h.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &limitedWriter{w: &output, n: maxOutput}
+	cmd.Stderr = cmd.Stdout
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		if out := strings.TrimSpace(output.String()); out != "" {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
+
+// limitedWriter keeps the first n bytes written to it, and discards the
+// rest, so that a chatty hook can't fill memory.
+type limitedWriter struct {
+	w *bytes.Buffer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if room := l.n - l.w.Len(); room > 0 {
+		if len(p) > room {
+			l.w.Write(p[:room])
+		} else {
+			l.w.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
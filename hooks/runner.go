@@ -0,0 +1,99 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hooks
+
+import (
+	"fmt"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Runner runs external commands when values change, alarms are raised or
+// cleared, or connections are lost or restored, so that boiler-mate can be
+// extended without changing its code.
+type Runner struct {
+	Serial string
+
+	hooks []*hook
+}
+
+func NewRunner(configs []Config, serial string) *Runner {
+	r := &Runner{Serial: serial}
+	for _, c := range configs {
+		r.hooks = append(r.hooks, &hook{Config: c, queue: make(chan Event, queueSize)})
+	}
+	return r
+}
+
+func (r *Runner) Start(events *bus.Bus) {
+	for _, h := range r.hooks {
+		go h.run()
+	}
+
+	events.OnChange(func(change bus.Change) {
+		r.dispatch(Event{
+			Type:      ChangeEvent,
+			Serial:    r.Serial,
+			Timestamp: change.Timestamp,
+			Category:  change.Category,
+			Key:       change.Key,
+			Value:     change.Value,
+			Previous:  change.Previous,
+		})
+	})
+	events.OnAlarm(func(alarm bus.Alarm) {
+		active := alarm.Active
+		r.dispatch(Event{
+			Type:      AlarmEvent,
+			Serial:    r.Serial,
+			Timestamp: alarm.Timestamp,
+			State:     alarm.State,
+			Active:    &active,
+			Text:      alarm.Text,
+		})
+	})
+	events.OnConnectivity(func(c bus.Connectivity) {
+		connected := c.Connected
+		text := fmt.Sprintf("Connection to %s restored", c.Component)
+		if !connected {
+			text = fmt.Sprintf("Connection to %s lost: %s", c.Component, c.Error)
+		}
+		r.dispatch(Event{
+			Type:      ConnectivityEvent,
+			Serial:    r.Serial,
+			Timestamp: c.Timestamp,
+			Component: c.Component,
+			Connected: &connected,
+			Text:      text,
+		})
+	})
+}
+
+func (r *Runner) dispatch(event Event) {
+	for _, h := range r.hooks {
+		if !h.matches(event) {
+			continue
+		}
+		select {
+		case h.queue <- event:
+		default:
+			log.Warnf("Hook %s is falling behind, dropping %s event", h.Command[0], event.Type)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/consumption"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// hopperRateDays is how many of the last complete days the rate the hopper
+// empties at is averaged over.
+const hopperRateDays = 3
+
+// publishHopperEmpty publishes the time the hopper will run empty, at the
+// rate pellets have been used recently, as hopper.empty_at whenever the
+// hopper content or the consumption data changes. Nothing is published
+// while too little has been burnt recently for the hopper to run empty
+// within a year.
+func publishHopperEmpty(events *bus.Bus, hopper *monitor.Monitor, consumptionData *monitor.Monitor) {
+	var mutex sync.Mutex
+	var last string
+
+	events.OnChange(func(change bus.Change) {
+		if change.Category != consumptionData.Category && (change.Category != hopper.Category || change.Key != "content") {
+			return
+		}
+		value, _ := hopper.Get("content")
+		var kg float64
+		switch v := value.(type) {
+		case nbe.RoundedFloat:
+			kg = float64(v)
+		case int64:
+			kg = float64(v)
+		default:
+			return
+		}
+		now := time.Now()
+		rate := consumption.Rate(consumption.Buckets(consumptionData.Values(), now), now, hopperRateDays)
+		if rate <= 0 || kg/rate > 365 {
+			return
+		}
+		emptyAt := now.Add(time.Duration(kg / rate * float64(24*time.Hour))).Truncate(10 * time.Minute).Format(time.RFC3339)
+
+		mutex.Lock()
+		previous := last
+		last = emptyAt
+		mutex.Unlock()
+		if emptyAt == previous {
+			return
+		}
+		update := bus.Change{Category: hopper.Category, Key: "empty_at", Value: emptyAt, Timestamp: now}
+		if previous != "" {
+			update.Previous = previous
+		}
+		events.Publish(bus.ChangeTopic, update)
+	})
+}
@@ -0,0 +1,231 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package ignition tracks how often the burner fails to ignite, which
+// creeps up as the ignition element wears or the pellets get worse.
+package ignition
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// Category the attempts, failures, failure rate and alert are published in.
+const Category = "ignitions"
+
+const (
+	DefaultWindow      = 7 * 24 * time.Hour
+	DefaultThreshold   = 20
+	DefaultMinAttempts = 5
+
+	stateKey       = "ignitions"
+	reviewInterval = time.Hour
+
+	// failedState is the power state raised when the burner fails to
+	// ignite.
+	failedState = 13
+)
+
+// Config raises the alert when more than Threshold % of the ignition
+// attempts within Window failed, once there have been at least MinAttempts
+// of them.
+type Config struct {
+	Window      time.Duration `yaml:"window"`
+	Threshold   float64       `yaml:"threshold"`
+	MinAttempts int           `yaml:"min_attempts"`
+}
+
+func (c *Config) Validate() error {
+	if c.Window < 0 {
+		return fmt.Errorf("window can't be negative")
+	}
+	if c.Threshold < 0 || c.Threshold > 100 {
+		return fmt.Errorf("threshold must be a percentage from 0 to 100")
+	}
+	if c.MinAttempts < 0 {
+		return fmt.Errorf("min_attempts can't be negative")
+	}
+	return nil
+}
+
+// Attempt is the outcome of an ignition.
+type Attempt struct {
+	Time   time.Time `json:"time"`
+	Failed bool      `json:"failed"`
+}
+
+// Tracker follows the power state through each ignition: an attempt
+// succeeds when the burner goes on to run, and fails when the controller
+// raises the ignition failure alarm. Ignitions that end any other way, such
+// as the boiler being switched off, aren't counted. Attempts are kept in the
+// state store so that the rate survives restarts.
+type Tracker struct {
+	Config
+
+	events *bus.Bus
+	store  *state.Store
+
+	mutex     sync.Mutex
+	attempts  []Attempt
+	igniting  bool
+	published bus.Published
+}
+
+func NewTracker(config Config, events *bus.Bus, store *state.Store) *Tracker {
+	if config.Window == 0 {
+		config.Window = DefaultWindow
+	}
+	if config.Threshold == 0 {
+		config.Threshold = DefaultThreshold
+	}
+	if config.MinAttempts == 0 {
+		config.MinAttempts = DefaultMinAttempts
+	}
+	t := &Tracker{
+		Config:    config,
+		events:    events,
+		store:     store,
+		published: make(bus.Published),
+	}
+	store.Get(stateKey, &t.attempts)
+	return t
+}
+
+func (t *Tracker) Start() {
+	t.events.OnChange(t.handle)
+
+	// Attempts age out of the window between ignitions too.
+	go func() {
+		t.publish()
+		ticker := time.NewTicker(reviewInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			t.publish()
+		}
+	}()
+}
+
+func (t *Tracker) handle(change bus.Change) {
+	if change.Category != "operating_data" || change.Key != "state" {
+		return
+	}
+	s, ok := change.Value.(int64)
+	if !ok {
+		return
+	}
+
+	t.mutex.Lock()
+	var outcome *Attempt
+	switch {
+	case nbe.Phase(s, 0) == nbe.PhaseIgnition:
+		t.igniting = true
+	case s == 0:
+		// The controller waits a moment between some steps.
+	case !t.igniting:
+	case nbe.Phase(s, 0) == nbe.PhaseRunning:
+		outcome = &Attempt{Time: change.Timestamp}
+	case s == failedState:
+		outcome = &Attempt{Time: change.Timestamp, Failed: true}
+	default:
+		t.igniting = false
+	}
+	if outcome != nil {
+		t.igniting = false
+		t.attempts = append(t.attempts, *outcome)
+	}
+	t.mutex.Unlock()
+
+	if outcome == nil {
+		return
+	}
+	if outcome.Failed {
+		log.Warnf("Ignition failed")
+	} else {
+		log.Debugf("Ignition succeeded")
+	}
+	t.save()
+	t.publish()
+}
+
+// publish publishes the attempts and failures within the window, the
+// failure rate in % and the alert, ON or OFF, where they have changed. The
+// failure rate isn't published until there has been an attempt.
+func (t *Tracker) publish() {
+	now := time.Now()
+	t.mutex.Lock()
+	t.prune(now)
+	var failures int64
+	for _, a := range t.attempts {
+		if a.Failed {
+			failures++
+		}
+	}
+	attempts := int64(len(t.attempts))
+	values := map[string]interface{}{
+		"attempts": attempts,
+		"failures": failures,
+	}
+	alert := "OFF"
+	if attempts > 0 {
+		rate := float64(failures) / float64(attempts) * 100
+		values["failure_rate"] = nbe.RoundedFloat(math.Round(rate*10) / 10)
+		if attempts >= int64(t.MinAttempts) && rate > t.Threshold {
+			alert = "ON"
+		}
+	}
+	values["alert"] = alert
+
+	changes := t.published.Changes(Category, values, now)
+	t.mutex.Unlock()
+
+	for _, change := range changes {
+		if change.Key == "alert" {
+			if change.Value == "ON" {
+				log.Warnf("%d of %d recent ignitions failed, more than %v%%. Check the ignition element and the pellets.", failures, attempts, t.Threshold)
+			} else if change.Previous != nil {
+				log.Infof("The ignition failure rate is back below %v%%", t.Threshold)
+			}
+		}
+		t.events.Publish(bus.ChangeTopic, change)
+	}
+}
+
+// prune forgets attempts that are older than the window.
+func (t *Tracker) prune(now time.Time) {
+	oldest := now.Add(-t.Window)
+	i := 0
+	for i < len(t.attempts) && t.attempts[i].Time.Before(oldest) {
+		i++
+	}
+	t.attempts = t.attempts[i:]
+}
+
+func (t *Tracker) save() {
+	t.mutex.Lock()
+	attempts := append([]Attempt(nil), t.attempts...)
+	t.mutex.Unlock()
+	if err := t.store.Set(stateKey, attempts); err != nil {
+		log.Errorf("Failed to save ignition attempts: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package incident
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// ignitionFailure is the power state raised when the burner fails to ignite.
+const ignitionFailure = 13
+
+// DefaultAlarms are the alarms that open an incident if none are configured:
+// the burner overheating, and overheating or the external auger being
+// disconnected.
+var DefaultAlarms = []int64{11, 29}
+
+const (
+	defaultWindow   = 24 * time.Hour
+	defaultSeverity = "critical"
+	defaultPriority = "P1"
+)
+
+var severities = []string{"critical", "error", "warning", "info"}
+
+// Config opens incidents in PagerDuty, Opsgenie or both. Alarms are the
+// power states that open an incident as soon as they are raised, and
+// DefaultAlarms if not set. With IgnitionFailures set, the burner failing to
+// ignite opens an incident when it happens that many times within Window.
+// Incidents are resolved when the alarm clears.
+type Config struct {
+	PagerDuty        *PagerDutyConfig `yaml:"pagerduty"`
+	Opsgenie         *OpsgenieConfig  `yaml:"opsgenie"`
+	Alarms           []int64          `yaml:"alarms"`
+	IgnitionFailures int              `yaml:"ignition_failures"`
+	Window           time.Duration    `yaml:"window"`
+}
+
+// PagerDutyConfig sends events to a service through the Events API v2.
+// RoutingKey is the service's integration key.
+type PagerDutyConfig struct {
+	RoutingKey string `yaml:"routing_key"`
+	Severity   string `yaml:"severity"`
+	API        string `yaml:"api"`
+}
+
+// OpsgenieConfig creates and closes alerts through the Alert API. API is
+// https://api.eu.opsgenie.com for accounts in the EU.
+type OpsgenieConfig struct {
+	APIKey   string   `yaml:"api_key"`
+	Priority string   `yaml:"priority"`
+	Tags     []string `yaml:"tags"`
+	API      string   `yaml:"api"`
+}
+
+func (c *Config) Validate() error {
+	if c.PagerDuty == nil && c.Opsgenie == nil {
+		return fmt.Errorf("no pagerduty or opsgenie configured")
+	}
+	if c.PagerDuty != nil {
+		if c.PagerDuty.RoutingKey == "" {
+			return fmt.Errorf("pagerduty needs a routing_key")
+		}
+		if c.PagerDuty.Severity != "" && !contains(severities, c.PagerDuty.Severity) {
+			return fmt.Errorf("pagerduty: unknown severity %q, expected one of critical, error, warning, info", c.PagerDuty.Severity)
+		}
+	}
+	if c.Opsgenie != nil {
+		if c.Opsgenie.APIKey == "" {
+			return fmt.Errorf("opsgenie needs an api_key")
+		}
+		switch c.Opsgenie.Priority {
+		case "", "P1", "P2", "P3", "P4", "P5":
+		default:
+			return fmt.Errorf("opsgenie: unknown priority %q, expected P1 to P5", c.Opsgenie.Priority)
+		}
+	}
+	for _, state := range c.Alarms {
+		if !nbe.AlarmStates[state] {
+			return fmt.Errorf("state %d (%s) is not an alarm", state, nbe.PowerStateText(state))
+		}
+	}
+	if c.IgnitionFailures < 0 {
+		return fmt.Errorf("ignition_failures can't be negative")
+	}
+	if c.Window < 0 {
+		return fmt.Errorf("window can't be negative")
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package incident opens incidents in PagerDuty or Opsgenie for critical
+// alarms and repeated ignition failures, and resolves them when the alarm
+// clears, for installations with someone on call.
+package incident
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	queueSize = 32
+	attempts  = 3
+	retryWait = 10 * time.Second
+)
+
+// Incident is opened or resolved in each service. Key stays the same for
+// the same fault, so that a service can deduplicate it and resolve it.
+type Incident struct {
+	Key         string
+	Name        string
+	Serial      string
+	Timestamp   time.Time
+	State       int64
+	Summary     string
+	Description string
+}
+
+type job struct {
+	incident Incident
+	resolve  bool
+}
+
+// Escalator opens and resolves incidents as alarms are raised and cleared.
+type Escalator struct {
+	Config
+	Serial string
+
+	name     func() string
+	services []service
+	client   *http.Client
+	queue    chan job
+
+	mutex    sync.Mutex
+	failures []time.Time
+	open     bool
+}
+
+// New creates an escalator. name returns the name of the boiler, which may
+// change while running.
+func New(config Config, serial string, name func() string) *Escalator {
+	e := &Escalator{
+		Config: config,
+		Serial: serial,
+		name:   name,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan job, queueSize),
+	}
+	if config.PagerDuty != nil {
+		e.services = append(e.services, &pagerDuty{*config.PagerDuty})
+	}
+	if config.Opsgenie != nil {
+		e.services = append(e.services, &opsgenie{*config.Opsgenie})
+	}
+	if e.Alarms == nil {
+		e.Alarms = DefaultAlarms
+	}
+	if e.Window == 0 {
+		e.Window = defaultWindow
+	}
+	return e
+}
+
+// String names the services incidents are opened in.
+func (e *Escalator) String() string {
+	names := make([]string, len(e.services))
+	for i, s := range e.services {
+		names[i] = s.String()
+	}
+	return strings.Join(names, " and ")
+}
+
+func (e *Escalator) Start(events *bus.Bus) {
+	go e.run()
+	events.OnAlarm(e.handleAlarm)
+}
+
+func (e *Escalator) handleAlarm(alarm bus.Alarm) {
+	incident := Incident{
+		Key:         fmt.Sprintf("boiler-mate-%s-alarm-%d", e.Serial, alarm.State),
+		Name:        e.name(),
+		Serial:      e.Serial,
+		Timestamp:   alarm.Timestamp,
+		State:       alarm.State,
+		Description: alarm.Description,
+	}
+	incident.Summary = fmt.Sprintf("%s: %s", incident.Name, alarm.Text)
+
+	// Alarms are resolved whether or not they were opened since starting,
+	// as they may have been opened before a restart.
+	for _, state := range e.Alarms {
+		if state == alarm.State {
+			e.enqueue(incident, !alarm.Active)
+		}
+	}
+
+	if alarm.State == ignitionFailure && e.IgnitionFailures > 0 {
+		e.handleIgnitionFailure(incident, alarm.Active)
+	}
+}
+
+// handleIgnitionFailure opens an incident once ignition has failed
+// IgnitionFailures times within the window, and resolves it when the last
+// failure clears, after which failures are counted afresh.
+func (e *Escalator) handleIgnitionFailure(incident Incident, active bool) {
+	incident.Key = fmt.Sprintf("boiler-mate-%s-ignition", e.Serial)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !active {
+		if e.open {
+			e.open = false
+			e.failures = nil
+			e.enqueue(incident, true)
+		}
+		return
+	}
+
+	since := incident.Timestamp.Add(-e.Window)
+	recent := e.failures[:0]
+	for _, t := range e.failures {
+		if t.After(since) {
+			recent = append(recent, t)
+		}
+	}
+	e.failures = append(recent, incident.Timestamp)
+	if len(e.failures) < e.IgnitionFailures || e.open {
+		return
+	}
+	e.open = true
+	incident.Summary = fmt.Sprintf("%s: ignition failed %d times in %s", incident.Name, len(e.failures), formatWindow(e.Window))
+	e.enqueue(incident, false)
+}
+
+func (e *Escalator) enqueue(incident Incident, resolve bool) {
+	select {
+	case e.queue <- job{incident: incident, resolve: resolve}:
+	default:
+		log.Warnf("Incident queue is full, dropping %s", incident.Key)
+	}
+}
+
+// run sends jobs in order, so that an incident is never resolved before it
+// is opened, retrying each a few times as it matters that they get through.
+func (e *Escalator) run() {
+	for job := range e.queue {
+		action, done := "open", "Opened"
+		if job.resolve {
+			action, done = "resolve", "Resolved"
+		}
+		for _, s := range e.services {
+			var err error
+			for attempt := 1; attempt <= attempts; attempt++ {
+				if job.resolve {
+					err = s.resolve(e.client, job.incident)
+				} else {
+					err = s.trigger(e.client, job.incident)
+				}
+				if err == nil || attempt == attempts {
+					break
+				}
+				log.Warnf("Failed to %s incident %s in %s, retrying: %v", action, job.incident.Key, s, err)
+				time.Sleep(time.Duration(attempt) * retryWait)
+			}
+			if err != nil {
+				log.Errorf("Failed to %s incident %s in %s: %v", action, job.incident.Key, s, err)
+				continue
+			}
+			log.Infof("%s incident in %s: %s", done, s, job.incident.Summary)
+		}
+	}
+}
+
+// formatWindow formats a duration without trailing zero units, e.g. 24h
+// rather than 24h0m0s.
+func formatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,179 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package incident
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	pagerDutyAPI = "https://events.pagerduty.com/v2/enqueue"
+	opsgenieAPI  = "https://api.opsgenie.com"
+
+	// opsgenieMessageLength is the most Opsgenie keeps of a message.
+	opsgenieMessageLength = 130
+)
+
+// service opens and resolves incidents.
+type service interface {
+	String() string
+	trigger(client *http.Client, incident Incident) error
+	resolve(client *http.Client, incident Incident) error
+}
+
+type pagerDuty struct {
+	PagerDutyConfig
+}
+
+func (p *pagerDuty) String() string {
+	return "PagerDuty"
+}
+
+func (p *pagerDuty) trigger(client *http.Client, incident Incident) error {
+	severity := p.Severity
+	if severity == "" {
+		severity = defaultSeverity
+	}
+	return p.send(client, map[string]interface{}{
+		"routing_key":  p.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    incident.Key,
+		"payload": map[string]interface{}{
+			"summary":   incident.Summary,
+			"source":    incident.Name,
+			"severity":  severity,
+			"timestamp": incident.Timestamp,
+			"component": "burner",
+			"class":     "alarm",
+			"custom_details": map[string]interface{}{
+				"serial":      incident.Serial,
+				"state":       incident.State,
+				"description": incident.Description,
+			},
+		},
+	})
+}
+
+func (p *pagerDuty) resolve(client *http.Client, incident Incident) error {
+	return p.send(client, map[string]interface{}{
+		"routing_key":  p.RoutingKey,
+		"event_action": "resolve",
+		"dedup_key":    incident.Key,
+	})
+}
+
+func (p *pagerDuty) send(client *http.Client, event map[string]interface{}) error {
+	api := p.API
+	if api == "" {
+		api = pagerDutyAPI
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(api, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+type opsgenie struct {
+	OpsgenieConfig
+}
+
+func (o *opsgenie) String() string {
+	return "Opsgenie"
+}
+
+func (o *opsgenie) trigger(client *http.Client, incident Incident) error {
+	priority := o.Priority
+	if priority == "" {
+		priority = defaultPriority
+	}
+	message := incident.Summary
+	if r := []rune(message); len(r) > opsgenieMessageLength {
+		message = string(r[:opsgenieMessageLength])
+	}
+	return o.send(client, "/v2/alerts", map[string]interface{}{
+		"message":     message,
+		"alias":       incident.Key,
+		"description": incident.Description,
+		"priority":    priority,
+		"entity":      incident.Name,
+		"source":      "boiler-mate",
+		"tags":        o.Tags,
+		"details": map[string]string{
+			"serial": incident.Serial,
+			"state":  fmt.Sprint(incident.State),
+		},
+	})
+}
+
+func (o *opsgenie) resolve(client *http.Client, incident Incident) error {
+	return o.send(client, fmt.Sprintf("/v2/alerts/%s/close?identifierType=alias", url.PathEscape(incident.Key)), map[string]interface{}{
+		"source": "boiler-mate",
+		"note":   "The alarm cleared.",
+	})
+}
+
+func (o *opsgenie) send(client *http.Client, path string, request map[string]interface{}) error {
+	api := o.API
+	if api == "" {
+		api = opsgenieAPI
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(api, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "GenieKey "+o.APIKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// checkResponse returns the status and any message of a failed request.
+// Both APIs accept events with 202 Accepted.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return nil
+	}
+	var result struct {
+		Message string `json:"message"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&result) == nil && result.Message != "" {
+		return fmt.Errorf("%s: %s", resp.Status, result.Message)
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
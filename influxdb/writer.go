@@ -0,0 +1,154 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package influxdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const measurement = "boiler_mate"
+
+// Writer periodically writes every numeric value held by the monitors to an
+// InfluxDB v2 bucket using the line protocol, one line per category.
+type Writer struct {
+	URI      *url.URL
+	Org      string
+	Bucket   string
+	Serial   string
+	Interval time.Duration
+
+	token  string
+	client *http.Client
+}
+
+// NewWriter creates a writer from a URI in the format
+// http[s]://<token>@<host>:<port>/<org>/<bucket>.
+func NewWriter(uri *url.URL, serial string, interval time.Duration) (*Writer, error) {
+	parts := strings.Split(strings.Trim(uri.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("InfluxDB URI must include /<org>/<bucket>")
+	}
+
+	return &Writer{
+		URI:      uri,
+		Org:      parts[0],
+		Bucket:   parts[1],
+		Serial:   serial,
+		Interval: interval,
+		token:    uri.User.Username(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (w *Writer) Start(monitors map[string]*monitor.Monitor) {
+	go func() {
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			batch := w.batch(monitors, time.Now())
+			if batch.Len() == 0 {
+				continue
+			}
+			if err := w.write(batch); err != nil {
+				log.Errorf("Failed to write to InfluxDB: %v", err)
+			}
+		}
+	}()
+}
+
+func (w *Writer) batch(monitors map[string]*monitor.Monitor, ts time.Time) *bytes.Buffer {
+	batch := new(bytes.Buffer)
+	for category, m := range monitors {
+		values := m.Values()
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var fields []string
+		for _, k := range keys {
+			// Always write floats: the controller omits the decimal point on
+			// whole numbers, which would otherwise cause field type conflicts.
+			switch v := values[k].(type) {
+			case nbe.RoundedFloat:
+				fields = append(fields, fmt.Sprintf("%s=%s", escape(k), strconv.FormatFloat(float64(v), 'f', -1, 64)))
+			case int64:
+				fields = append(fields, fmt.Sprintf("%s=%d.0", escape(k), v))
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(batch, "%s,serial=%s,category=%s %s %d\n", measurement, escape(w.Serial), escape(category), strings.Join(fields, ","), ts.Unix())
+	}
+	return batch
+}
+
+func (w *Writer) write(batch *bytes.Buffer) error {
+	endpoint := url.URL{
+		Scheme: w.URI.Scheme,
+		Host:   w.URI.Host,
+		Path:   "/api/v2/write",
+		RawQuery: url.Values{
+			"org":       {w.Org},
+			"bucket":    {w.Bucket},
+			"precision": {"s"},
+		}.Encode(),
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint.String(), batch)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Token %s", w.token))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+var escaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
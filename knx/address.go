@@ -0,0 +1,82 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package knx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseGroupAddress parses a group address in three level (main/middle/sub)
+// or two level (main/sub) notation.
+func ParseGroupAddress(text string) (uint16, error) {
+	parts := strings.Split(text, "/")
+	var limits []uint64
+	switch len(parts) {
+	case 3:
+		limits = []uint64{31, 7, 255}
+	case 2:
+		limits = []uint64{31, 2047}
+	default:
+		return 0, fmt.Errorf("invalid group address %q, expected main/middle/sub", text)
+	}
+	var address uint16
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 16)
+		if err != nil || n > limits[i] {
+			return 0, fmt.Errorf("invalid group address %q, expected main/middle/sub", text)
+		}
+		address = address<<bits(limits[i]) | uint16(n)
+	}
+	return address, nil
+}
+
+// ParseIndividualAddress parses an individual address, area.line.device.
+func ParseIndividualAddress(text string) (uint16, error) {
+	parts := strings.Split(text, ".")
+	limits := []uint64{15, 15, 255}
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid individual address %q, expected area.line.device", text)
+	}
+	var address uint16
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil || n > limits[i] {
+			return 0, fmt.Errorf("invalid individual address %q, expected area.line.device", text)
+		}
+		address = address<<bits(limits[i]) | uint16(n)
+	}
+	return address, nil
+}
+
+func bits(limit uint64) int {
+	n := 0
+	for ; limit > 0; limit >>= 1 {
+		n++
+	}
+	return n
+}
+
+func formatGroupAddress(address uint16) string {
+	return fmt.Sprintf("%d/%d/%d", address>>11, address>>8&0x07, address&0xff)
+}
+
+func formatIndividualAddress(address uint16) string {
+	return fmt.Sprintf("%d.%d.%d", address>>12, address>>8&0x0f, address&0xff)
+}
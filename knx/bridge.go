@@ -0,0 +1,313 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package knx bridges values to group addresses on a KNX installation, over
+// a KNXnet/IP tunnelling interface or router, so that KNX visualisations
+// and logic can use the boiler without a separate gateway.
+package knx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultAddress is the individual address telegrams are sent from
+	// when routing.
+	DefaultAddress = "15.15.250"
+
+	queueSize = 256
+)
+
+// Mapping sends a value to a group address as it changes, and answers
+// reads of it. If WriteGA is set, writes to it set the value on the
+// controller, e.g. boiler.temp.
+type Mapping struct {
+	Key     string `yaml:"key"`
+	GA      string `yaml:"ga"`
+	WriteGA string `yaml:"write_ga"`
+	DPT     string `yaml:"dpt"`
+}
+
+// Config connects to a tunnelling interface at Gateway, <host>[:<port>], or
+// joins the routing multicast group if Gateway is empty or a multicast
+// address. Address is the individual address used when routing; tunnelling
+// interfaces assign one.
+type Config struct {
+	Gateway  string    `yaml:"gateway"`
+	Address  string    `yaml:"address"`
+	Mappings []Mapping `yaml:"mappings"`
+}
+
+func (c *Config) Validate() error {
+	if _, err := c.gateway(); err != nil {
+		return err
+	}
+	if c.Address != "" {
+		if _, err := ParseIndividualAddress(c.Address); err != nil {
+			return err
+		}
+	}
+	if len(c.Mappings) == 0 {
+		return fmt.Errorf("no mappings configured")
+	}
+	writes := make(map[string]string)
+	for _, m := range c.Mappings {
+		if strings.Count(m.Key, ".") != 1 {
+			return fmt.Errorf("invalid key %q, expected category.key", m.Key)
+		}
+		if m.GA == "" && m.WriteGA == "" {
+			return fmt.Errorf("%s: needs a ga or write_ga", m.Key)
+		}
+		if m.GA != "" {
+			if _, err := ParseGroupAddress(m.GA); err != nil {
+				return fmt.Errorf("%s: %v", m.Key, err)
+			}
+		}
+		if m.WriteGA != "" {
+			if _, err := ParseGroupAddress(m.WriteGA); err != nil {
+				return fmt.Errorf("%s: %v", m.Key, err)
+			}
+			if other, ok := writes[m.WriteGA]; ok {
+				return fmt.Errorf("%s and %s both have write_ga %s", other, m.Key, m.WriteGA)
+			}
+			writes[m.WriteGA] = m.Key
+		}
+		if _, err := parseDatapoint(m.DPT); err != nil {
+			return fmt.Errorf("%s: %v", m.Key, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) gateway() (*net.UDPAddr, error) {
+	gateway := c.Gateway
+	if gateway == "" {
+		gateway = RoutingAddress
+	}
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, strconv.Itoa(Port))
+	}
+	addr, err := net.ResolveUDPAddr("udp4", gateway)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway %q: %v", c.Gateway, err)
+	}
+	return addr, nil
+}
+
+// conn exchanges group telegrams with the installation.
+type conn interface {
+	send(t telegram) error
+	close()
+}
+
+type mapping struct {
+	Mapping
+	ga        uint16
+	writeGA   uint16
+	datapoint datapoint
+	warned    bool
+}
+
+// Bridge sends values to their group addresses as they change, answers
+// GroupValueReads with the latest value, and writes GroupValueWrites to
+// write addresses to the controller.
+type Bridge struct {
+	Config
+
+	writer   *control.Writer
+	conn     conn
+	keys     map[string][]*mapping
+	statuses map[uint16][]*mapping
+	writes   map[uint16]*mapping
+	queue    chan telegram
+
+	values map[string]interface{}
+	mutex  sync.Mutex
+}
+
+func New(config Config, writer *control.Writer) *Bridge {
+	if config.Address == "" {
+		config.Address = DefaultAddress
+	}
+	b := &Bridge{
+		Config:   config,
+		writer:   writer,
+		keys:     make(map[string][]*mapping),
+		statuses: make(map[uint16][]*mapping),
+		writes:   make(map[uint16]*mapping),
+		queue:    make(chan telegram, queueSize),
+		values:   make(map[string]interface{}),
+	}
+	for _, c := range config.Mappings {
+		// Already validated.
+		m := &mapping{Mapping: c}
+		m.datapoint, _ = parseDatapoint(c.DPT)
+		if c.GA != "" {
+			m.ga, _ = ParseGroupAddress(c.GA)
+			b.keys[c.Key] = append(b.keys[c.Key], m)
+			b.statuses[m.ga] = append(b.statuses[m.ga], m)
+		}
+		if c.WriteGA != "" {
+			m.writeGA, _ = ParseGroupAddress(c.WriteGA)
+			b.writes[m.writeGA] = m
+		}
+	}
+	return b
+}
+
+// Start connects to the installation and sends changes to it.
+func (b *Bridge) Start(events *bus.Bus) error {
+	gateway, err := b.gateway()
+	if err != nil {
+		return err
+	}
+	if gateway.IP.IsMulticast() {
+		address, _ := ParseIndividualAddress(b.Address)
+		b.conn, err = newRouter(gateway, address, b.handle)
+		if err != nil {
+			return err
+		}
+	} else {
+		b.conn = newTunnel(gateway, b.handle, func(connected bool, err error) {
+			c := bus.Connectivity{Timestamp: time.Now(), Component: "knx", Connected: connected}
+			if err != nil {
+				c.Error = err.Error()
+			}
+			events.Publish(bus.ConnectivityTopic, c)
+			// Catch up on what changed while disconnected.
+			if connected {
+				b.sendAll()
+			}
+		})
+	}
+
+	events.OnChange(func(change bus.Change) {
+		key := fmt.Sprintf("%s.%s", change.Category, change.Key)
+		mappings, ok := b.keys[key]
+		if !ok {
+			return
+		}
+		b.mutex.Lock()
+		b.values[key] = change.Value
+		b.mutex.Unlock()
+		for _, m := range mappings {
+			b.enqueue(m, groupValueWrite, change.Value)
+		}
+	})
+
+	go func() {
+		for tg := range b.queue {
+			err := b.conn.send(tg)
+			if errors.Is(err, errNotConnected) {
+				log.Debugf("Not sending KNX %s: %v", tg, err)
+			} else if err != nil {
+				log.Errorf("Failed to send KNX %s: %v", tg, err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *Bridge) enqueue(m *mapping, service uint16, value interface{}) {
+	data, err := m.datapoint.encodeValue(value)
+	if err != nil {
+		b.mutex.Lock()
+		warned := m.warned
+		m.warned = true
+		b.mutex.Unlock()
+		if !warned {
+			log.Warnf("Not sending %s to KNX %s as DPT %s: %v", m.Key, m.GA, m.DPT, err)
+		}
+		return
+	}
+	tg := telegram{destination: m.ga, service: service, data: data, small: m.datapoint.small}
+	select {
+	case b.queue <- tg:
+	default:
+		log.Warnf("KNX queue is full, dropping %s", tg)
+	}
+}
+
+func (b *Bridge) sendAll() {
+	b.mutex.Lock()
+	values := make(map[string]interface{}, len(b.values))
+	for k, v := range b.values {
+		values[k] = v
+	}
+	b.mutex.Unlock()
+	for key, value := range values {
+		for _, m := range b.keys[key] {
+			b.enqueue(m, groupValueWrite, value)
+		}
+	}
+}
+
+// handle is called with every group telegram seen on the installation.
+func (b *Bridge) handle(tg telegram) {
+	switch tg.service {
+	case groupValueRead:
+		for _, m := range b.statuses[tg.destination] {
+			b.mutex.Lock()
+			value, ok := b.values[m.Key]
+			b.mutex.Unlock()
+			if ok {
+				b.enqueue(m, groupValueResponse, value)
+			}
+		}
+	case groupValueWrite:
+		m, ok := b.writes[tg.destination]
+		if !ok {
+			return
+		}
+		data := tg.data
+		if !m.datapoint.small && tg.small {
+			data = nil
+		}
+		value, err := m.datapoint.decodeValue(data)
+		if err != nil {
+			log.Warnf("Ignoring KNX %s for %s: %v", tg, m.Key, err)
+			return
+		}
+		log.Infof("KNX %s: setting %s to %s", tg, m.Key, value)
+		err = b.writer.SetAsync("knx", m.Key, []byte(value), func(response *nbe.NBEResponse) {
+			if response.Status != 0 {
+				log.Errorf("KNX failed to set %s to %s: %v", m.Key, value, response.Payload)
+			}
+		})
+		if err != nil {
+			log.Errorf("KNX failed to set %s to %s: %v", m.Key, value, err)
+		}
+	}
+}
+
+// Close disconnects from the installation.
+func (b *Bridge) Close() {
+	if b.conn != nil {
+		b.conn.close()
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package knx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// datapoint encodes values to, and decodes them from, the data of a
+// datapoint type. Decoded values are formatted to be written to the
+// controller.
+type datapoint struct {
+	// small datapoints fit in the 6 bits left in the APCI.
+	small  bool
+	size   int
+	encode func(v float64) ([]byte, error)
+	decode func(data []byte) string
+}
+
+// DPTs are identified by their main number, e.g. 9 for 9.001, and only
+// 5.001 scales its value.
+var datapoints = map[string]datapoint{
+	"1": {small: true, size: 1,
+		encode: func(v float64) ([]byte, error) {
+			if v != 0 {
+				return []byte{1}, nil
+			}
+			return []byte{0}, nil
+		},
+		decode: func(data []byte) string { return strconv.Itoa(int(data[0] & 0x01)) },
+	},
+	"5.001": {size: 1,
+		encode: func(v float64) ([]byte, error) {
+			if v < 0 || v > 100 {
+				return nil, fmt.Errorf("%v is out of range for DPT 5.001", v)
+			}
+			return []byte{byte(math.Round(v * 255 / 100))}, nil
+		},
+		decode: func(data []byte) string {
+			return strconv.FormatFloat(math.Round(float64(data[0])*100/255), 'f', -1, 64)
+		},
+	},
+	"5": {size: 1,
+		encode: func(v float64) ([]byte, error) {
+			if v < 0 || v > math.MaxUint8 {
+				return nil, fmt.Errorf("%v is out of range for DPT 5", v)
+			}
+			return []byte{byte(math.Round(v))}, nil
+		},
+		decode: func(data []byte) string { return strconv.Itoa(int(data[0])) },
+	},
+	"6": {size: 1,
+		encode: func(v float64) ([]byte, error) {
+			if v < math.MinInt8 || v > math.MaxInt8 {
+				return nil, fmt.Errorf("%v is out of range for DPT 6", v)
+			}
+			return []byte{byte(int8(math.Round(v)))}, nil
+		},
+		decode: func(data []byte) string { return strconv.Itoa(int(int8(data[0]))) },
+	},
+	"7": {size: 2,
+		encode: func(v float64) ([]byte, error) {
+			if v < 0 || v > math.MaxUint16 {
+				return nil, fmt.Errorf("%v is out of range for DPT 7", v)
+			}
+			return binary.BigEndian.AppendUint16(nil, uint16(math.Round(v))), nil
+		},
+		decode: func(data []byte) string { return strconv.Itoa(int(binary.BigEndian.Uint16(data))) },
+	},
+	"8": {size: 2,
+		encode: func(v float64) ([]byte, error) {
+			if v < math.MinInt16 || v > math.MaxInt16 {
+				return nil, fmt.Errorf("%v is out of range for DPT 8", v)
+			}
+			return binary.BigEndian.AppendUint16(nil, uint16(int16(math.Round(v)))), nil
+		},
+		decode: func(data []byte) string { return strconv.Itoa(int(int16(binary.BigEndian.Uint16(data)))) },
+	},
+	"9": {size: 2, encode: encodeFloat16, decode: decodeFloat16},
+	"12": {size: 4,
+		encode: func(v float64) ([]byte, error) {
+			if v < 0 || v > math.MaxUint32 {
+				return nil, fmt.Errorf("%v is out of range for DPT 12", v)
+			}
+			return binary.BigEndian.AppendUint32(nil, uint32(math.Round(v))), nil
+		},
+		decode: func(data []byte) string { return strconv.FormatUint(uint64(binary.BigEndian.Uint32(data)), 10) },
+	},
+	"13": {size: 4,
+		encode: func(v float64) ([]byte, error) {
+			if v < math.MinInt32 || v > math.MaxInt32 {
+				return nil, fmt.Errorf("%v is out of range for DPT 13", v)
+			}
+			return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(v)))), nil
+		},
+		decode: func(data []byte) string {
+			return strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(data))), 10)
+		},
+	},
+	"14": {size: 4,
+		encode: func(v float64) ([]byte, error) {
+			return binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(v))), nil
+		},
+		decode: func(data []byte) string {
+			return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(data))), 'f', -1, 32)
+		},
+	},
+}
+
+// stringSize is the length of DPT 16 strings, which are padded with NULs.
+const stringSize = 14
+
+func parseDatapoint(dpt string) (datapoint, error) {
+	if d, ok := datapoints[dpt]; ok {
+		return d, nil
+	}
+	main, _, _ := strings.Cut(dpt, ".")
+	if d, ok := datapoints[main]; ok {
+		return d, nil
+	}
+	if main == "16" {
+		return datapoint{size: stringSize}, nil
+	}
+	return datapoint{}, fmt.Errorf("unsupported DPT %q", dpt)
+}
+
+// encodeValue encodes a value reported by the controller. Strings are only
+// sent as DPT 16, and other DPTs need a number.
+func (d datapoint) encodeValue(value interface{}) ([]byte, error) {
+	if d.encode == nil {
+		text := fmt.Sprintf("%v", value)
+		if len(text) > stringSize {
+			text = text[:stringSize]
+		}
+		data := make([]byte, stringSize)
+		copy(data, text)
+		return data, nil
+	}
+	switch v := value.(type) {
+	case int64:
+		return d.encode(float64(v))
+	case nbe.RoundedFloat:
+		return d.encode(float64(v))
+	case float64:
+		return d.encode(v)
+	case bool:
+		if v {
+			return d.encode(1)
+		}
+		return d.encode(0)
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return d.encode(f)
+	}
+	return nil, fmt.Errorf("unsupported value %v", value)
+}
+
+// decodeValue decodes the data of a GroupValueWrite.
+func (d datapoint) decodeValue(data []byte) (string, error) {
+	if len(data) != d.size {
+		return "", fmt.Errorf("expected %d bytes of data, got %d", d.size, len(data))
+	}
+	if d.decode == nil {
+		return strings.TrimRight(string(data), "\x00"), nil
+	}
+	return d.decode(data), nil
+}
+
+// encodeFloat16 encodes the 2 byte floats of DPT 9, 0.01*M*2^E, where M is
+// a 12 bit two's complement mantissa and E a 4 bit exponent.
+func encodeFloat16(v float64) ([]byte, error) {
+	m := math.Round(v * 100)
+	e := 0
+	for m < -2048 || m > 2047 {
+		m = math.Round(m / 2)
+		e++
+	}
+	if e > 15 {
+		return nil, fmt.Errorf("%v is out of range for DPT 9", v)
+	}
+	mantissa := uint16(int16(m)) & 0x0fff
+	b := uint16(e)<<11 | mantissa&0x07ff
+	if m < 0 {
+		b |= 0x8000
+	}
+	return binary.BigEndian.AppendUint16(nil, b), nil
+}
+
+func decodeFloat16(data []byte) string {
+	b := binary.BigEndian.Uint16(data)
+	m := int(b & 0x07ff)
+	if b&0x8000 != 0 {
+		m -= 2048
+	}
+	e := int(b >> 11 & 0x0f)
+	v := 0.01 * float64(m) * math.Pow(2, float64(e))
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
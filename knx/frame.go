@@ -0,0 +1,166 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package knx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// KNXnet/IP services.
+const (
+	connectRequest          = 0x0205
+	connectResponse         = 0x0206
+	connectionStateRequest  = 0x0207
+	connectionStateResponse = 0x0208
+	disconnectRequest       = 0x0209
+	disconnectResponse      = 0x020a
+	tunnellingRequest       = 0x0420
+	tunnellingAck           = 0x0421
+	routingIndication       = 0x0530
+	routingLostMessage      = 0x0531
+	routingBusy             = 0x0532
+)
+
+// cEMI message codes.
+const (
+	lDataReq = 0x11
+	lDataCon = 0x2e
+	lDataInd = 0x29
+)
+
+// Application layer services.
+const (
+	groupValueRead     = 0x0000
+	groupValueResponse = 0x0040
+	groupValueWrite    = 0x0080
+)
+
+const headerSize = 6
+
+// packet wraps a body in a KNXnet/IP header.
+func packet(service uint16, body ...[]byte) []byte {
+	size := headerSize
+	for _, b := range body {
+		size += len(b)
+	}
+	p := []byte{headerSize, 0x10}
+	p = binary.BigEndian.AppendUint16(p, service)
+	p = binary.BigEndian.AppendUint16(p, uint16(size))
+	for _, b := range body {
+		p = append(p, b...)
+	}
+	return p
+}
+
+// parsePacket returns the service and body of a KNXnet/IP packet.
+func parsePacket(p []byte) (uint16, []byte, error) {
+	if len(p) < headerSize || p[0] != headerSize || p[1] != 0x10 {
+		return 0, nil, fmt.Errorf("not a KNXnet/IP packet")
+	}
+	size := int(binary.BigEndian.Uint16(p[4:6]))
+	if size < headerSize || size > len(p) {
+		return 0, nil, fmt.Errorf("truncated KNXnet/IP packet")
+	}
+	return binary.BigEndian.Uint16(p[2:4]), p[headerSize:size], nil
+}
+
+// hpai describes a UDP endpoint.
+func hpai(addr *net.UDPAddr) []byte {
+	b := []byte{8, 0x01}
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	b = append(b, ip...)
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+// telegram is a group telegram carried in a cEMI L_Data frame.
+type telegram struct {
+	source      uint16
+	destination uint16
+	service     uint16
+	data        []byte
+	// small data is carried in the 6 low bits of the APCI.
+	small bool
+}
+
+func (t telegram) String() string {
+	name := "GroupValueWrite"
+	switch t.service {
+	case groupValueRead:
+		name = "GroupValueRead"
+	case groupValueResponse:
+		name = "GroupValueResponse"
+	}
+	return fmt.Sprintf("%s from %s to %s", name, formatIndividualAddress(t.source), formatGroupAddress(t.destination))
+}
+
+// cemi encodes a telegram as an L_Data frame with the given message code.
+func (t telegram) cemi(code byte) []byte {
+	apdu := []byte{byte(t.service >> 8 & 0x03), byte(t.service & 0xc0)}
+	if t.small && len(t.data) > 0 {
+		apdu[1] |= t.data[0] & 0x3f
+	} else {
+		apdu = append(apdu, t.data...)
+	}
+	// Standard frame, no repeat, low priority; group address, hop count 6.
+	b := []byte{code, 0, 0xbc, 0xe0}
+	b = binary.BigEndian.AppendUint16(b, t.source)
+	b = binary.BigEndian.AppendUint16(b, t.destination)
+	b = append(b, byte(len(apdu)-1))
+	return append(b, apdu...)
+}
+
+// parseCEMI returns the message code and, for group telegrams, the telegram
+// of an L_Data frame. Other frames return a nil telegram.
+func parseCEMI(b []byte) (byte, *telegram, error) {
+	if len(b) < 2 || len(b) < 2+int(b[1]) {
+		return 0, nil, fmt.Errorf("truncated cEMI frame")
+	}
+	code := b[0]
+	b = b[2+int(b[1]):]
+	if code != lDataReq && code != lDataCon && code != lDataInd {
+		return code, nil, nil
+	}
+	if len(b) < 7 || len(b) < 7+int(b[6])+1 {
+		return 0, nil, fmt.Errorf("truncated L_Data frame")
+	}
+	if b[1]&0x80 == 0 {
+		// Addressed to an individual address.
+		return code, nil, nil
+	}
+	apdu := b[7 : 7+int(b[6])+1]
+	if len(apdu) < 2 {
+		return code, nil, nil
+	}
+	t := &telegram{
+		source:      binary.BigEndian.Uint16(b[2:4]),
+		destination: binary.BigEndian.Uint16(b[4:6]),
+		service:     uint16(apdu[0]&0x03)<<8 | uint16(apdu[1]&0xc0),
+	}
+	if len(apdu) == 2 {
+		t.small = true
+		t.data = []byte{apdu[1] & 0x3f}
+	} else {
+		t.data = apdu[2:]
+	}
+	return code, t, nil
+}
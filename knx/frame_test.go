@@ -0,0 +1,283 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package knx
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestAddresses(t *testing.T) {
+	groups := map[string]uint16{"0/0/1": 0x0001, "1/2/3": 0x0a03, "31/7/255": 0xffff, "1/515": 0x0a03}
+	for text, want := range groups {
+		got, err := ParseGroupAddress(text)
+		if err != nil || got != want {
+			t.Errorf("ParseGroupAddress(%q) = %#04x, %v, want %#04x", text, got, err, want)
+		}
+	}
+	if got := formatGroupAddress(0x0a03); got != "1/2/3" {
+		t.Errorf("formatGroupAddress(0x0a03) = %s", got)
+	}
+	for _, text := range []string{"32/0/0", "1/8/0", "1/2/256", "1/2048", "1", "1/2/3/4", "a/b/c"} {
+		if _, err := ParseGroupAddress(text); err == nil {
+			t.Errorf("ParseGroupAddress(%q) succeeded", text)
+		}
+	}
+
+	got, err := ParseIndividualAddress("1.1.10")
+	if err != nil || got != 0x110a {
+		t.Errorf("ParseIndividualAddress(1.1.10) = %#04x, %v", got, err)
+	}
+	if got := formatIndividualAddress(0xfffe); got != "15.15.254" {
+		t.Errorf("formatIndividualAddress(0xfffe) = %s", got)
+	}
+	for _, text := range []string{"16.0.0", "1.16.0", "1.1.256", "1.1"} {
+		if _, err := ParseIndividualAddress(text); err == nil {
+			t.Errorf("ParseIndividualAddress(%q) succeeded", text)
+		}
+	}
+}
+
+func TestDatapoints(t *testing.T) {
+	tests := []struct {
+		dpt     string
+		value   interface{}
+		encoded string
+		decoded string
+	}{
+		{"1.001", true, "01", "1"},
+		{"1.001", int64(0), "00", "0"},
+		{"5.001", nbe.RoundedFloat(100), "ff", "100"},
+		{"5.001", int64(50), "80", "50"},
+		{"5.010", int64(200), "c8", "200"},
+		{"6.001", int64(-5), "fb", "-5"},
+		{"7.001", int64(3600), "0e10", "3600"},
+		{"8.001", int64(-2), "fffe", "-2"},
+		// The examples of the KNX specification, and its limits.
+		{"9.001", nbe.RoundedFloat(20), "07d0", "20"},
+		{"9.001", 21.5, "0c33", "21.5"},
+		{"9.001", -30.0, "8a24", "-30"},
+		{"9.001", 0.01, "0001", "0.01"},
+		{"9.001", -0.01, "87ff", "-0.01"},
+		{"9.001", 0.0, "0000", "0"},
+		{"9.001", 670760.96, "7fff", "670760.96"},
+		{"9.001", -671088.64, "f800", "-671088.64"},
+		{"12.001", int64(123456), "0001e240", "123456"},
+		{"13.010", int64(-1), "ffffffff", "-1"},
+		{"14.056", 1234.5, "449a5000", "1234.5"},
+		{"16.000", "Running", "52756e6e696e67 00000000000000", "Running"},
+		{"16.001", "Ignition failed!", "49676e6974696f6e206661696c65", "Ignition faile"},
+	}
+	for _, tt := range tests {
+		d, err := parseDatapoint(tt.dpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := d.encodeValue(tt.value)
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.dpt, tt.value, err)
+			continue
+		}
+		if got := hex.EncodeToString(data); got != strings.ReplaceAll(tt.encoded, " ", "") {
+			t.Errorf("%s %v encoded as %s, want %s", tt.dpt, tt.value, got, tt.encoded)
+		}
+		decoded, err := d.decodeValue(data)
+		if err != nil || decoded != tt.decoded {
+			t.Errorf("%s %s decoded as %q, %v, want %q", tt.dpt, tt.encoded, decoded, err, tt.decoded)
+		}
+	}
+
+	outOfRange := map[string]interface{}{"5.001": 101.0, "5": -1.0, "6": 128.0, "7": 65536.0, "9": 700000.0, "12": -1.0}
+	for dpt, value := range outOfRange {
+		d, _ := parseDatapoint(dpt)
+		if data, err := d.encodeValue(value); err == nil {
+			t.Errorf("%s %v encoded as %x", dpt, value, data)
+		}
+	}
+	if _, err := parseDatapoint("232.600"); err == nil {
+		t.Error("parsed an unsupported DPT")
+	}
+}
+
+// TestTelegrams checks the cEMI frames of each service sent, from the
+// individual address 1.1.10 to the group address 1/2/3.
+func TestTelegrams(t *testing.T) {
+	tests := []struct {
+		name     string
+		telegram telegram
+		code     byte
+		frame    string
+	}{
+		{
+			name:     "small write",
+			telegram: telegram{source: 0x110a, destination: 0x0a03, service: groupValueWrite, data: []byte{1}, small: true},
+			code:     lDataInd,
+			frame:    "29 00 bc e0 110a 0a03 01 00 81",
+		},
+		{
+			name:     "write",
+			telegram: telegram{source: 0x110a, destination: 0x0a03, service: groupValueWrite, data: []byte{0x0c, 0x33}},
+			code:     lDataInd,
+			frame:    "29 00 bc e0 110a 0a03 03 00 80 0c33",
+		},
+		{
+			name:     "small response",
+			telegram: telegram{source: 0x110a, destination: 0x0a03, service: groupValueResponse, data: []byte{0}, small: true},
+			code:     lDataInd,
+			frame:    "29 00 bc e0 110a 0a03 01 00 40",
+		},
+		{
+			name:     "response",
+			telegram: telegram{source: 0x110a, destination: 0x0a03, service: groupValueResponse, data: []byte{0x80}},
+			code:     lDataInd,
+			frame:    "29 00 bc e0 110a 0a03 02 00 40 80",
+		},
+		{
+			name:     "read",
+			telegram: telegram{source: 0x110a, destination: 0x0a03, service: groupValueRead, small: true},
+			code:     lDataInd,
+			frame:    "29 00 bc e0 110a 0a03 01 00 00",
+		},
+		{
+			// The gateway fills in the source of tunnelled requests.
+			name:     "tunnelled write",
+			telegram: telegram{destination: 0x0a03, service: groupValueWrite, data: []byte{0x07, 0xd0}},
+			code:     lDataReq,
+			frame:    "11 00 bc e0 0000 0a03 03 00 80 07d0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := tt.telegram.cemi(tt.code)
+			if want := unhex(t, tt.frame); string(frame) != string(want) {
+				t.Errorf("frame\n got % x\nwant % x", frame, want)
+			}
+			code, tg, err := parseCEMI(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.code || tg == nil {
+				t.Fatalf("parsed code %#x, telegram %v", code, tg)
+			}
+			if tg.source != tt.telegram.source || tg.destination != tt.telegram.destination || tg.service != tt.telegram.service {
+				t.Errorf("parsed %s", tg)
+			}
+			if tt.telegram.data != nil && string(tg.data) != string(tt.telegram.data) {
+				t.Errorf("parsed data % x, want % x", tg.data, tt.telegram.data)
+			}
+		})
+	}
+}
+
+func TestParseCEMI(t *testing.T) {
+	// A frame with additional information, from an interface that adds a
+	// timestamp.
+	code, tg, err := parseCEMI(unhex(t, "29 04 04 02 1234 bc e0 110a 0a03 01 00 81"))
+	if err != nil || code != lDataInd || tg == nil || tg.destination != 0x0a03 || tg.data[0] != 1 {
+		t.Errorf("parsed %#x %v: %v", code, tg, err)
+	}
+	// Frames to individual addresses aren't group telegrams.
+	if _, tg, err := parseCEMI(unhex(t, "29 00 bc 60 110a 1101 01 00 81")); err != nil || tg != nil {
+		t.Errorf("parsed an individual frame as %v: %v", tg, err)
+	}
+	// Nor are other message codes.
+	if code, tg, err := parseCEMI(unhex(t, "fc 00 0000 01 01 00 01")); err != nil || tg != nil || code != 0xfc {
+		t.Errorf("parsed a property read as %#x %v: %v", code, tg, err)
+	}
+	for _, frame := range []string{"29", "29 04 00", "29 00 bc e0 110a 0a03 03 00 80"} {
+		if _, _, err := parseCEMI(unhex(t, frame)); err == nil {
+			t.Errorf("parsed truncated frame %s", frame)
+		}
+	}
+}
+
+// TestPackets checks each KNXnet/IP request sent, for a client at
+// 192.168.1.10:3671 on channel 7.
+func TestPackets(t *testing.T) {
+	local := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 3671}
+	tg := telegram{source: 0x110a, destination: 0x0a03, service: groupValueWrite, data: []byte{1}, small: true}
+	tests := []struct {
+		name   string
+		packet []byte
+		want   string
+	}{
+		{
+			name:   "connect request",
+			packet: packet(connectRequest, hpai(local), hpai(local), []byte{4, 0x04, 0x02, 0}),
+			want:   "06 10 0205 001a 08 01 c0a8010a 0e57 08 01 c0a8010a 0e57 04 04 02 00",
+		},
+		{
+			name:   "connection state request",
+			packet: packet(connectionStateRequest, []byte{7, 0}, hpai(local)),
+			want:   "06 10 0207 0010 07 00 08 01 c0a8010a 0e57",
+		},
+		{
+			name:   "disconnect request",
+			packet: packet(disconnectRequest, []byte{7, 0}, hpai(local)),
+			want:   "06 10 0209 0010 07 00 08 01 c0a8010a 0e57",
+		},
+		{
+			name:   "disconnect response",
+			packet: packet(disconnectResponse, []byte{7, 0}),
+			want:   "06 10 020a 0008 07 00",
+		},
+		{
+			name:   "tunnelling request",
+			packet: packet(tunnellingRequest, []byte{4, 7, 3, 0}, tg.cemi(lDataReq)),
+			want:   "06 10 0420 0015 04 07 03 00 11 00 bc e0 110a 0a03 01 00 81",
+		},
+		{
+			name:   "tunnelling ack",
+			packet: packet(tunnellingAck, []byte{4, 7, 3, 0}),
+			want:   "06 10 0421 000a 04 07 03 00",
+		},
+		{
+			name:   "routing indication",
+			packet: packet(routingIndication, tg.cemi(lDataInd)),
+			want:   "06 10 0530 0011 29 00 bc e0 110a 0a03 01 00 81",
+		},
+	}
+	for _, tt := range tests {
+		if want := unhex(t, tt.want); string(tt.packet) != string(want) {
+			t.Errorf("%s\n got % x\nwant % x", tt.name, tt.packet, want)
+		}
+	}
+
+	service, body, err := parsePacket(unhex(t, "06 10 0421 000a 04 07 03 00 ff"))
+	if err != nil || service != tunnellingAck || hex.EncodeToString(body) != "04070300" {
+		t.Errorf("parsed %#x % x: %v", service, body, err)
+	}
+	for _, p := range []string{"06 10 0421", "06 10 0421 000b 04 07 03 00", "06 20 0421 000a 04 07 03 00"} {
+		if _, _, err := parsePacket(unhex(t, p)); err == nil {
+			t.Errorf("parsed %s", p)
+		}
+	}
+}
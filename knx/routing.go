@@ -0,0 +1,98 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package knx
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RoutingAddress is the multicast group that KNXnet/IP routers use.
+const RoutingAddress = "224.0.23.12"
+
+// router exchanges telegrams with KNXnet/IP routers by multicast. There is
+// no connection to keep alive, but telegrams are sent from our own
+// individual address.
+type router struct {
+	group   *net.UDPAddr
+	address uint16
+	receive func(telegram)
+
+	conn   *net.UDPConn
+	mutex  sync.Mutex
+	closed bool
+}
+
+func newRouter(group *net.UDPAddr, address uint16, receive func(telegram)) (*router, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	r := &router{group: group, address: address, receive: receive, conn: conn}
+	go r.serve()
+	return r, nil
+}
+
+func (r *router) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, err := r.conn.Read(buf)
+		if err != nil {
+			r.mutex.Lock()
+			closed := r.closed
+			r.mutex.Unlock()
+			if !closed {
+				log.Errorf("Failed to read from KNX multicast group %s: %v", r.group, err)
+			}
+			return
+		}
+		service, body, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch service {
+		case routingIndication:
+			code, tg, err := parseCEMI(body)
+			if err != nil {
+				log.Debugf("Ignoring frame from KNX router: %v", err)
+				continue
+			}
+			// Our own telegrams are looped back.
+			if code == lDataInd && tg != nil && tg.source != r.address {
+				r.receive(*tg)
+			}
+		case routingBusy, routingLostMessage:
+			log.Warnf("KNX router is overloaded, telegrams may have been lost")
+		}
+	}
+}
+
+func (r *router) send(tg telegram) error {
+	tg.source = r.address
+	_, err := r.conn.WriteToUDP(packet(routingIndication, tg.cemi(lDataInd)), r.group)
+	return err
+}
+
+func (r *router) close() {
+	r.mutex.Lock()
+	r.closed = true
+	r.mutex.Unlock()
+	r.conn.Close()
+}
@@ -0,0 +1,337 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package knx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Port is the KNXnet/IP port.
+	Port = 3671
+
+	connectTimeout    = 10 * time.Second
+	ackTimeout        = time.Second
+	heartbeatInterval = 60 * time.Second
+	heartbeatTimeout  = 10 * time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+var errNotConnected = errors.New("not connected to the KNX gateway")
+
+// session is a single tunnelling connection.
+type session struct {
+	conn    *net.UDPConn
+	channel byte
+	address uint16
+	sendSeq byte
+	recvSeq byte
+	acks    chan byte
+	states  chan byte
+	done    chan struct{}
+}
+
+// tunnel connects to a KNXnet/IP interface as a tunnelling client,
+// reconnecting whenever the connection is lost.
+type tunnel struct {
+	gateway   *net.UDPAddr
+	receive   func(telegram)
+	connected func(bool, error)
+
+	sendMutex sync.Mutex
+	mutex     sync.Mutex
+	session   *session
+	closed    bool
+}
+
+func newTunnel(gateway *net.UDPAddr, receive func(telegram), connected func(bool, error)) *tunnel {
+	t := &tunnel{gateway: gateway, receive: receive, connected: connected}
+	go t.run()
+	return t
+}
+
+func (t *tunnel) run() {
+	delay := time.Second
+	for {
+		t.mutex.Lock()
+		closed := t.closed
+		t.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		s, err := t.connect()
+		if err != nil {
+			log.Errorf("Failed to connect to KNX gateway %s: %v, retrying in %s", t.gateway, err, delay)
+			time.Sleep(delay)
+			delay = min(delay*2, maxReconnectDelay)
+			continue
+		}
+		delay = time.Second
+
+		t.mutex.Lock()
+		if t.closed {
+			t.mutex.Unlock()
+			s.conn.Write(disconnect(s))
+			s.conn.Close()
+			return
+		}
+		t.session = s
+		t.mutex.Unlock()
+		log.Infof("Connected to KNX gateway %s as %s (channel %d)", t.gateway, formatIndividualAddress(s.address), s.channel)
+		t.connected(true, nil)
+		err = t.serve(s)
+		t.mutex.Lock()
+		t.session = nil
+		closed = t.closed
+		t.mutex.Unlock()
+		close(s.done)
+		s.conn.Close()
+		if !closed {
+			log.Errorf("Lost connection to KNX gateway %s: %v", t.gateway, err)
+			t.connected(false, err)
+		}
+	}
+}
+
+func (t *tunnel) connect() (*session, error) {
+	conn, err := net.DialUDP("udp4", nil, t.gateway)
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr().(*net.UDPAddr)
+	// A tunnelling connection on the link layer.
+	cri := []byte{4, 0x04, 0x02, 0}
+	if _, err := conn.Write(packet(connectRequest, hpai(local), hpai(local), cri)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		service, body, err := parsePacket(buf[:n])
+		if err != nil || service != connectResponse {
+			continue
+		}
+		if len(body) < 2 {
+			conn.Close()
+			return nil, fmt.Errorf("truncated connect response")
+		}
+		if body[1] != 0 {
+			conn.Close()
+			return nil, fmt.Errorf("connection refused with status 0x%02x", body[1])
+		}
+		s := &session{
+			conn:    conn,
+			channel: body[0],
+			acks:    make(chan byte, 1),
+			states:  make(chan byte, 1),
+			done:    make(chan struct{}),
+		}
+		// The CRD, after the data endpoint, has the address the gateway
+		// assigned to the connection.
+		if len(body) >= 14 {
+			s.address = uint16(body[12])<<8 | uint16(body[13])
+		}
+		return s, nil
+	}
+}
+
+// serve handles everything the gateway sends until the connection is lost
+// or closed.
+func (t *tunnel) serve(s *session) error {
+	go t.heartbeat(s)
+
+	buf := make([]byte, 512)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		service, body, err := parsePacket(buf[:n])
+		if err != nil {
+			log.Debugf("Ignoring packet from KNX gateway: %v", err)
+			continue
+		}
+
+		switch service {
+		case tunnellingRequest:
+			if len(body) < 4 || body[1] != s.channel {
+				continue
+			}
+			// A repeat of the last request is acknowledged again,
+			// but not handled twice, and anything else is dropped.
+			seq := body[2]
+			if seq == s.recvSeq-1 {
+				s.conn.Write(packet(tunnellingAck, []byte{4, s.channel, seq, 0}))
+				continue
+			}
+			if seq != s.recvSeq {
+				continue
+			}
+			s.conn.Write(packet(tunnellingAck, []byte{4, s.channel, seq, 0}))
+			s.recvSeq++
+			code, tg, err := parseCEMI(body[4:])
+			if err != nil {
+				log.Debugf("Ignoring frame from KNX gateway: %v", err)
+				continue
+			}
+			if code == lDataInd && tg != nil {
+				t.receive(*tg)
+			}
+		case tunnellingAck:
+			if len(body) >= 4 && body[1] == s.channel {
+				if body[3] != 0 {
+					log.Warnf("KNX gateway rejected telegram with status 0x%02x", body[3])
+				}
+				select {
+				case s.acks <- body[2]:
+				default:
+				}
+			}
+		case connectionStateResponse:
+			if len(body) >= 2 && body[0] == s.channel {
+				select {
+				case s.states <- body[1]:
+				default:
+				}
+			}
+		case disconnectRequest:
+			if len(body) >= 1 && body[0] == s.channel {
+				s.conn.Write(packet(disconnectResponse, []byte{s.channel, 0}))
+				return fmt.Errorf("disconnected by the gateway")
+			}
+		case disconnectResponse:
+			return fmt.Errorf("disconnected")
+		}
+	}
+}
+
+// heartbeat checks the connection every minute, as gateways drop
+// connections that are idle for two. If the gateway doesn't answer three
+// times in a row the connection is closed, which ends serve.
+func (t *tunnel) heartbeat(s *session) {
+	request := packet(connectionStateRequest, []byte{s.channel, 0}, hpai(s.conn.LocalAddr().(*net.UDPAddr)))
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if !ping(s, request) {
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// ping asks the gateway for the state of the connection, asking up to three
+// times.
+func ping(s *session, request []byte) bool {
+	for attempt := 0; attempt < 3; attempt++ {
+		s.conn.Write(request)
+		select {
+		case status := <-s.states:
+			if status != 0 {
+				log.Warnf("KNX gateway reported connection status 0x%02x", status)
+			}
+			return status == 0
+		case <-time.After(heartbeatTimeout):
+		case <-s.done:
+			return true
+		}
+	}
+	log.Warnf("KNX gateway didn't answer heartbeats")
+	return false
+}
+
+// send sends a telegram and waits for the gateway to acknowledge it,
+// repeating it once if it doesn't.
+func (t *tunnel) send(tg telegram) error {
+	t.sendMutex.Lock()
+	defer t.sendMutex.Unlock()
+
+	t.mutex.Lock()
+	s := t.session
+	t.mutex.Unlock()
+	if s == nil {
+		return errNotConnected
+	}
+
+	request := packet(tunnellingRequest, []byte{4, s.channel, s.sendSeq, 0}, tg.cemi(lDataReq))
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := s.conn.Write(request); err != nil {
+			return err
+		}
+		timeout := time.After(ackTimeout)
+	wait:
+		for {
+			select {
+			case seq := <-s.acks:
+				if seq == s.sendSeq {
+					s.sendSeq++
+					return nil
+				}
+			case <-timeout:
+				break wait
+			case <-s.done:
+				return errNotConnected
+			}
+		}
+	}
+	// Gateways expect the connection to be dropped when a request goes
+	// unacknowledged.
+	s.conn.Close()
+	return fmt.Errorf("%s was not acknowledged", tg)
+}
+
+func (t *tunnel) close() {
+	t.mutex.Lock()
+	t.closed = true
+	s := t.session
+	t.mutex.Unlock()
+	if s == nil {
+		return
+	}
+	s.conn.Write(disconnect(s))
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		s.conn.Close()
+	}
+}
+
+func disconnect(s *session) []byte {
+	return packet(disconnectRequest, []byte{s.channel, 0}, hpai(s.conn.LocalAddr().(*net.UDPAddr)))
+}
@@ -0,0 +1,259 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package knx
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// gateway is a KNXnet/IP tunnelling interface that hands out channel 7 and
+// the address 1.1.250.
+type gateway struct {
+	t    *testing.T
+	conn *net.UDPConn
+	peer *net.UDPAddr
+}
+
+func newGateway(t *testing.T) *gateway {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &gateway{t: t, conn: conn}
+}
+
+func (g *gateway) read() (uint16, []byte) {
+	g.t.Helper()
+	buf := make([]byte, 512)
+	g.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := g.conn.ReadFromUDP(buf)
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	g.peer = addr
+	service, body, err := parsePacket(buf[:n])
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	return service, body
+}
+
+func (g *gateway) write(p []byte) {
+	g.t.Helper()
+	if _, err := g.conn.WriteToUDP(p, g.peer); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+func (g *gateway) expect(service uint16, body string) {
+	g.t.Helper()
+	got, b := g.read()
+	if got != service || hex.EncodeToString(b) != body {
+		g.t.Fatalf("received %#04x %x, want %#04x %s", got, b, service, body)
+	}
+}
+
+// hpaiHex is the endpoint a packet from the tunnel should give.
+func (g *gateway) hpaiHex() string {
+	return hex.EncodeToString(hpai(g.peer))
+}
+
+func TestTunnel(t *testing.T) {
+	g := newGateway(t)
+	received := make(chan telegram, 10)
+	connected := make(chan bool, 10)
+	tun := newTunnel(g.conn.LocalAddr().(*net.UDPAddr), func(tg telegram) { received <- tg }, func(ok bool, _ error) { connected <- ok })
+	defer tun.close()
+
+	// Connect, on the link layer.
+	service, body := g.read()
+	if want := g.hpaiHex() + g.hpaiHex() + "04040200"; service != connectRequest || hex.EncodeToString(body) != want {
+		t.Fatalf("connect request %#04x %x, want %s", service, body, want)
+	}
+	g.write(unhex(t, "06 10 0206 0014 07 00 08 01 7f000001 0e57 04 04 11fa"))
+	select {
+	case ok := <-connected:
+		if !ok {
+			t.Fatal("not connected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+	tun.mutex.Lock()
+	if s := tun.session; s.channel != 7 || s.address != 0x11fa {
+		t.Errorf("channel %d, address %s", s.channel, formatIndividualAddress(s.address))
+	}
+	tun.mutex.Unlock()
+
+	// A telegram sent is acknowledged, in sequence.
+	for seq := 0; seq < 2; seq++ {
+		sent := make(chan error)
+		go func() {
+			sent <- tun.send(telegram{destination: 0x0a03, service: groupValueWrite, data: []byte{0x07, 0xd0}})
+		}()
+		g.expect(tunnellingRequest, "0407"+hex.EncodeToString([]byte{byte(seq)})+"00"+"1100bce000000a0303008007d0")
+		g.write(packet(tunnellingAck, []byte{4, 7, byte(seq), 0}))
+		if err := <-sent; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A telegram received is acknowledged and passed on once, even if it
+	// is repeated.
+	indication := packet(tunnellingRequest, []byte{4, 7, 0, 0}, unhex(t, "29 00 bc e0 1101 0a03 01 00 81"))
+	for i := 0; i < 2; i++ {
+		g.write(indication)
+		g.expect(tunnellingAck, "04070000")
+	}
+	select {
+	case tg := <-received:
+		if tg.source != 0x1101 || tg.destination != 0x0a03 || tg.service != groupValueWrite || tg.data[0] != 1 {
+			t.Errorf("received %s % x", tg, tg.data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("telegram wasn't passed on")
+	}
+	select {
+	case tg := <-received:
+		t.Errorf("repeat was passed on: %s", tg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Out of sequence requests, and those for other channels, are dropped.
+	g.write(packet(tunnellingRequest, []byte{4, 7, 5, 0}, unhex(t, "29 00 bc e0 1101 0a03 01 00 81")))
+	g.write(packet(tunnellingRequest, []byte{4, 8, 1, 0}, unhex(t, "29 00 bc e0 1101 0a03 01 00 81")))
+	g.write(packet(connectionStateResponse, []byte{7, 0}))
+	g.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := g.conn.ReadFromUDP(make([]byte, 512)); err == nil {
+		t.Errorf("dropped requests were answered with %d bytes", n)
+	}
+
+	// The gateway disconnecting is answered, and a new connection made.
+	g.write(packet(disconnectRequest, []byte{7, 0}, unhex(t, "08 01 7f000001 0e57")))
+	g.expect(disconnectResponse, "0700")
+	if ok := <-connected; ok {
+		t.Error("still connected after the gateway disconnected")
+	}
+	if service, _ := g.read(); service != connectRequest {
+		t.Errorf("%#04x instead of a new connect request", service)
+	}
+	g.write(unhex(t, "06 10 0206 0014 08 00 08 01 7f000001 0e57 04 04 11fb"))
+	<-connected
+
+	// Closing disconnects.
+	done := make(chan struct{})
+	go func() {
+		tun.close()
+		close(done)
+	}()
+	g.expect(disconnectRequest, "0800"+g.hpaiHex())
+	g.write(packet(disconnectResponse, []byte{8, 0}))
+	<-done
+}
+
+func TestTunnelUnacknowledged(t *testing.T) {
+	g := newGateway(t)
+	connected := make(chan bool, 10)
+	tun := newTunnel(g.conn.LocalAddr().(*net.UDPAddr), func(telegram) {}, func(ok bool, _ error) { connected <- ok })
+	defer tun.close()
+	g.read()
+	g.write(unhex(t, "06 10 0206 0014 07 00 08 01 7f000001 0e57 04 04 11fa"))
+	<-connected
+
+	// The request is repeated once, then the connection dropped.
+	sent := make(chan error)
+	go func() {
+		sent <- tun.send(telegram{destination: 0x0a03, service: groupValueRead, small: true})
+	}()
+	g.expect(tunnellingRequest, "04070000"+"1100bce000000a03010000")
+	g.expect(tunnellingRequest, "04070000"+"1100bce000000a03010000")
+	if err := <-sent; err == nil {
+		t.Error("unacknowledged telegram was sent")
+	}
+	if ok := <-connected; ok {
+		t.Error("still connected")
+	}
+}
+
+func TestTunnelRefused(t *testing.T) {
+	g := newGateway(t)
+	tun := &tunnel{gateway: g.conn.LocalAddr().(*net.UDPAddr)}
+	result := make(chan error)
+	go func() {
+		_, err := tun.connect()
+		result <- err
+	}()
+	g.read()
+	// E_NO_MORE_CONNECTIONS.
+	g.write(unhex(t, "06 10 0206 0008 00 24"))
+	if err := <-result; err == nil {
+		t.Error("connected when refused")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	// Unicast stands in for the multicast group.
+	group, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Close()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan telegram, 10)
+	r := &router{group: group.LocalAddr().(*net.UDPAddr), address: 0x11fa, receive: func(tg telegram) { received <- tg }, conn: conn}
+	go r.serve()
+	defer r.close()
+
+	if err := r.send(telegram{destination: 0x0a03, service: groupValueResponse, data: []byte{0x80}}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	group.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := group.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex(t, "06 10 0530 0012 29 00 bc e0 11fa 0a03 02 00 40 80"); string(buf[:n]) != string(want) {
+		t.Errorf("routing indication\n got % x\nwant % x", buf[:n], want)
+	}
+
+	// Our own telegrams, looped back, are ignored.
+	to := conn.LocalAddr().(*net.UDPAddr)
+	group.WriteToUDP(buf[:n], to)
+	group.WriteToUDP(unhex(t, "06 10 0530 0011 29 00 bc e0 1101 0a03 01 00 81"), to)
+	select {
+	case tg := <-received:
+		if tg.source != 0x1101 || tg.service != groupValueWrite {
+			t.Errorf("received %s", tg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("telegram wasn't passed on")
+	}
+	select {
+	case tg := <-received:
+		t.Errorf("received %s", tg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
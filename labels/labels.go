@@ -0,0 +1,168 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package labels maps the values of enum settings to the labels the
+// controller shows for them, as found in its language files.
+package labels
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The bundled labels are a snapshot of the common enum settings, in
+// English, for when no language file is given.
+//
+//go:embed en.txt
+var bundled string
+
+// Table maps the values of settings, by category.key, to labels.
+type Table struct {
+	labels map[string]map[int64]string
+}
+
+// Bundled returns the labels that ship with boiler-mate.
+func Bundled() *Table {
+	t, err := Parse(strings.NewReader(bundled))
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Load reads a language file.
+func Load(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+// Parse reads a language file, with a <category>.<key>.<value>=<label>
+// line for each label. Blank lines and lines starting with # are ignored.
+func Parse(r io.Reader) (*Table, error) {
+	t := &Table{labels: make(map[string]map[int64]string)}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, label, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected <category>.<key>.<value>=<label>", line)
+		}
+		i := strings.LastIndex(name, ".")
+		if i < 0 || !strings.Contains(name[:i], ".") {
+			return nil, fmt.Errorf("line %d: %q is not a category.key.value", line, name)
+		}
+		value, err := strconv.ParseInt(name[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value %q", line, name[i+1:])
+		}
+		if t.labels[name[:i]] == nil {
+			t.labels[name[:i]] = make(map[int64]string)
+		}
+		t.labels[name[:i]][value] = strings.TrimSpace(label)
+	}
+	return t, scanner.Err()
+}
+
+// Merge adds the labels of other, replacing any for the same value.
+func (t *Table) Merge(other *Table) {
+	for name, values := range other.labels {
+		if t.labels[name] == nil {
+			t.labels[name] = make(map[int64]string)
+		}
+		for value, label := range values {
+			t.labels[name][value] = label
+		}
+	}
+}
+
+// Label returns the label of a value of category.key.
+func (t *Table) Label(category string, key string, value int64) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	label, ok := t.labels[category+"."+key][value]
+	return label, ok
+}
+
+// Value returns the value that a label of category.key stands for. Labels
+// are matched regardless of case.
+func (t *Table) Value(category string, key string, label string) (int64, bool) {
+	if t == nil {
+		return 0, false
+	}
+	for value, l := range t.labels[category+"."+key] {
+		if strings.EqualFold(l, label) {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// Labels returns every value of category.key and its label.
+func (t *Table) Labels(category string, key string) map[int64]string {
+	if t == nil {
+		return nil
+	}
+	return t.labels[category+"."+key]
+}
+
+// Options returns the labels of category.key in order of value.
+func (t *Table) Options(category string, key string) []string {
+	values := t.Labels(category, key)
+	order := make([]int64, 0, len(values))
+	for value := range values {
+		order = append(order, value)
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	options := make([]string, len(order))
+	for i, value := range order {
+		options[i] = values[value]
+	}
+	return options
+}
+
+// Keys returns the category.key of every setting with labels, sorted.
+func (t *Table) Keys() []string {
+	if t == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(t.labels))
+	for name := range t.labels {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	return keys
+}
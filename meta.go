@@ -0,0 +1,63 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/names"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/units"
+	log "github.com/sirupsen/logrus"
+)
+
+// settingMeta is published, retained, on <prefix>/meta/<category>/<key> for
+// every setting the controller reports a range for, so that dashboards can
+// build controls without knowing the controller.
+type settingMeta struct {
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	Step     float64 `json:"step"`
+	Decimals int64   `json:"decimals"`
+}
+
+// metaFor returns the range of a setting in the units it is published in.
+// The step is the resolution the controller stores the setting at, e.g. 0.1
+// for a setting with one decimal, and the range is rounded to it.
+func metaFor(setting nbe.SettingDefinition, category string, key string, unitSystem units.System) settingMeta {
+	q := units.QuantityOf(category, key)
+	scale := math.Pow(10, float64(setting.Decimals))
+	return settingMeta{
+		Min:      math.Round(unitSystem.Number(q, float64(setting.Min))*scale) / scale,
+		Max:      math.Round(unitSystem.Number(q, float64(setting.Max))*scale) / scale,
+		Step:     1 / scale,
+		Decimals: setting.Decimals,
+	}
+}
+
+func publishMeta(mqttClient *mqtt.Client, schema map[string]nbe.SettingDefinition, topics *names.Names, unitSystem units.System) {
+	for _, setting := range schema {
+		meta := metaFor(setting, setting.Group, setting.Name, unitSystem)
+		topic := fmt.Sprintf("%s/meta/%s", mqttClient.Prefix, topics.Topic(setting.Group, setting.Name))
+		if err := mqttClient.PublishJSON(topic, meta); err != nil {
+			log.Errorf("Failed to publish meta for %s.%s: %v", setting.Group, setting.Name, err)
+		}
+	}
+}
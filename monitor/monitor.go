@@ -0,0 +1,264 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// DeriveFunc is called for every changed key and may add derived values
+// to the change set. It is called once every changed key of a response is
+// in the change set, so that it can read the other values that changed
+// with it, and with the monitor's mutex held, so calls are never
+// concurrent although they come from the boiler's goroutines.
+type DeriveFunc func(key string, value interface{}, changeSet map[string]interface{})
+
+// RetainedFunc reports whether value is what key was published as, and
+// retained, before a restart.
+type RetainedFunc func(key string, value interface{}) bool
+
+// Change describes a single value that changed between two polls.
+type Change = bus.Change
+
+// Monitor periodically polls one category of data from the boiler, keeps
+// the latest values in a cache and publishes anything that changed on the
+// event bus. The first poll is sent Offset after Start.
+type Monitor struct {
+	Category string
+	Function nbe.Function
+	Path     string
+	Interval time.Duration
+	Offset   time.Duration
+	Derive   DeriveFunc
+	Retained RetainedFunc
+
+	boiler   nbe.Boiler
+	events   *bus.Bus
+	cache    map[string]interface{}
+	started  time.Time
+	lastPoll time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+	mutex    sync.RWMutex
+
+	// The poll loop's heartbeat, and which loop is current, are atomic so
+	// that the watchdog can check them even if the mutex is stuck.
+	heartbeat  atomic.Int64
+	generation atomic.Int64
+	errorCount atomic.Int64
+}
+
+func NewMonitor(boiler nbe.Boiler, events *bus.Bus, category string, function nbe.Function, path string, interval time.Duration) *Monitor {
+	return &Monitor{
+		Category: category,
+		Function: function,
+		Path:     path,
+		Interval: interval,
+		boiler:   boiler,
+		events:   events,
+		cache:    make(map[string]interface{}),
+		stop:     make(chan struct{}),
+	}
+}
+
+func (m *Monitor) Start() {
+	m.mutex.Lock()
+	m.started = time.Now()
+	m.mutex.Unlock()
+
+	m.run(m.Offset)
+}
+
+// run starts a new poll loop, polling first after delay. Any previous loop
+// exits the next time it wakes up.
+func (m *Monitor) run(delay time.Duration) {
+	generation := m.generation.Add(1)
+	m.heartbeat.Store(time.Now().UnixNano())
+
+	go func() {
+		if delay > 0 {
+			select {
+			case <-m.stop:
+				return
+			case <-time.After(delay):
+			}
+		}
+		for m.generation.Load() == generation {
+			m.heartbeat.Store(time.Now().UnixNano())
+			_, err := m.boiler.GetAsync(m.Function, m.Path, m.handle)
+			if err != nil {
+				pollErrors.Add(context.Background(), 1, metric.WithAttributes(attribute.String("category", m.Category)))
+				m.errorCount.Add(1)
+				log.Errorf("Failed to poll %s: %v", m.Category, err)
+			}
+			select {
+			case <-m.stop:
+				return
+			case <-time.After(m.Interval):
+			}
+		}
+	}()
+}
+
+// Stalled reports an error if the poll loop has not run for three
+// intervals, which only happens if it is stuck.
+func (m *Monitor) Stalled() error {
+	last := m.heartbeat.Load()
+	if last == 0 {
+		return nil
+	}
+	if age := time.Since(time.Unix(0, last)); age > 3*m.Interval {
+		return fmt.Errorf("%s poll loop has not run for %s", m.Category, age.Round(time.Second))
+	}
+	return nil
+}
+
+// Restart abandons a stuck poll loop and starts a new one.
+func (m *Monitor) Restart() error {
+	select {
+	case <-m.stop:
+		return fmt.Errorf("%s monitor is stopped", m.Category)
+	default:
+	}
+	m.run(0)
+	return nil
+}
+
+// Stop stops polling. Responses to polls already sent are still handled.
+func (m *Monitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// LastPoll returns the time of the last successful poll.
+func (m *Monitor) LastPoll() time.Time {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.lastPoll
+}
+
+// PollErrors returns the number of polls that could not be sent.
+func (m *Monitor) PollErrors() int64 {
+	return m.errorCount.Load()
+}
+
+// Healthz reports an error if the monitor has not had a successful poll
+// within three intervals.
+func (m *Monitor) Healthz() error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.started.IsZero() {
+		return fmt.Errorf("%s monitor not started", m.Category)
+	}
+	last := m.lastPoll
+	if last.IsZero() {
+		last = m.started
+	}
+	if age := time.Since(last); age > 3*m.Interval {
+		return fmt.Errorf("no successful %s poll for %s", m.Category, age.Round(time.Second))
+	}
+	return nil
+}
+
+// Get returns the cached value of a single key.
+func (m *Monitor) Get(key string) (interface{}, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	val, ok := m.cache[key]
+	return val, ok
+}
+
+// Values returns a copy of all cached values.
+func (m *Monitor) Values() map[string]interface{} {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	values := make(map[string]interface{}, len(m.cache))
+	for k, v := range m.cache {
+		values[k] = v
+	}
+	return values
+}
+
+func (m *Monitor) handle(response *nbe.NBEResponse) {
+	ctx, span := tracer.Start(context.Background(), "monitor.handle")
+	defer span.End()
+	category := metric.WithAttributes(attribute.String("category", m.Category))
+
+	changeSet := make(map[string]interface{})
+	previous := make(map[string]interface{})
+	unseen := make(map[string]bool)
+
+	m.mutex.Lock()
+	m.lastPoll = time.Now()
+	var changed []string
+	for k, v := range response.Payload {
+		if _, ok := m.cache[k]; !ok {
+			unseen[k] = true
+		}
+		if !cmp.Equal(m.cache[k], v) {
+			previous[k] = m.cache[k]
+			changeSet[k] = v
+			m.cache[k] = v
+			changed = append(changed, k)
+		}
+	}
+	if m.Derive != nil {
+		for _, k := range changed {
+			m.Derive(k, response.Payload[k], changeSet)
+		}
+	}
+	for k, v := range changeSet {
+		if _, ok := previous[k]; !ok {
+			previous[k] = m.cache[k]
+		}
+		if _, ok := m.cache[k]; !ok {
+			unseen[k] = true
+		}
+		m.cache[k] = v
+	}
+	m.mutex.Unlock()
+
+	pollCounter.Add(ctx, 1, category)
+	changeCounter.Add(ctx, int64(len(changeSet)), category)
+	span.SetAttributes(attribute.String("category", m.Category), attribute.Int("changes", len(changeSet)))
+
+	now := time.Now()
+	for k, v := range changeSet {
+		m.events.Publish(bus.ChangeTopic, Change{
+			Category:  m.Category,
+			Key:       k,
+			Value:     v,
+			Previous:  previous[k],
+			Timestamp: now,
+			Retained:  unseen[k] && m.Retained != nil && m.Retained(k, v),
+		})
+	}
+}
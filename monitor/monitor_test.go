@@ -0,0 +1,188 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// changes starts m against boiler, returning the changes it publishes.
+func changes(t *testing.T, m *Monitor, events *bus.Bus) <-chan Change {
+	t.Helper()
+	ch := make(chan Change, 100)
+	events.OnChange(func(change Change) {
+		ch <- change
+	})
+	m.Start()
+	t.Cleanup(m.Stop)
+	return ch
+}
+
+// waitFor returns the first change to key, failing the test if none comes.
+func waitFor(t *testing.T, ch <-chan Change, key string) Change {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case change := <-ch:
+			if change.Key == key {
+				return change
+			}
+		case <-timeout:
+			t.Fatalf("no change to %s", key)
+		}
+	}
+}
+
+func TestMonitorPublishesChanges(t *testing.T) {
+	boiler := nbe.NewMockBoiler("12345")
+	events := bus.New()
+	m := NewMonitor(boiler, events, "operating_data", nbe.GetOperatingDataFunction, "*", 10*time.Millisecond)
+	ch := changes(t, m, events)
+
+	first := waitFor(t, ch, "boiler_temp")
+	if first.Category != "operating_data" || first.Value != nbe.RoundedFloat(float32(64.8)) || first.Previous != nil {
+		t.Errorf("first change = %+v, want boiler_temp 64.8 from nothing", first)
+	}
+
+	boiler.SetValue(nbe.GetOperatingDataFunction, "boiler_temp", "70.5")
+	change := waitFor(t, ch, "boiler_temp")
+	if change.Value != nbe.RoundedFloat(70.5) || change.Previous != nbe.RoundedFloat(float32(64.8)) {
+		t.Errorf("change = %+v, want boiler_temp 64.8 to 70.5", change)
+	}
+	if got, _ := m.Get("boiler_temp"); got != nbe.RoundedFloat(70.5) {
+		t.Errorf("Get(boiler_temp) = %v, want 70.5", got)
+	}
+	if m.LastPoll().IsZero() {
+		t.Errorf("LastPoll is zero after polling")
+	}
+	if err := m.Healthz(); err != nil {
+		t.Errorf("Healthz: %v", err)
+	}
+}
+
+func TestMonitorSettings(t *testing.T) {
+	boiler := nbe.NewMockBoiler("12345")
+	events := bus.New()
+	m := NewMonitor(boiler, events, "boiler", nbe.GetSetupFunction, "boiler.*", 10*time.Millisecond)
+	ch := changes(t, m, events)
+
+	waitFor(t, ch, "temp")
+	if _, err := boiler.Set("boiler.temp", []byte("70")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if change := waitFor(t, ch, "temp"); change.Category != "boiler" || change.Value != int64(70) {
+		t.Errorf("change = %+v, want boiler.temp 70", change)
+	}
+	if _, ok := m.Get("content"); ok {
+		t.Errorf("boiler monitor holds hopper.content")
+	}
+}
+
+func TestMonitorDerive(t *testing.T) {
+	boiler := nbe.NewMockBoiler("12345")
+	events := bus.New()
+	m := NewMonitor(boiler, events, "operating_data", nbe.GetOperatingDataFunction, "*", 10*time.Millisecond)
+	m.Derive = func(key string, value interface{}, changeSet map[string]interface{}) {
+		if key == "power_kw" {
+			changeSet["power_w"] = int64(float64(value.(nbe.RoundedFloat)) * 1000)
+		}
+	}
+	ch := changes(t, m, events)
+
+	if change := waitFor(t, ch, "power_w"); change.Value != int64(6300) {
+		t.Errorf("power_w = %v, want 6300", change.Value)
+	}
+	if got, _ := m.Get("power_w"); got != int64(6300) {
+		t.Errorf("Get(power_w) = %v, want 6300", got)
+	}
+}
+
+// TestMonitorDeriveSeesResponse checks that every key that changed in a
+// response is in the change set when any of them is derived from, whatever
+// order the payload is iterated in.
+func TestMonitorDeriveSeesResponse(t *testing.T) {
+	boiler := nbe.NewMockBoiler("12345")
+	events := bus.New()
+	m := NewMonitor(boiler, events, "operating_data", nbe.GetOperatingDataFunction, "*", time.Hour)
+	m.Derive = func(key string, value interface{}, changeSet map[string]interface{}) {
+		if key == "smoke_temp" {
+			changeSet["state_with_smoke"] = changeSet["state"]
+		}
+	}
+	ch := changes(t, m, events)
+	waitFor(t, ch, "state_with_smoke")
+
+	boiler.SetValue(nbe.GetOperatingDataFunction, "state", "9")
+	boiler.SetValue(nbe.GetOperatingDataFunction, "smoke_temp", "80.5")
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if change := waitFor(t, ch, "state_with_smoke"); change.Value != int64(9) {
+		t.Errorf("state_with_smoke = %v, want 9", change.Value)
+	}
+}
+
+func TestMonitorSubscribe(t *testing.T) {
+	boiler := nbe.NewMockBoiler("12345")
+	responses := make(chan *nbe.NBEResponse, 100)
+	unsubscribe := boiler.Subscribe(func(response *nbe.NBEResponse) {
+		responses <- response
+	})
+	defer unsubscribe()
+
+	m := NewMonitor(boiler, bus.New(), "operating_data", nbe.GetOperatingDataFunction, "*", 10*time.Millisecond)
+	m.Start()
+	defer m.Stop()
+
+	select {
+	case response := <-responses:
+		if response.Function != nbe.GetOperatingDataFunction {
+			t.Errorf("subscriber got function %d, want %d", response.Function, nbe.GetOperatingDataFunction)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("subscriber saw no poll")
+	}
+}
+
+func TestMonitorStop(t *testing.T) {
+	boiler := nbe.NewMockBoiler("12345")
+	polls := make(chan struct{}, 1000)
+	defer boiler.Subscribe(func(*nbe.NBEResponse) { polls <- struct{}{} })()
+
+	m := NewMonitor(boiler, bus.New(), "operating_data", nbe.GetOperatingDataFunction, "*", 5*time.Millisecond)
+	m.Start()
+	<-polls
+	m.Stop()
+	if err := m.Restart(); err == nil {
+		t.Errorf("Restart of a stopped monitor succeeded")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	for len(polls) > 0 {
+		<-polls
+	}
+	time.Sleep(30 * time.Millisecond)
+	if n := len(polls); n > 0 {
+		t.Errorf("%d polls after Stop", n)
+	}
+}
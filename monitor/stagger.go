@@ -0,0 +1,48 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"sort"
+	"time"
+)
+
+// Stagger spreads the first polls of monitors sharing an interval evenly
+// across it, so that the categories polled every 10 seconds aren't all
+// requested from the controller at once. It returns the largest offset,
+// after which every monitor has been polled once.
+func Stagger(monitors []*Monitor) time.Duration {
+	groups := make(map[time.Duration][]*Monitor)
+	for _, m := range monitors {
+		groups[m.Interval] = append(groups[m.Interval], m)
+	}
+
+	var longest time.Duration
+	for interval, group := range groups {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].Category < group[j].Category
+		})
+		for i, m := range group {
+			m.Offset = interval * time.Duration(i) / time.Duration(len(group))
+			if m.Offset > longest {
+				longest = m.Offset
+			}
+		}
+	}
+	return longest
+}
@@ -0,0 +1,35 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	tracer = otel.Tracer("github.com/mlipscombe/boiler-mate/monitor")
+	meter  = otel.Meter("github.com/mlipscombe/boiler-mate/monitor")
+
+	pollCounter, _ = meter.Int64Counter("boiler_mate.monitor.polls",
+		metric.WithDescription("Polls answered by the controller."))
+	pollErrors, _ = meter.Int64Counter("boiler_mate.monitor.poll_errors",
+		metric.WithDescription("Polls that could not be sent."))
+	changeCounter, _ = meter.Int64Counter("boiler_mate.monitor.changes",
+		metric.WithDescription("Values that changed between polls."))
+)
@@ -18,13 +18,41 @@
 package mqtt
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mlipscombe/boiler-mate/bus"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	meter = otel.Meter("github.com/mlipscombe/boiler-mate/mqtt")
+
+	publishCounter, _ = meter.Int64Counter("boiler_mate.mqtt.published",
+		metric.WithDescription("Messages published to the broker."))
+	publishErrors, _ = meter.Int64Counter("boiler_mate.mqtt.publish_errors",
+		metric.WithDescription("Messages the broker failed to accept."))
+	droppedCounter, _ = meter.Int64Counter("boiler_mate.mqtt.dropped",
+		metric.WithDescription("Messages dropped because the outbound queue was full."))
+)
+
+// Publishes are queued and sent in order by a single goroutine, which waits
+// while the broker is unreachable. Rather than waiting for the broker to
+// accept each message, their tokens are handed to a few workers which
+// record the outcome, so that a poll returning hundreds of values doesn't
+// start a goroutine per value.
+const (
+	tokenWorkers   = 4
+	tokenQueueSize = 1024
 )
 
 type Client struct {
@@ -32,24 +60,82 @@ type Client struct {
 	ClientID   string
 	Prefix     string
 	connection mqtt.Client
+	events     *bus.Bus
+	queue      *queue
+	tokens     chan mqtt.Token
+	profile    *profile
+
+	tlsCA   string
+	tlsCert string
+	tlsKey  string
+	sasKey  string
+
+	routes          map[string]MessageHandler
+	routeMutex      sync.Mutex
+	inboxSubscribed bool
+
+	homeAssistant   bool
+	domoticzPrefix  string
+	discoveryTopics map[string]bool
+	discoveryMutex  sync.Mutex
+	errorCount      atomic.Int64
 }
 
 type Message mqtt.Message
 
 type MessageHandler func(client *Client, message Message)
 
-func NewClient(uri *url.URL, client_id string, prefix string) (*Client, error) {
+// NewClient connects to the broker at uri. Connections being lost and
+// restored are published on events.
+func NewClient(uri *url.URL, client_id string, prefix string, events *bus.Bus, options ...Option) (*Client, error) {
 	client := Client{
-		URI:      uri,
-		ClientID: client_id,
-		Prefix:   prefix,
+		URI:             uri,
+		ClientID:        client_id,
+		Prefix:          prefix,
+		events:          events,
+		queue:           newQueue(defaultQueueSize, DropOldest),
+		tokens:          make(chan mqtt.Token, tokenQueueSize),
+		homeAssistant:   true,
+		discoveryTopics: make(map[string]bool),
+		routes:          make(map[string]MessageHandler),
+	}
+	for _, option := range options {
+		option(&client)
+	}
+	profile, err := newProfile(uri, client_id, client.sasKey)
+	if err != nil {
+		return nil, err
+	}
+	client.profile = profile
+	client.ClientID = profile.clientID
+	opts, err := client.createClientOptions()
+	if err != nil {
+		return nil, err
 	}
-	opts := createClientOptions(client.URI, client.ClientID)
+	for i := 0; i < tokenWorkers; i++ {
+		go client.confirm()
+	}
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Errorf("mqtt connection lost: %v", err)
+		client.events.Publish(bus.ConnectivityTopic, bus.Connectivity{
+			Timestamp: time.Now(),
+			Component: "mqtt",
+			Error:     err.Error(),
+		})
+	})
+	opts.SetOnConnectHandler(func(_ mqtt.Client) {
+		client.events.Publish(bus.ConnectivityTopic, bus.Connectivity{
+			Timestamp: time.Now(),
+			Component: "mqtt",
+			Connected: true,
+		})
+	})
 
-	opts.SetWill(fmt.Sprintf("%s/device/status", client.Prefix), "offline", 1, true)
-	err := client.connect(opts)
+	opts.SetWill(client.profile.topic(fmt.Sprintf("%s/device/status", client.Prefix)), "offline", 1, true)
+	err = client.connect(opts)
 
-	client.connection.Publish(fmt.Sprintf("%s/device/status", client.Prefix), 1, true, "online")
+	client.connection.Publish(client.profile.topic(fmt.Sprintf("%s/device/status", client.Prefix)), 1, true, "online")
+	go client.send()
 
 	return &client, err
 }
@@ -65,6 +151,14 @@ func (client *Client) connect(opts *mqtt.ClientOptions) error {
 	return nil
 }
 
+// Healthz reports an error if the connection to the broker is down.
+func (client *Client) Healthz() error {
+	if !client.connection.IsConnectionOpen() {
+		return errors.New("not connected to MQTT broker")
+	}
+	return nil
+}
+
 func (client *Client) PublishMany(topic string, values map[string]interface{}) error {
 	for key, val := range values {
 		err := client.PublishRaw(fmt.Sprintf("%s/%s/%s", client.Prefix, topic, key), val)
@@ -76,50 +170,181 @@ func (client *Client) PublishMany(topic string, values map[string]interface{}) e
 }
 
 func (client *Client) PublishRaw(topic string, val interface{}) error {
-	var payload []byte
-	switch p := val.(type) {
-	case string:
-		payload = []byte(p)
-	case []byte:
-		payload = p
-	default:
-		jsonVal, err := json.Marshal(val)
-		if err != nil {
-			return fmt.Errorf("marshalling %s: %v", topic, val)
-		}
-		payload = jsonVal
+	return client.publish(topic, val, true)
+}
+
+func (client *Client) PublishJSON(topic string, val interface{}) error {
+	jsonVal, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("marshalling %s: %v", topic, val)
 	}
+	return client.publish(topic, jsonVal, true)
+}
 
-	token := client.connection.Publish(topic, 0, true, payload)
-	go func() {
-		<-token.Done()
-		if token.Error() != nil {
-			log.Error(token.Error())
+// Dropped returns the number of messages dropped because the outbound queue
+// was full.
+func (client *Client) Dropped() int64 {
+	return client.queue.dropped.Load()
+}
+
+// QueueLength returns the number of messages waiting to be sent.
+func (client *Client) QueueLength() int {
+	return client.queue.length()
+}
+
+// PublishErrors returns the number of messages the broker has failed to
+// accept.
+func (client *Client) PublishErrors() int64 {
+	return client.errorCount.Load()
+}
+
+// PublishDiscovery publishes a retained discovery config, given as for
+// Home Assistant under homeassistant/, remembering the topic so that it can
+// be removed by ClearDiscovery. It is also published for Domoticz if that
+// is enabled and Domoticz supports the component.
+func (client *Client) PublishDiscovery(topic string, val interface{}) error {
+	var err error
+	if client.homeAssistant {
+		err = client.publishDiscovery(topic, val)
+	}
+	if client.domoticzPrefix == "" {
+		return err
+	}
+	if domoticz, ok := domoticzTopic(client.domoticzPrefix, topic); ok {
+		config, cerr := domoticzConfig(val)
+		if cerr == nil {
+			cerr = client.publishDiscovery(domoticz, config)
+		}
+		if err == nil {
+			err = cerr
 		}
-	}()
+	}
+	return err
+}
 
-	return nil
+func (client *Client) publishDiscovery(topic string, val interface{}) error {
+	client.discoveryMutex.Lock()
+	client.discoveryTopics[topic] = true
+	client.discoveryMutex.Unlock()
+	return client.PublishJSON(topic, val)
 }
 
-func (client *Client) PublishJSON(topic string, val interface{}) error {
-	jsonVal, err := json.Marshal(val)
+// RemoveDiscovery removes a discovery config published by PublishDiscovery,
+// such as when an entity changes component.
+func (client *Client) RemoveDiscovery(topic string) {
+	var topics []string
+	if client.homeAssistant {
+		topics = append(topics, topic)
+	}
+	if domoticz, ok := domoticzTopic(client.domoticzPrefix, topic); ok && client.domoticzPrefix != "" {
+		topics = append(topics, domoticz)
+	}
+	client.discoveryMutex.Lock()
+	for _, t := range topics {
+		delete(client.discoveryTopics, t)
+	}
+	client.discoveryMutex.Unlock()
+	for _, t := range topics {
+		client.PublishRaw(t, "")
+	}
+}
+
+// ClearDiscovery removes every discovery config published, by publishing an
+// empty retained message to each topic.
+func (client *Client) ClearDiscovery() {
+	client.discoveryMutex.Lock()
+	defer client.discoveryMutex.Unlock()
+	for topic := range client.discoveryTopics {
+		client.connection.Publish(client.profile.topic(topic), 1, true, "").WaitTimeout(3 * time.Second)
+	}
+	client.discoveryTopics = make(map[string]bool)
+}
+
+// Close marks the device offline, waits for pending messages to be sent,
+// and disconnects from the broker.
+func (client *Client) Close() {
+	for deadline := time.Now().Add(3 * time.Second); client.queue.length() > 0 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	client.connection.Publish(client.profile.topic(fmt.Sprintf("%s/device/status", client.Prefix)), 1, true, "offline").WaitTimeout(3 * time.Second)
+	client.connection.Disconnect(1000)
+}
+
+// PublishEvent publishes an event to a topic under the prefix. Unlike
+// values, events are not retained, so that subscribers don't see a stale
+// event replayed when they connect.
+func (client *Client) PublishEvent(topic string, val interface{}) error {
+	return client.publish(fmt.Sprintf("%s/%s", client.Prefix, topic), val, false)
+}
+
+func (client *Client) publish(topic string, val interface{}, retained bool) error {
+	payload, err := Payload(val)
 	if err != nil {
 		return fmt.Errorf("marshalling %s: %v", topic, val)
 	}
-	token := client.connection.Publish(topic, 0, true, jsonVal)
-	go func() {
+
+	client.queue.push(message{topic: topic, payload: payload, retained: retained})
+	return nil
+}
+
+// send publishes queued messages, holding them while the broker is
+// unreachable, or the profile's rate is reached, so that the queue's drop
+// policy decides what is lost.
+func (client *Client) send() {
+	var limit <-chan time.Time
+	if client.profile.rate > 0 {
+		limit = time.NewTicker(time.Second / time.Duration(client.profile.rate)).C
+	}
+	for {
+		m := client.queue.pop()
+		for !client.connection.IsConnectionOpen() {
+			time.Sleep(time.Second)
+		}
+		if limit != nil {
+			<-limit
+		}
+		client.tokens <- client.connection.Publish(client.profile.topic(m.topic), 0, m.retained, m.payload)
+	}
+}
+
+// confirm waits for the broker to accept each published message in turn,
+// counting those it fails to.
+func (client *Client) confirm() {
+	for token := range client.tokens {
 		<-token.Done()
 		if token.Error() != nil {
+			publishErrors.Add(context.Background(), 1)
+			client.errorCount.Add(1)
 			log.Error(token.Error())
+			continue
 		}
-	}()
-
-	return nil
+		publishCounter.Add(context.Background(), 1)
+	}
 }
 
 func (client *Client) Subscribe(topic string, qos byte, callback MessageHandler) error {
-	full_topic := fmt.Sprintf("%s/%s", client.Prefix, topic)
-	token := client.connection.Subscribe(full_topic, qos, func(_ mqtt.Client, msg mqtt.Message) {
+	return client.SubscribeRaw(fmt.Sprintf("%s/%s", client.Prefix, topic), qos, callback)
+}
+
+// Unsubscribe stops a subscription made with Subscribe.
+func (client *Client) Unsubscribe(topic string) error {
+	if client.profile.inbox != "" {
+		client.unroute(fmt.Sprintf("%s/%s", client.Prefix, topic))
+		return nil
+	}
+	token := client.connection.Unsubscribe(fmt.Sprintf("%s/%s", client.Prefix, topic))
+	for !token.WaitTimeout(3 * time.Second) {
+	}
+	return token.Error()
+}
+
+// SubscribeRaw subscribes to a topic outside of the prefix, such as one
+// published by another device.
+func (client *Client) SubscribeRaw(topic string, qos byte, callback MessageHandler) error {
+	if client.profile.inbox != "" {
+		return client.route(topic, callback)
+	}
+	token := client.connection.Subscribe(topic, qos, func(_ mqtt.Client, msg mqtt.Message) {
 		callback(client, msg)
 	})
 	for !token.WaitTimeout(3 * time.Second) {
@@ -130,23 +355,41 @@ func (client *Client) Subscribe(topic string, qos byte, callback MessageHandler)
 	return nil
 }
 
-func createClientOptions(uri *url.URL, clientId string) *mqtt.ClientOptions {
+func (client *Client) createClientOptions() (*mqtt.ClientOptions, error) {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s", uri.Host))
-	opts.SetUsername(uri.User.Username())
-	password, _ := uri.User.Password()
-	opts.SetPassword(password)
-	opts.SetClientID(clientId)
+	opts.AddBroker(client.profile.broker)
+	if client.profile.secure {
+		config, err := client.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(config)
+	}
+	opts.SetUsername(client.profile.username)
+	opts.SetPassword(client.profile.password)
+	if client.profile.credentials != nil {
+		opts.SetCredentialsProvider(client.profile.credentials)
+	}
+	opts.SetClientID(client.profile.clientID)
 	opts.SetKeepAlive(30 * time.Second)
 	opts.SetMaxReconnectInterval(10 * time.Second)
 	opts.SetAutoReconnect(true)
 
-	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
-		log.Errorf("mqtt connection lost: %v", err)
-	})
 	opts.SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
 		log.Warn("mqtt reconnecting")
 	})
 
-	return opts
+	return opts, nil
+}
+
+// Payload returns what is published for a value: strings and bytes as they
+// are, and anything else as JSON.
+func Payload(val interface{}) ([]byte, error) {
+	switch p := val.(type) {
+	case string:
+		return []byte(p), nil
+	case []byte:
+		return p, nil
+	}
+	return json.Marshal(val)
 }
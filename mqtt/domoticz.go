@@ -0,0 +1,97 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const homeAssistantPrefix = "homeassistant/"
+
+// domoticzComponents are the Home Assistant components Domoticz's MQTT
+// Auto Discovery gateway creates devices for.
+var domoticzComponents = map[string]bool{
+	"sensor":        true,
+	"binary_sensor": true,
+	"switch":        true,
+	"select":        true,
+	"number":        true,
+	"button":        true,
+}
+
+// domoticzIgnored are options Domoticz doesn't understand, which are left
+// out rather than risk confusing it.
+var domoticzIgnored = []string{
+	"avty",
+	"avty_mode",
+	"entity_category",
+	"ic",
+	"json_attr_t",
+	"mode",
+	"native_unit_of_measurement",
+	"suggested_display_precision",
+	"suggested_unit_of_measurement",
+}
+
+// domoticzTopic returns the topic a Home Assistant discovery topic is
+// published on for Domoticz, or false if Domoticz doesn't support the
+// component.
+func domoticzTopic(prefix string, topic string) (string, bool) {
+	rest, ok := strings.CutPrefix(topic, homeAssistantPrefix)
+	if !ok {
+		return "", false
+	}
+	component, _, _ := strings.Cut(rest, "/")
+	if !domoticzComponents[component] {
+		return "", false
+	}
+	return prefix + "/" + rest, true
+}
+
+// domoticzConfig adapts a Home Assistant discovery config to the subset
+// Domoticz supports. Domoticz follows a single availability topic, so only
+// the first of several is kept, and takes the unit from
+// unit_of_measurement.
+func domoticzConfig(val interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	if list, ok := config["avty"].([]interface{}); ok && len(list) > 0 {
+		if first, ok := list[0].(map[string]interface{}); ok {
+			if _, ok := config["avty_t"]; !ok {
+				config["avty_t"] = first["t"]
+			}
+		}
+	}
+	if unit, ok := config["native_unit_of_measurement"]; ok {
+		if _, ok := config["unit_of_measurement"]; !ok {
+			config["unit_of_measurement"] = unit
+		}
+	}
+	for _, key := range domoticzIgnored {
+		delete(config, key)
+	}
+	return config, nil
+}
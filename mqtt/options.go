@@ -0,0 +1,59 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithQueue sets how many messages can wait to be sent to the broker, and
+// what happens to messages published while that many are waiting. The
+// default is 1024 messages, dropping the oldest.
+func WithQueue(size int, policy DropPolicy) Option {
+	return func(client *Client) {
+		client.queue = newQueue(size, policy)
+	}
+}
+
+// WithDiscovery sets where discovery configs are published: for Home
+// Assistant, under homeassistant/, unless homeAssistant is false, and a
+// Domoticz compatible copy under domoticzPrefix, unless it is empty.
+func WithDiscovery(homeAssistant bool, domoticzPrefix string) Option {
+	return func(client *Client) {
+		client.homeAssistant = homeAssistant
+		client.domoticzPrefix = domoticzPrefix
+	}
+}
+
+// WithTLS sets the file of the CA certificates that the broker's
+// certificate is checked against, instead of the system's, and the files
+// of a certificate and key to authenticate with. Any can be empty.
+func WithTLS(ca string, cert string, key string) Option {
+	return func(client *Client) {
+		client.tlsCA = ca
+		client.tlsCert = cert
+		client.tlsKey = key
+	}
+}
+
+// WithSASKey sets the shared access key that an Azure IoT Hub device signs
+// its SAS tokens with.
+func WithSASKey(key string) Option {
+	return func(client *Client) {
+		client.sasKey = key
+	}
+}
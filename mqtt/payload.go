@@ -0,0 +1,55 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseFloat reads a number from another device's payload, which is either
+// a bare number or, if field is set, a JSON object with the number at a
+// dotted field path, e.g. "temperature" for zigbee2mqtt.
+func ParseFloat(payload []byte, field string) (float64, error) {
+	if field == "" {
+		return strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return 0, err
+	}
+	for _, part := range strings.Split(field, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("no field %s", field)
+		}
+		if value, ok = obj[part]; !ok {
+			return 0, fmt.Errorf("no field %s", field)
+		}
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("field %s is not a number", field)
+}
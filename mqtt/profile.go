@@ -0,0 +1,308 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	securePort = "8883"
+
+	// AWS IoT Core throttles connections publishing more than this many
+	// messages a second, and Azure IoT Hub hubs with few units.
+	cloudRate = 100
+
+	azureAPIVersion = "2021-04-12"
+	// IoT Hub drops the connection when its SAS token expires, and it is
+	// reconnected with a new one.
+	sasTokenTTL = 24 * time.Hour
+)
+
+// profile is what a broker requires of its clients, chosen by the scheme
+// of the broker URI:
+//
+//   - ssl:// or mqtts:// connects with TLS, and anything else, such as
+//     tcp://, in plain text.
+//   - aws://<thing>@<endpoint> connects to AWS IoT Core as the thing, with
+//     its certificate.
+//   - azure://<device>@<hub> connects to Azure IoT Hub as the device, with
+//     a SAS token or its certificate. Hubs only accept device-to-cloud
+//     messages, so messages are sent as those with the topic as a
+//     property, and cloud-to-device messages are delivered to
+//     subscriptions that match their topic property.
+type profile struct {
+	name        string
+	broker      string
+	clientID    string
+	username    string
+	password    string
+	credentials mqtt.CredentialsProvider
+	secure      bool
+	alpn        []string
+	// certificate is set if the broker only accepts clients with a
+	// certificate.
+	certificate bool
+	// topic returns the topic to publish a message for topic on.
+	topic func(string) string
+	// inbox, if set, is the only topic that can be subscribed to.
+	inbox string
+	// rate, if not 0, limits the messages published a second.
+	rate int
+}
+
+func newProfile(uri *url.URL, clientID string, sasKey string) (*profile, error) {
+	same := func(topic string) string { return topic }
+	password, _ := uri.User.Password()
+	p := &profile{
+		name:     "MQTT",
+		clientID: clientID,
+		username: uri.User.Username(),
+		password: password,
+		topic:    same,
+	}
+
+	switch uri.Scheme {
+	case "ssl", "tls", "mqtts":
+		p.broker = fmt.Sprintf("ssl://%s", hostPort(uri))
+		p.secure = true
+	case "aws":
+		if uri.User.Username() == "" {
+			return nil, fmt.Errorf("no thing name, use aws://<thing>@<endpoint>")
+		}
+		p.name = "AWS IoT"
+		p.broker = fmt.Sprintf("ssl://%s", hostPort(uri))
+		p.secure = true
+		p.certificate = true
+		// Policies usually only let a thing connect with its own name.
+		p.clientID = uri.User.Username()
+		p.username, p.password = "", ""
+		if uri.Port() == "443" {
+			p.alpn = []string{"x-amzn-mqtt-ca"}
+		}
+		p.rate = cloudRate
+	case "azure":
+		device := uri.User.Username()
+		if device == "" {
+			return nil, fmt.Errorf("no device id, use azure://<device>@<hub>")
+		}
+		hub := uri.Hostname()
+		p.name = "Azure IoT Hub"
+		p.broker = fmt.Sprintf("ssl://%s", hostPort(uri))
+		p.secure = true
+		p.clientID = device
+		p.username = fmt.Sprintf("%s/%s/?api-version=%s", hub, device, azureAPIVersion)
+		p.password = ""
+		if sasKey != "" {
+			if _, err := base64.StdEncoding.DecodeString(sasKey); err != nil {
+				return nil, fmt.Errorf("invalid shared access key: %v", err)
+			}
+			// Each connection gets a new token, as the old one may have
+			// expired.
+			p.credentials = func() (string, string) {
+				token, _ := sasToken(hub, device, sasKey, sasTokenTTL)
+				return p.username, token
+			}
+		} else {
+			p.certificate = true
+		}
+		events := fmt.Sprintf("devices/%s/messages/events/", device)
+		p.topic = func(topic string) string {
+			return events + url.Values{"topic": {topic}}.Encode()
+		}
+		p.inbox = fmt.Sprintf("devices/%s/messages/devicebound/#", device)
+		p.rate = cloudRate
+	default:
+		p.broker = fmt.Sprintf("tcp://%s", uri.Host)
+	}
+	return p, nil
+}
+
+func hostPort(uri *url.URL) string {
+	if uri.Port() != "" {
+		return uri.Host
+	}
+	return net.JoinHostPort(uri.Hostname(), securePort)
+}
+
+// Retains reports whether the broker at uri keeps retained messages, which
+// discovery and warm starts rely on. Azure IoT Hub doesn't.
+func Retains(uri *url.URL) bool {
+	return uri.Scheme != "azure"
+}
+
+// ParseConnectionString converts an Azure IoT Hub device connection
+// string, HostName=<hub>;DeviceId=<device>;SharedAccessKey=<key>, to the
+// broker URI and the shared access key.
+func ParseConnectionString(s string) (*url.URL, string, error) {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, "", fmt.Errorf("invalid connection string")
+		}
+		fields[name] = value
+	}
+	if fields["HostName"] == "" || fields["DeviceId"] == "" {
+		return nil, "", fmt.Errorf("connection string has no HostName or DeviceId")
+	}
+	if fields["ModuleId"] != "" {
+		return nil, "", fmt.Errorf("module connection strings aren't supported")
+	}
+	return &url.URL{
+		Scheme: "azure",
+		User:   url.User(fields["DeviceId"]),
+		Host:   fields["HostName"],
+	}, fields["SharedAccessKey"], nil
+}
+
+// sasToken signs a token for an IoT Hub device with its shared access key.
+func sasToken(hub string, device string, key string, ttl time.Duration) (string, error) {
+	secret, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	resource := url.QueryEscape(fmt.Sprintf("%s/devices/%s", hub, device))
+	expiry := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(resource + "\n" + expiry))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s", resource, url.QueryEscape(signature), expiry), nil
+}
+
+func (client *Client) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: client.profile.alpn,
+	}
+	if client.tlsCA != "" {
+		pem, err := os.ReadFile(client.tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", client.tlsCA)
+		}
+	}
+	if client.tlsCert != "" || client.tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(client.tlsCert, client.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else if client.profile.certificate {
+		return nil, fmt.Errorf("%s needs a client certificate and key", client.profile.name)
+	}
+	return config, nil
+}
+
+// routedMessage is a message from the inbox, carrying the topic it was
+// sent for.
+type routedMessage struct {
+	mqtt.Message
+	topic string
+}
+
+func (m routedMessage) Topic() string {
+	return m.topic
+}
+
+// route delivers messages from the inbox to callback when their topic
+// property matches topic, subscribing to the inbox the first time.
+func (client *Client) route(topic string, callback MessageHandler) error {
+	client.routeMutex.Lock()
+	client.routes[topic] = callback
+	subscribed := client.inboxSubscribed
+	client.inboxSubscribed = true
+	client.routeMutex.Unlock()
+	if subscribed {
+		return nil
+	}
+
+	token := client.connection.Subscribe(client.profile.inbox, 1, client.deliver)
+	for !token.WaitTimeout(3 * time.Second) {
+	}
+	if err := token.Error(); err != nil {
+		client.routeMutex.Lock()
+		client.inboxSubscribed = false
+		client.routeMutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (client *Client) unroute(topic string) {
+	client.routeMutex.Lock()
+	defer client.routeMutex.Unlock()
+	delete(client.routes, topic)
+}
+
+func (client *Client) deliver(_ mqtt.Client, msg mqtt.Message) {
+	// The properties are the last level of the topic.
+	properties, err := url.ParseQuery(msg.Topic()[strings.LastIndex(msg.Topic(), "/")+1:])
+	if err != nil || properties.Get("topic") == "" {
+		log.Warnf("Ignoring message on %s without a topic property", msg.Topic())
+		return
+	}
+	topic := properties.Get("topic")
+
+	client.routeMutex.Lock()
+	var callbacks []MessageHandler
+	for filter, callback := range client.routes {
+		if matchTopic(filter, topic) {
+			callbacks = append(callbacks, callback)
+		}
+	}
+	client.routeMutex.Unlock()
+	if len(callbacks) == 0 {
+		log.Warnf("Ignoring message for %s, which nothing is subscribed to", topic)
+	}
+	for _, callback := range callbacks {
+		callback(client, routedMessage{Message: msg, topic: topic})
+	}
+}
+
+// matchTopic reports whether topic matches an MQTT topic filter.
+func matchTopic(filter string, topic string) bool {
+	filters := strings.Split(filter, "/")
+	levels := strings.Split(topic, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(levels) || (f != "+" && f != levels[i]) {
+			return false
+		}
+	}
+	return len(filters) == len(levels)
+}
@@ -0,0 +1,125 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DropPolicy decides what happens to a message published while the
+// outbound queue is full, because the broker is slow or unreachable.
+type DropPolicy string
+
+const (
+	// DropOldest discards the oldest queued message to make room, so that
+	// the latest values get through once the broker catches up.
+	DropOldest DropPolicy = "oldest"
+	// DropNewest discards the message being published.
+	DropNewest DropPolicy = "newest"
+	// Block waits for room in the queue, holding up whatever published.
+	Block DropPolicy = "block"
+)
+
+var dropPolicies = []DropPolicy{DropOldest, DropNewest, Block}
+
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	for _, p := range dropPolicies {
+		if DropPolicy(s) == p {
+			return p, nil
+		}
+	}
+	names := make([]string, len(dropPolicies))
+	for i, p := range dropPolicies {
+		names[i] = string(p)
+	}
+	return "", fmt.Errorf("unknown drop policy %q, expected one of %s", s, strings.Join(names, ", "))
+}
+
+const defaultQueueSize = 1024
+
+type message struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+// queue holds messages waiting to be sent to the broker.
+type queue struct {
+	size     int
+	policy   DropPolicy
+	messages []message
+	dropped  atomic.Int64
+	mutex    sync.Mutex
+	cond     *sync.Cond
+}
+
+func newQueue(size int, policy DropPolicy) *queue {
+	q := &queue{size: size, policy: policy}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push adds a message to the queue, applying the drop policy if it is full.
+func (q *queue) push(m message) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.messages) >= q.size {
+		switch q.policy {
+		case DropNewest:
+			q.drop()
+			return
+		case Block:
+			q.cond.Wait()
+		default:
+			q.messages = q.messages[1:]
+			q.drop()
+		}
+	}
+	q.messages = append(q.messages, m)
+	q.cond.Broadcast()
+}
+
+// pop waits for a message and removes it from the queue.
+func (q *queue) pop() message {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.messages) == 0 {
+		q.cond.Wait()
+	}
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+	q.cond.Broadcast()
+	return m
+}
+
+func (q *queue) length() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.messages)
+}
+
+func (q *queue) drop() {
+	q.dropped.Add(1)
+	droppedCounter.Add(context.Background(), 1)
+}
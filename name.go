@@ -0,0 +1,83 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mlipscombe/boiler-mate/state"
+)
+
+const (
+	nameTopic     = "bridge/name"
+	nameStateKey  = "name"
+	maxNameLength = 64
+)
+
+// boilerName is the name the boiler is shown with in Home Assistant. It
+// can be changed from there, and is kept in the state store rather than on
+// the controller, which has nowhere to keep it.
+type boilerName struct {
+	serial   string
+	store    *state.Store
+	onChange []func(string)
+	mutex    sync.Mutex
+}
+
+func newBoilerName(serial string, store *state.Store) *boilerName {
+	return &boilerName{serial: serial, store: store}
+}
+
+// Get returns the name given to the boiler, or a name made from its serial
+// number if it has not been given one.
+func (n *boilerName) Get() string {
+	var name string
+	if n.store.Get(nameStateKey, &name) && name != "" {
+		return name
+	}
+	return fmt.Sprintf("NBE Boiler (%s)", n.serial)
+}
+
+// Set renames the boiler, or restores the default name if name is empty.
+func (n *boilerName) Set(name string) error {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return fmt.Errorf("name is longer than %d characters", maxNameLength)
+	}
+	if err := n.store.Set(nameStateKey, name); err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	handlers := n.onChange
+	n.mutex.Unlock()
+	for _, fn := range handlers {
+		fn(n.Get())
+	}
+	return nil
+}
+
+// OnChange calls fn with the new name whenever the boiler is renamed.
+func (n *boilerName) OnChange(fn func(string)) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.onChange = append(n.onChange, fn)
+}
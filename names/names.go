@@ -0,0 +1,157 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package names maps the category and key of values, as the controller
+// reports them, to the names they are published under: MQTT topics,
+// Prometheus metrics and Home Assistant discovery.
+package names
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Renames maps category.key to the name to publish it under, either a new
+// key in the same category, e.g. temp: dhw_temp, or a new category.key.
+type Renames map[string]string
+
+func (r Renames) Validate() error {
+	targets := make(map[string]string)
+	for from, to := range r {
+		category, key, ok := strings.Cut(from, ".")
+		if !ok || category == "" || key == "" {
+			return fmt.Errorf("%q is not a category.key", from)
+		}
+		target := to
+		if !strings.Contains(to, ".") {
+			target = category + "." + to
+		}
+		newCategory, newKey, _ := strings.Cut(target, ".")
+		if newCategory == "" || newKey == "" || Sanitize(newCategory) != newCategory || Sanitize(newKey) != newKey {
+			return fmt.Errorf("%s: %q may only contain a-z, 0-9 and _", from, to)
+		}
+		if other, ok := targets[target]; ok {
+			return fmt.Errorf("%s and %s are both renamed to %s", other, from, target)
+		}
+		targets[target] = from
+	}
+	return nil
+}
+
+type name struct {
+	category string
+	key      string
+}
+
+// Names publishes values under their sanitized names, or what they are
+// renamed to, and maps those names back for writes. A nil Names only
+// sanitizes.
+type Names struct {
+	forward map[name]name
+	reverse map[name]name
+	mutex   sync.RWMutex
+}
+
+func New(renames Renames) *Names {
+	n := &Names{
+		forward: make(map[name]name),
+		reverse: make(map[name]name),
+	}
+	for from, to := range renames {
+		category, key, _ := strings.Cut(from, ".")
+		target := name{category: category, key: to}
+		if c, k, ok := strings.Cut(to, "."); ok {
+			target = name{category: c, key: k}
+		}
+		n.forward[name{category, key}] = target
+		n.reverse[target] = name{category, key}
+	}
+	return n
+}
+
+// Name returns the category and key that category.key is published under.
+func (n *Names) Name(category string, key string) (string, string) {
+	if n == nil {
+		return Sanitize(category), Sanitize(key)
+	}
+	from := name{category, key}
+	n.mutex.RLock()
+	to, ok := n.forward[from]
+	n.mutex.RUnlock()
+	if ok {
+		return to.category, to.key
+	}
+
+	to = name{Sanitize(category), Sanitize(key)}
+	if to != from {
+		// Remember sanitized names so that writes to them can be mapped
+		// back.
+		n.mutex.Lock()
+		n.forward[from] = to
+		if _, taken := n.reverse[to]; !taken {
+			n.reverse[to] = from
+		}
+		n.mutex.Unlock()
+	}
+	return to.category, to.key
+}
+
+// Topic returns the topic, below the prefix, that category.key is
+// published on.
+func (n *Names) Topic(category string, key string) string {
+	category, key = n.Name(category, key)
+	return category + "/" + key
+}
+
+// Lookup maps a published category and key back to the controller's.
+// Names that were never renamed or sanitized are returned unchanged.
+func (n *Names) Lookup(category string, key string) (string, string) {
+	if n == nil {
+		return category, key
+	}
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if from, ok := n.reverse[name{category, key}]; ok {
+		return from.category, from.key
+	}
+	return category, key
+}
+
+// Sanitize lowercases a name and replaces anything but a-z, 0-9 and _,
+// such as the MQTT wildcards and separators, with _.
+func Sanitize(s string) string {
+	clean := true
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range strings.ToLower(s) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+// AlarmTexts describe the alarm states by language, with what to check
+// before restarting the boiler.
+var AlarmTexts = map[string]map[int64]string{
+	"en": {
+		8:  "The boiler temperature is outside its limits. Check the boiler temperature sensor and that water is circulating.",
+		11: "The burner has overheated. Find the cause, such as a blocked flue or a failed fan, before restarting.",
+		12: "The burner plug is disconnected. Check the plug between the burner and the boiler.",
+		13: "The burner failed to ignite. Check the ignition element, the photo sensor and that there are pellets in the hopper.",
+		15: "The boiler temperature sensor is faulty or disconnected.",
+		16: "The photo sensor is faulty, disconnected or dirty.",
+		17: "The burner temperature sensor is faulty or disconnected.",
+		18: "The return temperature sensor is faulty or disconnected.",
+		19: "A motor output is faulty. Check the auger, fan and cleaning motors and their wiring.",
+		20: "The fire went out. The hopper is probably empty, or the auger is blocked.",
+		21: "The smoke temperature sensor is faulty or disconnected.",
+		26: "The fan is not turning at the speed it is driven at. Check the fan and its wiring.",
+		27: "The fire went out at low power. Check the oxygen and power settings.",
+		28: "The boiler door is open.",
+		29: "The burner overheated or the external auger is disconnected.",
+		31: "The compressor for cleaning has failed. Check the compressor and its air supply.",
+		34: "The vacuum system failed to fill the hopper. Check the pellet store, the hoses and the vacuum motor.",
+		35: "The oxygen sensor is faulty or needs calibrating.",
+	},
+	"da": {
+		8:  "Kedeltemperaturen er uden for grænserne. Kontroller kedelføleren og at vandet cirkulerer.",
+		11: "Brænderen er overophedet. Find årsagen, f.eks. en blokeret røggang eller en defekt blæser, før genstart.",
+		12: "Brænderstikket er afbrudt. Kontroller stikket mellem brænder og kedel.",
+		13: "Brænderen tændte ikke. Kontroller tændelegemet, fotocellen og at der er piller i magasinet.",
+		15: "Kedelføleren er defekt eller afbrudt.",
+		16: "Fotocellen er defekt, afbrudt eller snavset.",
+		17: "Brænderføleren er defekt eller afbrudt.",
+		18: "Returføleren er defekt eller afbrudt.",
+		19: "En motorudgang er defekt. Kontroller snegl, blæser og rensemotorer og deres ledninger.",
+		20: "Ilden er gået ud. Magasinet er sandsynligvis tomt, eller sneglen er blokeret.",
+		21: "Røgføleren er defekt eller afbrudt.",
+		26: "Blæseren kører ikke med den hastighed den styres til. Kontroller blæseren og dens ledninger.",
+		27: "Ilden er gået ud ved lav effekt. Kontroller ilt- og effektindstillingerne.",
+		28: "Kedellågen er åben.",
+		29: "Brænderen er overophedet eller den eksterne snegl er afbrudt.",
+		31: "Kompressoren til rensning har fejlet. Kontroller kompressoren og dens lufttilførsel.",
+		34: "Vakuumsystemet kunne ikke fylde magasinet. Kontroller pillelageret, slangerne og vakuummotoren.",
+		35: "Iltsonden er defekt eller skal kalibreres.",
+	},
+}
+
+var alarmTextOverrides map[int64]string
+
+// OverrideAlarmTexts replaces the description of alarm states, whatever
+// the language. It must be called before anything asks for an AlarmText.
+func OverrideAlarmTexts(texts map[int64]string) {
+	alarmTextOverrides = texts
+}
+
+// AlarmText describes an alarm state in language, falling back to English
+// and then to the text of the power state.
+func AlarmText(language string, state int64) string {
+	if text, ok := alarmTextOverrides[state]; ok {
+		return text
+	}
+	if text, ok := AlarmTexts[language][state]; ok {
+		return text
+	}
+	if text, ok := AlarmTexts["en"][state]; ok {
+		return text
+	}
+	return PowerStateText(state)
+}
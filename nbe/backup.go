@@ -0,0 +1,66 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import "fmt"
+
+// Backup is a snapshot of every setting, together with the range of each
+// and what the controller reports about itself, so that tuned settings can
+// be restored after a service visit or a controller replacement.
+type Backup struct {
+	SettingsDump
+	Schema map[string]SettingDefinition `json:"schema"`
+	Info   map[string]interface{}       `json:"info,omitempty"`
+}
+
+// BackupSettings dumps every settings category with its ranges. Ranges and
+// info that can't be read are recorded in Errors, like categories that
+// can't be, as not every controller reports them.
+func BackupSettings(boiler Boiler) (*Backup, error) {
+	dump, err := DumpSettings(boiler)
+	if err != nil {
+		return nil, err
+	}
+	backup := Backup{
+		SettingsDump: *dump,
+		Schema:       make(map[string]SettingDefinition),
+	}
+
+	for category := range dump.Settings {
+		schema, err := LoadSchema(boiler, []string{category})
+		if err != nil {
+			backup.Errors[category] = err.Error()
+			continue
+		}
+		for name, definition := range schema {
+			backup.Schema[name] = definition
+		}
+	}
+
+	response, err := boiler.Get(GetInfoFunction, "*")
+	switch {
+	case err != nil:
+		backup.Errors["info"] = err.Error()
+	case response.Status != 0:
+		backup.Errors["info"] = fmt.Sprintf("controller answered with status %d", response.Status)
+	default:
+		backup.Info = response.Payload
+	}
+
+	return &backup, nil
+}
@@ -0,0 +1,76 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"net/url"
+	"time"
+)
+
+// Boiler is a controller that boiler-mate can poll and write settings to.
+// It is implemented by *NBE, which talks to a real controller over UDP, and
+// by MockBoiler and Replay, so that anything built on Boiler can be run
+// without hardware.
+type Boiler interface {
+	// Serial returns the controller's serial number.
+	Serial() string
+	// Address returns the host the controller is reached at.
+	Address() string
+
+	Get(function Function, path string) (*NBEResponse, error)
+	GetAsync(function Function, path string, cb func(*NBEResponse)) (int8, error)
+	Set(path string, value []byte) (*NBEResponse, error)
+	SetAsync(path string, value []byte, cb func(*NBEResponse)) (int8, error)
+	// Subscribe calls cb with every response the controller answers a
+	// request with, whoever made the request, until the returned function
+	// is called. cb must not block.
+	Subscribe(cb func(*NBEResponse)) (unsubscribe func())
+
+	// QueueLength returns the number of requests waiting for a response,
+	// and OldestPending how long the oldest of them has been waiting.
+	QueueLength() int
+	OldestPending() time.Duration
+	// Timeouts returns the number of requests that went unanswered.
+	Timeouts() int64
+	// Mismatches returns the number of responses dropped because they
+	// didn't match a waiting request.
+	Mismatches() int64
+	// Stalled reports an error if requests have gone unanswered for longer
+	// than timeout, and Reconnect tries to recover from that.
+	Stalled(timeout time.Duration) error
+	Reconnect() error
+	Close() error
+}
+
+var _ Boiler = (*NBE)(nil)
+var _ Boiler = (*MockBoiler)(nil)
+var _ Boiler = (*Replay)(nil)
+
+// Dial returns a Boiler for uri. Controllers are given as
+// tcp://<serial>:<password>@<host>:<port>, and captures written by
+// WithRecorder as replay:<path>.
+func Dial(uri *url.URL, options ...Option) (Boiler, error) {
+	if uri.Scheme == "replay" {
+		path := uri.Opaque
+		if path == "" {
+			path = uri.Host + uri.Path
+		}
+		return OpenReplay(path)
+	}
+	return NewNBE(uri, options...)
+}
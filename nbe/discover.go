@@ -0,0 +1,130 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// DiscoveryAddress is where controllers listen for discovery broadcasts.
+const DiscoveryAddress = "255.255.255.255:8483"
+
+// Controller is a controller that answered a discovery broadcast.
+type Controller struct {
+	Serial   string `json:"serial"`
+	IP       string `json:"ip"`
+	Model    string `json:"model,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// Discover sends a discovery request to address, usually DiscoveryAddress,
+// and returns every controller that answers within wait, ordered by serial.
+// Controllers answer with their serial, IP address, model (type) and
+// firmware version (ver), though older firmware only sends the serial.
+func Discover(address string, wait time.Duration) ([]Controller, error) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	appID, err := randomString(12)
+	if err != nil {
+		return nil, err
+	}
+	controllerID, err := randomString(6)
+	if err != nil {
+		return nil, err
+	}
+	request := NBERequest{
+		AppID:        appID,
+		ControllerID: controllerID,
+		Function:     DiscoveryFunction,
+		Payload:      []byte("NBE Discovery"),
+	}
+	packet := new(bytes.Buffer)
+	if err := request.Pack(packet); err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(packet.Bytes(), addr); err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]Controller)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	buffer := make([]byte, datagramBuffer)
+	for {
+		n, from, err := conn.ReadFrom(buffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Anything else on the port, such as another client's broadcast,
+		// is ignored.
+		var response NBEResponse
+		if err := response.Unpack(bytes.NewReader(buffer[:n])); err != nil {
+			continue
+		}
+		if response.Function != DiscoveryFunction || response.AppID != appID {
+			continue
+		}
+		controller := Controller{
+			Serial:   payloadString(response.Payload, "serial"),
+			IP:       payloadString(response.Payload, "ip"),
+			Model:    payloadString(response.Payload, "type"),
+			Firmware: payloadString(response.Payload, "ver"),
+		}
+		if controller.Serial == "" {
+			continue
+		}
+		if controller.IP == "" {
+			controller.IP = from.(*net.UDPAddr).IP.String()
+		}
+		found[controller.Serial] = controller
+	}
+
+	controllers := make([]Controller, 0, len(found))
+	for _, controller := range found {
+		controllers = append(controllers, controller)
+	}
+	sort.Slice(controllers, func(i, j int) bool {
+		return controllers[i].Serial < controllers[j].Serial
+	})
+	return controllers, nil
+}
+
+func payloadString(payload map[string]interface{}, key string) string {
+	value, ok := payload[key]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,58 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"fmt"
+	"time"
+)
+
+// SettingsDump is a snapshot of every settings category on the controller.
+type SettingsDump struct {
+	Timestamp time.Time                         `json:"timestamp"`
+	Serial    string                            `json:"serial"`
+	Settings  map[string]map[string]interface{} `json:"settings"`
+	Errors    map[string]string                 `json:"errors,omitempty"`
+}
+
+// DumpSettings queries every settings category in turn. Categories that
+// fail to respond are recorded in Errors rather than aborting the dump, as
+// not every controller supports every category.
+func DumpSettings(boiler Boiler) (*SettingsDump, error) {
+	dump := SettingsDump{
+		Timestamp: time.Now(),
+		Serial:    boiler.Serial(),
+		Settings:  make(map[string]map[string]interface{}),
+		Errors:    make(map[string]string),
+	}
+
+	for _, category := range Settings {
+		response, err := boiler.Get(GetSetupFunction, fmt.Sprintf("%s.*", category))
+		if err != nil {
+			dump.Errors[category] = err.Error()
+			continue
+		}
+		dump.Settings[category] = response.Payload
+	}
+
+	if len(dump.Settings) == 0 {
+		return nil, fmt.Errorf("no settings categories could be read")
+	}
+
+	return &dump, nil
+}
@@ -0,0 +1,74 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// Frames are small and packed or unpacked for every request, so these
+// helpers work on byte slices rather than going through fmt.
+
+// appendPadded appends s right aligned in a field of width runes, as %*s
+// does, or %0*s if pad is '0'.
+func appendPadded(b []byte, s string, width int, pad byte) []byte {
+	for n := utf8.RuneCountInString(s); n < width; n++ {
+		b = append(b, pad)
+	}
+	return append(b, s...)
+}
+
+// appendNumber appends n zero padded to width, as %0*d does.
+func appendNumber(b []byte, n int64, width int) []byte {
+	var digits [20]byte
+	d := strconv.AppendInt(digits[:0], n, 10)
+	if n < 0 {
+		b = append(b, '-')
+		d = d[1:]
+		width--
+	}
+	for i := len(d); i < width; i++ {
+		b = append(b, '0')
+	}
+	return append(b, d...)
+}
+
+// parseNumber parses a decimal field of a frame, optionally signed, as
+// strconv.ParseInt does without converting the field to a string.
+func parseNumber(field []byte) (int64, bool) {
+	negative := false
+	if len(field) > 0 && (field[0] == '-' || field[0] == '+') {
+		negative = field[0] == '-'
+		field = field[1:]
+	}
+	if len(field) == 0 || len(field) > 18 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range field {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if negative {
+		n = -n
+	}
+	return n, true
+}
@@ -0,0 +1,353 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// generatedKey returns a key like the one the simulator generates, made
+// once as it is slow.
+func generatedKey(t testing.TB) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		testKey = key
+	})
+	return testKey
+}
+
+func TestRequestPackUnpack(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		request NBERequest
+		encrypt bool
+		want    string
+	}{
+		{
+			name:    "plain",
+			request: NBERequest{AppID: "boiler-mate", ControllerID: "123456", Function: GetSetupFunction, SeqNo: 7, PinCode: "0000000000", Timestamp: ts, Payload: []byte("boiler.*")},
+			want:    " boiler-mate123456 \x02010700000000001700000000extr008boiler.*\x04",
+		},
+		{
+			name:    "pin code",
+			request: NBERequest{AppID: "boiler-mate", ControllerID: "123456", Function: SetSetupFunction, SeqNo: 12, PinCode: "0123456789", Timestamp: ts, Payload: []byte("boiler.temp=70")},
+			want:    " boiler-mate123456 \x0202120123456789" + "1700000000extr014boiler.temp=70\x04",
+		},
+		{
+			name:    "last seq no",
+			request: NBERequest{AppID: "boiler-mate", ControllerID: "123456", Function: GetOperatingDataFunction, SeqNo: maxSeqNo, PinCode: "0000000000", Timestamp: ts, Payload: []byte("*")},
+			want:    " boiler-mate123456 \x020499" + "0000000000" + "1700000000extr001*\x04",
+		},
+		{
+			name:    "first seq no",
+			request: NBERequest{AppID: "boiler-mate", ControllerID: "123456", Function: GetOperatingDataFunction, SeqNo: 0, PinCode: "0000000000", Timestamp: ts, Payload: []byte("*")},
+			want:    " boiler-mate123456 \x020400" + "0000000000" + "1700000000extr001*\x04",
+		},
+		{
+			name:    "encrypted",
+			request: NBERequest{AppID: "boiler-mate", ControllerID: "123456", Function: SetSetupFunction, SeqNo: 99, PinCode: "0123456789", Timestamp: ts, Payload: []byte("boiler.temp=70")},
+			encrypt: true,
+		},
+		{
+			name:    "encrypted longest payload",
+			request: NBERequest{AppID: "boiler-mate", ControllerID: "123456", Function: SetSetupFunction, SeqNo: 1, PinCode: "0000000000", Timestamp: ts, Payload: []byte(strings.Repeat("x", encryptedSize-33))},
+			encrypt: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := tt.request
+			var key *rsa.PrivateKey
+			if tt.encrypt {
+				key = generatedKey(t)
+				request.RSAKey = &key.PublicKey
+			}
+
+			var buf bytes.Buffer
+			if err := request.Pack(&buf); err != nil {
+				t.Fatalf("Pack: %v", err)
+			}
+			if tt.want != "" && buf.String() != tt.want {
+				t.Errorf("Pack wrote %q, want %q", buf.String(), tt.want)
+			}
+			if tt.encrypt {
+				if buf.Bytes()[18] != '*' {
+					t.Errorf("encryption marker is %q, want '*'", buf.Bytes()[18])
+				}
+				if bytes.Contains(buf.Bytes(), request.Payload) {
+					t.Errorf("encrypted request contains the payload in the clear")
+				}
+			}
+
+			var got NBERequest
+			if err := got.UnpackEncrypted(&buf, key); err != nil {
+				t.Fatalf("Unpack: %v", err)
+			}
+			if !reflect.DeepEqual(got, request) {
+				t.Errorf("Unpack = %+v, want %+v", got, request)
+			}
+		})
+	}
+}
+
+func TestRequestPackErrors(t *testing.T) {
+	key := generatedKey(t)
+	tests := []struct {
+		name    string
+		request NBERequest
+	}{
+		{"no app id", NBERequest{ControllerID: "12345", Payload: []byte("*")}},
+		{"no controller id", NBERequest{AppID: "boiler-mate", Payload: []byte("*")}},
+		{"no payload", NBERequest{AppID: "boiler-mate", ControllerID: "12345"}},
+		{"payload too long", NBERequest{AppID: "boiler-mate", ControllerID: "12345", Payload: bytes.Repeat([]byte("x"), 1000)}},
+		{"too long to encrypt", NBERequest{AppID: "boiler-mate", ControllerID: "12345", RSAKey: &key.PublicKey, Payload: bytes.Repeat([]byte("x"), encryptedSize-32)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.request.Pack(&buf); err == nil {
+				t.Errorf("Pack succeeded, want an error")
+			}
+			if buf.Len() != 0 {
+				t.Errorf("Pack wrote %q after failing", buf.String())
+			}
+		})
+	}
+}
+
+func TestRequestUnpackEncryptedWithoutKey(t *testing.T) {
+	key := generatedKey(t)
+	request := NBERequest{AppID: "boiler-mate", ControllerID: "12345", RSAKey: &key.PublicKey, Function: GetSetupFunction, Payload: []byte("boiler.*")}
+	var buf bytes.Buffer
+	if err := request.Pack(&buf); err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	var got NBERequest
+	if err := got.Unpack(&buf); err == nil {
+		t.Errorf("Unpack of an encrypted request without a key succeeded")
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	key := generatedKey(t)
+	plain := append([]byte{0x02}, bytes.Repeat([]byte("p"), encryptedSize-1)...)
+	encrypt := func(plain []byte) []byte {
+		c := new(big.Int).SetBytes(plain)
+		return c.Exp(c, big.NewInt(int64(key.E)), key.N).Bytes()
+	}
+
+	got, err := decrypt(bytes.NewReader(encrypt(plain)), key)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("decrypt = %q, want %q", got, plain)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tests := []struct {
+		name   string
+		cipher []byte
+		key    *rsa.PrivateKey
+	}{
+		{"empty", nil, key},
+		{"short padding", encrypt(plain[:encryptedSize-1]), key},
+		{"longer than the key", bytes.Repeat([]byte{0xff}, key.Size()+1), key},
+		{"wrong key", encrypt(plain), other},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decrypt(bytes.NewReader(tt.cipher), tt.key); err == nil {
+				t.Errorf("decrypt succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestResponsePackUnpack(t *testing.T) {
+	tests := []struct {
+		name     string
+		response NBEResponse
+		want     string
+	}{
+		{
+			name: "values",
+			response: NBEResponse{AppID: "boiler-mate", ControllerID: "12345", Function: GetOperatingDataFunction, SeqNo: 42, Payload: map[string]interface{}{
+				"boiler_temp": RoundedFloat(65.5),
+				"power_pct":   int64(40),
+				"state":       "Power",
+			}},
+			want: " boiler-mate 12345\x0204420041boiler_temp=65.5;power_pct=40;state=Power\x04",
+		},
+		{
+			name: "status",
+			response: NBEResponse{AppID: "boiler-mate", ControllerID: "12345", Function: SetSetupFunction, SeqNo: 3, Status: 1, Payload: map[string]interface{}{
+				"boiler.temp": int64(70),
+			}},
+			want: " boiler-mate 12345\x0202031014boiler.temp=70\x04",
+		},
+		{
+			name: "range",
+			response: NBEResponse{AppID: "boiler-mate", ControllerID: "12345", Function: GetSetupRangeFunction, SeqNo: 5, Payload: map[string]interface{}{
+				"temp": map[string]interface{}{"min": int64(10), "max": int64(85), "default": int64(65), "decimals": int64(0)},
+			}},
+			want: " boiler-mate 12345\x0203050015temp=10,85,65,0\x04",
+		},
+		{
+			name:     "last seq no",
+			response: NBEResponse{AppID: "boiler-mate", ControllerID: "12345", Function: GetOperatingDataFunction, SeqNo: maxSeqNo, Payload: map[string]interface{}{"state": int64(5)}},
+			want:     " boiler-mate 12345\x0204990007state=5\x04",
+		},
+		{
+			name:     "first seq no",
+			response: NBEResponse{AppID: "boiler-mate", ControllerID: "12345", Function: GetOperatingDataFunction, SeqNo: 0, Payload: map[string]interface{}{"state": int64(5)}},
+			want:     " boiler-mate 12345\x0204000007state=5\x04",
+		},
+		{
+			name:     "error",
+			response: NBEResponse{AppID: "boiler-mate", ControllerID: "12345", Function: UnknownFunction, SeqNo: -1, Payload: map[string]interface{}{"error": "bad request"}},
+			want:     " boiler-mate 12345\x02-1-10011bad request\x04",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.response.Pack(&buf); err != nil {
+				t.Fatalf("Pack: %v", err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("Pack wrote %q, want %q", buf.String(), tt.want)
+			}
+
+			var got NBEResponse
+			if err := got.Unpack(&buf); err != nil {
+				t.Fatalf("Unpack: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.response) {
+				t.Errorf("Unpack = %+v, want %+v", got, tt.response)
+			}
+		})
+	}
+}
+
+func TestResponseUnpackErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"short header", " boiler-mate 12345\x020442"},
+		{"start marker", " boiler-mate 12345\x0304420007state=5\x04"},
+		{"status", " boiler-mate 12345\x020442x007state=5\x04"},
+		{"payload length", " boiler-mate 12345\x0204420x07state=5\x04"},
+		{"short payload", " boiler-mate 12345\x0204420009state=5\x04"},
+		{"end marker", " boiler-mate 12345\x0204420007state=5\x03"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got NBEResponse
+			if err := got.Unpack(strings.NewReader(tt.frame)); err == nil {
+				t.Errorf("Unpack succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestPendingSeqNoWraps(t *testing.T) {
+	p := newPendingRequests(maxSeqNo+1, nopTelemetry{})
+	p.seqNo = maxSeqNo - 1
+
+	var got []int8
+	for i := 0; i < 3; i++ {
+		seqNo, err := p.add(&pendingRequest{sent: time.Now()}, time.Minute)
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		got = append(got, seqNo)
+	}
+	if want := []int8{maxSeqNo, 0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("seq nos = %v, want %v", got, want)
+	}
+}
+
+func TestPendingSeqNoSkipsBusy(t *testing.T) {
+	p := newPendingRequests(maxSeqNo+1, nopTelemetry{})
+	p.seqNo = maxSeqNo
+	p.requests[0] = &pendingRequest{sent: time.Now()}
+
+	seqNo, err := p.add(&pendingRequest{sent: time.Now()}, time.Minute)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if seqNo != 1 {
+		t.Errorf("seq no = %d, want 1", seqNo)
+	}
+}
+
+func BenchmarkRequestPack(b *testing.B) {
+	request := NBERequest{AppID: "boiler-mate", ControllerID: "12345", Function: GetOperatingDataFunction, Timestamp: time.Unix(1700000000, 0), Payload: []byte("*")}
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := request.Pack(&buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResponseUnpack(b *testing.B) {
+	response := NBEResponse{AppID: "boiler-mate", ControllerID: "12345", Function: GetOperatingDataFunction, SeqNo: 42, Payload: map[string]interface{}{
+		"boiler_temp": RoundedFloat(65.5),
+		"smoke_temp":  RoundedFloat(120.2),
+		"power_kw":    RoundedFloat(7.4),
+		"power_pct":   int64(40),
+		"state":       int64(5),
+		"substate":    int64(0),
+	}}
+	var frame bytes.Buffer
+	if err := response.Pack(&frame); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var got NBEResponse
+		if err := got.Unpack(bytes.NewReader(frame.Bytes())); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockBoiler is an in-memory controller. Values are held as the raw strings
+// a real controller sends, and go through the same parsing, so consumers
+// see the same types they would from an NBE.
+type MockBoiler struct {
+	SerialNo string
+
+	values      map[Function]map[string]string
+	seqNo       int8
+	subscribers subscribers
+	mutex       sync.RWMutex
+}
+
+// NewMockBoiler returns a MockBoiler seeded with the values of an idle
+// boiler holding its setpoint.
+func NewMockBoiler(serial string) *MockBoiler {
+	return &MockBoiler{
+		SerialNo: serial,
+		values: map[Function]map[string]string{
+			GetSetupFunction: {
+				"boiler.temp":                 "65",
+				"boiler.diff_under":           "5",
+				"boiler.diff_over":            "15",
+				"hot_water.temp":              "50",
+				"hot_water.diff_under":        "5",
+				"regulation.boiler_power_min": "30",
+				"regulation.boiler_power_max": "100",
+				"hopper.content":              "120.5",
+				"hopper.auger_capacity":       "5.2",
+				"oxygen.regulation":           "1",
+				"oxygen.o2_low":               "11.0",
+				"oxygen.o2_medium":            "9.0",
+				"oxygen.o2_high":              "7.0",
+				"oxygen.gain":                 "1.5",
+				"oxygen.start_calibrate":      "0",
+				"auger.capacity":              "520",
+				"auger.start_calibrate":       "0",
+				"weather.active":              "1",
+				"weather.room_temp":           "21",
+				"weather.curve":               "1.2",
+				"weather.offset":              "0",
+				"weather.flow_min":            "25",
+				"weather.flow_max":            "70",
+				"weather2.active":             "1",
+				"weather2.room_temp":          "20",
+				"weather2.curve":              "0.6",
+				"weather2.offset":             "2",
+				"weather2.flow_min":           "20",
+				"weather2.flow_max":           "45",
+				"cleaning.compressor_count":   "1342",
+				"cleaning.countdown":          "240",
+				"cleaning.start":              "0",
+				"vacuum.state":                "0",
+				"vacuum.countdown":            "95",
+				"vacuum.error":                "0",
+				"vacuum.fill_now":             "0",
+				"sun.collector_temp":          "48.6",
+				"sun.tank_top_temp":           "52.3",
+				"sun.tank_bottom_temp":        "38.9",
+				"sun.pump":                    "1",
+				"misc.start":                  "0",
+				"misc.stop":                   "0",
+			},
+			GetSetupRangeFunction: {
+				"boiler.temp":                 "0,85,65,0",
+				"boiler.diff_under":           "0,50,5,0",
+				"boiler.diff_over":            "10,20,15,0",
+				"hot_water.temp":              "0,80,50,0",
+				"hot_water.diff_under":        "0,50,5,0",
+				"regulation.boiler_power_min": "10,100,30,0",
+				"regulation.boiler_power_max": "10,100,100,0",
+				"hopper.content":              "0,999,0,0",
+				"hopper.auger_capacity":       "0,50,5,1",
+				"oxygen.regulation":           "0,2,1,0",
+				"oxygen.o2_low":               "2,21,11,1",
+				"oxygen.o2_medium":            "2,21,9,1",
+				"oxygen.o2_high":              "2,21,7,1",
+				"oxygen.gain":                 "0.1,10,1.5,1",
+				"oxygen.start_calibrate":      "0,1,0,0",
+				"auger.capacity":              "100,5000,520,0",
+				"auger.start_calibrate":       "0,1,0,0",
+				"weather.active":              "0,1,0,0",
+				"weather.room_temp":           "5,30,21,0",
+				"weather.curve":               "0.2,3.5,1.2,1",
+				"weather.offset":              "-10,10,0,0",
+				"weather.flow_min":            "10,60,25,0",
+				"weather.flow_max":            "30,85,70,0",
+				"weather2.active":             "0,1,0,0",
+				"weather2.room_temp":          "5,30,21,0",
+				"weather2.curve":              "0.2,3.5,1.2,1",
+				"weather2.offset":             "-10,10,0,0",
+				"weather2.flow_min":           "10,60,25,0",
+				"weather2.flow_max":           "30,85,70,0",
+				"cleaning.start":              "0,1,0,0",
+				"vacuum.fill_now":             "0,1,0,0",
+				"misc.start":                  "0,1,0,0",
+				"misc.stop":                   "0,1,0,0",
+			},
+			GetOperatingDataFunction: {
+				"boiler_temp": "64.8",
+				"boiler_ref":  "65",
+				"dhw_temp":    "48.2",
+				"dhw_ref":     "50",
+				"return_temp": "52.1",
+				"smoke_temp":  "112.4",
+				"shaft_temp":  "31.0",
+				"oxygen":      "9.8",
+				"oxygen_ref":  "10",
+				"photo_level": "87.5",
+				"power_pct":   "42",
+				"power_kw":    "6.3",
+				"state":       "5",
+				"substate":    "0",
+			},
+			GetAdvancedDataFunction: {
+				"fan_speed":  "38",
+				"auger_time": "2.4",
+			},
+			GetConsumptionDataFunction: {
+				"total_days":  "12.1,14.3,11.8,9.6,13.0,15.2,6.4",
+				"total_hours": "0.6,0.7,0.5,0.6",
+				"dhw_days":    "1.2,1.4,1.1,0.9,1.3,1.5,0.6",
+			},
+		},
+	}
+}
+
+// SetValue changes a value as if the controller had changed it. For
+// settings, key is category.key.
+func (m *MockBoiler) SetValue(function Function, key string, value string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.values[function] == nil {
+		m.values[function] = make(map[string]string)
+	}
+	m.values[function][key] = value
+}
+
+// Value returns a raw value, and whether it is set.
+func (m *MockBoiler) Value(function Function, key string) (string, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	value, ok := m.values[function][key]
+	return value, ok
+}
+
+func (m *MockBoiler) Serial() string {
+	return m.SerialNo
+}
+
+func (m *MockBoiler) Address() string {
+	return "mock"
+}
+
+// Get answers a request the way a controller would. Settings are read with
+// a path of category.key or category.*, and everything else with *.
+func (m *MockBoiler) Get(function Function, path string) (*NBEResponse, error) {
+	response, err := m.get(function, path)
+	if err == nil {
+		m.subscribers.notify(response)
+	}
+	return response, err
+}
+
+func (m *MockBoiler) get(function Function, path string) (*NBEResponse, error) {
+	m.mutex.Lock()
+	m.seqNo = (m.seqNo + 1) % 100
+	seqNo := m.seqNo
+	m.mutex.Unlock()
+
+	response := &NBEResponse{
+		AppID:        "mock",
+		ControllerID: m.SerialNo,
+		Function:     function,
+		SeqNo:        seqNo,
+		Payload:      make(map[string]interface{}),
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	values, ok := m.values[function]
+	if !ok {
+		return nil, fmt.Errorf("mock boiler does not support function %d", function)
+	}
+	parse := parseValue
+	if function == GetSetupRangeFunction {
+		parse = func(v string) interface{} {
+			r, _ := parseRange(v)
+			return r
+		}
+	}
+	prefix, wildcard := strings.CutSuffix(path, "*")
+	for k, v := range values {
+		if wildcard && strings.HasPrefix(k, prefix) {
+			response.Payload[strings.TrimPrefix(k, prefix)] = parse(v)
+		} else if k == path {
+			_, key, _ := strings.Cut(k, ".")
+			response.Payload[key] = parse(v)
+		}
+	}
+	if len(response.Payload) == 0 {
+		response.Status = 1
+	}
+	return response, nil
+}
+
+func (m *MockBoiler) GetAsync(function Function, path string, cb func(*NBEResponse)) (int8, error) {
+	response, err := m.Get(function, path)
+	if err != nil {
+		return 0, err
+	}
+	go cb(response)
+	return response.SeqNo, nil
+}
+
+// Set writes a setting. Like a controller, it refuses keys that do not
+// exist with a non-zero status.
+func (m *MockBoiler) Set(path string, value []byte) (*NBEResponse, error) {
+	m.mutex.Lock()
+	m.seqNo = (m.seqNo + 1) % 100
+	response := &NBEResponse{
+		AppID:        "mock",
+		ControllerID: m.SerialNo,
+		Function:     SetSetupFunction,
+		SeqNo:        m.seqNo,
+		Payload:      make(map[string]interface{}),
+	}
+	if _, ok := m.values[GetSetupFunction][path]; ok {
+		m.values[GetSetupFunction][path] = string(value)
+	} else {
+		response.Status = 1
+	}
+	m.mutex.Unlock()
+	m.subscribers.notify(response)
+	return response, nil
+}
+
+func (m *MockBoiler) SetAsync(path string, value []byte, cb func(*NBEResponse)) (int8, error) {
+	response, err := m.Set(path, value)
+	if err != nil {
+		return 0, err
+	}
+	go cb(response)
+	return response.SeqNo, nil
+}
+
+// Subscribe calls cb with the response to every Get and Set.
+func (m *MockBoiler) Subscribe(cb func(*NBEResponse)) func() {
+	return m.subscribers.add(cb)
+}
+
+func (m *MockBoiler) QueueLength() int                    { return 0 }
+func (m *MockBoiler) OldestPending() time.Duration        { return 0 }
+func (m *MockBoiler) Timeouts() int64                     { return 0 }
+func (m *MockBoiler) Mismatches() int64                   { return 0 }
+func (m *MockBoiler) Stalled(timeout time.Duration) error { return nil }
+func (m *MockBoiler) Reconnect() error                    { return nil }
+func (m *MockBoiler) Close() error                        { return nil }
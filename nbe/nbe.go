@@ -28,10 +28,10 @@ import (
 	"math/big"
 	"net"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
 func randomString(len int) (string, error) {
@@ -46,25 +46,57 @@ func randomString(len int) (string, error) {
 	return string(bytes), nil
 }
 
+// NBE is a client for a single controller. It is safe for concurrent use.
 type NBE struct {
 	URI          *url.URL
 	AppID        string
 	ControllerID string
-	Serial       string
 	IPAddress    string
-	SeqNo        int8
-	PinCode      string
-	RSAKey       *rsa.PublicKey // rsa key
-
-	SettingSchema map[string]SettingDefinition
-	Ready         chan bool
 
-	listener   net.PacketConn
-	queue      map[int8]func(*NBEResponse)
-	queueMutex sync.RWMutex
+	serial     string
+	pinCode    string
+	rsaKey     *rsa.PublicKey
+	timeout    time.Duration
+	timeouts   map[Function]time.Duration
+	maxPending int
+	logger     Logger
+	telemetry  Telemetry
+	recorder   *recorder
+
+	listener      net.PacketConn
+	listenerMutex sync.RWMutex
+	pending       *pendingRequests
+	subscribers   subscribers
+	datagrams     chan datagram
+	workers       sync.WaitGroup
+	done          chan struct{}
+	closeOnce     sync.Once
+
+	// waitingSince is when the oldest request sent since the last packet
+	// was received went out, in unix nanoseconds, or 0 if nothing is
+	// outstanding.
+	waitingSince  atomic.Int64
+	timeoutCount  atomic.Int64
+	mismatchCount atomic.Int64
+
+	// socketErrors counts reads and writes that have failed in a row.
+	socketErrors atomic.Int64
+	recovering   atomic.Bool
+	closed       atomic.Bool
 }
 
-func NewNBE(uri *url.URL) (*NBE, error) {
+// maxSeqNo is the highest sequence number that fits in the two digits the
+// protocol allows for it.
+const maxSeqNo = 99
+
+// abandonAfter is how many timeouts a request can go unanswered before its
+// sequence number is given to another request.
+const abandonAfter = 10
+
+// NewNBE connects to the controller at uri, in the format
+// tcp://<serial>:<password>@<host>:<port>, and fetches its serial number and
+// public key. The password is only needed to write settings.
+func NewNBE(uri *url.URL, options ...Option) (*NBE, error) {
 	appID, err := randomString(12)
 	if err != nil {
 		return nil, err
@@ -78,37 +110,101 @@ func NewNBE(uri *url.URL) (*NBE, error) {
 		URI:          uri,
 		AppID:        appID,
 		ControllerID: controllerID,
-		Serial:       uri.User.Username(),
 		IPAddress:    uri.Hostname(),
-		PinCode:      password,
-		SeqNo:        0,
-		Ready:        make(chan bool),
-		queue:        make(map[int8]func(*NBEResponse)),
-		queueMutex:   sync.RWMutex{},
+		serial:       uri.User.Username(),
+		pinCode:      password,
+		timeout:      defaultTimeout,
+		maxPending:   defaultMaxPending,
+		logger:       nopLogger{},
+		telemetry:    nopTelemetry{},
+	}
+	for _, option := range options {
+		option(&nbe)
+	}
+	nbe.pending = newPendingRequests(nbe.maxPending, nbe.telemetry)
+	nbe.telemetry.Pending(nbe.pending.len, nbe.pending.oldest)
+	nbe.datagrams = make(chan datagram, datagramQueue)
+	nbe.done = make(chan struct{})
+	nbe.workers.Add(handleWorkers)
+	for i := 0; i < handleWorkers; i++ {
+		go nbe.work()
+	}
+	if err = nbe.connect(); err != nil {
+		nbe.Close()
 	}
-	err = nbe.connect()
 	return &nbe, err
 }
 
-func (nbe *NBE) listen() chan error {
-	// doneChan := make(chan error, 1)
-	defer nbe.listener.Close()
+// Received datagrams are handed to a few workers in buffers reused from one
+// datagram to the next, rather than each getting a goroutine and a buffer
+// of its own, which adds up on small devices.
+const (
+	handleWorkers  = 4
+	datagramQueue  = 64
+	datagramBuffer = 1024
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, datagramBuffer)
+		return &buffer
+	},
+}
+
+type datagram struct {
+	buffer *[]byte
+	n      int
+}
+
+func (nbe *NBE) listen(listener net.PacketConn) {
+	defer listener.Close()
 
 	for {
-		buffer := make([]byte, 1024)
+		buffer := bufferPool.Get().(*[]byte)
 
-		_, addr, err := nbe.listener.ReadFrom(buffer)
+		n, addr, err := listener.ReadFrom(*buffer)
+		if errors.Is(err, net.ErrClosed) {
+			bufferPool.Put(buffer)
+			return
+		}
+		if err != nil {
+			bufferPool.Put(buffer)
+			nbe.logger.Errorf("%v", err)
+			nbe.socketError(listener, err)
+			// A broken socket fails every read at once.
+			time.Sleep(socketErrorDelay)
+			continue
+		}
+		nbe.socketErrors.Store(0)
 		if addr.String() != nbe.URI.Host {
 			// ignore packets from other hosts
+			bufferPool.Put(buffer)
 			continue
 		}
-		if err != nil {
-			log.Errorln(err)
+		nbe.waitingSince.Store(0)
+		nbe.recorder.record(RecordedFrame{Direction: Received, Raw: (*buffer)[:n]})
+		select {
+		case nbe.datagrams <- datagram{buffer: buffer, n: n}:
+		case <-nbe.done:
+			bufferPool.Put(buffer)
+			return
 		}
-		go nbe.handle(buffer)
 	}
+}
 
-	// return doneChan
+// work handles received datagrams, returning their buffers to the pool once
+// they have been unpacked, until the NBE is closed.
+func (nbe *NBE) work() {
+	defer nbe.workers.Done()
+	for {
+		select {
+		case d := <-nbe.datagrams:
+			nbe.handle((*d.buffer)[:d.n])
+			bufferPool.Put(d.buffer)
+		case <-nbe.done:
+			return
+		}
+	}
 }
 
 func (nbe *NBE) handle(buffer []byte) {
@@ -116,57 +212,197 @@ func (nbe *NBE) handle(buffer []byte) {
 	reader := bytes.NewReader(buffer)
 	err := response.Unpack(reader)
 	if err != nil {
-		log.Errorf("failed to unpack response: %s", err)
+		nbe.logger.Errorf("failed to unpack response: %s", err)
 		return
 	}
 
-	log.Debugf("recv %d %d %s", response.SeqNo, response.Function, response.Payload)
+	nbe.logger.Debugf("recv %d %d %s", response.SeqNo, response.Function, response.Payload)
 
 	if response.SeqNo == -1 {
 		// Probably an error packet, log the payload.
-		log.Errorf("protocol error: %s", response.Payload["error"])
+		nbe.logger.Errorf("protocol error: %s", response.Payload["error"])
 		return
 	}
 
-	nbe.queueMutex.RLock()
-	if val, ok := nbe.queue[response.SeqNo]; ok {
-		nbe.queueMutex.RUnlock()
-		val(&response)
-		nbe.queueMutex.Lock()
-		delete(nbe.queue, response.SeqNo)
-		nbe.queueMutex.Unlock()
-	} else {
-		nbe.queueMutex.RUnlock()
-		log.Infof("sequence %d has no callback", response.SeqNo)
+	pending, ok := nbe.pending.take(&response)
+
+	// A late answer to a request that timed out, or a duplicate, is dropped
+	// rather than handed to whichever request has the sequence number now.
+	if !ok {
+		nbe.mismatch("unknown_seqno")
+		nbe.logger.Infof("sequence %d has no callback", response.SeqNo)
+		return
+	}
+	if !pending.matches(&response) {
+		nbe.mismatch("wrong_request")
+		nbe.logger.Infof("response %d to function %d does not match the request waiting on that sequence", response.SeqNo, response.Function)
+		return
 	}
+	pending.cb(&response)
+	nbe.subscribers.notify(&response)
 }
 
-func (nbe *NBE) connect() error {
+func (nbe *NBE) mismatch(reason string) {
+	nbe.mismatchCount.Add(1)
+	nbe.telemetry.Mismatch(reason)
+}
+
+// Serial returns the serial number reported by the controller.
+func (nbe *NBE) Serial() string {
+	return nbe.serial
+}
+
+// Subscribe calls cb with every response received from the controller,
+// after the callback of the request it answers.
+func (nbe *NBE) Subscribe(cb func(*NBEResponse)) func() {
+	return nbe.subscribers.add(cb)
+}
+
+// Address returns the controller's IP address.
+func (nbe *NBE) Address() string {
+	return nbe.IPAddress
+}
+
+// Close stops listening for responses from the controller, and waits for
+// the goroutines handling them to stop. It must not be called from a
+// response callback.
+func (nbe *NBE) Close() error {
+	var err error
+	nbe.closeOnce.Do(func() {
+		nbe.closed.Store(true)
+		close(nbe.done)
+		if conn := nbe.conn(); conn != nil {
+			err = conn.Close()
+		}
+		nbe.workers.Wait()
+	})
+	return err
+}
+
+func (nbe *NBE) conn() net.PacketConn {
+	nbe.listenerMutex.RLock()
+	defer nbe.listenerMutex.RUnlock()
+	return nbe.listener
+}
+
+// Stalled reports an error if requests have been going unanswered for
+// longer than timeout, which means either the controller is unreachable or
+// the socket has stopped delivering packets.
+func (nbe *NBE) Stalled(timeout time.Duration) error {
+	since := nbe.waitingSince.Load()
+	if since == 0 {
+		return nil
+	}
+	if age := time.Since(time.Unix(0, since)); age > timeout {
+		return fmt.Errorf("no response from controller for %s", age.Round(time.Second))
+	}
+	return nil
+}
+
+// Reconnect replaces the socket used to talk to the controller, and the
+// goroutine listening on it. Requests waiting on the old socket are never
+// answered.
+func (nbe *NBE) Reconnect() error {
 	listener, err := net.ListenPacket("udp4", "0.0.0.0:0")
 	if err != nil {
-		panic(err)
+		return err
 	}
+	nbe.listenerMutex.Lock()
+	old := nbe.listener
 	nbe.listener = listener
+	nbe.listenerMutex.Unlock()
 
-	go nbe.listen()
+	old.Close()
+	nbe.waitingSince.Store(0)
+	nbe.socketErrors.Store(0)
+	go nbe.listen(listener)
+	return nil
+}
 
-	request := NBERequest{
-		AppID:        nbe.AppID,
-		ControllerID: nbe.ControllerID,
-		Function:     DiscoveryFunction,
-		Payload:      []byte("NBE Discovery"),
+// A socket that fails this many reads or writes in a row is assumed to be
+// dead, e.g. after the network interface bounced, and is replaced.
+const (
+	maxSocketErrors  = 5
+	socketErrorDelay = 100 * time.Millisecond
+	maxRecoverDelay  = time.Minute
+)
+
+// socketError counts a failed read or write on conn, and starts recovering
+// once conn has failed maxSocketErrors times in a row.
+func (nbe *NBE) socketError(conn net.PacketConn, err error) {
+	if nbe.socketErrors.Add(1) < maxSocketErrors || nbe.closed.Load() {
+		return
+	}
+	if nbe.recovering.CompareAndSwap(false, true) {
+		go nbe.recover(conn, err)
 	}
+}
 
-	response, err := nbe.Send(&request)
+// recover replaces a dead socket and starts a new session with the
+// controller, retrying with backoff until it answers.
+func (nbe *NBE) recover(broken net.PacketConn, cause error) {
+	defer nbe.recovering.Store(false)
+	if nbe.conn() != broken {
+		return
+	}
+	nbe.logger.Errorf("socket to controller keeps failing (%v), reconnecting", cause)
+	nbe.telemetry.SocketRecovery()
+
+	for delay := time.Second; !nbe.closed.Load(); delay = min(2*delay, maxRecoverDelay) {
+		err := nbe.Reconnect()
+		if err == nil {
+			_, err = nbe.discover()
+		}
+		if err == nil {
+			nbe.logger.Infof("reconnected to controller at %s", nbe.URI.Host)
+			return
+		}
+		nbe.logger.Errorf("failed to reconnect to controller: %v", err)
+		time.Sleep(delay)
+	}
+}
+
+// QueueLength returns the number of requests waiting for a response.
+func (nbe *NBE) QueueLength() int {
+	return nbe.pending.len()
+}
+
+// OldestPending returns how long the oldest request still waiting for a
+// response has been waiting, or 0 if none are.
+func (nbe *NBE) OldestPending() time.Duration {
+	return nbe.pending.oldest()
+}
+
+// Timeouts returns the number of requests that timed out waiting for a
+// response.
+func (nbe *NBE) Timeouts() int64 {
+	return nbe.timeoutCount.Load()
+}
+
+// Mismatches returns the number of responses dropped because they didn't
+// match a request waiting for one.
+func (nbe *NBE) Mismatches() int64 {
+	return nbe.mismatchCount.Load()
+}
+
+func (nbe *NBE) connect() error {
+	listener, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return err
+	}
+	nbe.listener = listener
+
+	go nbe.listen(listener)
+
+	nbe.serial, err = nbe.discover()
 	if err != nil {
 		return err
 	}
-	nbe.Serial = fmt.Sprintf("%v", response.Payload["serial"])
 	pub, err := nbe.getRSAKey()
 	if err != nil {
 		return err
 	}
-	nbe.RSAKey = pub
+	nbe.rsaKey = pub
 
 	return nil
 }
@@ -174,46 +410,70 @@ func (nbe *NBE) connect() error {
 func (nbe *NBE) SendAsync(request *NBERequest, cb func(*NBEResponse)) (int8, error) {
 	var err error
 
-	nbe.queueMutex.Lock()
-	nbe.SeqNo++
-	if nbe.SeqNo > 99 {
-		nbe.SeqNo = 0
-	}
-	request.SeqNo = nbe.SeqNo
-	nbe.queueMutex.Unlock()
-
 	addr, err := net.ResolveUDPAddr("udp4", nbe.URI.Host)
 	if err != nil {
-		return request.SeqNo, err
+		return -1, err
+	}
+
+	done := nbe.telemetry.Request(request)
+	pending := &pendingRequest{
+		function: request.Function,
+		sent:     time.Now(),
+		cb: func(response *NBEResponse) {
+			done(response, nil)
+			cb(response)
+		},
+	}
+	if request.Function == GetSetupFunction {
+		if _, key, ok := strings.Cut(string(request.Payload), "."); ok && key != "*" {
+			pending.key = strings.ToLower(key)
+		}
+	}
+
+	// The sequence number is reserved before packing, so that two requests
+	// sent at once can't be given the same one.
+	request.SeqNo, err = nbe.pending.add(pending, abandonAfter*nbe.timeoutFor(request.Function))
+	if err == nil {
+		packet := new(bytes.Buffer)
+		if err = request.Pack(packet); err == nil {
+			err = nbe.write(request, packet.Bytes(), addr)
+		}
 	}
-	packet := new(bytes.Buffer)
-	err = request.Pack(packet)
 	if err != nil {
+		nbe.pending.forget(request.SeqNo)
+		done(nil, err)
 		return request.SeqNo, err
 	}
+	return request.SeqNo, nil
+}
 
-	nbe.queueMutex.Lock()
-	nbe.queue[request.SeqNo] = cb
-	nbe.queueMutex.Unlock()
-
-	log.Debugf("send %d %d %s", request.SeqNo, request.Function, request.Payload)
-
-	_, err = nbe.listener.WriteTo(packet.Bytes(), addr)
-	if err != nil {
-		nbe.queueMutex.Lock()
-		delete(nbe.queue, request.SeqNo)
-		nbe.queueMutex.Unlock()
+// write sends a packed request.
+func (nbe *NBE) write(request *NBERequest, packet []byte, addr net.Addr) error {
+	nbe.logger.Debugf("send %d %d %s", request.SeqNo, request.Function, request.Payload)
+	nbe.recorder.record(RecordedFrame{Direction: Sent, Function: request.Function, SeqNo: request.SeqNo, Payload: string(request.Payload)})
 
-		return request.SeqNo, err
+	nbe.waitingSince.CompareAndSwap(0, time.Now().UnixNano())
+	conn := nbe.conn()
+	if _, err := conn.WriteTo(packet, addr); err != nil {
+		nbe.socketError(conn, err)
+		return err
 	}
+	nbe.socketErrors.Store(0)
+	return nil
+}
 
-	return request.SeqNo, nil
+// timeoutFor returns how long requests of a function wait for a response.
+func (nbe *NBE) timeoutFor(function Function) time.Duration {
+	if timeout, ok := nbe.timeouts[function]; ok {
+		return timeout
+	}
+	return nbe.timeout
 }
 
 func (nbe *NBE) Send(request *NBERequest) (*NBEResponse, error) {
 	responseChan := make(chan *NBEResponse, 1)
 
-	_, err := nbe.SendAsync(request, func(response *NBEResponse) {
+	seqNo, err := nbe.SendAsync(request, func(response *NBEResponse) {
 		responseChan <- response
 	})
 
@@ -224,7 +484,10 @@ func (nbe *NBE) Send(request *NBERequest) (*NBEResponse, error) {
 	select {
 	case response := <-responseChan:
 		return response, nil
-	case <-time.After(time.Duration(3) * time.Second):
+	case <-time.After(nbe.timeoutFor(request.Function)):
+		nbe.pending.forget(seqNo)
+		nbe.telemetry.Timeout(request.Function)
+		nbe.timeoutCount.Add(1)
 		return nil, errors.New("timeout waiting for request")
 	}
 }
@@ -262,8 +525,8 @@ func (nbe *NBE) SetAsync(path string, value []byte, cb func(*NBEResponse)) (int8
 		AppID:        nbe.AppID,
 		ControllerID: nbe.ControllerID,
 		Function:     SetSetupFunction,
-		RSAKey:       nbe.RSAKey,
-		PinCode:      nbe.PinCode,
+		RSAKey:       nbe.rsaKey,
+		PinCode:      nbe.pinCode,
 		Payload:      payload.Bytes(),
 	}
 	seq, err := nbe.SendAsync(&request, cb)
@@ -281,17 +544,34 @@ func (nbe *NBE) Set(path string, value []byte) (*NBEResponse, error) {
 		AppID:        nbe.AppID,
 		ControllerID: nbe.ControllerID,
 		Function:     SetSetupFunction,
-		RSAKey:       nbe.RSAKey,
-		PinCode:      nbe.PinCode,
+		RSAKey:       nbe.rsaKey,
+		PinCode:      nbe.pinCode,
 		Payload:      payload.Bytes(),
 	}
 
 	return nbe.Send(&request)
 }
 
+// discover starts a session with the controller, returning its serial
+// number.
+func (nbe *NBE) discover() (string, error) {
+	request := NBERequest{
+		AppID:        nbe.AppID,
+		ControllerID: nbe.ControllerID,
+		Function:     DiscoveryFunction,
+		Payload:      []byte("NBE Discovery"),
+	}
+
+	response, err := nbe.Send(&request)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v", response.Payload["serial"]), nil
+}
+
 func (nbe *NBE) getRSAKey() (*rsa.PublicKey, error) {
-	if nbe.RSAKey != nil {
-		return nbe.RSAKey, nil
+	if nbe.rsaKey != nil {
+		return nbe.rsaKey, nil
 	}
 
 	response, err := nbe.Get(GetSetupFunction, "misc.rsa_key")
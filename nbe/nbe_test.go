@@ -0,0 +1,80 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe_test
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/simulator"
+)
+
+// serve starts a simulated controller, returning the URI to dial it at.
+func serve(t *testing.T) *url.URL {
+	t.Helper()
+	server, err := simulator.NewServer(nbe.NewMockBoiler("12345"), "0123456789")
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() { conn.Close() })
+
+	uri, err := url.Parse(fmt.Sprintf("tcp://12345:0123456789@%s", conn.LocalAddr()))
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	return uri
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	uri := serve(t)
+	before := runtime.NumGoroutine()
+
+	boiler, err := nbe.NewNBE(uri, nbe.WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("NewNBE: %v", err)
+	}
+	if _, err := boiler.Set("boiler.temp", []byte("70")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := boiler.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := boiler.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	// The listener returns once its socket is closed, which Close doesn't
+	// wait for.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines running after Close, %d before NewNBE", after, before)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import "time"
+
+const defaultTimeout = 3 * time.Second
+
+// Logger receives the client's log messages. It is satisfied by logrus and
+// most other levelled loggers.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// Option configures an NBE client.
+type Option func(*NBE)
+
+// WithLogger sends log messages to logger. By default nothing is logged.
+func WithLogger(logger Logger) Option {
+	return func(nbe *NBE) {
+		nbe.logger = logger
+	}
+}
+
+// WithTelemetry reports requests to the controller to telemetry. By
+// default nothing is reported.
+func WithTelemetry(telemetry Telemetry) Option {
+	return func(nbe *NBE) {
+		nbe.telemetry = telemetry
+	}
+}
+
+// WithTimeout sets how long Get and Set wait for a response. The default
+// is three seconds.
+func WithTimeout(timeout time.Duration) Option {
+	return func(nbe *NBE) {
+		nbe.timeout = timeout
+	}
+}
+
+// WithFunctionTimeout sets how long requests of one function wait for a
+// response, overriding WithTimeout. Consumption and event log queries can
+// be slow to answer, while operating data polls are better failing fast.
+func WithFunctionTimeout(function Function, timeout time.Duration) Option {
+	return func(nbe *NBE) {
+		if nbe.timeouts == nil {
+			nbe.timeouts = make(map[Function]time.Duration)
+		}
+		nbe.timeouts[function] = timeout
+	}
+}
+
+// WithMaxPending sets how many requests can wait for a response at once.
+// Requests made while that many are waiting fail with ErrBacklogged. The
+// default is 32.
+func WithMaxPending(n int) Option {
+	return func(nbe *NBE) {
+		nbe.maxPending = n
+	}
+}
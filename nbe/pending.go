@@ -0,0 +1,146 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrBacklogged is returned for requests made while too many are already
+// waiting for the controller to answer.
+var ErrBacklogged = errors.New("controller is backlogged")
+
+// defaultMaxPending is how many requests can wait for a response at once
+// by default.
+const defaultMaxPending = 32
+
+// pendingRequest is a request waiting for a response. The protocol has no
+// room for a nonce, so besides the sequence number a response is checked
+// against the function it answers and, when a single setting was asked
+// for, the key it returns.
+type pendingRequest struct {
+	function Function
+	key      string
+	sent     time.Time
+	cb       func(*NBEResponse)
+}
+
+func (p *pendingRequest) matches(response *NBEResponse) bool {
+	if response.Function != p.function {
+		return false
+	}
+	if p.key != "" && response.Status == 0 {
+		_, ok := response.Payload[p.key]
+		return ok
+	}
+	return true
+}
+
+// pendingRequests are the requests waiting for a response, by sequence
+// number. At most limit can be waiting at once, so that a controller that
+// has stopped keeping up is noticed rather than buried in requests.
+type pendingRequests struct {
+	limit     int
+	requests  map[int8]*pendingRequest
+	seqNo     int8
+	telemetry Telemetry
+	mutex     sync.Mutex
+}
+
+func newPendingRequests(limit int, telemetry Telemetry) *pendingRequests {
+	return &pendingRequests{
+		limit:     limit,
+		requests:  make(map[int8]*pendingRequest),
+		telemetry: telemetry,
+	}
+}
+
+// add reserves the next sequence number that isn't waiting for a response
+// for request. Requests nobody has been waiting on for longer than abandon
+// give up their number, as the callers of SendAsync don't all give up on
+// their own.
+func (p *pendingRequests) add(request *pendingRequest, abandon time.Duration) (int8, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for seqNo, pending := range p.requests {
+		if time.Since(pending.sent) > abandon {
+			delete(p.requests, seqNo)
+		}
+	}
+	if len(p.requests) >= p.limit {
+		return -1, fmt.Errorf("%w: %d requests are waiting for a response", ErrBacklogged, len(p.requests))
+	}
+
+	for i := 0; i <= maxSeqNo; i++ {
+		p.seqNo++
+		if p.seqNo > maxSeqNo {
+			p.seqNo = 0
+		}
+		if _, busy := p.requests[p.seqNo]; !busy {
+			p.requests[p.seqNo] = request
+			return p.seqNo, nil
+		}
+		p.telemetry.SeqNoCollision()
+	}
+	return -1, fmt.Errorf("all %d sequence numbers are waiting for a response", maxSeqNo+1)
+}
+
+// take returns the request waiting on response's sequence number, removing
+// it if the response answers it.
+func (p *pendingRequests) take(response *NBEResponse) (*pendingRequest, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pending, ok := p.requests[response.SeqNo]
+	if ok && pending.matches(response) {
+		delete(p.requests, response.SeqNo)
+	}
+	return pending, ok
+}
+
+// forget stops waiting for a response to seqNo.
+func (p *pendingRequests) forget(seqNo int8) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.requests, seqNo)
+}
+
+func (p *pendingRequests) len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.requests)
+}
+
+// oldest returns how long the oldest request has been waiting, or 0 if
+// none are.
+func (p *pendingRequests) oldest() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var oldest time.Duration
+	for _, pending := range p.requests {
+		if age := time.Since(pending.sent); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
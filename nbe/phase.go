@@ -0,0 +1,91 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import "fmt"
+
+// Phases group power states by what the burner is doing, which decides
+// what its substate means.
+const (
+	PhaseIgnition = "ignition"
+	PhaseRunning  = "running"
+	PhaseCleaning = "cleaning"
+	PhaseCooldown = "cooldown"
+	PhaseStopped  = "stopped"
+	PhaseAlarm    = "alarm"
+	PhaseOff      = "off"
+)
+
+var phaseSubstates = map[string][]string{
+	PhaseIgnition: {
+		"Preparing",
+		"Fan purge",
+		"Loading pellets",
+		"Heating ignition element",
+		"Waiting for flame",
+		"Flame stabilising",
+	},
+	PhaseRunning: {
+		"Modulating",
+		"Minimum power",
+		"Maximum power",
+	},
+	PhaseCleaning: {
+		"Preparing",
+		"Cleaning",
+		"Settling",
+	},
+	PhaseCooldown: {
+		"",
+		"Burning out",
+		"Fan cooling",
+	},
+}
+
+// Phase returns the phase of a power state. A stopped burner is cooling
+// down for as long as it reports a substate.
+func Phase(state int64, substate int64) string {
+	switch {
+	case state >= 1 && state <= 4:
+		return PhaseIgnition
+	case state == 5 || state == 7:
+		return PhaseRunning
+	case state == 32:
+		return PhaseCleaning
+	case state == 14:
+		return PhaseOff
+	case AlarmStates[state]:
+		return PhaseAlarm
+	case substate != 0:
+		return PhaseCooldown
+	}
+	return PhaseStopped
+}
+
+// SubstateText describes the substate of a power state, or returns a
+// placeholder for substates that aren't known.
+func SubstateText(state int64, substate int64) string {
+	steps := phaseSubstates[Phase(state, substate)]
+	if substate >= 0 && substate < int64(len(steps)) {
+		return steps[substate]
+	}
+	if substate == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Unknown substate (%d)", substate)
+}
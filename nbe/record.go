@@ -0,0 +1,67 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Directions of recorded frames.
+const (
+	Sent     = "send"
+	Received = "recv"
+)
+
+// RecordedFrame is one line of a capture written by WithRecorder. Requests
+// are recorded decoded, without the pin code, and responses exactly as they
+// were received, so that a capture can be replayed through the same
+// parsing as the original.
+type RecordedFrame struct {
+	Timestamp time.Time `json:"ts"`
+	Direction string    `json:"dir"`
+	Function  Function  `json:"function,omitempty"`
+	SeqNo     int8      `json:"seq,omitempty"`
+	Payload   string    `json:"payload,omitempty"`
+	Raw       []byte    `json:"raw,omitempty"`
+}
+
+type recorder struct {
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+func (r *recorder) record(frame RecordedFrame) {
+	if r == nil {
+		return
+	}
+	frame.Timestamp = time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.encoder.Encode(frame)
+}
+
+// WithRecorder writes every request sent and response received to w as
+// JSON lines, which can be replayed with NewReplay.
+func WithRecorder(w io.Writer) Option {
+	return func(nbe *NBE) {
+		nbe.recorder = &recorder{encoder: json.NewEncoder(w)}
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Replay is a Boiler that answers requests with the responses recorded in
+// a capture, so that a controller's quirks can be reproduced without it.
+// Each request is answered with the recorded responses to the same request
+// in turn, starting again from the first when they run out, so values
+// change the way they did when the capture was made.
+type Replay struct {
+	serial      string
+	responses   map[string][][]byte
+	next        map[string]int
+	seqNo       int8
+	subscribers subscribers
+	mutex       sync.Mutex
+}
+
+// OpenReplay reads a capture written by WithRecorder.
+func OpenReplay(path string) (*Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewReplay(f)
+}
+
+func NewReplay(r io.Reader) (*Replay, error) {
+	replay := &Replay{
+		responses: make(map[string][][]byte),
+		next:      make(map[string]int),
+	}
+
+	// Responses are matched to the request with the same sequence number
+	// sent most recently before them.
+	pending := make(map[int8]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var frame RecordedFrame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		switch frame.Direction {
+		case Sent:
+			pending[frame.SeqNo] = replayKey(frame.Function, frame.Payload)
+		case Received:
+			var response NBEResponse
+			if err := response.Unpack(bytes.NewReader(frame.Raw)); err != nil {
+				continue
+			}
+			key, ok := pending[response.SeqNo]
+			if !ok {
+				continue
+			}
+			delete(pending, response.SeqNo)
+			replay.responses[key] = append(replay.responses[key], frame.Raw)
+			if response.Function == DiscoveryFunction {
+				replay.serial = fmt.Sprintf("%v", response.Payload["serial"])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(replay.responses) == 0 {
+		return nil, fmt.Errorf("capture has no responses")
+	}
+	return replay, nil
+}
+
+func replayKey(function Function, payload string) string {
+	return fmt.Sprintf("%d %s", function, payload)
+}
+
+func (r *Replay) Serial() string {
+	return r.serial
+}
+
+func (r *Replay) Address() string {
+	return "replay"
+}
+
+func (r *Replay) respond(function Function, payload string) (*NBEResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.seqNo = (r.seqNo + 1) % 100
+	key := replayKey(function, payload)
+	recorded := r.responses[key]
+	if len(recorded) == 0 {
+		if function == SetSetupFunction {
+			// Writes that were never recorded succeed without effect.
+			return &NBEResponse{Function: function, SeqNo: r.seqNo, Payload: map[string]interface{}{}}, nil
+		}
+		return nil, fmt.Errorf("no recorded response to function %d %s", function, payload)
+	}
+
+	raw := recorded[r.next[key]%len(recorded)]
+	r.next[key]++
+	var response NBEResponse
+	if err := response.Unpack(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	response.SeqNo = r.seqNo
+	return &response, nil
+}
+
+func (r *Replay) Get(function Function, path string) (*NBEResponse, error) {
+	response, err := r.respond(function, path)
+	if err == nil {
+		r.subscribers.notify(response)
+	}
+	return response, err
+}
+
+func (r *Replay) GetAsync(function Function, path string, cb func(*NBEResponse)) (int8, error) {
+	response, err := r.Get(function, path)
+	if err != nil {
+		return 0, err
+	}
+	go cb(response)
+	return response.SeqNo, nil
+}
+
+func (r *Replay) Set(path string, value []byte) (*NBEResponse, error) {
+	response, err := r.respond(SetSetupFunction, fmt.Sprintf("%s=%s", path, value))
+	if err == nil {
+		r.subscribers.notify(response)
+	}
+	return response, err
+}
+
+func (r *Replay) SetAsync(path string, value []byte, cb func(*NBEResponse)) (int8, error) {
+	response, err := r.Set(path, value)
+	if err != nil {
+		return 0, err
+	}
+	go cb(response)
+	return response.SeqNo, nil
+}
+
+// Subscribe calls cb with the response to every Get and Set.
+func (r *Replay) Subscribe(cb func(*NBEResponse)) func() {
+	return r.subscribers.add(cb)
+}
+
+func (r *Replay) QueueLength() int                    { return 0 }
+func (r *Replay) OldestPending() time.Duration        { return 0 }
+func (r *Replay) Timeouts() int64                     { return 0 }
+func (r *Replay) Mismatches() int64                   { return 0 }
+func (r *Replay) Stalled(timeout time.Duration) error { return nil }
+func (r *Replay) Reconnect() error                    { return nil }
+func (r *Replay) Close() error                        { return nil }
@@ -21,13 +21,19 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"math/big"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// encryptedSize is the length an encrypted request is padded to before
+// encryption. The controller expects exactly this much, so a request whose
+// body, including its payload, is longer can't be sent encrypted.
+const encryptedSize = 64
+
 type NBERequest struct {
 	AppID        string         // client application id
 	ControllerID string         // controller id
@@ -49,156 +55,155 @@ func (frame *NBERequest) Validate() error {
 	if len(frame.Payload) == 0 {
 		return fmt.Errorf(" Payload is empty")
 	}
+	if len(frame.Payload) > 999 {
+		return fmt.Errorf("payload too long: %d bytes", len(frame.Payload))
+	}
 	return nil
 }
 
 func (frame *NBERequest) Pack(writer io.Writer) error {
-	var err error
-	err = frame.Validate()
-	if err != nil {
-		return err
-	}
-	err = binary.Write(writer, binary.BigEndian, []byte(fmt.Sprintf("%12s", frame.AppID)))
-	if err != nil {
-		return err
-	}
-	err = binary.Write(writer, binary.BigEndian, []byte(fmt.Sprintf("%06s", frame.ControllerID)))
-	if err != nil {
-		return err
-	}
-	buf := new(bytes.Buffer)
-	err = buf.WriteByte(0x02)
-	if err != nil {
-		return err
-	}
-	_, err = buf.WriteString(fmt.Sprintf("%02d", frame.Function))
-	if err != nil {
-		return err
-	}
-	_, err = buf.WriteString(fmt.Sprintf("%02d", frame.SeqNo))
-	if err != nil {
-		return err
-	}
-	if frame.PinCode != "" {
-		_, err = buf.WriteString(fmt.Sprintf("%10s", frame.PinCode))
-	} else {
-		_, err = buf.WriteString("0000000000")
-	}
-	if err != nil {
+	if err := frame.Validate(); err != nil {
 		return err
 	}
 	if frame.Timestamp.IsZero() {
 		frame.Timestamp = time.Now()
 	}
-	_, err = buf.WriteString(fmt.Sprintf("%010d", frame.Timestamp.Unix()))
-	if err != nil {
-		return err
-	}
-	_, err = buf.WriteString("extr")
-	if err != nil {
-		return err
-	}
-	_, err = buf.WriteString(fmt.Sprintf("%03d", len(frame.Payload)))
-	if err != nil {
-		return err
-	}
-	_, err = buf.Write(frame.Payload)
-	if err != nil {
-		return err
-	}
-	err = buf.WriteByte(0x04)
-	if err != nil {
-		return err
+
+	// The header is always sent in the clear, followed by a marker saying
+	// whether the rest of the frame is encrypted.
+	buf := make([]byte, 0, 128)
+	buf = appendPadded(buf, frame.AppID, 12, ' ')
+	buf = appendPadded(buf, frame.ControllerID, 6, '0')
+	marker := len(buf)
+	buf = append(buf, ' ')
+
+	body := len(buf)
+	buf = append(buf, 0x02)
+	buf = appendNumber(buf, int64(frame.Function), 2)
+	buf = appendNumber(buf, int64(frame.SeqNo), 2)
+	if frame.PinCode != "" {
+		buf = appendPadded(buf, frame.PinCode, 10, ' ')
+	} else {
+		buf = append(buf, "0000000000"...)
 	}
+	buf = appendNumber(buf, frame.Timestamp.Unix(), 10)
+	buf = append(buf, "extr"...)
+	buf = appendNumber(buf, int64(len(frame.Payload)), 3)
+	buf = append(buf, frame.Payload...)
+	buf = append(buf, 0x04)
 
 	if frame.RSAKey != nil {
-		padLen := 64 - buf.Len()
-		padBytes := make([]byte, padLen)
-		_, err = rand.Read(padBytes)
-		if err != nil {
-			return err
+		if n := len(buf) - body; n > encryptedSize {
+			return fmt.Errorf("request too long to encrypt: %d bytes, at most %d", n, encryptedSize)
 		}
-
-		binary.Write(writer, binary.BigEndian, []byte("*"))
-		err = binary.Write(buf, binary.BigEndian, padBytes)
-		if err != nil {
+		padBytes := make([]byte, encryptedSize-(len(buf)-body))
+		if _, err := rand.Read(padBytes); err != nil {
 			return err
 		}
-		c := new(big.Int).SetBytes(buf.Bytes())
-		err = binary.Write(writer, binary.BigEndian, c.Exp(c, big.NewInt(int64(frame.RSAKey.E)), frame.RSAKey.N).Bytes())
-		if err != nil {
-			return err
+		buf[marker] = '*'
+		c := new(big.Int).SetBytes(append(buf[body:], padBytes...))
+		buf = append(buf[:body], c.Exp(c, big.NewInt(int64(frame.RSAKey.E)), frame.RSAKey.N).Bytes()...)
+	}
+
+	_, err := writer.Write(buf)
+	return err
+}
+
+// Unpack reads an unencrypted request, as sent to the controller.
+func (frame *NBERequest) Unpack(reader io.Reader) error {
+	return frame.UnpackEncrypted(reader, nil)
+}
+
+// UnpackEncrypted reads a request as the controller does, decrypting it
+// with key if it was packed with the public half of key. RSAKey is set on
+// encrypted requests, so that packing the frame again encrypts it too.
+func (frame *NBERequest) UnpackEncrypted(reader io.Reader, key *rsa.PrivateKey) error {
+	header := make([]byte, 19)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	frame.AppID = strings.TrimSpace(string(header[:12]))
+	frame.ControllerID = strings.TrimSpace(string(header[12:18]))
+	frame.RSAKey = nil
+	switch header[18] {
+	case ' ':
+	case '*':
+		if key == nil {
+			return fmt.Errorf("request is encrypted")
 		}
-	} else {
-		binary.Write(writer, binary.BigEndian, []byte(" "))
-		_, err = buf.WriteTo(writer)
+		plain, err := decrypt(reader, key)
 		if err != nil {
 			return err
 		}
+		reader = bytes.NewReader(plain)
+		frame.RSAKey = &key.PublicKey
+	default:
+		return fmt.Errorf("invalid encryption marker: %x", header[18])
 	}
-	return err
-}
 
-func (frame *NBERequest) Unpack(reader io.Reader) error {
-	var err error
-	err = binary.Read(reader, binary.BigEndian, frame.AppID[:12])
-	if err != nil {
+	body := make([]byte, 32)
+	if _, err := io.ReadFull(reader, body); err != nil {
 		return err
 	}
-	err = binary.Read(reader, binary.BigEndian, frame.ControllerID[:6])
+	if body[0] != 0x02 {
+		return fmt.Errorf("invalid start marker: %x", body[0])
+	}
+	function, err := strconv.Atoi(strings.TrimSpace(string(body[1:3])))
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid function: %s", body[1:3])
 	}
-	encryption := make([]byte, 1)
-	err = binary.Read(reader, binary.BigEndian, encryption)
+	frame.Function = Function(function)
+	seqNo, err := strconv.Atoi(strings.TrimSpace(string(body[3:5])))
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid seq no: %s", body[3:5])
 	}
-	startMarker := make([]byte, 1)
-	err = binary.Read(reader, binary.BigEndian, startMarker)
+	frame.SeqNo = int8(seqNo)
+	frame.PinCode = strings.TrimSpace(string(body[5:15]))
+	ts, err := strconv.ParseInt(string(body[15:25]), 10, 64)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid timestamp: %s", body[15:25])
 	}
-	if startMarker[0] != 0x02 {
-		return fmt.Errorf("invalid start marker: %c", startMarker[0])
+	frame.Timestamp = time.Unix(ts, 0)
+	if string(body[25:29]) != "extr" {
+		return fmt.Errorf("invalid extra marker: %s", body[25:29])
 	}
-	err = binary.Read(reader, binary.BigEndian, &frame.Function)
+	payloadLen, err := strconv.Atoi(string(body[29:32]))
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid payload length: %s", body[29:32])
 	}
-	err = binary.Read(reader, binary.BigEndian, &frame.SeqNo)
-	if err != nil {
+
+	frame.Payload = make([]byte, payloadLen)
+	if _, err := io.ReadFull(reader, frame.Payload); err != nil {
 		return err
 	}
-	err = binary.Read(reader, binary.BigEndian, frame.PinCode[:10])
-	if err != nil {
+	endMarker := make([]byte, 1)
+	if _, err := io.ReadFull(reader, endMarker); err != nil {
 		return err
 	}
-	var ts int64
-	err = binary.Read(reader, binary.BigEndian, &ts)
-	if err != nil {
-		return err
+	if endMarker[0] != 0x04 {
+		return fmt.Errorf("invalid end marker: %x", endMarker[0])
 	}
-	frame.Timestamp = time.Unix(ts, 0)
-	err = binary.Read(reader, binary.BigEndian, "extr")
+	return nil
+}
+
+// decrypt reverses the textbook RSA used by Pack. The plain text is the
+// frame after the header, followed by random padding to encryptedSize which
+// Unpack ignores.
+func decrypt(reader io.Reader, key *rsa.PrivateKey) ([]byte, error) {
+	cipher, err := io.ReadAll(reader)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var payloadLenBytes [3]byte
-	err = binary.Read(reader, binary.BigEndian, &payloadLenBytes)
-	if err != nil {
-		return err
+	if len(cipher) == 0 {
+		return nil, fmt.Errorf("encrypted request is empty")
 	}
-	payloadLen := int(payloadLenBytes[0]) | int(payloadLenBytes[1])<<8 | int(payloadLenBytes[2])<<16
-	frame.Payload = make([]byte, int(payloadLen))
-	err = binary.Read(reader, binary.BigEndian, frame.Payload)
-	if err != nil {
-		return err
+	c := new(big.Int).SetBytes(cipher)
+	if c.Cmp(key.N) >= 0 {
+		return nil, fmt.Errorf("encrypted request is longer than the key")
 	}
-	err = binary.Read(reader, binary.BigEndian, 0x04)
-	if err != nil {
-		return err
+	plain := c.Exp(c, key.D, key.N).Bytes()
+	if len(plain) != encryptedSize {
+		return nil, fmt.Errorf("decrypted request is %d bytes, want %d", len(plain), encryptedSize)
 	}
-
-	return nil
+	return plain, nil
 }
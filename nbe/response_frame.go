@@ -14,17 +14,25 @@
  * You should have received a copy of the GNU General Public License
  * along with this program. If not, see <http://www.gnu.org/licenses/>.
  */
-
 package nbe
 
 import (
-	"encoding/binary"
+	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
+// responseHeaderSize is the length of everything before the payload: the
+// app id, controller id, start marker, function, seq no, status and
+// payload length.
+const responseHeaderSize = 27
+
 type NBEResponse struct {
 	AppID        string // client application id
 	ControllerID string // controller id
@@ -34,147 +42,226 @@ type NBEResponse struct {
 	Payload      map[string]interface{}
 }
 
+// Pack writes a response, as sent by the controller. Payload values are
+// written in key order.
 func (frame *NBEResponse) Pack(writer io.Writer) error {
-	var err error
+	buf := make([]byte, 0, 256)
+	buf = appendPadded(buf, frame.AppID, 12, ' ')
+	buf = appendPadded(buf, frame.ControllerID, 6, ' ')
+	buf = append(buf, 0x02)
+	buf = appendNumber(buf, int64(frame.Function), 2)
+	buf = appendNumber(buf, int64(frame.SeqNo), 2)
+	buf = append(buf, '0'+frame.Status%10)
 
-	err = binary.Write(writer, binary.BigEndian, []byte(fmt.Sprintf("%12s", frame.AppID)))
-	if err != nil {
-		return err
-	}
-	err = binary.Write(writer, binary.BigEndian, []byte(fmt.Sprintf("%6s", frame.ControllerID)))
-	if err != nil {
-		return err
-	}
-	err = binary.Write(writer, binary.BigEndian, [1]byte{0x02})
-	if err != nil {
-		return err
-	}
-	err = binary.Write(writer, binary.BigEndian, &frame.Function)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(writer, binary.BigEndian, &frame.SeqNo)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(writer, binary.BigEndian, &frame.Status)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(writer, binary.BigEndian, &frame.Payload)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(writer, binary.BigEndian, [1]byte{0x04})
-	if err != nil {
-		return err
+	// The payload length is filled in once the payload has been written.
+	lengthAt := len(buf)
+	buf = append(buf, "000"...)
+	buf = frame.appendPayload(buf)
+	payloadLen := len(buf) - lengthAt - 3
+	if payloadLen > 999 {
+		return fmt.Errorf("payload too long: %d bytes", payloadLen)
 	}
+	appendNumber(buf[lengthAt:lengthAt], int64(payloadLen), 3)
+	buf = append(buf, 0x04)
 
-	return nil
+	_, err := writer.Write(buf)
+	return err
 }
 
-func (frame *NBEResponse) Unpack(reader io.Reader) error {
-	var err error
-
-	appId := make([]byte, 12)
-	if _, err = io.ReadFull(reader, appId); err != nil {
-		return err
+func (frame *NBEResponse) appendPayload(buf []byte) []byte {
+	if frame.Function == UnknownFunction {
+		return fmt.Appendf(buf, "%v", frame.Payload["error"])
 	}
-	frame.AppID = string(appId)
-
-	controllerId := make([]byte, 6)
-	if _, err = io.ReadFull(reader, controllerId); err != nil {
-		return err
+	keys := make([]string, 0, len(frame.Payload))
+	for k := range frame.Payload {
+		keys = append(keys, k)
 	}
-	frame.ControllerID = string(controllerId)
+	sort.Strings(keys)
 
-	startMarker := make([]byte, 1)
-	if _, err = io.ReadFull(reader, startMarker); err != nil {
-		return err
+	for i, k := range keys {
+		if i > 0 {
+			buf = append(buf, ';')
+		}
+		buf = append(buf, k...)
+		buf = append(buf, '=')
+		value := frame.Payload[k]
+		if r, ok := value.(map[string]interface{}); ok && frame.Function == GetSetupRangeFunction {
+			buf = appendValue(buf, r["min"])
+			buf = append(buf, ',')
+			buf = appendValue(buf, r["max"])
+			buf = append(buf, ',')
+			buf = appendValue(buf, r["default"])
+			buf = append(buf, ',')
+			buf = appendValue(buf, r["decimals"])
+			continue
+		}
+		buf = appendValue(buf, value)
 	}
-	if startMarker[0] != 0x02 {
-		return fmt.Errorf("invalid start marker: %x", startMarker[0])
+	return buf
+}
+
+// appendValue is the inverse of parseValue.
+func appendValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case RoundedFloat:
+		return strconv.AppendFloat(buf, float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.AppendFloat(buf, v, 'f', -1, 64)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case string:
+		return append(buf, v...)
+	case nil:
+		return buf
 	}
+	return fmt.Appendf(buf, "%v", value)
+}
 
-	function := make([]byte, 2)
-	if _, err = io.ReadFull(reader, function); err != nil {
+// Unpack reads a response, as sent by the controller.
+func (frame *NBEResponse) Unpack(reader io.Reader) error {
+	var header [responseHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
 		return err
 	}
-	functionInt, err := strconv.ParseInt(strings.TrimSpace(string(function)), 10, 8)
-	if err != nil {
-		functionInt = -1
+	frame.AppID = string(bytes.TrimSpace(header[0:12]))
+	frame.ControllerID = string(bytes.TrimSpace(header[12:18]))
+	if header[18] != 0x02 {
+		return fmt.Errorf("invalid start marker: %x", header[18])
 	}
-	frame.Function = Function(functionInt)
 
-	seqNo := make([]byte, 2)
-	if _, err = io.ReadFull(reader, seqNo); err != nil {
-		return fmt.Errorf("invalid seq no: %s", string(seqNo))
+	function, ok := parseNumber(bytes.TrimSpace(header[19:21]))
+	if !ok {
+		function = -1
 	}
-	seqNoInt, err := strconv.ParseInt(strings.TrimSpace(string(seqNo)), 10, 8)
-	if err != nil {
-		seqNoInt = -1
-	}
-	frame.SeqNo = int8(seqNoInt)
+	frame.Function = Function(function)
 
-	status := make([]byte, 1)
-	if _, err = io.ReadFull(reader, status); err != nil {
-		return err
+	seqNo, ok := parseNumber(bytes.TrimSpace(header[21:23]))
+	if !ok {
+		seqNo = -1
 	}
-	statusInt, err := strconv.ParseUint(strings.TrimSpace(string(status)), 10, 8)
-	if err != nil {
-		return fmt.Errorf("invalid status: %s", string(status))
-	}
-	frame.Status = uint8(statusInt)
+	frame.SeqNo = int8(seqNo)
 
-	payloadLenBytes := make([]byte, 3)
-	if _, err = io.ReadFull(reader, payloadLenBytes); err != nil {
-		return fmt.Errorf("invalid payload length: %s", string(payloadLenBytes))
+	status := header[23]
+	if status < '0' || status > '9' {
+		return fmt.Errorf("invalid status: %s", header[23:24])
 	}
-	payloadLen, err := strconv.ParseInt(string(payloadLenBytes), 10, 32)
-	if err != nil {
-		return fmt.Errorf("invalid payload length: %s", string(payloadLenBytes))
+	frame.Status = status - '0'
+
+	payloadLen, ok := parseNumber(header[24:27])
+	if !ok || payloadLen < 0 {
+		return fmt.Errorf("invalid payload length: %s", header[24:27])
 	}
 
-	payload := make([]byte, payloadLen)
-	if _, err = io.ReadFull(reader, payload); err != nil {
+	// The payload and end marker are read together.
+	body := make([]byte, payloadLen+1)
+	if _, err := io.ReadFull(reader, body); err != nil {
 		return err
 	}
-	frame.Payload = make(map[string]interface{})
+	payload := body[:payloadLen]
 
-	if frame.Function == -1 {
-		frame.Payload["error"] = string(payload)
+	if frame.Function == UnknownFunction {
+		frame.Payload = map[string]interface{}{"error": string(payload)}
 	} else {
-		parts := strings.Split(string(payload), ";")
-		for _, part := range parts {
-			keyValue := strings.SplitN(part, "=", 2)
-			if len(keyValue) != 2 {
+		frame.Payload = make(map[string]interface{}, bytes.Count(payload, []byte{';'})+1)
+		for more := true; more; {
+			var part []byte
+			part, payload, more = bytes.Cut(payload, []byte{';'})
+			k, v, ok := bytes.Cut(part, []byte{'='})
+			if !ok {
 				continue
 			}
-			key := strings.ToLower(keyValue[0])
-			if frame.Function == 3 {
-				values := strings.Split(keyValue[1], ",")
-				frame.Payload[key] = make(map[string]interface{})
-				frame.Payload[key].(map[string]interface{})["min"] = parseValue(values[0])
-				frame.Payload[key].(map[string]interface{})["max"] = parseValue(values[1])
-				frame.Payload[key].(map[string]interface{})["default"] = parseValue(values[2])
-				frame.Payload[key].(map[string]interface{})["decimals"] = parseValue(values[3])
+			key := lower(k)
+			if frame.Function == GetSetupRangeFunction {
+				r, ok := parseRange(string(v))
+				if !ok {
+					continue
+				}
+				frame.Payload[key] = r
 			} else {
-				frame.Payload[key] = parseValue(keyValue[1])
+				frame.Payload[key] = parseField(v)
 			}
 		}
 	}
 
-	endMarker := make([]byte, 1)
-	if _, err = io.ReadFull(reader, endMarker); err != nil {
-		return err
-	}
-	if endMarker[0] != 0x04 {
-		return fmt.Errorf("invalid end marker: %x", endMarker[0])
+	if body[payloadLen] != 0x04 {
+		return fmt.Errorf("invalid end marker: %x", body[payloadLen])
 	}
 
 	return nil
 }
 
+// payloadKeys interns the keys seen in payloads, of which a controller
+// has a few hundred, so that parsing a response doesn't allocate a string
+// for every key. Keys beyond maxPayloadKeys are not interned, in case a
+// misbehaving controller sends an endless variety of them.
+var payloadKeys = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+const maxPayloadKeys = 4096
+
+// lower returns a payload key in lower case.
+func lower(key []byte) string {
+	payloadKeys.RLock()
+	s, ok := payloadKeys.m[string(key)]
+	payloadKeys.RUnlock()
+	if ok {
+		return s
+	}
+
+	s = string(key)
+	for _, c := range key {
+		if ('A' <= c && c <= 'Z') || c >= utf8.RuneSelf {
+			s = strings.ToLower(s)
+			break
+		}
+	}
+	payloadKeys.Lock()
+	if len(payloadKeys.m) < maxPayloadKeys {
+		payloadKeys.m[string(key)] = s
+	}
+	payloadKeys.Unlock()
+	return s
+}
+
+// parseRange parses the min,max,default,decimals of a setting, as answered
+// to GetSetupRangeFunction.
+func parseRange(value string) (map[string]interface{}, bool) {
+	var values [4]string
+	for i := 0; i < 3; i++ {
+		var ok bool
+		values[i], value, ok = strings.Cut(value, ",")
+		if !ok {
+			return nil, false
+		}
+	}
+	if strings.Contains(value, ",") {
+		return nil, false
+	}
+	values[3] = value
+	return map[string]interface{}{
+		"min":      parseValue(values[0]),
+		"max":      parseValue(values[1]),
+		"default":  parseValue(values[2]),
+		"decimals": parseValue(values[3]),
+	}, true
+}
+
+// parseField is parseValue for a field still in the frame, which is only
+// copied into a string if it isn't an integer.
+func parseField(value []byte) interface{} {
+	if n, ok := parseNumber(value); ok && n >= math.MinInt32 && n <= math.MaxInt32 {
+		return n
+	}
+	// Anything strconv.ParseInt would accept has been handled above.
+	s := string(value)
+	if floatVal, err := strconv.ParseFloat(s, 32); err == nil {
+		return RoundedFloat(floatVal)
+	}
+	return s
+}
+
 func parseValue(value string) interface{} {
 	intVal, err := strconv.ParseInt(value, 10, 32)
 	if err == nil {
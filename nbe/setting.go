@@ -17,6 +17,16 @@
 
 package nbe
 
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SettingDefinition is the range of a setting, as reported by the
+// controller. Decimals is the number of decimal places the controller
+// keeps.
 type SettingDefinition struct {
 	Name     string       `json:"name"`
 	Group    string       `json:"group"`
@@ -25,6 +35,87 @@ type SettingDefinition struct {
 	Decimals int64        `json:"decimals"`
 }
 
+// Validate checks that value, as it would be written to the controller, is
+// a number within the setting's range with no more decimal places than the
+// controller keeps.
 func (setting *SettingDefinition) Validate(value interface{}) error {
+	name := setting.Group + "." + setting.Name
+	var f float64
+	switch v := value.(type) {
+	case int64:
+		f = float64(v)
+	case RoundedFloat:
+		f = float64(v)
+	case float64:
+		f = v
+	case string, []byte:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(fmt.Sprintf("%s", v)), 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, not %q", name, v)
+		}
+		f = parsed
+	default:
+		return fmt.Errorf("%s must be a number, not %v", name, value)
+	}
+
+	// The range is reported as 32 bit floats, so is rounded to the places
+	// the controller keeps before comparing.
+	places := int(setting.Decimals)
+	scale := math.Pow10(places)
+	min := math.Round(float64(setting.Min)*scale) / scale
+	max := math.Round(float64(setting.Max)*scale) / scale
+	if f < min || f > max {
+		return fmt.Errorf("%s must be between %s and %s", name,
+			strconv.FormatFloat(min, 'f', places, 64), strconv.FormatFloat(max, 'f', places, 64))
+	}
+	if math.Abs(f*scale-math.Round(f*scale)) > 1e-6 {
+		switch places {
+		case 0:
+			return fmt.Errorf("%s must be a whole number", name)
+		case 1:
+			return fmt.Errorf("%s can have at most 1 decimal place", name)
+		}
+		return fmt.Errorf("%s can have at most %d decimal places", name, places)
+	}
 	return nil
 }
+
+// LoadSchema reads the definition of every setting in categories, keyed by
+// category.key. Categories the controller has no ranges for are skipped.
+func LoadSchema(boiler Boiler, categories []string) (map[string]SettingDefinition, error) {
+	schema := make(map[string]SettingDefinition)
+	for _, category := range categories {
+		response, err := boiler.Get(GetSetupRangeFunction, fmt.Sprintf("%s.*", category))
+		if err != nil {
+			return schema, fmt.Errorf("reading ranges of %s: %v", category, err)
+		}
+		if response.Status != 0 {
+			continue
+		}
+		for key, value := range response.Payload {
+			r, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			decimals, _ := r["decimals"].(int64)
+			schema[category+"."+key] = SettingDefinition{
+				Name:     key,
+				Group:    category,
+				Min:      toRoundedFloat(r["min"]),
+				Max:      toRoundedFloat(r["max"]),
+				Decimals: decimals,
+			}
+		}
+	}
+	return schema, nil
+}
+
+func toRoundedFloat(value interface{}) RoundedFloat {
+	switch v := value.(type) {
+	case RoundedFloat:
+		return v
+	case int64:
+		return RoundedFloat(v)
+	}
+	return 0
+}
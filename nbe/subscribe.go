@@ -0,0 +1,58 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import "sync"
+
+// subscribers are the callbacks registered with a Boiler's Subscribe. The
+// zero value is ready to use.
+type subscribers struct {
+	mutex sync.RWMutex
+	next  int
+	cbs   map[int]func(*NBEResponse)
+}
+
+// add registers cb, returning a function that removes it again.
+func (s *subscribers) add(cb func(*NBEResponse)) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cbs == nil {
+		s.cbs = make(map[int]func(*NBEResponse))
+	}
+	id := s.next
+	s.next++
+	s.cbs[id] = cb
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.cbs, id)
+	}
+}
+
+// notify calls every subscriber with response.
+func (s *subscribers) notify(response *NBEResponse) {
+	s.mutex.RLock()
+	cbs := make([]func(*NBEResponse), 0, len(s.cbs))
+	for _, cb := range s.cbs {
+		cbs = append(cbs, cb)
+	}
+	s.mutex.RUnlock()
+	for _, cb := range cbs {
+		cb(response)
+	}
+}
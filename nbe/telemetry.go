@@ -0,0 +1,54 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import "time"
+
+// Telemetry is told about the requests made to the controller, for tracing
+// and metrics. By default nothing is reported.
+type Telemetry interface {
+	// Request is called as a request is sent. The function it returns is
+	// called once with the response, or with the error if the request
+	// couldn't be sent, and never if the request goes unanswered.
+	Request(request *NBERequest) func(response *NBEResponse, err error)
+	// Timeout is called when a request isn't answered in time.
+	Timeout(function Function)
+	// Mismatch is called when a response is dropped because it doesn't
+	// match a waiting request, with the reason why.
+	Mismatch(reason string)
+	// SeqNoCollision is called when a sequence number is skipped because a
+	// request is still waiting on it.
+	SeqNoCollision()
+	// SocketRecovery is called when the socket to the controller is
+	// replaced after failing repeatedly.
+	SocketRecovery()
+	// Pending is called once, with functions returning how many requests
+	// are waiting for a response and how long the oldest has been waiting.
+	Pending(count func() int, oldest func() time.Duration)
+}
+
+type nopTelemetry struct{}
+
+func (nopTelemetry) Request(request *NBERequest) func(response *NBEResponse, err error) {
+	return func(response *NBEResponse, err error) {}
+}
+func (nopTelemetry) Timeout(function Function)                             {}
+func (nopTelemetry) Mismatch(reason string)                                {}
+func (nopTelemetry) SeqNoCollision()                                       {}
+func (nopTelemetry) SocketRecovery()                                       {}
+func (nopTelemetry) Pending(count func() int, oldest func() time.Duration) {}
@@ -18,6 +18,7 @@
 package nbe
 
 import (
+	"fmt"
 	"strconv"
 )
 
@@ -31,6 +32,21 @@ func (r RoundedFloat) Equal(other RoundedFloat) bool {
 	return strconv.FormatFloat(float64(r), 'f', 2, 32) == strconv.FormatFloat(float64(other), 'f', 2, 32)
 }
 
+// Decimal is a number formatted with a fixed number of decimal places, for
+// values whose precision is known.
+type Decimal struct {
+	Value  float64
+	Places int
+}
+
+func (d Decimal) String() string {
+	return strconv.FormatFloat(d.Value, 'f', d.Places, 64)
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
 type Function int16
 
 const (
@@ -48,6 +64,21 @@ const (
 	UnknownFunction              Function = -1
 )
 
+// FunctionNames names the functions, for configuring them by name.
+var FunctionNames = map[string]Function{
+	"discovery":          DiscoveryFunction,
+	"get_setup":          GetSetupFunction,
+	"set_setup":          SetSetupFunction,
+	"get_setup_range":    GetSetupRangeFunction,
+	"operating_data":     GetOperatingDataFunction,
+	"advanced_data":      GetAdvancedDataFunction,
+	"consumption_data":   GetConsumptionDataFunction,
+	"chart_data":         GetChartDataFunction,
+	"event_log":          GetEventLogFunction,
+	"info":               GetInfoFunction,
+	"available_programs": GetAvailableProgramsFunction,
+}
+
 var Settings = []string{
 	"boiler",
 	"hot_water",
@@ -62,6 +93,7 @@ var Settings = []string{
 	"ignition",
 	"pump",
 	"sun",
+	"sun2",
 	"vacuum",
 	"misc",
 	"alarm",
@@ -87,10 +119,10 @@ var PowerStates = []string{
 	"Error boiler temp. sensor",
 	"Error photo sensor",
 	"Error burner temp. sensor",
-	"",
+	"Error return temp. sensor",
 	"Error on a motor output",
 	"Error no fire - out of pellets",
-	"",
+	"Error smoke temp. sensor",
 	"Stopped by external temperature",
 	"Stopped by timer",
 	"Stopped by external contact",
@@ -101,4 +133,53 @@ var PowerStates = []string{
 	"Overheat/auger disconnected",
 	"Stopped by cascade",
 	"Compressor failure",
+	"Compressor cleaning",
+	"Vacuum filling hopper",
+	"Error vacuum - hopper not filled",
+	"Error oxygen sensor",
+	"Stopped by solar",
+}
+
+var powerStateOverrides map[int64]string
+
+// OverridePowerStates renames power states, or describes states that
+// PowerStates doesn't know, for firmwares that differ. It must be called
+// before anything asks for a PowerStateText.
+func OverridePowerStates(states map[int64]string) {
+	powerStateOverrides = states
+}
+
+// PowerStateText returns the description of a power state, or a
+// placeholder for states that aren't known.
+func PowerStateText(state int64) string {
+	if text, ok := powerStateOverrides[state]; ok {
+		return text
+	}
+	if state >= 0 && state < int64(len(PowerStates)) && PowerStates[state] != "" {
+		return PowerStates[state]
+	}
+	return fmt.Sprintf("Unknown state (%d)", state)
+}
+
+// AlarmStates are the power states that indicate a fault needing attention,
+// as opposed to normal operation or a deliberate stop.
+var AlarmStates = map[int64]bool{
+	8:  true,
+	11: true,
+	12: true,
+	13: true,
+	15: true,
+	16: true,
+	17: true,
+	18: true,
+	19: true,
+	20: true,
+	21: true,
+	26: true,
+	27: true,
+	28: true,
+	29: true,
+	31: true,
+	34: true,
+	35: true,
 }
@@ -0,0 +1,224 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package notify
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Events that can be notified.
+const (
+	AlarmEvent              = "alarm"
+	AlarmClearedEvent       = "alarm_cleared"
+	PelletsLowEvent         = "pellets_low"
+	ConnectionLostEvent     = "connection_lost"
+	ConnectionRestoredEvent = "connection_restored"
+)
+
+var eventTypes = []string{AlarmEvent, AlarmClearedEvent, PelletsLowEvent, ConnectionLostEvent, ConnectionRestoredEvent}
+
+var defaultTemplates = map[string]string{
+	AlarmEvent:              "{{.Name}}: {{.Text}}. {{.Description}}",
+	AlarmClearedEvent:       "{{.Name}}: alarm cleared, {{.Text}}",
+	PelletsLowEvent:         "{{.Name}}: pellets are low, {{.Value}} kg left in the hopper",
+	ConnectionLostEvent:     "{{.Name}}: lost connection to {{.Component}}: {{.Error}}",
+	ConnectionRestoredEvent: "{{.Name}}: connection to {{.Component}} restored",
+}
+
+const defaultGrace = time.Minute
+
+// Config configures notifications, sent to Telegram, Pushover, email or any
+// combination of them.
+// Events defaults to every event, but pellets_low is only sent if
+// PelletsLow, the hopper content in kg it is sent below, is set. A lost
+// connection is only notified if it isn't restored within Grace.
+type Config struct {
+	Telegram   *TelegramConfig   `yaml:"telegram"`
+	Pushover   *PushoverConfig   `yaml:"pushover"`
+	Email      *EmailConfig      `yaml:"email"`
+	Events     []string          `yaml:"events"`
+	Templates  map[string]string `yaml:"templates"`
+	PelletsLow *float64          `yaml:"pellets_low"`
+	QuietHours *QuietHours       `yaml:"quiet_hours"`
+	Grace      time.Duration     `yaml:"grace"`
+}
+
+// TelegramConfig sends messages from a bot to a chat. API is the Bot API
+// server, for those running their own.
+type TelegramConfig struct {
+	Token  string `yaml:"token"`
+	ChatID string `yaml:"chat_id"`
+	API    string `yaml:"api"`
+}
+
+// PushoverConfig sends messages from an application to a user or group,
+// and optionally only to one of their devices.
+type PushoverConfig struct {
+	Token  string `yaml:"token"`
+	User   string `yaml:"user"`
+	Device string `yaml:"device"`
+}
+
+// EmailConfig sends email through an SMTP server, given as host:port.
+// Security is tls for a connection that is encrypted from the start, the
+// default on port 465, starttls to insist on upgrading it, or none. It
+// otherwise upgrades when the server offers to. Events restricts the events
+// emailed, from those notified, and Subjects replaces the subject of an
+// event. With Digest set, emails are collected and sent together at most
+// that often, apart from the events in Immediate.
+type EmailConfig struct {
+	Server    string            `yaml:"server"`
+	Security  string            `yaml:"security"`
+	Username  string            `yaml:"username"`
+	Password  string            `yaml:"password"`
+	From      string            `yaml:"from"`
+	To        []string          `yaml:"to"`
+	Events    []string          `yaml:"events"`
+	Subjects  map[string]string `yaml:"subjects"`
+	Digest    time.Duration     `yaml:"digest"`
+	Immediate []string          `yaml:"immediate"`
+}
+
+// QuietHours is a daily period, from HH:MM to HH:MM in local time, during
+// which notifications are sent silently, apart from the events in Except.
+type QuietHours struct {
+	From   string   `yaml:"from"`
+	To     string   `yaml:"to"`
+	Except []string `yaml:"except"`
+}
+
+func (c *Config) Validate() error {
+	if c.Telegram == nil && c.Pushover == nil && c.Email == nil {
+		return fmt.Errorf("no telegram, pushover or email configured")
+	}
+	if c.Telegram != nil && (c.Telegram.Token == "" || c.Telegram.ChatID == "") {
+		return fmt.Errorf("telegram needs a token and chat_id")
+	}
+	if c.Pushover != nil && (c.Pushover.Token == "" || c.Pushover.User == "") {
+		return fmt.Errorf("pushover needs a token and user")
+	}
+	if c.Email != nil {
+		if err := c.Email.Validate(); err != nil {
+			return fmt.Errorf("email: %v", err)
+		}
+	}
+	for _, e := range c.Events {
+		if !contains(eventTypes, e) {
+			return fmt.Errorf("unknown event %q, expected one of %s", e, strings.Join(eventTypes, ", "))
+		}
+		if e == PelletsLowEvent && c.PelletsLow == nil {
+			return fmt.Errorf("pellets_low events need a pellets_low level")
+		}
+	}
+	for e, text := range c.Templates {
+		if !contains(eventTypes, e) {
+			return fmt.Errorf("template for unknown event %q", e)
+		}
+		if _, err := template.New(e).Parse(text); err != nil {
+			return fmt.Errorf("invalid %s template: %v", e, err)
+		}
+	}
+	if c.QuietHours != nil {
+		if _, err := parseClock(c.QuietHours.From); err != nil {
+			return fmt.Errorf("quiet_hours: invalid from: %v", err)
+		}
+		if _, err := parseClock(c.QuietHours.To); err != nil {
+			return fmt.Errorf("quiet_hours: invalid to: %v", err)
+		}
+		for _, e := range c.QuietHours.Except {
+			if !contains(eventTypes, e) {
+				return fmt.Errorf("quiet_hours: unknown event %q", e)
+			}
+		}
+	}
+	if c.Grace < 0 {
+		return fmt.Errorf("grace can't be negative")
+	}
+	return nil
+}
+
+func (c *EmailConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		return fmt.Errorf("invalid server, expected host:port: %v", err)
+	}
+	if !contains(securityModes, c.Security) {
+		return fmt.Errorf("unknown security %q, expected one of tls, starttls, none", c.Security)
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return fmt.Errorf("invalid from: %v", err)
+	}
+	if len(c.To) == 0 {
+		return fmt.Errorf("no recipients configured")
+	}
+	for _, to := range c.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid recipient %q: %v", to, err)
+		}
+	}
+	for _, e := range append(c.Events, c.Immediate...) {
+		if !contains(eventTypes, e) {
+			return fmt.Errorf("unknown event %q, expected one of %s", e, strings.Join(eventTypes, ", "))
+		}
+	}
+	for e, text := range c.Subjects {
+		if !contains(eventTypes, e) {
+			return fmt.Errorf("subject for unknown event %q", e)
+		}
+		if _, err := template.New(e).Parse(text); err != nil {
+			return fmt.Errorf("invalid %s subject: %v", e, err)
+		}
+	}
+	if c.Digest < 0 {
+		return fmt.Errorf("digest can't be negative")
+	}
+	return nil
+}
+
+// parseClock parses HH:MM as the time since midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// quiet reports whether t is within quiet hours, which may span midnight.
+func (q *QuietHours) quiet(t time.Time) bool {
+	from, _ := parseClock(q.From)
+	to, _ := parseClock(q.To)
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if from <= to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package notify
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var securityModes = []string{"", "tls", "starttls", "none"}
+
+var defaultSubjects = map[string]string{
+	AlarmEvent:              "{{.Name}}: {{.Text}}",
+	AlarmClearedEvent:       "{{.Name}}: alarm cleared",
+	PelletsLowEvent:         "{{.Name}}: pellets are low",
+	ConnectionLostEvent:     "{{.Name}}: lost connection to {{.Component}}",
+	ConnectionRestoredEvent: "{{.Name}}: connection to {{.Component}} restored",
+}
+
+const smtpTimeout = 30 * time.Second
+
+type message struct {
+	event   Event
+	subject string
+	text    string
+}
+
+type email struct {
+	EmailConfig
+
+	from     *mail.Address
+	to       []*mail.Address
+	subjects map[string]*template.Template
+
+	mutex   sync.Mutex
+	pending []message
+}
+
+func newEmail(config EmailConfig) (*email, error) {
+	e := &email{
+		EmailConfig: config,
+		subjects:    make(map[string]*template.Template),
+	}
+	var err error
+	if e.from, err = mail.ParseAddress(config.From); err != nil {
+		return nil, err
+	}
+	for _, to := range config.To {
+		addr, err := mail.ParseAddress(to)
+		if err != nil {
+			return nil, err
+		}
+		e.to = append(e.to, addr)
+	}
+	for _, ev := range eventTypes {
+		text, ok := config.Subjects[ev]
+		if !ok {
+			text = defaultSubjects[ev]
+		}
+		t, err := template.New(ev).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		e.subjects[ev] = t
+	}
+	return e, nil
+}
+
+func (e *email) String() string {
+	return "email"
+}
+
+func (e *email) wants(eventType string) bool {
+	return len(e.Events) == 0 || contains(e.Events, eventType)
+}
+
+// send emails the text of an event straight away, or adds it to the digest.
+// Email has no sound to silence, so quiet is ignored.
+func (e *email) send(client *http.Client, event Event, text string, quiet bool) error {
+	var subject bytes.Buffer
+	if err := e.subjects[event.Type].Execute(&subject, event); err != nil {
+		return err
+	}
+	msg := message{event: event, subject: subject.String(), text: text}
+	if e.Digest == 0 || contains(e.Immediate, event.Type) {
+		return e.deliver(msg.subject, msg.text)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if len(e.pending) == 0 {
+		time.AfterFunc(e.Digest, e.flush)
+	}
+	e.pending = append(e.pending, msg)
+	return nil
+}
+
+// flush sends the digest, if anything is waiting for it. A digest of one
+// message is sent as that message.
+func (e *email) flush() {
+	e.mutex.Lock()
+	pending := e.pending
+	e.pending = nil
+	e.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	subject, text := pending[0].subject, pending[0].text
+	if len(pending) > 1 {
+		name := pending[len(pending)-1].event.Name
+		subject = fmt.Sprintf("%s: %d notifications", name, len(pending))
+		var body strings.Builder
+		fmt.Fprintf(&body, "%d notifications from %s:\n", len(pending), name)
+		for _, msg := range pending {
+			fmt.Fprintf(&body, "\n%s  %s\n", msg.event.Timestamp.Local().Format("2006-01-02 15:04:05"), msg.text)
+		}
+		text = body.String()
+	}
+	if err := e.deliver(subject, text); err != nil {
+		log.Errorf("Failed to send email digest of %d notifications: %v", len(pending), err)
+		return
+	}
+	log.Debugf("Sent email digest of %d notifications", len(pending))
+}
+
+func (e *email) deliver(subject string, text string) error {
+	host, port, _ := net.SplitHostPort(e.Server)
+	implicit := e.Security == "tls" || (e.Security == "" && port == "465")
+	tlsConfig := &tls.Config{ServerName: host}
+
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	var err error
+	if implicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.Server, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", e.Server)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if hostname, err := os.Hostname(); err == nil {
+		if err := c.Hello(hostname); err != nil {
+			return err
+		}
+	}
+	if !implicit && e.Security != "none" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if e.Security == "starttls" {
+			return fmt.Errorf("%s does not support STARTTLS", e.Server)
+		}
+	}
+	if e.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.Username, e.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(e.from.Address); err != nil {
+		return err
+	}
+	for _, to := range e.to {
+		if err := c.Rcpt(to.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(e.message(subject, text)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (e *email) message(subject string, text string) []byte {
+	to := make([]string, len(e.to))
+	for i, addr := range e.to {
+		to[i] = addr.String()
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+	domain := e.from.Address[strings.LastIndex(e.from.Address, "@")+1:]
+
+	var b bytes.Buffer
+	header := func(key string, value string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	header("From", e.from.String())
+	header("To", strings.Join(to, ", "))
+	// Alarm text may contain anything, so keep it to one line.
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject), " ")))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	header("Auto-Submitted", "auto-generated")
+	b.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n")))
+	w.Close()
+	return b.Bytes()
+}
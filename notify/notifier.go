@@ -0,0 +1,272 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package notify sends notifications of alarms, low pellets and lost
+// connections through Telegram, Pushover or email, for those without an
+// alerting stack of their own.
+package notify
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const queueSize = 32
+
+// Event is passed to templates. Which fields are set depends on the type.
+type Event struct {
+	Type        string
+	Name        string
+	Serial      string
+	Timestamp   time.Time
+	State       int64
+	Text        string
+	Description string
+	Component   string
+	Error       string
+	Value       interface{}
+}
+
+// Notifier turns alarms, the hopper running low and connections being lost
+// and restored into notifications.
+type Notifier struct {
+	Config
+	Serial string
+
+	name      func() string
+	services  []service
+	templates map[string]*template.Template
+	client    *http.Client
+	queue     chan Event
+
+	mutex    sync.Mutex
+	low      bool
+	lost     map[string]*time.Timer
+	notified map[string]bool
+}
+
+// New creates a notifier. name returns the name of the boiler, which may
+// change while running.
+func New(config Config, serial string, name func() string) (*Notifier, error) {
+	n := &Notifier{
+		Config:    config,
+		Serial:    serial,
+		name:      name,
+		templates: make(map[string]*template.Template),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		queue:     make(chan Event, queueSize),
+		lost:      make(map[string]*time.Timer),
+		notified:  make(map[string]bool),
+	}
+	if config.Telegram != nil {
+		n.services = append(n.services, &telegram{*config.Telegram})
+	}
+	if config.Pushover != nil {
+		n.services = append(n.services, &pushover{*config.Pushover})
+	}
+	if config.Email != nil {
+		e, err := newEmail(*config.Email)
+		if err != nil {
+			return nil, err
+		}
+		n.services = append(n.services, e)
+	}
+	if n.Grace == 0 {
+		n.Grace = defaultGrace
+	}
+	for _, e := range eventTypes {
+		text, ok := config.Templates[e]
+		if !ok {
+			text = defaultTemplates[e]
+		}
+		t, err := template.New(e).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		n.templates[e] = t
+	}
+	return n, nil
+}
+
+// String names the services notifications are sent to.
+func (n *Notifier) String() string {
+	names := make([]string, len(n.services))
+	for i, s := range n.services {
+		names[i] = s.String()
+	}
+	return strings.Join(names, " and ")
+}
+
+func (n *Notifier) Start(events *bus.Bus) {
+	go n.run()
+
+	events.OnAlarm(func(alarm bus.Alarm) {
+		event := Event{
+			Type:        AlarmEvent,
+			Timestamp:   alarm.Timestamp,
+			State:       alarm.State,
+			Text:        alarm.Text,
+			Description: alarm.Description,
+		}
+		if !alarm.Active {
+			event.Type = AlarmClearedEvent
+		}
+		n.notify(event)
+	})
+	if n.PelletsLow != nil {
+		events.OnChange(n.handleHopper)
+	}
+	events.OnConnectivity(n.handleConnectivity)
+}
+
+// Close sends anything held back for a digest.
+func (n *Notifier) Close() {
+	for _, s := range n.services {
+		if f, ok := s.(flusher); ok {
+			f.flush()
+		}
+	}
+}
+
+// handleHopper notifies once each time the hopper content falls below the
+// pellets_low level.
+func (n *Notifier) handleHopper(change bus.Change) {
+	if change.Category != "hopper" || change.Key != "content" {
+		return
+	}
+	var content float64
+	switch v := change.Value.(type) {
+	case nbe.RoundedFloat:
+		content = math.Round(float64(v)*10) / 10
+	case int64:
+		content = float64(v)
+	default:
+		return
+	}
+
+	n.mutex.Lock()
+	low := content < *n.PelletsLow
+	fell := low && !n.low
+	n.low = low
+	n.mutex.Unlock()
+
+	if fell {
+		n.notify(Event{
+			Type:      PelletsLowEvent,
+			Timestamp: change.Timestamp,
+			Value:     content,
+		})
+	}
+}
+
+// handleConnectivity notifies a connection being lost once it has been
+// lost for the grace period, so that brief drops go unnoticed, and then
+// its being restored.
+func (n *Notifier) handleConnectivity(c bus.Connectivity) {
+	component := c.Component
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if c.Connected {
+		if timer, pending := n.lost[component]; pending {
+			timer.Stop()
+			delete(n.lost, component)
+		}
+		if n.notified[component] {
+			delete(n.notified, component)
+			n.notify(Event{
+				Type:      ConnectionRestoredEvent,
+				Timestamp: c.Timestamp,
+				Component: component,
+			})
+		}
+		return
+	}
+
+	if _, pending := n.lost[component]; pending || n.notified[component] {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(n.Grace, func() {
+		n.mutex.Lock()
+		if n.lost[component] != timer {
+			n.mutex.Unlock()
+			return
+		}
+		delete(n.lost, component)
+		n.notified[component] = true
+		n.mutex.Unlock()
+
+		n.notify(Event{
+			Type:      ConnectionLostEvent,
+			Timestamp: c.Timestamp,
+			Component: component,
+			Error:     c.Error,
+		})
+	})
+	n.lost[component] = timer
+}
+
+func (n *Notifier) enabled(eventType string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+	return contains(n.Events, eventType)
+}
+
+func (n *Notifier) notify(event Event) {
+	if !n.enabled(event.Type) {
+		return
+	}
+	event.Name = n.name()
+	event.Serial = n.Serial
+	select {
+	case n.queue <- event:
+	default:
+		log.Warnf("Notification queue is full, dropping %s notification", event.Type)
+	}
+}
+
+func (n *Notifier) run() {
+	for event := range n.queue {
+		var text bytes.Buffer
+		if err := n.templates[event.Type].Execute(&text, event); err != nil {
+			log.Errorf("Failed to write %s notification: %v", event.Type, err)
+			continue
+		}
+		quiet := n.QuietHours != nil && n.QuietHours.quiet(time.Now()) && !contains(n.QuietHours.Except, event.Type)
+		for _, s := range n.services {
+			if f, ok := s.(filter); ok && !f.wants(event.Type) {
+				continue
+			}
+			if err := s.send(n.client, event, text.String(), quiet); err != nil {
+				log.Errorf("Failed to send %s notification to %s: %v", event.Type, s, err)
+				continue
+			}
+			log.Debugf("Sent %s notification to %s", event.Type, s)
+		}
+	}
+}
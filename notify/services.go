@@ -0,0 +1,132 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	telegramAPI = "https://api.telegram.org"
+	pushoverAPI = "https://api.pushover.net/1/messages.json"
+)
+
+// service delivers the text of an event. Quiet messages are sent without
+// sound.
+type service interface {
+	String() string
+	send(client *http.Client, event Event, text string, quiet bool) error
+}
+
+// filter is a service that is only sent some events.
+type filter interface {
+	wants(eventType string) bool
+}
+
+// flusher is a service that holds on to messages, and sends them when
+// flushed.
+type flusher interface {
+	flush()
+}
+
+type telegram struct {
+	TelegramConfig
+}
+
+func (t *telegram) String() string {
+	return "Telegram"
+}
+
+func (t *telegram) send(client *http.Client, event Event, text string, quiet bool) error {
+	api := t.API
+	if api == "" {
+		api = telegramAPI
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"chat_id":              t.ChatID,
+		"text":                 text,
+		"disable_notification": quiet,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimSuffix(api, "/"), t.Token), "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The error includes the URL, and so the token.
+		return fmt.Errorf("request failed: %v", strings.ReplaceAll(err.Error(), t.Token, "<token>"))
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&result); err != nil || !result.OK {
+		if result.Description != "" {
+			return fmt.Errorf("%s: %s", resp.Status, result.Description)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+type pushover struct {
+	PushoverConfig
+}
+
+func (p *pushover) String() string {
+	return "Pushover"
+}
+
+func (p *pushover) send(client *http.Client, event Event, text string, quiet bool) error {
+	form := url.Values{
+		"token":   {p.Token},
+		"user":    {p.User},
+		"title":   {event.Name},
+		"message": {text},
+	}
+	if p.Device != "" {
+		form.Set("device", p.Device)
+	}
+	if quiet {
+		form.Set("priority", "-1")
+	}
+	resp, err := client.PostForm(pushoverAPI, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status int      `json:"status"`
+		Errors []string `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&result); err != nil || result.Status != 1 {
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, strings.Join(result.Errors, ", "))
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const table = "boiler_mate_values"
+
+const schema = `
+CREATE TABLE IF NOT EXISTS ` + table + ` (
+	time     TIMESTAMPTZ      NOT NULL,
+	serial   TEXT             NOT NULL,
+	category TEXT             NOT NULL,
+	key      TEXT             NOT NULL,
+	value    DOUBLE PRECISION,
+	text     TEXT
+);
+CREATE INDEX IF NOT EXISTS ` + table + `_key_time_idx ON ` + table + ` (serial, category, key, time DESC);
+`
+
+// Store periodically inserts a snapshot of every value held by the monitors
+// into PostgreSQL. If the TimescaleDB extension is available the table is
+// created as a hypertable and retention is handled by Timescale.
+type Store struct {
+	Serial    string
+	Interval  time.Duration
+	Retention time.Duration
+
+	db        *sql.DB
+	timescale bool
+}
+
+func NewStore(dsn string, serial string, interval time.Duration, retention time.Duration) (*Store, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &Store{
+		Serial:    serial,
+		Interval:  interval,
+		Retention: retention,
+		db:        db,
+	}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *Store) migrate() error {
+	if _, err := s.db.Exec(schema); err != nil {
+		return fmt.Errorf("creating schema: %v", err)
+	}
+
+	var installed bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&installed)
+	if err != nil {
+		return err
+	}
+	if !installed {
+		log.Infof("TimescaleDB extension not found, using a plain PostgreSQL table")
+		return nil
+	}
+
+	s.timescale = true
+	if _, err := s.db.Exec(fmt.Sprintf(`SELECT create_hypertable('%s', 'time', if_not_exists => TRUE, migrate_data => TRUE)`, table)); err != nil {
+		return fmt.Errorf("creating hypertable: %v", err)
+	}
+	if s.Retention > 0 {
+		if _, err := s.db.Exec(fmt.Sprintf(`SELECT remove_retention_policy('%s', if_exists => TRUE)`, table)); err != nil {
+			return fmt.Errorf("removing retention policy: %v", err)
+		}
+		if _, err := s.db.Exec(fmt.Sprintf(`SELECT add_retention_policy('%s', INTERVAL '%d seconds')`, table, int64(s.Retention.Seconds()))); err != nil {
+			return fmt.Errorf("adding retention policy: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) Start(monitors map[string]*monitor.Monitor) {
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for ts := range ticker.C {
+			if err := s.insert(monitors, ts); err != nil {
+				log.Errorf("Failed to write to PostgreSQL: %v", err)
+			}
+			if s.Retention > 0 && !s.timescale {
+				if err := s.expire(ts); err != nil {
+					log.Errorf("Failed to expire PostgreSQL rows: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// insert writes one batch with COPY, which is far cheaper than a round trip
+// per row.
+func (s *Store) insert(monitors map[string]*monitor.Monitor, ts time.Time) error {
+	txn, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	stmt, err := txn.Prepare(pq.CopyIn(table, "time", "serial", "category", "key", "value", "text"))
+	if err != nil {
+		return err
+	}
+
+	for category, m := range monitors {
+		for k, v := range m.Values() {
+			var value sql.NullFloat64
+			var text sql.NullString
+			switch t := v.(type) {
+			case nbe.RoundedFloat:
+				value = sql.NullFloat64{Float64: float64(t), Valid: true}
+			case int64:
+				value = sql.NullFloat64{Float64: float64(t), Valid: true}
+			default:
+				text = sql.NullString{String: fmt.Sprintf("%v", t), Valid: true}
+			}
+			if _, err := stmt.Exec(ts, s.Serial, category, k, value, text); err != nil {
+				stmt.Close()
+				return err
+			}
+		}
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func (s *Store) expire(now time.Time) error {
+	_, err := s.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE time < $1`, table), now.Add(-s.Retention))
+	return err
+}
@@ -0,0 +1,121 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package price
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const entsoeURL = "https://web-api.tp.entsoe.eu/api"
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+var resolutions = map[string]time.Duration{
+	"PT15M": 15 * time.Minute,
+	"PT30M": 30 * time.Minute,
+	"PT60M": time.Hour,
+}
+
+type entsoeDocument struct {
+	TimeSeries []struct {
+		Period []struct {
+			TimeInterval struct {
+				Start string `xml:"start"`
+				End   string `xml:"end"`
+			} `xml:"timeInterval"`
+			Resolution string `xml:"resolution"`
+			Points     []struct {
+				Position int     `xml:"position"`
+				Price    float64 `xml:"price.amount"`
+			} `xml:"Point"`
+		} `xml:"Period"`
+	} `xml:"TimeSeries"`
+}
+
+// fetchENTSOE returns the day-ahead prices for an area (an EIC code, e.g.
+// 10YNO-1--------2) from today until the end of tomorrow, in EUR/MWh.
+func fetchENTSOE(token string, area string, now time.Time) ([]Slot, error) {
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	query := url.Values{
+		"securityToken": {token},
+		"documentType":  {"A44"},
+		"in_Domain":     {area},
+		"out_Domain":    {area},
+		"periodStart":   {start.Format("200601021504")},
+		"periodEnd":     {start.AddDate(0, 0, 2).Format("200601021504")},
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%s?%s", entsoeURL, query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, body)
+	}
+
+	var doc entsoeDocument
+	if err := xml.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var slots []Slot
+	for _, ts := range doc.TimeSeries {
+		for _, period := range ts.Period {
+			begin, err := time.Parse("2006-01-02T15:04Z", period.TimeInterval.Start)
+			if err != nil {
+				return nil, err
+			}
+			end, err := time.Parse("2006-01-02T15:04Z", period.TimeInterval.End)
+			if err != nil {
+				return nil, err
+			}
+			resolution, ok := resolutions[period.Resolution]
+			if !ok {
+				return nil, fmt.Errorf("unsupported resolution %s", period.Resolution)
+			}
+
+			// Points that repeat the previous price may be left out, so
+			// every position up to the end of the period is filled in.
+			prices := make(map[int]float64, len(period.Points))
+			for _, p := range period.Points {
+				prices[p.Position] = p.Price
+			}
+			var last float64
+			for pos := 1; begin.Add(time.Duration(pos-1) * resolution).Before(end); pos++ {
+				if price, ok := prices[pos]; ok {
+					last = price
+				} else if pos == 1 {
+					continue
+				}
+				slots = append(slots, Slot{
+					Start:    begin.Add(time.Duration(pos-1) * resolution),
+					Duration: resolution,
+					Price:    last,
+				})
+			}
+		}
+	}
+	return slots, nil
+}
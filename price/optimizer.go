@@ -0,0 +1,230 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package price
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const checkInterval = time.Minute
+
+// mqttSlot is the format of prices published to the price topic. End
+// defaults to an hour after start.
+type mqttSlot struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end"`
+	Price float64    `json:"price"`
+}
+
+// Optimizer applies the cheap or normal settings as the price changes, and
+// publishes its decisions under <prefix>/price.
+type Optimizer struct {
+	Config
+
+	writer     *control.Writer
+	mqttClient *mqtt.Client
+	slots      []Slot
+	cheap      *bool
+	mutex      sync.Mutex
+}
+
+func NewOptimizer(config Config, writer *control.Writer, mqttClient *mqtt.Client) *Optimizer {
+	if config.Interval == 0 {
+		config.Interval = time.Hour
+	}
+	if config.Unit == "" && config.Source == ENTSOE {
+		config.Unit = "EUR/MWh"
+	}
+	return &Optimizer{
+		Config:     config,
+		writer:     writer,
+		mqttClient: mqttClient,
+	}
+}
+
+func (o *Optimizer) Start() error {
+	if o.Source == MQTT {
+		err := o.mqttClient.SubscribeRaw(o.Topic, 1, func(_ *mqtt.Client, msg mqtt.Message) {
+			var prices []mqttSlot
+			if err := json.Unmarshal(msg.Payload(), &prices); err != nil {
+				log.Warnf("Ignoring prices from %s: %v", msg.Topic(), err)
+				return
+			}
+			slots := make([]Slot, 0, len(prices))
+			for _, p := range prices {
+				duration := time.Hour
+				if p.End != nil {
+					duration = p.End.Sub(p.Start)
+				}
+				slots = append(slots, Slot{Start: p.Start, Duration: duration, Price: p.Price})
+			}
+			o.setSlots(slots)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		go func() {
+			for {
+				slots, err := fetchENTSOE(o.Token, o.Area, time.Now())
+				if err != nil {
+					log.Errorf("Failed to fetch prices: %v", err)
+				} else {
+					o.setSlots(slots)
+				}
+				time.Sleep(o.Interval)
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			time.Sleep(checkInterval)
+			o.check(time.Now())
+		}
+	}()
+	return nil
+}
+
+func (o *Optimizer) setSlots(slots []Slot) {
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].Start.Before(slots[j].Start)
+	})
+	o.mutex.Lock()
+	o.slots = slots
+	o.mutex.Unlock()
+	log.Debugf("Received %d price slots", len(slots))
+	o.check(time.Now())
+}
+
+func (o *Optimizer) check(now time.Time) {
+	o.mutex.Lock()
+	slots := o.slots
+	o.mutex.Unlock()
+
+	cheapSet := cheapSlots(slots, o.CheapestHours, o.MaxPrice)
+	var current *Slot
+	var nextCheap *time.Time
+	for i := range slots {
+		s := &slots[i]
+		if !now.Before(s.Start) && now.Before(s.End()) {
+			current = s
+		}
+		if _, ok := cheapSet[s.Start]; ok && s.Start.After(now) && nextCheap == nil {
+			nextCheap = &s.Start
+		}
+	}
+
+	values := map[string]interface{}{}
+	if nextCheap != nil {
+		values["next_cheap"] = nextCheap.Format(time.RFC3339)
+	}
+	if current == nil {
+		values["cheap"] = "OFF"
+		values["reason"] = "no price known for the current time"
+		go o.mqttClient.PublishMany("price", values)
+		return
+	}
+
+	reason, cheap := cheapSet[current.Start]
+	if !cheap {
+		reason = fmt.Sprintf("price %.4g is not among the cheapest hours", current.Price)
+	}
+	values["current"] = current.Price
+	values["reason"] = reason
+	values["cheap"] = "OFF"
+	if cheap {
+		values["cheap"] = "ON"
+	}
+	go o.mqttClient.PublishMany("price", values)
+
+	o.mutex.Lock()
+	changed := o.cheap == nil || *o.cheap != cheap
+	o.cheap = &cheap
+	o.mutex.Unlock()
+	if !changed {
+		return
+	}
+
+	settings := o.Normal
+	if cheap {
+		settings = o.Cheap
+	}
+	log.Infof("Applying %s price settings: %s", map[bool]string{true: "cheap", false: "normal"}[cheap], reason)
+	for k, v := range settings {
+		key, value := k, v
+		err := o.writer.SetAsync("price", key, []byte(value), func(response *nbe.NBEResponse) {
+			if response.Status != 0 {
+				log.Errorf("Failed to set %s to %s: %v", key, value, response.Payload)
+			}
+		})
+		if err != nil {
+			log.Errorf("Failed to set %s: %v", key, err)
+		}
+	}
+}
+
+// PublishDiscovery announces the price decisions to Home Assistant as
+// entities of the boiler's device.
+func (o *Optimizer) PublishDiscovery(serial string) {
+	prefix := o.mqttClient.Prefix
+	dev := map[string]interface{}{
+		"ids": []string{fmt.Sprintf("nbe_%s", serial)},
+	}
+	entities := map[string]map[string]interface{}{
+		"sensor/price_current": {
+			"name":                "Energy Price",
+			"unit_of_measurement": o.Unit,
+			"state_class":         "measurement",
+			"stat_t":              fmt.Sprintf("%s/price/current", prefix),
+		},
+		"binary_sensor/price_cheap": {
+			"name":   "Cheap Energy",
+			"stat_t": fmt.Sprintf("%s/price/cheap", prefix),
+		},
+		"sensor/price_next_cheap": {
+			"name":         "Next Cheap Energy",
+			"device_class": "timestamp",
+			"stat_t":       fmt.Sprintf("%s/price/next_cheap", prefix),
+		},
+		"sensor/price_reason": {
+			"name":   "Energy Price Decision",
+			"stat_t": fmt.Sprintf("%s/price/reason", prefix),
+		},
+	}
+	for k, e := range entities {
+		component, id, _ := strings.Cut(k, "/")
+		e["uniq_id"] = fmt.Sprintf("nbe_%s_%s", serial, id)
+		e["avty_t"] = fmt.Sprintf("%s/device/status", prefix)
+		e["dev"] = dev
+		err := o.mqttClient.PublishDiscovery(fmt.Sprintf("homeassistant/%s/nbe_%s/%s/config", component, serial, id), e)
+		if err != nil {
+			log.Errorf("Error publishing discovery message for %s: %v", id, err)
+		}
+	}
+}
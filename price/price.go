@@ -0,0 +1,127 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package price
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Price sources.
+const (
+	ENTSOE = "entsoe"
+	MQTT   = "mqtt"
+)
+
+// Config moves settings into the cheapest hours of the day. Cheap settings
+// are applied while the current price is one of the CheapestHours cheapest
+// hours of its day, or at or below MaxPrice if set, and Normal settings
+// otherwise. Unit is what prices are in, which is EUR/MWh for ENTSO-E and
+// must be given for prices read from MQTT.
+type Config struct {
+	Source        string            `yaml:"source"`
+	Token         string            `yaml:"token"`
+	Area          string            `yaml:"area"`
+	Topic         string            `yaml:"topic"`
+	Interval      time.Duration     `yaml:"interval"`
+	CheapestHours float64           `yaml:"cheapest_hours"`
+	MaxPrice      *float64          `yaml:"max_price"`
+	Unit          string            `yaml:"unit"`
+	Cheap         map[string]string `yaml:"cheap"`
+	Normal        map[string]string `yaml:"normal"`
+}
+
+func (c *Config) Validate() error {
+	switch c.Source {
+	case ENTSOE:
+		if c.Token == "" || c.Area == "" {
+			return fmt.Errorf("token and area are required for %s", ENTSOE)
+		}
+	case MQTT:
+		if c.Topic == "" || c.Unit == "" {
+			return fmt.Errorf("topic and unit are required for %s", MQTT)
+		}
+	default:
+		return fmt.Errorf("unknown source %q, expected %s or %s", c.Source, ENTSOE, MQTT)
+	}
+	if c.CheapestHours <= 0 && c.MaxPrice == nil {
+		return fmt.Errorf("cheapest_hours or max_price is required")
+	}
+	if len(c.Cheap) == 0 {
+		return fmt.Errorf("no cheap settings configured")
+	}
+	for k := range c.Cheap {
+		if strings.Count(k, ".") != 1 {
+			return fmt.Errorf("invalid key %q, expected category.key", k)
+		}
+	}
+	for k := range c.Normal {
+		if strings.Count(k, ".") != 1 {
+			return fmt.Errorf("invalid key %q, expected category.key", k)
+		}
+	}
+	return nil
+}
+
+// Slot is the price for a period, usually an hour.
+type Slot struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"-"`
+	Price    float64       `json:"price"`
+}
+
+func (s *Slot) End() time.Time {
+	return s.Start.Add(s.Duration)
+}
+
+// cheapSlots returns the starts of the slots that are cheap, being those at
+// or below maxPrice, or within the cheapest hours of their local day.
+func cheapSlots(slots []Slot, cheapestHours float64, maxPrice *float64) map[time.Time]string {
+	cheap := make(map[time.Time]string)
+	days := make(map[string][]Slot)
+	for _, s := range slots {
+		if maxPrice != nil && s.Price <= *maxPrice {
+			cheap[s.Start] = fmt.Sprintf("price %.4g is at or below %.4g", s.Price, *maxPrice)
+		}
+		day := s.Start.Local().Format("2006-01-02")
+		days[day] = append(days[day], s)
+	}
+	if cheapestHours <= 0 {
+		return cheap
+	}
+
+	budget := time.Duration(cheapestHours * float64(time.Hour))
+	for _, day := range days {
+		sort.SliceStable(day, func(i, j int) bool {
+			return day[i].Price < day[j].Price
+		})
+		var used time.Duration
+		for _, s := range day {
+			if used+s.Duration > budget {
+				break
+			}
+			used += s.Duration
+			if _, ok := cheap[s.Start]; !ok {
+				cheap[s.Start] = fmt.Sprintf("price %.4g is within the cheapest %g hours of the day", s.Price, cheapestHours)
+			}
+		}
+	}
+	return cheap
+}
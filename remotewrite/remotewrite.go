@@ -0,0 +1,209 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package remotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Pusher periodically gathers the registered metrics and pushes them to a
+// Prometheus remote_write endpoint, for installations that can't be scraped.
+type Pusher struct {
+	URI      *url.URL
+	Token    string
+	Interval time.Duration
+	Labels   map[string]string
+
+	gatherer prometheus.Gatherer
+	client   *http.Client
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type series struct {
+	labels []label
+	value  float64
+}
+
+// NewPusher creates a pusher for the endpoint at uri. Basic auth
+// credentials may be included in the URI, or a bearer token given instead.
+func NewPusher(uri *url.URL, token string, interval time.Duration, labels map[string]string) *Pusher {
+	return &Pusher{
+		URI:      uri,
+		Token:    token,
+		Interval: interval,
+		Labels:   labels,
+		gatherer: prometheus.DefaultGatherer,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (p *Pusher) Start() {
+	go func() {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := p.push(time.Now()); err != nil {
+				log.Errorf("Failed to push metrics: %v", err)
+			}
+		}
+	}()
+}
+
+func (p *Pusher) push(ts time.Time) error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(p.series(families), ts.UnixMilli()))
+
+	endpoint := *p.URI
+	endpoint.User = nil
+	req, err := http.NewRequest(http.MethodPost, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "boiler-mate")
+	if password, ok := p.URI.User.Password(); ok {
+		req.SetBasicAuth(p.URI.User.Username(), password)
+	} else if p.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", p.Token))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// series flattens metric families into individual samples, expanding
+// summaries and histograms the same way the text exposition format does.
+func (p *Pusher) series(families []*dto.MetricFamily) []series {
+	var result []series
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			base := make([]label, 0, len(m.GetLabel())+len(p.Labels)+2)
+			for k, v := range p.Labels {
+				base = append(base, label{k, v})
+			}
+			for _, l := range m.GetLabel() {
+				base = append(base, label{l.GetName(), l.GetValue()})
+			}
+
+			add := func(name string, value float64, extra ...label) {
+				labels := append([]label{{"__name__", name}}, base...)
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				result = append(result, series{labels: labels, value: value})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), label{"le", formatFloat(b.GetUpperBound())})
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), label{"le", "+Inf"})
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return result
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest protobuf message:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(all []series, ts int64) []byte {
+	var req []byte
+	for _, s := range all {
+		var timeseries []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			timeseries = protowire.AppendTag(timeseries, 1, protowire.BytesType)
+			timeseries = protowire.AppendBytes(timeseries, lb)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(ts))
+		timeseries = protowire.AppendTag(timeseries, 2, protowire.BytesType)
+		timeseries = protowire.AppendBytes(timeseries, sample)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, timeseries)
+	}
+	return req
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,254 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/units"
+)
+
+// settingChange is a setting whose value differs between two snapshots.
+// From or To is empty if the setting is missing from that snapshot.
+type settingChange struct {
+	Category string `json:"category"`
+	Key      string `json:"key"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+}
+
+func (c settingChange) String() string {
+	return c.Category + "." + c.Key
+}
+
+// diffSettings returns the settings that differ between from and to, in
+// order. Values are compared as the controller would read them, so that 5
+// and 5.00 are the same.
+func diffSettings(from map[string]map[string]interface{}, to map[string]map[string]interface{}) []settingChange {
+	var changes []settingChange
+	seen := make(map[string]bool)
+	add := func(category string, key string) {
+		if seen[category+"."+key] {
+			return
+		}
+		seen[category+"."+key] = true
+		change := settingChange{Category: category, Key: key}
+		if v, ok := from[category][key]; ok {
+			change.From = settingString(v)
+		}
+		if v, ok := to[category][key]; ok {
+			change.To = settingString(v)
+		}
+		if change.From != change.To {
+			changes = append(changes, change)
+		}
+	}
+	for _, snapshot := range []map[string]map[string]interface{}{from, to} {
+		for category, values := range snapshot {
+			for key := range values {
+				add(category, key)
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].String() < changes[j].String()
+	})
+	return changes
+}
+
+// settingString formats a setting as it is written to the controller,
+// whether it was read from the controller or from a backup.
+func settingString(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case nbe.RoundedFloat:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 32)
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 32)
+		}
+		return v.String()
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// parseCategories parses a comma separated list of settings categories.
+func parseCategories(list string) (map[string]bool, error) {
+	categories := make(map[string]bool)
+	for _, category := range strings.Split(list, ",") {
+		if category = strings.TrimSpace(category); category == "" {
+			continue
+		}
+		if !isSetting(category) {
+			return nil, fmt.Errorf("unknown category: %s", category)
+		}
+		categories[category] = true
+	}
+	return categories, nil
+}
+
+func readBackup(path string) (*nbe.Backup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var backup nbe.Backup
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+	if err := decoder.Decode(&backup); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	if len(backup.Settings) == 0 {
+		return nil, fmt.Errorf("%s has no settings", path)
+	}
+	return &backup, nil
+}
+
+// runRestore writes the settings in a backup that differ from the
+// controller's, after showing what would change and asking to go ahead.
+func runRestore(args []string) error {
+	var controllerUrlOpt, logLevel, categories string
+	var dryRun, yes bool
+
+	flags := newCommandFlags("restore", &controllerUrlOpt, &logLevel)
+	flags.StringVar(&categories, "category", "", "comma separated categories to restore, or empty for all")
+	flags.BoolVar(&dryRun, "dry-run", false, "only show what would change")
+	flags.BoolVar(&yes, "yes", false, "apply the changes without asking")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: boiler-mate restore [flags] <backup.json>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a backup file")
+	}
+	backup, err := readBackup(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	only, err := parseCategories(categories)
+	if err != nil {
+		return err
+	}
+
+	boiler, err := connectController(controllerUrlOpt, logLevel)
+	if err != nil {
+		return err
+	}
+	defer boiler.Close()
+
+	if backup.Serial != boiler.Serial() {
+		fmt.Fprintf(os.Stderr, "The backup was taken from controller %s, restoring it to %s\n", backup.Serial, boiler.Serial())
+	}
+	live, err := nbe.DumpSettings(boiler)
+	if err != nil {
+		return err
+	}
+
+	// Commands, such as misc.start, are never restored, and settings this
+	// controller doesn't have can't be.
+	var changes []settingChange
+	for _, change := range diffSettings(live.Settings, backup.Settings) {
+		switch {
+		case len(only) > 0 && !only[change.Category]:
+		case units.IsCommand(change.String()), change.To == "":
+		case change.From == "":
+			fmt.Fprintf(os.Stderr, "Skipping %s, which this controller doesn't have\n", change)
+		default:
+			changes = append(changes, change)
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Println("Nothing to restore, the controller already matches the backup")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tCONTROLLER\tBACKUP")
+	for _, change := range changes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", change, change.From, change.To)
+	}
+	tw.Flush()
+
+	if dryRun {
+		return nil
+	}
+	if !yes && !confirm(os.Stdin, fmt.Sprintf("Write %d settings to controller %s?", len(changes), boiler.Serial())) {
+		return fmt.Errorf("nothing written")
+	}
+
+	failed := 0
+	for _, change := range changes {
+		if err := restoreSetting(boiler, change); err != nil {
+			fmt.Printf("%s: failed: %v\n", change, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: restored %s\n", change, change.To)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d settings failed", failed, len(changes))
+	}
+	return nil
+}
+
+// restoreSetting writes a setting and reads it back to confirm the write.
+func restoreSetting(boiler nbe.Boiler, change settingChange) error {
+	response, err := boiler.Set(change.String(), []byte(change.To))
+	if err != nil {
+		return err
+	}
+	if response.Status != 0 {
+		return fmt.Errorf("controller rejected it (status %d)", response.Status)
+	}
+	after, err := readSetting(boiler, query{category: change.Category, key: change.Key})
+	if err != nil {
+		return fmt.Errorf("reading back: %v", err)
+	}
+	if !sameValue(after, change.To) {
+		return fmt.Errorf("controller reports %s after writing", formatCell(after))
+	}
+	return nil
+}
+
+// confirm asks a yes or no question, defaulting to no.
+func confirm(r io.Reader, question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(r).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
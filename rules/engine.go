@@ -0,0 +1,154 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rules
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/webhook"
+	log "github.com/sirupsen/logrus"
+)
+
+type rule struct {
+	Rule
+	condition *condition
+	active    bool
+}
+
+// Engine evaluates rules locally against every change, so that safety
+// automations keep working when Home Assistant or the broker is down.
+type Engine struct {
+	Serial string
+
+	rules      []*rule
+	writer     *control.Writer
+	mqttClient *mqtt.Client
+	dispatcher *webhook.Dispatcher
+	mutex      sync.Mutex
+}
+
+// NewEngine creates an engine. The dispatcher may be nil if no webhooks are
+// configured, in which case webhook actions are skipped.
+func NewEngine(rules []Rule, serial string, writer *control.Writer, mqttClient *mqtt.Client, dispatcher *webhook.Dispatcher) (*Engine, error) {
+	e := &Engine{
+		Serial:     serial,
+		writer:     writer,
+		mqttClient: mqttClient,
+		dispatcher: dispatcher,
+	}
+	for i, r := range rules {
+		c, err := parseCondition(r.When)
+		if err != nil {
+			return nil, err
+		}
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		e.rules = append(e.rules, &rule{Rule: r, condition: c})
+	}
+	return e, nil
+}
+
+func (e *Engine) Start(events *bus.Bus) {
+	events.OnChange(e.handle)
+}
+
+func (e *Engine) handle(change bus.Change) {
+	name := fmt.Sprintf("%s.%s", change.Category, change.Key)
+
+	var fired []*rule
+	e.mutex.Lock()
+	for _, r := range e.rules {
+		if r.condition.Key != name {
+			continue
+		}
+		matched := r.condition.matches(change.Value)
+		if matched && !r.active {
+			fired = append(fired, r)
+		}
+		r.active = matched
+	}
+	e.mutex.Unlock()
+
+	for _, r := range fired {
+		e.fire(r, change)
+	}
+}
+
+func (e *Engine) fire(r *rule, change bus.Change) {
+	text := fmt.Sprintf("Rule %s triggered: %s (%v)", r.Name, r.When, change.Value)
+	log.Warn(text)
+
+	for k, v := range r.Set {
+		key, value := k, v
+		err := e.writer.SetAsync("rules", key, []byte(value), func(response *nbe.NBEResponse) {
+			if response.Status != 0 {
+				log.Errorf("Rule %s failed to set %s to %s: %v", r.Name, key, value, response.Payload)
+				return
+			}
+			log.Infof("Rule %s set %s to %s", r.Name, key, value)
+		})
+		if err != nil {
+			log.Errorf("Rule %s failed to set %s: %v", r.Name, key, err)
+		}
+	}
+
+	if r.Publish != nil {
+		var payload interface{} = r.Publish.Payload
+		if r.Publish.Payload == "" {
+			payload = map[string]interface{}{
+				"rule":     r.Name,
+				"category": change.Category,
+				"key":      change.Key,
+				"value":    change.Value,
+				"ts":       change.Timestamp,
+			}
+		}
+		if err := e.mqttClient.PublishEvent(r.Publish.Topic, payload); err != nil {
+			log.Errorf("Rule %s failed to publish: %v", r.Name, err)
+		}
+	}
+
+	if r.Webhook && e.dispatcher != nil {
+		e.dispatcher.Dispatch(webhook.Event{
+			Type:      webhook.RuleEvent,
+			Serial:    e.Serial,
+			Timestamp: change.Timestamp,
+			Category:  change.Category,
+			Key:       change.Key,
+			Value:     change.Value,
+			Previous:  change.Previous,
+			Text:      text,
+		})
+	}
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
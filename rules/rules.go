@@ -0,0 +1,120 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var conditionPattern = regexp.MustCompile(`^\s*([A-Za-z0-9_]+\.[A-Za-z0-9_]+)\s*(>=|<=|==|!=|>|<)\s*(.+?)\s*$`)
+
+// Publish is an MQTT message sent when a rule fires. The topic is relative
+// to the MQTT prefix.
+type Publish struct {
+	Topic   string `yaml:"topic"`
+	Payload string `yaml:"payload"`
+}
+
+// Rule runs its actions when its condition becomes true, e.g.
+// "operating_data.boiler_temp > 85". It does not fire again until the
+// condition has been false.
+type Rule struct {
+	Name    string            `yaml:"name"`
+	When    string            `yaml:"when"`
+	Set     map[string]string `yaml:"set"`
+	Publish *Publish          `yaml:"publish"`
+	Webhook bool              `yaml:"webhook"`
+}
+
+func (r *Rule) Validate() error {
+	if _, err := parseCondition(r.When); err != nil {
+		return err
+	}
+	if len(r.Set) == 0 && r.Publish == nil && !r.Webhook {
+		return fmt.Errorf("no actions configured")
+	}
+	for k := range r.Set {
+		if strings.Count(k, ".") != 1 {
+			return fmt.Errorf("invalid key %q, expected category.key", k)
+		}
+	}
+	if r.Publish != nil && r.Publish.Topic == "" {
+		return fmt.Errorf("publish needs a topic")
+	}
+	return nil
+}
+
+type condition struct {
+	Key      string
+	Operator string
+	Text     string
+	Number   float64
+	Numeric  bool
+}
+
+func parseCondition(text string) (*condition, error) {
+	match := conditionPattern.FindStringSubmatch(text)
+	if match == nil {
+		return nil, fmt.Errorf("invalid condition %q, expected <category>.<key> <operator> <value>", text)
+	}
+	c := &condition{
+		Key:      match[1],
+		Operator: match[2],
+		Text:     strings.Trim(match[3], `"'`),
+	}
+	if n, err := strconv.ParseFloat(c.Text, 64); err == nil {
+		c.Number = n
+		c.Numeric = true
+	} else if c.Operator != "==" && c.Operator != "!=" {
+		return nil, fmt.Errorf("invalid condition %q, %s needs a number", text, c.Operator)
+	}
+	return c, nil
+}
+
+// matches compares a value against the condition, numerically if both
+// sides are numbers and as text otherwise.
+func (c *condition) matches(value interface{}) bool {
+	if v, ok := toFloat(value); ok && c.Numeric {
+		switch c.Operator {
+		case ">":
+			return v > c.Number
+		case ">=":
+			return v >= c.Number
+		case "<":
+			return v < c.Number
+		case "<=":
+			return v <= c.Number
+		case "==":
+			return v == c.Number
+		case "!=":
+			return v != c.Number
+		}
+		return false
+	}
+
+	switch c.Operator {
+	case "==":
+		return fmt.Sprintf("%v", value) == c.Text
+	case "!=":
+		return fmt.Sprintf("%v", value) != c.Text
+	}
+	return false
+}
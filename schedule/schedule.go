@@ -0,0 +1,121 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Program applies its settings at a time of day, on the given days or
+// every day if there are none. A program stays active until the next one
+// starts.
+type Program struct {
+	Name string            `yaml:"name" json:"name"`
+	Days []string          `yaml:"days" json:"days,omitempty"`
+	At   string            `yaml:"at" json:"at"`
+	Set  map[string]string `yaml:"set" json:"set"`
+}
+
+func (p *Program) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("program has no name")
+	}
+	if _, err := time.Parse("15:04", p.At); err != nil {
+		return fmt.Errorf("program %s: invalid time %q, expected HH:MM", p.Name, p.At)
+	}
+	for _, d := range p.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("program %s: invalid day %q", p.Name, d)
+		}
+	}
+	if len(p.Set) == 0 {
+		return fmt.Errorf("program %s: nothing to set", p.Name)
+	}
+	for k := range p.Set {
+		if strings.Count(k, ".") != 1 {
+			return fmt.Errorf("program %s: invalid key %q, expected category.key", p.Name, k)
+		}
+	}
+	return nil
+}
+
+func (p *Program) runsOn(day time.Weekday) bool {
+	if len(p.Days) == 0 {
+		return true
+	}
+	for _, d := range p.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Config is the schedule section of the config file.
+type Config struct {
+	Programs []Program `yaml:"programs"`
+}
+
+func (c *Config) Validate() error {
+	return validate(c.Programs)
+}
+
+func validate(programs []Program) error {
+	for _, p := range programs {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// active returns the program that most recently started before now, and
+// when it started, looking back up to a week.
+func active(programs []Program, now time.Time) (*Program, time.Time) {
+	var current *Program
+	var started time.Time
+	for i := range programs {
+		p := &programs[i]
+		at, _ := time.Parse("15:04", p.At)
+		for d := 0; d <= 7; d++ {
+			day := now.AddDate(0, 0, -d)
+			start := time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+			if start.After(now) || !p.runsOn(start.Weekday()) {
+				continue
+			}
+			if current == nil || start.After(started) {
+				current = p
+				started = start
+			}
+			break
+		}
+	}
+	return current, started
+}
@@ -0,0 +1,140 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package schedule
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const checkInterval = 30 * time.Second
+
+// Scheduler applies the active program's settings whenever a new program
+// starts. The programs can be replaced at runtime by publishing a JSON list
+// of programs to <prefix>/schedule/set. Programs from the config file are
+// trusted, but those set over MQTT are written as if each setting had been
+// published to <prefix>/set, so the access lists apply to them, and if
+// Confirmer is set the settings that need confirming are held for it.
+type Scheduler struct {
+	Confirmer *control.Confirmer
+
+	writer     *control.Writer
+	mqttClient *mqtt.Client
+	programs   []Program
+	source     string
+	applied    time.Time
+	mutex      sync.Mutex
+}
+
+func NewScheduler(config Config, writer *control.Writer, mqttClient *mqtt.Client) *Scheduler {
+	return &Scheduler{
+		writer:     writer,
+		mqttClient: mqttClient,
+		programs:   config.Programs,
+		source:     "schedule",
+	}
+}
+
+func (s *Scheduler) Start() error {
+	err := s.mqttClient.Subscribe("schedule/set", 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		var programs []Program
+		if err := json.Unmarshal(msg.Payload(), &programs); err != nil {
+			log.Errorf("Invalid schedule: %v", err)
+			return
+		}
+		if err := validate(programs); err != nil {
+			log.Errorf("Invalid schedule: %v", err)
+			return
+		}
+
+		s.mutex.Lock()
+		s.programs = programs
+		s.source = control.SourceMQTT
+		s.applied = time.Time{}
+		s.mutex.Unlock()
+
+		log.Infof("Schedule replaced with %d program(s)", len(programs))
+		s.publishPrograms()
+		s.check(time.Now())
+	})
+	if err != nil {
+		return err
+	}
+
+	s.publishPrograms()
+	go func() {
+		for {
+			s.check(time.Now())
+			time.Sleep(checkInterval)
+		}
+	}()
+	return nil
+}
+
+func (s *Scheduler) publishPrograms() {
+	s.mutex.Lock()
+	programs := s.programs
+	s.mutex.Unlock()
+	if programs == nil {
+		programs = []Program{}
+	}
+	go s.mqttClient.PublishMany("schedule", map[string]interface{}{"programs": programs})
+}
+
+func (s *Scheduler) check(now time.Time) {
+	s.mutex.Lock()
+	program, started := active(s.programs, now)
+	if program == nil || started.Equal(s.applied) {
+		s.mutex.Unlock()
+		return
+	}
+	s.applied = started
+	p := *program
+	source := s.source
+	s.mutex.Unlock()
+
+	log.Infof("Starting scheduled program %s", p.Name)
+	go s.mqttClient.PublishMany("schedule", map[string]interface{}{
+		"active":  p.Name,
+		"started": started,
+	})
+
+	for k, v := range p.Set {
+		key, value := k, v
+		if source == control.SourceMQTT && s.Confirmer != nil && s.Confirmer.Required(key) {
+			s.Confirmer.Hold(key, []byte(value))
+			continue
+		}
+		err := s.writer.SetAsync(source, key, []byte(value), func(response *nbe.NBEResponse) {
+			if response.Status != 0 {
+				log.Errorf("Program %s failed to set %s to %s: %v", p.Name, key, value, response.Payload)
+				return
+			}
+			log.Infof("Program %s set %s to %s", p.Name, key, value)
+		})
+		if err != nil {
+			log.Errorf("Program %s failed to set %s: %v", p.Name, key, err)
+		}
+	}
+}
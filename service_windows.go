@@ -0,0 +1,197 @@
+//go:build windows
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func init() {
+	commands["service"] = command{"install, uninstall, start or stop the Windows service", runService}
+}
+
+var (
+	serviceStopped = make(chan struct{})
+	serviceExited  = make(chan struct{})
+)
+
+type windowsService struct{}
+
+// Execute reports the service running until the service manager asks it to
+// stop, then waits for the shutdown sequence to finish.
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				serviceStop <- "service stop request"
+				<-serviceStopped
+				return false, 0
+			}
+		case <-serviceStopped:
+			return false, 0
+		}
+	}
+}
+
+// eventLogHook copies log entries to the Windows event log.
+type eventLogHook struct {
+	log *eventlog.Log
+}
+
+func (h *eventLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *eventLogHook) Fire(entry *log.Entry) error {
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		return h.log.Error(1, msg)
+	case log.WarnLevel:
+		return h.log.Warning(1, msg)
+	}
+	return h.log.Info(1, msg)
+}
+
+func startService() (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return true, err
+	}
+	log.AddHook(&eventLogHook{log: elog})
+
+	go func() {
+		defer close(serviceExited)
+		if err := svc.Run(serviceName, windowsService{}); err != nil {
+			log.Errorf("Service failed: %v", err)
+			serviceStop <- "service failure"
+		}
+	}()
+	return true, nil
+}
+
+func stopService() {
+	close(serviceStopped)
+	select {
+	case <-serviceExited:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// runService manages the Windows service. Arguments after install are
+// passed to boiler-mate whenever the service starts, e.g.
+// boiler-mate service install -controller tcp://... -mqtt tcp://...
+func runService(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected install, uninstall, start or stop")
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	switch args[0] {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		exe, err = filepath.Abs(exe)
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "boiler-mate",
+			Description: "Bridges an NBE pellet boiler controller to MQTT",
+			StartType:   mgr.StartAutomatic,
+		}, args[1:]...)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return fmt.Errorf("installing event log source: %v", err)
+		}
+		fmt.Printf("Installed service %s\n", serviceName)
+	case "uninstall":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		if err := eventlog.Remove(serviceName); err != nil {
+			return fmt.Errorf("removing event log source: %v", err)
+		}
+		fmt.Printf("Uninstalled service %s\n", serviceName)
+	case "start":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := s.Start(); err != nil {
+			return err
+		}
+		fmt.Printf("Started service %s\n", serviceName)
+	case "stop":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if _, err := s.Control(svc.Stop); err != nil {
+			return err
+		}
+		fmt.Printf("Stopping service %s\n", serviceName)
+	default:
+		return fmt.Errorf("unknown service command %s, expected install, uninstall, start or stop", args[0])
+	}
+	return nil
+}
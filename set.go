@@ -0,0 +1,131 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// runSet writes a setting, after checking the value against the range the
+// controller reports for it, and reads it back to confirm the write.
+func runSet(args []string) error {
+	var controllerUrlOpt, logLevel string
+
+	flags := newCommandFlags("set", &controllerUrlOpt, &logLevel)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: boiler-mate set [flags] <category.key> <value>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("expected a setting and a value")
+	}
+	q, err := parseQuery(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if !isSetting(q.category) {
+		return fmt.Errorf("%s is not a setting", q.category)
+	}
+	if q.key == "*" {
+		return fmt.Errorf("missing key: %s", flags.Arg(0))
+	}
+	value := strings.TrimSpace(flags.Arg(1))
+
+	boiler, err := connectController(controllerUrlOpt, logLevel)
+	if err != nil {
+		return err
+	}
+	defer boiler.Close()
+
+	before, err := readSetting(boiler, q)
+	if err != nil {
+		return err
+	}
+	if err := validateSetting(boiler, q, value); err != nil {
+		return err
+	}
+
+	response, err := boiler.Set(q.String(), []byte(value))
+	if err != nil {
+		return err
+	}
+	if response.Status != 0 {
+		return fmt.Errorf("controller rejected %s=%s (status %d)", q, value, response.Status)
+	}
+
+	after, err := readSetting(boiler, q)
+	if err != nil {
+		return fmt.Errorf("reading back %s: %v", q, err)
+	}
+	if !sameValue(after, value) {
+		return fmt.Errorf("controller reports %s as %s after writing %s", q, formatCell(after), value)
+	}
+	fmt.Printf("%s set to %s (was %s), controller status %d\n", q, formatCell(after), formatCell(before), response.Status)
+	return nil
+}
+
+func readSetting(boiler nbe.Boiler, q query) (interface{}, error) {
+	response, err := boiler.Get(nbe.GetSetupFunction, q.String())
+	if err != nil {
+		return nil, err
+	}
+	value, ok := response.Payload[q.key]
+	if response.Status != 0 || !ok {
+		return nil, fmt.Errorf("unknown setting: %s", q)
+	}
+	return value, nil
+}
+
+// validateSetting checks value against the range the controller reports
+// for the setting, if it reports one.
+func validateSetting(boiler nbe.Boiler, q query, value string) error {
+	schema, err := nbe.LoadSchema(boiler, []string{q.category})
+	if err != nil {
+		return err
+	}
+	definition, ok := schema[q.String()]
+	if !ok {
+		log.Warnf("The controller reports no range for %s, writing it unchecked", q)
+		return nil
+	}
+	return definition.Validate(value)
+}
+
+// sameValue reports whether a value read back from the controller is what
+// was written, comparing numbers numerically so that 5 and 5.0 match.
+func sameValue(read interface{}, written string) bool {
+	w, err := strconv.ParseFloat(written, 64)
+	if err != nil {
+		return fmt.Sprintf("%v", read) == written
+	}
+	switch r := read.(type) {
+	case int64:
+		return float64(r) == w
+	case nbe.RoundedFloat:
+		return r.Equal(nbe.RoundedFloat(w))
+	}
+	return false
+}
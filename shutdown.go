@@ -0,0 +1,80 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/history"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/telemetry"
+	"github.com/mlipscombe/boiler-mate/watchdog"
+	log "github.com/sirupsen/logrus"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// shutdown stops everything in the reverse order it was started, so that
+// the broker sees the device go offline straight away rather than waiting
+// for the will, and nothing is left half written. Any of dog, store and
+// otelProvider may be nil.
+func shutdown(boiler nbe.Boiler, mqttClient *mqtt.Client, monitors map[string]*monitor.Monitor, dog *watchdog.Watchdog, servers []*http.Server, store *history.Store, otelProvider *telemetry.Provider, clearDiscovery bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// The watchdog would otherwise restart everything as it is stopped.
+	if dog != nil {
+		dog.Stop()
+	}
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorf("Failed to stop HTTP server on %s: %v", server.Addr, err)
+		}
+	}
+
+	for _, m := range monitors {
+		m.Stop()
+	}
+
+	if clearDiscovery {
+		log.Infof("Removing discovery configs")
+		mqttClient.ClearDiscovery()
+	}
+	mqttClient.Close()
+
+	if err := boiler.Close(); err != nil {
+		log.Errorf("Failed to close controller connection: %v", err)
+	}
+
+	if store != nil {
+		if err := store.Close(); err != nil {
+			log.Errorf("Failed to close history database: %v", err)
+		}
+	}
+
+	if otelProvider != nil {
+		if err := otelProvider.Shutdown(ctx); err != nil {
+			log.Errorf("Failed to flush OpenTelemetry: %v", err)
+		}
+	}
+}
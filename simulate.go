@@ -0,0 +1,69 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/simulator"
+)
+
+const simulateSerial = "12345"
+
+// simulation stands in for the controller and the MQTT broker with
+// -simulate, so that the whole pipeline, Home Assistant discovery included,
+// can be run in CI and demos with nothing else installed.
+type simulation struct {
+	boiler *nbe.MockBoiler
+	broker *simulator.Broker
+	stop   chan struct{}
+}
+
+// startSimulation starts a simulated boiler, and an MQTT broker listening
+// on the host and port of mqttUrl. If scenarioName is empty the simulated
+// values wander about at random.
+func startSimulation(mqttUrl *url.URL, scenarioName string) (*simulation, error) {
+	s := &simulation{
+		boiler: nbe.NewMockBoiler(simulateSerial),
+		broker: simulator.NewBroker(),
+		stop:   make(chan struct{}),
+	}
+
+	if scenarioName != "" {
+		scenario, err := simulator.LoadScenario(scenarioName)
+		if err != nil {
+			return nil, err
+		}
+		go scenario.Run(s.boiler, 1, s.stop)
+	} else {
+		go simulator.Jitter(s.boiler, time.Second, s.stop)
+	}
+
+	if err := s.broker.ListenAndServe(mqttUrl.Host); err != nil {
+		close(s.stop)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *simulation) Close() {
+	close(s.stop)
+	s.broker.Close()
+}
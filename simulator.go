@@ -0,0 +1,94 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/simulator"
+	log "github.com/sirupsen/logrus"
+)
+
+// runSimulator serves a simulated controller over UDP, as nbe-simulator
+// does, until interrupted.
+func runSimulator(args []string) error {
+	var bind, serial, pin, scenarioName, logLevel string
+	var port int
+	var interval time.Duration
+	var speed float64
+
+	flags := flag.NewFlagSet("simulator", flag.ExitOnError)
+	flags.StringVar(&bind, "bind", "0.0.0.0", "address to listen for requests on")
+	flags.IntVar(&port, "port", 8483, "port to listen for requests on")
+	flags.StringVar(&serial, "serial", "12345", "serial number of the simulated controller")
+	flags.StringVar(&pin, "pin", "0123456789", "password required to write settings")
+	flags.DurationVar(&interval, "interval", time.Second, "interval between changes to the simulated values, or 0 to keep them fixed")
+	flags.StringVar(&scenarioName, "scenario", "", fmt.Sprintf("scenario to play instead of random changes, either a YAML file or one of: %s", strings.Join(simulator.Scenarios(), ", ")))
+	flags.Float64Var(&speed, "speed", 1, "how many times faster than real time to play the scenario")
+	flags.StringVar(&logLevel, "log-level", "INFO", "logging level")
+	flags.Parse(args)
+
+	ll, err := log.ParseLevel(logLevel)
+	if err != nil {
+		ll = log.InfoLevel
+	}
+	log.SetLevel(ll)
+
+	boiler := nbe.NewMockBoiler(serial)
+	server, err := simulator.NewServer(boiler, pin)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if scenarioName != "" {
+		scenario, err := simulator.LoadScenario(scenarioName)
+		if err != nil {
+			return err
+		}
+		log.Infof("Playing scenario %s", scenario.Name)
+		go scenario.Run(boiler, speed, stop)
+	} else if interval > 0 {
+		go simulator.Jitter(boiler, interval, stop)
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		server.Close()
+	}()
+
+	listen := net.JoinHostPort(bind, strconv.Itoa(port))
+	host := bind
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	log.Infof("Simulating controller %s on %s, connect with -controller tcp://%s:%s@%s", serial, listen, serial, pin, net.JoinHostPort(host, strconv.Itoa(port)))
+	return server.ListenAndServe(listen)
+}
@@ -0,0 +1,473 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package simulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MQTT control packet types.
+const (
+	connectPacket     = 1
+	connackPacket     = 2
+	publishPacket     = 3
+	pubackPacket      = 4
+	pubrecPacket      = 5
+	pubrelPacket      = 6
+	pubcompPacket     = 7
+	subscribePacket   = 8
+	subackPacket      = 9
+	unsubscribePacket = 10
+	unsubackPacket    = 11
+	pingreqPacket     = 12
+	pingrespPacket    = 13
+	disconnectPacket  = 14
+)
+
+const maxPacketSize = 1 << 20
+
+// errProtocolVersion is returned for a CONNECT of an MQTT version other than
+// 3.1 or 3.1.1, which is refused with return code 1.
+var errProtocolVersion = errors.New("unsupported protocol version")
+
+type message struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// Broker is a minimal in-process MQTT 3.1.1 broker, good enough for running
+// boiler-mate and Home Assistant against a simulated boiler in demos and CI.
+// Messages are delivered at QoS 0 whatever was asked for, there are no
+// persistent sessions, and anyone may connect.
+type Broker struct {
+	mutex    sync.Mutex
+	listener net.Listener
+	clients  map[*brokerClient]bool
+	retained map[string][]byte
+}
+
+type brokerClient struct {
+	id            string
+	conn          net.Conn
+	writeMutex    sync.Mutex
+	subscriptions map[string]bool
+	will          *message
+	// replaced is set, under the broker's mutex, when another connection
+	// takes over the client ID, so that the will isn't published.
+	replaced bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		clients:  make(map[*brokerClient]bool),
+		retained: make(map[string][]byte),
+	}
+}
+
+// ListenAndServe starts the broker on a TCP address, returning once it is
+// listening.
+func (b *Broker) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go b.Serve(listener)
+	return nil
+}
+
+// Serve accepts connections on listener until the broker is closed.
+func (b *Broker) Serve(listener net.Listener) error {
+	b.mutex.Lock()
+	b.listener = listener
+	b.mutex.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go b.handle(conn)
+	}
+}
+
+// Close stops listening and disconnects every client.
+func (b *Broker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for c := range b.clients {
+		c.conn.Close()
+	}
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Close()
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	header, body, err := readPacket(r)
+	if err != nil || header>>4 != connectPacket {
+		return
+	}
+	c, keepAlive, err := parseConnect(body)
+	if err != nil {
+		log.Debugf("Broker refused connection from %s: %v", conn.RemoteAddr(), err)
+		if errors.Is(err, errProtocolVersion) {
+			(&brokerClient{conn: conn}).write(connackPacket<<4, []byte{0, 1})
+		}
+		return
+	}
+	c.conn = conn
+	if err := c.write(connackPacket<<4, []byte{0, 0}); err != nil {
+		return
+	}
+
+	b.mutex.Lock()
+	// A client reconnecting before its old connection has timed out takes
+	// over from it.
+	for other := range b.clients {
+		if c.id != "" && other.id == c.id {
+			other.replaced = true
+			other.conn.Close()
+			delete(b.clients, other)
+		}
+	}
+	b.clients[c] = true
+	b.mutex.Unlock()
+	log.Debugf("Broker accepted client %s from %s", c.id, conn.RemoteAddr())
+
+	clean := false
+	defer func() {
+		b.mutex.Lock()
+		replaced := c.replaced
+		delete(b.clients, c)
+		b.mutex.Unlock()
+		if !clean && !replaced && c.will != nil {
+			b.publish(*c.will)
+		}
+		log.Debugf("Broker client %s disconnected", c.id)
+	}()
+
+	for {
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case publishPacket:
+			msg, id, err := parsePublish(header, body)
+			if err != nil {
+				return
+			}
+			b.publish(msg)
+			switch (header >> 1) & 3 {
+			case 1:
+				c.write(pubackPacket<<4, packetID(id))
+			case 2:
+				c.write(pubrecPacket<<4, packetID(id))
+			}
+		case pubrelPacket:
+			if len(body) < 2 {
+				return
+			}
+			c.write(pubcompPacket<<4, body[:2])
+		case subscribePacket:
+			if err := b.subscribe(c, body); err != nil {
+				return
+			}
+		case unsubscribePacket:
+			if err := b.unsubscribe(c, body); err != nil {
+				return
+			}
+		case pingreqPacket:
+			c.write(pingrespPacket<<4, nil)
+		case disconnectPacket:
+			clean = true
+			return
+		case pubackPacket, pubrecPacket, pubcompPacket:
+		default:
+			return
+		}
+	}
+}
+
+func (b *Broker) publish(msg message) {
+	b.mutex.Lock()
+	if msg.retain {
+		if len(msg.payload) == 0 {
+			delete(b.retained, msg.topic)
+		} else {
+			b.retained[msg.topic] = msg.payload
+		}
+	}
+	var recipients []*brokerClient
+	for c := range b.clients {
+		for filter := range c.subscriptions {
+			if topicMatches(filter, msg.topic) {
+				recipients = append(recipients, c)
+				break
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	// The retain flag is only set on messages sent because of a new
+	// subscription.
+	for _, c := range recipients {
+		c.send(message{topic: msg.topic, payload: msg.payload})
+	}
+}
+
+func (b *Broker) subscribe(c *brokerClient, body []byte) error {
+	if len(body) < 2 {
+		return errors.New("short subscribe")
+	}
+	id, rest := body[:2], body[2:]
+	var filters []string
+	for len(rest) > 0 {
+		filter, n, err := readString(rest)
+		if err != nil || len(rest) < n+1 {
+			return errors.New("malformed subscribe")
+		}
+		filters = append(filters, filter)
+		rest = rest[n+1:]
+	}
+
+	b.mutex.Lock()
+	var retained []message
+	for _, filter := range filters {
+		c.subscriptions[filter] = true
+		for topic, payload := range b.retained {
+			if topicMatches(filter, topic) {
+				retained = append(retained, message{topic: topic, payload: payload, retain: true})
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	// Every subscription is granted at QoS 0.
+	if err := c.write(subackPacket<<4, append(id, make([]byte, len(filters))...)); err != nil {
+		return err
+	}
+	for _, msg := range retained {
+		c.send(msg)
+	}
+	return nil
+}
+
+func (b *Broker) unsubscribe(c *brokerClient, body []byte) error {
+	if len(body) < 2 {
+		return errors.New("short unsubscribe")
+	}
+	id, rest := body[:2], body[2:]
+	b.mutex.Lock()
+	for len(rest) > 0 {
+		filter, n, err := readString(rest)
+		if err != nil {
+			b.mutex.Unlock()
+			return err
+		}
+		delete(c.subscriptions, filter)
+		rest = rest[n:]
+	}
+	b.mutex.Unlock()
+	return c.write(unsubackPacket<<4, id)
+}
+
+func (c *brokerClient) send(msg message) {
+	var header byte = publishPacket << 4
+	if msg.retain {
+		header |= 1
+	}
+	body := appendString(nil, msg.topic)
+	body = append(body, msg.payload...)
+	if err := c.write(header, body); err != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *brokerClient) write(header byte, body []byte) error {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxPacketSize {
+		return 0, nil, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func parseConnect(body []byte) (*brokerClient, time.Duration, error) {
+	protocol, n, err := readString(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if protocol != "MQTT" && protocol != "MQIsdp" {
+		return nil, 0, fmt.Errorf("unknown protocol %q", protocol)
+	}
+	body = body[n:]
+	if len(body) < 4 {
+		return nil, 0, errors.New("short connect")
+	}
+	if level := body[0]; (protocol == "MQTT" && level != 4) || (protocol == "MQIsdp" && level != 3) {
+		return nil, 0, fmt.Errorf("%w %s %d", errProtocolVersion, protocol, level)
+	}
+	flags := body[1]
+	keepAlive := time.Duration(binary.BigEndian.Uint16(body[2:4])) * time.Second
+	body = body[4:]
+
+	c := &brokerClient{subscriptions: make(map[string]bool)}
+	if c.id, n, err = readString(body); err != nil {
+		return nil, 0, err
+	}
+	body = body[n:]
+	if flags&0x04 != 0 {
+		topic, n, err := readString(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		body = body[n:]
+		payload, n, err := readString(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		c.will = &message{topic: topic, payload: []byte(payload), retain: flags&0x20 != 0}
+	}
+	return c, keepAlive, nil
+}
+
+func parsePublish(header byte, body []byte) (message, uint16, error) {
+	topic, n, err := readString(body)
+	if err != nil {
+		return message{}, 0, err
+	}
+	body = body[n:]
+	var id uint16
+	if (header>>1)&3 > 0 {
+		if len(body) < 2 {
+			return message{}, 0, errors.New("short publish")
+		}
+		id = binary.BigEndian.Uint16(body)
+		body = body[2:]
+	}
+	return message{topic: topic, payload: body, retain: header&1 != 0}, id, nil
+}
+
+// readString reads a length prefixed string, returning the number of bytes
+// consumed.
+func readString(b []byte) (string, int, error) {
+	if len(b) < 2 {
+		return "", 0, errors.New("short string")
+	}
+	length := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+length {
+		return "", 0, errors.New("short string")
+	}
+	return string(b[2 : 2+length]), 2 + length, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func packetID(id uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, id)
+}
+
+// topicMatches reports whether topic matches a subscription filter, which
+// may contain + and # wildcards. As in the spec, a leading wildcard doesn't
+// match topics beginning with $.
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
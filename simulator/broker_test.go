@@ -0,0 +1,334 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package simulator
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"nbe/1234/boiler/temp", "nbe/1234/boiler/temp", true},
+		{"nbe/1234/boiler/temp", "nbe/1234/boiler/power", false},
+		{"nbe/+/boiler/temp", "nbe/1234/boiler/temp", true},
+		{"nbe/+/temp", "nbe/1234/boiler/temp", false},
+		{"nbe/#", "nbe/1234/boiler/temp", true},
+		{"nbe/#", "nbe", true},
+		{"nbe/1234/#", "nbe/5678/boiler", false},
+		{"+/+", "nbe/1234", true},
+		{"+", "nbe/1234", false},
+		{"#", "nbe/1234", true},
+		{"nbe/+", "nbe/", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+	}
+	for _, tt := range tests {
+		if got := topicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestPacketLength(t *testing.T) {
+	// The boundaries of the one to three byte remaining length encodings,
+	// and the largest packet accepted.
+	for _, length := range []int{0, 127, 128, 16383, 16384, maxPacketSize} {
+		client, server := net.Pipe()
+		go func() {
+			c := &brokerClient{conn: client}
+			c.write(publishPacket<<4|1, make([]byte, length))
+			client.Close()
+		}()
+		header, body, err := readPacket(bufio.NewReader(server))
+		server.Close()
+		if err != nil {
+			t.Errorf("%d bytes: %v", length, err)
+			continue
+		}
+		if header != publishPacket<<4|1 || len(body) != length {
+			t.Errorf("%d bytes: read header %#x and %d bytes", length, header, len(body))
+		}
+	}
+
+	malformed := [][]byte{
+		{publishPacket << 4, 0xff, 0xff, 0xff, 0xff, 0x01},
+		// One byte more than maxPacketSize.
+		{publishPacket << 4, 0x81, 0x80, 0x40},
+	}
+	for _, packet := range malformed {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(packet)
+			client.Close()
+		}()
+		if _, _, err := readPacket(bufio.NewReader(server)); err == nil {
+			t.Errorf("% x: read a malformed packet", packet)
+		}
+		server.Close()
+	}
+}
+
+func startBroker(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBroker()
+	go b.Serve(listener)
+	t.Cleanup(func() { b.Close() })
+	return listener.Addr().String()
+}
+
+func connectClient(t *testing.T, addr string, id string) mqtt.Client {
+	t.Helper()
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://" + addr)
+	opts.SetClientID(id)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connecting %s: %v", id, token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client
+}
+
+// subscribe subscribes client to filter, returning the messages received.
+func subscribe(t *testing.T, client mqtt.Client, filter string) <-chan mqtt.Message {
+	t.Helper()
+	ch := make(chan mqtt.Message, 100)
+	token := client.Subscribe(filter, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		ch <- msg
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribing to %s: %v", filter, token.Error())
+	}
+	return ch
+}
+
+func receive(t *testing.T, ch <-chan mqtt.Message) mqtt.Message {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func expectNone(t *testing.T, ch <-chan mqtt.Message) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		t.Errorf("unexpected message on %s: %q", msg.Topic(), msg.Payload())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestBrokerPublishSubscribe(t *testing.T) {
+	addr := startBroker(t)
+	publisher := connectClient(t, addr, "publisher")
+	subscriber := connectClient(t, addr, "subscriber")
+	temps := subscribe(t, subscriber, "nbe/+/boiler/temp")
+	all := subscribe(t, connectClient(t, addr, "all"), "nbe/#")
+
+	for qos := byte(0); qos <= 2; qos++ {
+		token := publisher.Publish("nbe/1234/boiler/temp", qos, false, "70.5")
+		if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+			t.Fatalf("publishing at QoS %d: %v", qos, token.Error())
+		}
+		for _, ch := range []<-chan mqtt.Message{temps, all} {
+			msg := receive(t, ch)
+			if msg.Topic() != "nbe/1234/boiler/temp" || string(msg.Payload()) != "70.5" || msg.Retained() {
+				t.Errorf("QoS %d: received %s %q retained %v", qos, msg.Topic(), msg.Payload(), msg.Retained())
+			}
+			// Everything is delivered at QoS 0.
+			if msg.Qos() != 0 {
+				t.Errorf("QoS %d: delivered at QoS %d", qos, msg.Qos())
+			}
+		}
+	}
+
+	publisher.Publish("nbe/1234/hopper/content", 0, false, "20").Wait()
+	if msg := receive(t, all); msg.Topic() != "nbe/1234/hopper/content" {
+		t.Errorf("received %s", msg.Topic())
+	}
+	expectNone(t, temps)
+
+	if token := subscriber.Unsubscribe("nbe/+/boiler/temp"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	publisher.Publish("nbe/1234/boiler/temp", 0, false, "71").Wait()
+	receive(t, all)
+	expectNone(t, temps)
+}
+
+func TestBrokerRetained(t *testing.T) {
+	addr := startBroker(t)
+	publisher := connectClient(t, addr, "publisher")
+	publisher.Publish("homeassistant/sensor/nbe_1234/temp/config", 1, true, "{}").Wait()
+	publisher.Publish("nbe/1234/availability", 1, true, "online").Wait()
+
+	subscriber := connectClient(t, addr, "subscriber")
+	ch := subscribe(t, subscriber, "homeassistant/#")
+	msg := receive(t, ch)
+	if msg.Topic() != "homeassistant/sensor/nbe_1234/temp/config" || !msg.Retained() {
+		t.Errorf("received %s retained %v", msg.Topic(), msg.Retained())
+	}
+	expectNone(t, ch)
+
+	// A live message isn't flagged as retained, even if it was published
+	// retained.
+	publisher.Publish("homeassistant/sensor/nbe_1234/temp/config", 1, true, `{"name":"Temp"}`).Wait()
+	if msg := receive(t, ch); msg.Retained() {
+		t.Error("live message was flagged as retained")
+	}
+
+	// An empty retained message clears it.
+	publisher.Publish("homeassistant/sensor/nbe_1234/temp/config", 1, true, "").Wait()
+	receive(t, ch)
+	expectNone(t, subscribe(t, connectClient(t, addr, "late"), "homeassistant/#"))
+}
+
+// rawConnect connects with a CONNECT packet built by hand, returning the
+// connection and the CONNACK return code.
+func rawConnect(t *testing.T, addr string, protocol string, level byte, id string, will *message) (net.Conn, *bufio.Reader, byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	flags := byte(0x02)
+	if will != nil {
+		flags |= 0x04
+		if will.retain {
+			flags |= 0x20
+		}
+	}
+	body := appendString(nil, protocol)
+	body = append(body, level, flags, 0, 0)
+	body = appendString(body, id)
+	if will != nil {
+		body = appendString(body, will.topic)
+		body = appendString(body, string(will.payload))
+	}
+	c := &brokerClient{conn: conn}
+	if err := c.write(connectPacket<<4, body); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	header, ack, err := readPacket(r)
+	if err != nil {
+		t.Fatalf("reading CONNACK: %v", err)
+	}
+	if header != connackPacket<<4 || len(ack) != 2 {
+		t.Fatalf("CONNACK = %#x % x", header, ack)
+	}
+	return conn, r, ack[1]
+}
+
+func TestBrokerConnect(t *testing.T) {
+	addr := startBroker(t)
+	tests := []struct {
+		protocol string
+		level    byte
+		want     byte
+	}{
+		{"MQTT", 4, 0},
+		{"MQIsdp", 3, 0},
+		{"MQTT", 5, 1},
+		{"MQTT", 3, 1},
+	}
+	for _, tt := range tests {
+		_, _, code := rawConnect(t, addr, tt.protocol, tt.level, "raw", nil)
+		if code != tt.want {
+			t.Errorf("%s level %d: return code %d, want %d", tt.protocol, tt.level, code, tt.want)
+		}
+	}
+}
+
+func TestBrokerPing(t *testing.T) {
+	addr := startBroker(t)
+	conn, r, _ := rawConnect(t, addr, "MQTT", 4, "raw", nil)
+	(&brokerClient{conn: conn}).write(pingreqPacket<<4, nil)
+	header, body, err := readPacket(r)
+	if err != nil || header != pingrespPacket<<4 || len(body) != 0 {
+		t.Errorf("PINGREQ answered with %#x % x: %v", header, body, err)
+	}
+}
+
+func TestBrokerWill(t *testing.T) {
+	addr := startBroker(t)
+	ch := subscribe(t, connectClient(t, addr, "subscriber"), "nbe/+/availability")
+	will := &message{topic: "nbe/1234/availability", payload: []byte("offline"), retain: true}
+
+	// A clean disconnect discards the will.
+	conn, _, _ := rawConnect(t, addr, "MQTT", 4, "clean", will)
+	(&brokerClient{conn: conn}).write(disconnectPacket<<4, nil)
+	conn.Close()
+	expectNone(t, ch)
+
+	// Losing the connection publishes it.
+	conn, _, _ = rawConnect(t, addr, "MQTT", 4, "lost", will)
+	conn.Close()
+	msg := receive(t, ch)
+	if msg.Topic() != "nbe/1234/availability" || string(msg.Payload()) != "offline" {
+		t.Errorf("will = %s %q", msg.Topic(), msg.Payload())
+	}
+	// And retains it, as asked.
+	late := subscribe(t, connectClient(t, addr, "late"), "nbe/+/availability")
+	if msg := receive(t, late); !msg.Retained() || string(msg.Payload()) != "offline" {
+		t.Errorf("retained will = %q retained %v", msg.Payload(), msg.Retained())
+	}
+}
+
+func TestBrokerTakeover(t *testing.T) {
+	addr := startBroker(t)
+	ch := subscribe(t, connectClient(t, addr, "subscriber"), "nbe/+/availability")
+	will := &message{topic: "nbe/1234/availability", payload: []byte("offline")}
+
+	old, oldReader, _ := rawConnect(t, addr, "MQTT", 4, "nbemqtt-1234", will)
+	_, _, code := rawConnect(t, addr, "MQTT", 4, "nbemqtt-1234", will)
+	if code != 0 {
+		t.Fatalf("takeover refused with %d", code)
+	}
+
+	old.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := readPacket(oldReader); err == nil {
+		t.Error("old connection wasn't closed")
+	}
+	// The old connection's will isn't published, as it would mark the
+	// reconnected client offline.
+	expectNone(t, ch)
+}
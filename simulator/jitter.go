@@ -0,0 +1,126 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package simulator
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// Power states used by the simulation.
+const (
+	statePower = 5
+	stateOff   = 14
+)
+
+// Jitter makes the operating data of boiler change the way a real boiler's
+// would, every interval until stop is closed. The boiler temperature heats
+// towards its setpoint while running and cools while off, power modulates
+// with the difference, and everything else wanders a little around where it
+// should be. Writing 1 to misc.start or misc.stop starts or stops it.
+func Jitter(boiler *nbe.MockBoiler, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			step(boiler)
+		}
+	}
+}
+
+func step(boiler *nbe.MockBoiler) {
+	state := setting(boiler, nbe.GetOperatingDataFunction, "state", statePower)
+	if setting(boiler, nbe.GetSetupFunction, "misc.start", 0) == 1 {
+		boiler.SetValue(nbe.GetSetupFunction, "misc.start", "0")
+		state = statePower
+	}
+	if setting(boiler, nbe.GetSetupFunction, "misc.stop", 0) == 1 {
+		boiler.SetValue(nbe.GetSetupFunction, "misc.stop", "0")
+		state = stateOff
+	}
+	running := state != stateOff
+
+	ref := setting(boiler, nbe.GetSetupFunction, "boiler.temp", 65)
+	temp := setting(boiler, nbe.GetOperatingDataFunction, "boiler_temp", ref)
+	powerMin := setting(boiler, nbe.GetSetupFunction, "regulation.boiler_power_min", 30)
+	powerMax := setting(boiler, nbe.GetSetupFunction, "regulation.boiler_power_max", 100)
+
+	power := 0.0
+	if running {
+		power = clamp(50+(ref-temp)*10, powerMin, powerMax)
+		temp += (ref-temp)*0.05 + noise(0.2)
+	} else {
+		temp += (20-temp)*0.01 + noise(0.1)
+	}
+
+	dhwRef := setting(boiler, nbe.GetSetupFunction, "hot_water.temp", 50)
+	dhw := setting(boiler, nbe.GetOperatingDataFunction, "dhw_temp", dhwRef)
+	dhw += (math.Min(dhwRef, temp-5)-dhw)*0.02 + noise(0.1)
+
+	oxygenRef := setting(boiler, nbe.GetOperatingDataFunction, "oxygen_ref", 10)
+	oxygen := 20.9
+	smoke := temp + noise(1)
+	photo := noise(1)
+	if running {
+		oxygen = clamp(oxygenRef+noise(0.5), 2, 20.9)
+		smoke = 80 + power*0.9 + noise(2)
+		photo = clamp(85+noise(3), 0, 100)
+	}
+
+	set := func(key string, value float64, decimals int) {
+		boiler.SetValue(nbe.GetOperatingDataFunction, key, strconv.FormatFloat(value, 'f', decimals, 64))
+	}
+	set("state", float64(state), 0)
+	set("boiler_ref", ref, 0)
+	set("boiler_temp", temp, 1)
+	set("return_temp", temp-12+noise(0.3), 1)
+	set("dhw_temp", dhw, 1)
+	set("dhw_ref", dhwRef, 0)
+	set("smoke_temp", smoke, 1)
+	set("oxygen", oxygen, 1)
+	set("photo_level", math.Abs(photo), 1)
+	set("power_pct", power, 0)
+	set("power_kw", power*0.15, 1)
+}
+
+func setting(boiler *nbe.MockBoiler, function nbe.Function, key string, fallback float64) float64 {
+	raw, ok := boiler.Value(function, key)
+	if !ok {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func noise(amplitude float64) float64 {
+	return (rand.Float64()*2 - 1) * amplitude
+}
+
+func clamp(value float64, min float64, max float64) float64 {
+	return math.Max(min, math.Min(max, value))
+}
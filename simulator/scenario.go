@@ -0,0 +1,193 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package simulator
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed scenarios/*.yaml
+var builtin embed.FS
+
+// rampStep is how often ramped values are updated.
+const rampStep = time.Second
+
+// Ramp changes a value linearly from whatever it is when the step starts.
+type Ramp struct {
+	To   float64       `yaml:"to"`
+	Over time.Duration `yaml:"over"`
+}
+
+// Step happens at a time after the scenario starts. Keys are category.key,
+// e.g. operating_data.boiler_temp or boiler.temp.
+type Step struct {
+	At   time.Duration     `yaml:"at"`
+	Log  string            `yaml:"log"`
+	Set  map[string]string `yaml:"set"`
+	Ramp map[string]Ramp   `yaml:"ramp"`
+}
+
+// Scenario is a timeline of changes to a MockBoiler, so that ignition
+// cycles, alarms and the like can be reproduced exactly.
+type Scenario struct {
+	Name  string `yaml:"name"`
+	Loop  bool   `yaml:"loop"`
+	Steps []Step `yaml:"steps"`
+}
+
+func (s *Scenario) Validate() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	for i, step := range s.Steps {
+		if i > 0 && step.At < s.Steps[i-1].At {
+			return fmt.Errorf("step %d is before the step preceding it", i+1)
+		}
+		for key, value := range step.Set {
+			if !strings.Contains(key, ".") {
+				return fmt.Errorf("step %d: key %q must be category.key", i+1, key)
+			}
+			if strings.ContainsAny(value, "=;") {
+				return fmt.Errorf("step %d: value of %s may not contain = or ;", i+1, key)
+			}
+		}
+		for key, ramp := range step.Ramp {
+			if !strings.Contains(key, ".") {
+				return fmt.Errorf("step %d: key %q must be category.key", i+1, key)
+			}
+			if ramp.Over <= 0 {
+				return fmt.Errorf("step %d: ramp of %s needs a positive over", i+1, key)
+			}
+		}
+	}
+	return nil
+}
+
+// Scenarios returns the names of the built in scenarios.
+func Scenarios() []string {
+	entries, _ := builtin.ReadDir("scenarios")
+	var names []string
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".yaml"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadScenario reads a scenario from a YAML file, or one of the built in
+// scenarios by name.
+func LoadScenario(name string) (*Scenario, error) {
+	data, err := builtin.ReadFile(fmt.Sprintf("scenarios/%s.yaml", name))
+	if err != nil {
+		data, err = os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var scenario Scenario
+	if err := yaml.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", name, err)
+	}
+	if err := scenario.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return &scenario, nil
+}
+
+// Run plays the scenario against boiler until it ends, or stop is closed.
+// Speed scales time, so 10 plays it ten times faster.
+func (s *Scenario) Run(boiler *nbe.MockBoiler, speed float64, stop <-chan struct{}) {
+	if speed <= 0 {
+		speed = 1
+	}
+	scale := func(d time.Duration) time.Duration {
+		return time.Duration(float64(d) / speed)
+	}
+
+	for {
+		start := time.Now()
+		for _, step := range s.Steps {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Until(start.Add(scale(step.At)))):
+			}
+			s.apply(boiler, step, scale, stop)
+		}
+		if !s.Loop {
+			log.Infof("Scenario %s finished", s.Name)
+			return
+		}
+	}
+}
+
+func (s *Scenario) apply(boiler *nbe.MockBoiler, step Step, scale func(time.Duration) time.Duration, stop <-chan struct{}) {
+	if step.Log != "" {
+		log.Infof("Scenario %s: %s", s.Name, step.Log)
+	}
+	for key, value := range step.Set {
+		function, k := lookup(key)
+		boiler.SetValue(function, k, value)
+	}
+	for key, ramp := range step.Ramp {
+		go runRamp(boiler, key, ramp, scale, stop)
+	}
+}
+
+func runRamp(boiler *nbe.MockBoiler, key string, ramp Ramp, scale func(time.Duration) time.Duration, stop <-chan struct{}) {
+	function, k := lookup(key)
+	from := setting(boiler, function, k, ramp.To)
+	steps := int(ramp.Over / rampStep)
+	if steps < 1 {
+		steps = 1
+	}
+	for i := 1; i <= steps; i++ {
+		select {
+		case <-stop:
+			return
+		case <-time.After(scale(rampStep)):
+		}
+		value := from + (ramp.To-from)*float64(i)/float64(steps)
+		boiler.SetValue(function, k, strconv.FormatFloat(value, 'f', 1, 64))
+	}
+}
+
+// lookup maps category.key to the function and key it is stored under.
+func lookup(key string) (nbe.Function, string) {
+	category, k, _ := strings.Cut(key, ".")
+	switch category {
+	case "operating_data":
+		return nbe.GetOperatingDataFunction, k
+	case "advanced_data":
+		return nbe.GetAdvancedDataFunction, k
+	case "consumption_data":
+		return nbe.GetConsumptionDataFunction, k
+	}
+	return nbe.GetSetupFunction, key
+}
@@ -0,0 +1,150 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package simulator
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server answers NBE protocol requests over UDP from a MockBoiler, so that
+// boiler-mate, or anything else speaking the protocol, can be run without a
+// controller.
+type Server struct {
+	Boiler *nbe.MockBoiler
+	Pin    string
+
+	key  *rsa.PrivateKey
+	conn net.PacketConn
+}
+
+// NewServer returns a server for boiler, which only accepts writes with
+// pin. A new RSA key is generated and published as misc.rsa_key, which
+// clients use to encrypt writes.
+func NewServer(boiler *nbe.MockBoiler, pin string) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	boiler.SetValue(nbe.GetSetupFunction, "misc.rsa_key", base64.StdEncoding.EncodeToString(der))
+
+	return &Server{
+		Boiler: boiler,
+		Pin:    pin,
+		key:    key,
+	}, nil
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve answers requests on conn until it is closed.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.conn = conn
+	defer conn.Close()
+
+	for {
+		buffer := make([]byte, 1024)
+		n, addr, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		response, err := s.handle(buffer[:n])
+		if err != nil {
+			log.Warnf("Bad request from %s: %v", addr, err)
+			continue
+		}
+		if _, err := conn.WriteTo(response, addr); err != nil {
+			log.Errorf("Failed to reply to %s: %v", addr, err)
+		}
+	}
+}
+
+func (s *Server) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *Server) handle(packet []byte) ([]byte, error) {
+	var request nbe.NBERequest
+	if err := request.UnpackEncrypted(bytes.NewReader(packet), s.key); err != nil {
+		return nil, err
+	}
+	log.Debugf("recv %d %d %s", request.SeqNo, request.Function, request.Payload)
+
+	response := s.respond(&request)
+	response.AppID = request.AppID
+	response.ControllerID = request.ControllerID
+	response.SeqNo = request.SeqNo
+
+	buf := new(bytes.Buffer)
+	if err := response.Pack(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Server) respond(request *nbe.NBERequest) *nbe.NBEResponse {
+	path := string(request.Payload)
+	switch request.Function {
+	case nbe.DiscoveryFunction:
+		return &nbe.NBEResponse{
+			Function: request.Function,
+			Payload:  map[string]interface{}{"serial": s.Boiler.Serial()},
+		}
+	case nbe.SetSetupFunction:
+		if request.PinCode != s.Pin {
+			log.Warnf("Refused write of %s with the wrong pin", path)
+			return &nbe.NBEResponse{Function: request.Function, Status: 1, Payload: map[string]interface{}{}}
+		}
+		key, value, _ := strings.Cut(path, "=")
+		response, _ := s.Boiler.Set(key, []byte(value))
+		log.Infof("Set %s to %s (status %d)", key, value, response.Status)
+		return response
+	}
+
+	response, err := s.Boiler.Get(request.Function, path)
+	if err != nil {
+		return &nbe.NBEResponse{Function: request.Function, Status: 1, Payload: map[string]interface{}{}}
+	}
+	return response
+}
@@ -0,0 +1,615 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package snmp is a read-only SNMP v1 and v2c agent for the boiler's key
+// values, for plant rooms monitored with classic network management tools.
+// It can also send v2c traps when alarms are raised and cleared.
+package snmp
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultCommunity = "public"
+	trapPort         = 162
+
+	// Responses are kept within an Ethernet frame, as v2c has no way for a
+	// manager to say how much it can take.
+	maxMessageSize = 1472
+)
+
+const (
+	version1  = 0
+	version2c = 1
+)
+
+// Error statuses of responses.
+const (
+	errTooBig      = 1
+	errNoSuchName  = 2
+	errNotWritable = 17
+)
+
+// TruthValue, from SNMPv2-TC.
+const (
+	truthTrue  = 1
+	truthFalse = 2
+)
+
+var (
+	// Base is the root of boiler-mate's objects, under the enterprise
+	// number set aside for documentation (RFC 5612), as boiler-mate has
+	// none of its own.
+	Base = OID{1, 3, 6, 1, 4, 1, 32473, 1}
+
+	system      = OID{1, 3, 6, 1, 2, 1, 1}
+	sysUpTime   = system.Append(3, 0)
+	snmpTrapOID = OID{1, 3, 6, 1, 6, 3, 1, 1, 4, 1, 0}
+
+	boiler           = Base.Append(1)
+	alarmState       = boiler.Append(13, 0)
+	alarmText        = boiler.Append(14, 0)
+	alarmDescription = boiler.Append(15, 0)
+
+	alarmRaisedTrap  = Base.Append(2, 0, 1)
+	alarmClearedTrap = Base.Append(2, 0, 2)
+)
+
+var errBadCommunity = errors.New("wrong community")
+
+// Config configures the agent. Traps are host[:port] targets, on port 162
+// unless given, sent with the same community as requests are answered to.
+type Config struct {
+	Address   string
+	Community string
+	Traps     []string
+	Serial    string
+	Name      string
+	Version   string
+	Language  string
+}
+
+type object struct {
+	oid OID
+	get func() (element, bool)
+}
+
+type varbind struct {
+	oid   OID
+	value element
+}
+
+func (v varbind) encode() []byte {
+	return encode(tagSequence, objectID(v.oid).encode(), v.value.encode())
+}
+
+// Agent answers SNMP requests with the latest values seen on the bus.
+type Agent struct {
+	Config
+
+	conn      *net.UDPConn
+	objects   []object
+	started   time.Time
+	requestID atomic.Int32
+
+	mutex     sync.RWMutex
+	values    map[string]interface{}
+	connected bool
+}
+
+func New(config Config) (*Agent, error) {
+	if config.Community == "" {
+		config.Community = DefaultCommunity
+	}
+	traps := make([]string, len(config.Traps))
+	for i, target := range config.Traps {
+		target = strings.TrimSpace(target)
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, strconv.Itoa(trapPort))
+		}
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid trap target %q", config.Traps[i])
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid trap target %q: bad port", config.Traps[i])
+		}
+		traps[i] = target
+	}
+	config.Traps = traps
+
+	a := &Agent{
+		Config:    config,
+		started:   time.Now(),
+		values:    make(map[string]interface{}),
+		connected: true,
+	}
+	a.objects = a.mib()
+	return a, nil
+}
+
+// mib lists the objects, in the order GetNext walks them. Temperatures,
+// oxygen and power in kW are in tenths, as SNMP has no floating point.
+func (a *Agent) mib() []object {
+	objects := []object{
+		{system.Append(1, 0), a.text(func() string {
+			return fmt.Sprintf("boiler-mate %s, NBE boiler %s", a.Version, a.Serial)
+		})},
+		{system.Append(2, 0), func() (element, bool) { return objectID(Base), true }},
+		{sysUpTime, func() (element, bool) { return a.upTime(), true }},
+		{system.Append(5, 0), a.text(a.name)},
+
+		{boiler.Append(1, 0), a.text(func() string { return a.Serial })},
+		{boiler.Append(2, 0), a.integer("operating_data.state", 1)},
+		{boiler.Append(3, 0), a.stateText},
+		{boiler.Append(4, 0), a.integer("operating_data.boiler_temp", 10)},
+		{boiler.Append(5, 0), a.integer("operating_data.boiler_ref", 10)},
+		{boiler.Append(6, 0), a.integer("operating_data.return_temp", 10)},
+		{boiler.Append(7, 0), a.integer("operating_data.dhw_temp", 10)},
+		{boiler.Append(8, 0), a.integer("operating_data.smoke_temp", 10)},
+		{boiler.Append(9, 0), a.integer("operating_data.oxygen", 10)},
+		{boiler.Append(10, 0), a.integer("operating_data.power_pct", 1)},
+		{boiler.Append(11, 0), a.integer("operating_data.power_kw", 10)},
+		{boiler.Append(12, 0), a.alarmActive},
+		{alarmState, a.alarmState},
+		{alarmText, a.alarmText},
+		{alarmDescription, a.alarmDescription},
+		{boiler.Append(16, 0), a.controllerConnected},
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].oid.Compare(objects[j].oid) < 0
+	})
+	return objects
+}
+
+// SetName changes sysName, when the boiler is renamed.
+func (a *Agent) SetName(name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.Name = name
+}
+
+func (a *Agent) name() string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.Name
+}
+
+func (a *Agent) value(key string) (interface{}, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	v, ok := a.values[key]
+	return v, ok
+}
+
+func (a *Agent) upTime() element {
+	return unsigned(tagTimeTicks, uint32(time.Since(a.started)/(10*time.Millisecond)))
+}
+
+func (a *Agent) text(fn func() string) func() (element, bool) {
+	return func() (element, bool) {
+		return octets(fn()), true
+	}
+}
+
+// integer returns the value of key multiplied by scale, rounded.
+func (a *Agent) integer(key string, scale float64) func() (element, bool) {
+	return func() (element, bool) {
+		v, ok := a.value(key)
+		if !ok {
+			return element{}, false
+		}
+		switch v := v.(type) {
+		case nbe.RoundedFloat:
+			return integer(int64(math.Round(float64(v) * scale))), true
+		case int64:
+			return integer(int64(math.Round(float64(v) * scale))), true
+		}
+		return element{}, false
+	}
+}
+
+func (a *Agent) state() (int64, bool) {
+	v, ok := a.value("operating_data.state")
+	if !ok {
+		return 0, false
+	}
+	state, ok := v.(int64)
+	return state, ok
+}
+
+func (a *Agent) stateText() (element, bool) {
+	state, ok := a.state()
+	if !ok {
+		return element{}, false
+	}
+	return octets(nbe.PowerStateText(state)), true
+}
+
+func (a *Agent) alarmActive() (element, bool) {
+	state, ok := a.state()
+	if !ok {
+		return element{}, false
+	}
+	return truth(nbe.AlarmStates[state]), true
+}
+
+// alarmState is the state of the alarm, or 0 if there is none.
+func (a *Agent) alarmState() (element, bool) {
+	state, ok := a.state()
+	if !ok {
+		return element{}, false
+	}
+	if !nbe.AlarmStates[state] {
+		state = 0
+	}
+	return integer(state), true
+}
+
+func (a *Agent) alarmText() (element, bool) {
+	state, ok := a.state()
+	if !ok {
+		return element{}, false
+	}
+	if !nbe.AlarmStates[state] {
+		return octets(""), true
+	}
+	return octets(nbe.PowerStateText(state)), true
+}
+
+func (a *Agent) alarmDescription() (element, bool) {
+	state, ok := a.state()
+	if !ok {
+		return element{}, false
+	}
+	if !nbe.AlarmStates[state] {
+		return octets(""), true
+	}
+	return octets(nbe.AlarmText(a.Language, state)), true
+}
+
+func (a *Agent) controllerConnected() (element, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return truth(a.connected), true
+}
+
+func truth(b bool) element {
+	if b {
+		return integer(truthTrue)
+	}
+	return integer(truthFalse)
+}
+
+func (a *Agent) Start(events *bus.Bus) error {
+	addr, err := net.ResolveUDPAddr("udp", a.Address)
+	if err != nil {
+		return err
+	}
+	a.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	events.OnChange(func(change bus.Change) {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		a.values[fmt.Sprintf("%s.%s", change.Category, change.Key)] = change.Value
+	})
+	events.OnConnectivity(func(c bus.Connectivity) {
+		if c.Component != "controller" {
+			return
+		}
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		a.connected = c.Connected
+	})
+	if len(a.Traps) > 0 {
+		events.OnAlarm(a.trap)
+	}
+
+	go a.serve()
+	return nil
+}
+
+func (a *Agent) Close() {
+	if a.conn != nil {
+		a.conn.Close()
+	}
+}
+
+func (a *Agent) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("SNMP agent failed to read: %v", err)
+			continue
+		}
+		response, err := a.handle(buf[:n])
+		if err != nil {
+			// Like any agent, stay silent rather than tell a stranger
+			// what went wrong.
+			log.Debugf("Ignoring SNMP request from %s: %v", addr, err)
+			continue
+		}
+		if _, err := a.conn.WriteToUDP(response, addr); err != nil {
+			log.Warnf("SNMP agent failed to answer %s: %v", addr, err)
+		}
+	}
+}
+
+// handle answers a request, or returns an error if it should be dropped.
+func (a *Agent) handle(packet []byte) ([]byte, error) {
+	msg, _, err := decode(packet)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := msg.children()
+	if err != nil {
+		return nil, err
+	}
+	if msg.tag != tagSequence || len(fields) != 3 || fields[1].tag != tagOctetString {
+		return nil, fmt.Errorf("not an SNMP message")
+	}
+	version, err := fields[0].int()
+	if err != nil {
+		return nil, err
+	}
+	if version != version1 && version != version2c {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	if subtle.ConstantTimeCompare(fields[1].content, []byte(a.Community)) != 1 {
+		return nil, errBadCommunity
+	}
+
+	pdu := fields[2]
+	parts, err := pdu.children()
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) != 4 || parts[3].tag != tagSequence {
+		return nil, fmt.Errorf("invalid PDU")
+	}
+	requestID := parts[0]
+	if _, err := requestID.int(); err != nil {
+		return nil, err
+	}
+	var params [2]int64
+	for i := range params {
+		if params[i], err = parts[i+1].int(); err != nil {
+			return nil, err
+		}
+	}
+	list, err := parts[3].children()
+	if err != nil {
+		return nil, err
+	}
+	request := make([]varbind, len(list))
+	for i, item := range list {
+		pair, err := item.children()
+		if err != nil {
+			return nil, err
+		}
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid variable binding")
+		}
+		oid, err := pair[0].oid()
+		if err != nil {
+			return nil, err
+		}
+		request[i] = varbind{oid: oid, value: pair[1]}
+	}
+
+	var response []varbind
+	status, index := 0, 0
+	switch pdu.tag {
+	case pduGetRequest:
+		response, status, index = a.get(version, request)
+	case pduGetNextRequest:
+		response, status, index = a.getNext(version, request)
+	case pduGetBulkRequest:
+		if version == version1 {
+			return nil, fmt.Errorf("GetBulk in an SNMPv1 message")
+		}
+		response = a.getBulk(request, int(params[0]), int(params[1]), maxMessageSize-len(a.Community)-64)
+	case pduSetRequest:
+		log.Warnf("Refusing SNMP set of %s, the agent is read-only", request[0].oid)
+		status, index = errNotWritable, 1
+		if version == version1 {
+			status = errNoSuchName
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PDU 0x%02x", pdu.tag)
+	}
+	if status != 0 {
+		// Errors echo the request, for the manager to find the index in.
+		response = request
+	}
+
+	b := message(version, a.Community, pduResponse, requestID, status, index, response)
+	if len(b) > maxMessageSize {
+		if version == version1 {
+			response = request
+		} else {
+			response = nil
+		}
+		b = message(version, a.Community, pduResponse, requestID, errTooBig, 0, response)
+	}
+	return b, nil
+}
+
+// lookup returns the value of oid, or in v2c an exception if it has none.
+func (a *Agent) lookup(oid OID) (element, bool) {
+	i := sort.Search(len(a.objects), func(i int) bool {
+		return a.objects[i].oid.Compare(oid) >= 0
+	})
+	if i == len(a.objects) || a.objects[i].oid.Compare(oid) != 0 {
+		return element{tag: tagNoSuchObject}, false
+	}
+	value, ok := a.objects[i].get()
+	if !ok {
+		return element{tag: tagNoSuchInstance}, false
+	}
+	return value, true
+}
+
+// next returns the first object after oid with a value.
+func (a *Agent) next(oid OID) (varbind, bool) {
+	for _, o := range a.objects {
+		if o.oid.Compare(oid) <= 0 {
+			continue
+		}
+		if value, ok := o.get(); ok {
+			return varbind{oid: o.oid, value: value}, true
+		}
+	}
+	return varbind{oid: oid, value: element{tag: tagEndOfMibView}}, false
+}
+
+func (a *Agent) get(version int64, request []varbind) ([]varbind, int, int) {
+	response := make([]varbind, len(request))
+	for i, b := range request {
+		value, ok := a.lookup(b.oid)
+		if !ok && version == version1 {
+			return nil, errNoSuchName, i + 1
+		}
+		response[i] = varbind{oid: b.oid, value: value}
+	}
+	return response, 0, 0
+}
+
+func (a *Agent) getNext(version int64, request []varbind) ([]varbind, int, int) {
+	response := make([]varbind, len(request))
+	for i, b := range request {
+		next, ok := a.next(b.oid)
+		if !ok && version == version1 {
+			return nil, errNoSuchName, i + 1
+		}
+		response[i] = next
+	}
+	return response, 0, 0
+}
+
+// getBulk answers a GetBulk request, leaving off repetitions that would
+// take the response over size bytes.
+func (a *Agent) getBulk(request []varbind, nonRepeaters int, maxRepetitions int, size int) []varbind {
+	nonRepeaters = min(max(nonRepeaters, 0), len(request))
+	var response []varbind
+	add := func(b varbind) bool {
+		size -= len(b.encode())
+		if size < 0 {
+			return false
+		}
+		response = append(response, b)
+		return true
+	}
+
+	for _, b := range request[:nonRepeaters] {
+		next, _ := a.next(b.oid)
+		if !add(next) {
+			return response
+		}
+	}
+	last := make([]OID, 0, len(request)-nonRepeaters)
+	for _, b := range request[nonRepeaters:] {
+		last = append(last, b.oid)
+	}
+	for r := 0; r < maxRepetitions && len(last) > 0; r++ {
+		done := true
+		for i, oid := range last {
+			next, ok := a.next(oid)
+			if !add(next) {
+				return response
+			}
+			last[i] = next.oid
+			done = done && !ok
+		}
+		if done {
+			break
+		}
+	}
+	return response
+}
+
+func message(version int64, community string, pduType byte, requestID element, status int, index int, bindings []varbind) []byte {
+	var list []byte
+	for _, b := range bindings {
+		list = append(list, b.encode()...)
+	}
+	pdu := encode(pduType,
+		requestID.encode(),
+		integer(int64(status)).encode(),
+		integer(int64(index)).encode(),
+		encode(tagSequence, list),
+	)
+	return encode(tagSequence, integer(version).encode(), octets(community).encode(), pdu)
+}
+
+// trap sends a v2c trap to every target when an alarm is raised or
+// cleared.
+func (a *Agent) trap(alarm bus.Alarm) {
+	trapOID := alarmRaisedTrap
+	if !alarm.Active {
+		trapOID = alarmClearedTrap
+	}
+	packet := message(version2c, a.Community, pduTrapV2, integer(int64(a.requestID.Add(1))), 0, 0, []varbind{
+		{sysUpTime, a.upTime()},
+		{snmpTrapOID, objectID(trapOID)},
+		{alarmState, integer(alarm.State)},
+		{alarmText, octets(alarm.Text)},
+		{alarmDescription, octets(alarm.Description)},
+	})
+	for _, target := range a.Traps {
+		// Resolving the target may block, and bus handlers must not.
+		go func(target string) {
+			if err := send(target, packet); err != nil {
+				log.Errorf("Failed to send SNMP trap to %s: %v", target, err)
+				return
+			}
+			log.Debugf("Sent SNMP trap %s to %s", trapOID, target)
+		}(target)
+	}
+}
+
+func send(target string, packet []byte) error {
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
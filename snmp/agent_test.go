@@ -0,0 +1,350 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package snmp
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newTestAgent(t *testing.T, traps ...string) (*Agent, *bus.Bus) {
+	t.Helper()
+	a, err := New(Config{Address: "127.0.0.1:0", Name: "Boiler", Serial: "1234", Version: "v1.0.0", Traps: traps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := bus.New()
+	if err := a.Start(events); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.Close)
+	for key, value := range map[string]interface{}{
+		"boiler_temp": nbe.RoundedFloat(65.3),
+		"boiler_ref":  nbe.RoundedFloat(12.8),
+		"return_temp": nbe.RoundedFloat(-5.2),
+		"state":       int64(5),
+	} {
+		events.Publish(bus.ChangeTopic, bus.Change{Category: "operating_data", Key: key, Value: value})
+	}
+	return a, events
+}
+
+// TestGoldenPackets checks the encoding of each kind of message the agent
+// sends against packets assembled by hand.
+func TestGoldenPackets(t *testing.T) {
+	a, _ := newTestAgent(t)
+
+	// Each request is message(version, "public", pdu(request-id 1, 0, 0,
+	// bindings)).
+	const (
+		public  = "04 06 7075626c6963"
+		id      = "02 01 01"
+		noError = "02 01 00 02 01 00"
+		sysName = "06 08 2b06010201010500"
+		// 1.3.6.1.4.1.32473.1.1.4.0, the boiler temperature.
+		boilerTemp = "06 0c 2b06010401 81fd59 01 01 04 00"
+		boilerRef  = "06 0c 2b06010401 81fd59 01 01 05 00"
+		returnTemp = "06 0c 2b06010401 81fd59 01 01 06 00"
+		dhwTemp    = "06 0c 2b06010401 81fd59 01 01 07 00"
+		// 1.3.6.1.4.1.32473.1.1.16.0, controller connected, the last
+		// object.
+		connected = "06 0c 2b06010401 81fd59 01 01 10 00"
+		unknown   = "06 0c 2b06010401 81fd59 01 01 63 00"
+	)
+	tests := []struct {
+		name     string
+		request  string
+		response string
+	}{
+		{
+			name:     "v2c get of a string",
+			request:  "30 26 02 01 01" + public + "a0 19" + id + noError + "30 0e 30 0c" + sysName + "05 00",
+			response: "30 2c 02 01 01" + public + "a2 1f" + id + noError + "30 14 30 12" + sysName + "04 06 426f696c6572",
+		},
+		{
+			name:     "v1 get of a string",
+			request:  "30 26 02 01 00" + public + "a0 19" + id + noError + "30 0e 30 0c" + sysName + "05 00",
+			response: "30 2c 02 01 00" + public + "a2 1f" + id + noError + "30 14 30 12" + sysName + "04 06 426f696c6572",
+		},
+		{
+			// 653, 128, which needs a leading zero, and -52.
+			name: "v2c get of integers",
+			request: "30 4e 02 01 01" + public + "a0 41" + id + noError + "30 36" +
+				"30 10" + boilerTemp + "05 00" + "30 10" + boilerRef + "05 00" + "30 10" + returnTemp + "05 00",
+			response: "30 53 02 01 01" + public + "a2 46" + id + noError + "30 3b" +
+				"30 12" + boilerTemp + "02 02 028d" + "30 12" + boilerRef + "02 02 0080" + "30 11" + returnTemp + "02 01 cc",
+		},
+		{
+			name:     "v2c get of an object identifier",
+			request:  "30 26 02 01 01" + public + "a0 19" + id + noError + "30 0e 30 0c 06 08 2b06010201010200 05 00",
+			response: "30 2f 02 01 01" + public + "a2 22" + id + noError + "30 17 30 15 06 08 2b06010201010200 06 09 2b06010401 81fd59 01",
+		},
+		{
+			name: "v2c get without a value",
+			request: "30 3c 02 01 01" + public + "a0 2f" + id + noError + "30 24" +
+				"30 10" + unknown + "05 00" + "30 10" + dhwTemp + "05 00",
+			response: "30 3c 02 01 01" + public + "a2 2f" + id + noError + "30 24" +
+				"30 10" + unknown + "80 00" + "30 10" + dhwTemp + "81 00",
+		},
+		{
+			name:     "v1 get without a value",
+			request:  "30 2a 02 01 00" + public + "a0 1d" + id + noError + "30 12 30 10" + dhwTemp + "05 00",
+			response: "30 2a 02 01 00" + public + "a2 1d" + id + "02 01 02 02 01 01" + "30 12 30 10" + dhwTemp + "05 00",
+		},
+		{
+			name:     "v2c get next",
+			request:  "30 2a 02 01 01" + public + "a1 1d" + id + noError + "30 12 30 10" + boilerRef + "05 00",
+			response: "30 2b 02 01 01" + public + "a2 1e" + id + noError + "30 13 30 11" + returnTemp + "02 01 cc",
+		},
+		{
+			name:     "v2c get next at the end",
+			request:  "30 2a 02 01 01" + public + "a1 1d" + id + noError + "30 12 30 10" + connected + "05 00",
+			response: "30 2a 02 01 01" + public + "a2 1d" + id + noError + "30 12 30 10" + connected + "82 00",
+		},
+		{
+			name:     "v1 get next at the end",
+			request:  "30 2a 02 01 00" + public + "a1 1d" + id + noError + "30 12 30 10" + connected + "05 00",
+			response: "30 2a 02 01 00" + public + "a2 1d" + id + "02 01 02 02 01 01" + "30 12 30 10" + connected + "05 00",
+		},
+		{
+			// The object after the boiler temperature as a non-repeater,
+			// then two repetitions from it.
+			name: "v2c get bulk",
+			request: "30 3c 02 01 01" + public + "a5 2f" + id + "02 01 01 02 01 02" + "30 24" +
+				"30 10" + boilerTemp + "05 00" + "30 10" + boilerTemp + "05 00",
+			response: "30 53 02 01 01" + public + "a2 46" + id + noError + "30 3b" +
+				"30 12" + boilerRef + "02 02 0080" + "30 12" + boilerRef + "02 02 0080" + "30 11" + returnTemp + "02 01 cc",
+		},
+		{
+			name:     "v2c set",
+			request:  "30 2b 02 01 01" + public + "a3 1e" + id + noError + "30 13 30 11" + boilerRef + "02 01 46",
+			response: "30 2b 02 01 01" + public + "a2 1e" + id + "02 01 11 02 01 01" + "30 13 30 11" + boilerRef + "02 01 46",
+		},
+		{
+			name:     "v1 set",
+			request:  "30 2b 02 01 00" + public + "a3 1e" + id + noError + "30 13 30 11" + boilerRef + "02 01 46",
+			response: "30 2b 02 01 00" + public + "a2 1e" + id + "02 01 02 02 01 01" + "30 13 30 11" + boilerRef + "02 01 46",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.handle(unhex(t, tt.request))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := unhex(t, tt.response); string(got) != string(want) {
+				t.Errorf("response\n got % x\nwant % x", got, want)
+			}
+		})
+	}
+}
+
+func TestTooBig(t *testing.T) {
+	a, _ := newTestAgent(t)
+	// sysDescr, asked for 40 times, doesn't fit in a response.
+	binding := "30 0c 06 08 2b06010201010100 05 00"
+	list := strings.Repeat(binding, 40)
+	pdu := "02 01 01 02 01 00 02 01 00 30 82 0230" + list
+	request := "30 82 024c 02 01 01 04 06 7075626c6963 a0 82 023d" + pdu
+
+	got, err := a.handle(unhex(t, request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "30 18 02 01 01 04 06 7075626c6963 a2 0b 02 01 01 02 01 01 02 01 00 30 00"
+	if string(got) != string(unhex(t, want)) {
+		t.Errorf("response\n got % x\nwant % x", got, unhex(t, want))
+	}
+}
+
+func TestDropped(t *testing.T) {
+	a, _ := newTestAgent(t)
+	tests := map[string]string{
+		"wrong community": "30 27 02 01 01 04 07 70726976617465 a0 19 02 01 01 02 01 00 02 01 00 30 0e 30 0c 06 08 2b06010201010500 05 00",
+		"v3":              "30 26 02 01 03 04 06 7075626c6963 a0 19 02 01 01 02 01 00 02 01 00 30 0e 30 0c 06 08 2b06010201010500 05 00",
+		"v1 get bulk":     "30 26 02 01 00 04 06 7075626c6963 a5 19 02 01 01 02 01 00 02 01 00 30 0e 30 0c 06 08 2b06010201010500 05 00",
+		"truncated":       "30 26 02 01 01 04 06 7075626c6963 a0 19 02 01 01",
+		"not a sequence":  "04 06 7075626c6963",
+	}
+	for name, request := range tests {
+		if response, err := a.handle(unhex(t, request)); err == nil {
+			t.Errorf("%s: answered % x", name, response)
+		}
+	}
+}
+
+func manager(t *testing.T, a *Agent, version gosnmp.SnmpVersion, community string) *gosnmp.GoSNMP {
+	t.Helper()
+	addr := a.conn.LocalAddr().(*net.UDPAddr)
+	g := &gosnmp.GoSNMP{
+		Target:    addr.IP.String(),
+		Port:      uint16(addr.Port),
+		Community: community,
+		Version:   version,
+		Timeout:   time.Second,
+		Retries:   0,
+		MaxOids:   gosnmp.MaxOids,
+	}
+	if err := g.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Conn.Close() })
+	return g
+}
+
+// TestManager queries the agent with gosnmp, as a network management
+// system would.
+func TestManager(t *testing.T) {
+	a, _ := newTestAgent(t)
+	for _, version := range []gosnmp.SnmpVersion{gosnmp.Version1, gosnmp.Version2c} {
+		t.Run(version.String(), func(t *testing.T) {
+			g := manager(t, a, version, "public")
+
+			result, err := g.Get([]string{".1.3.6.1.2.1.1.5.0", ".1.3.6.1.4.1.32473.1.1.4.0", ".1.3.6.1.4.1.32473.1.1.3.0"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Error != gosnmp.NoError || len(result.Variables) != 3 {
+				t.Fatalf("Get = %v, %d variables", result.Error, len(result.Variables))
+			}
+			if v := result.Variables[0]; v.Type != gosnmp.OctetString || string(v.Value.([]byte)) != "Boiler" {
+				t.Errorf("sysName = %v %v", v.Type, v.Value)
+			}
+			if v := result.Variables[1]; v.Type != gosnmp.Integer || v.Value.(int) != 653 {
+				t.Errorf("boiler temperature = %v %v", v.Type, v.Value)
+			}
+			if v := result.Variables[2]; v.Type != gosnmp.OctetString || string(v.Value.([]byte)) != nbe.PowerStateText(5) {
+				t.Errorf("state = %v %q", v.Type, v.Value)
+			}
+
+			walk := g.WalkAll
+			if version == gosnmp.Version2c {
+				walk = g.BulkWalkAll
+			}
+			results, err := walk(".1.3.6.1.4.1.32473.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Everything but the DHW temperature, power and oxygen, which
+			// haven't been seen.
+			var oids []string
+			for _, pdu := range results {
+				oids = append(oids, strings.TrimPrefix(pdu.Name, ".1.3.6.1.4.1.32473.1.1."))
+			}
+			if got, want := strings.Join(oids, " "), "1.0 2.0 3.0 4.0 5.0 6.0 12.0 13.0 14.0 15.0 16.0"; got != want {
+				t.Errorf("walked %s, want %s", got, want)
+			}
+
+			result, err = g.Set([]gosnmp.SnmpPDU{{Name: ".1.3.6.1.4.1.32473.1.1.5.0", Type: gosnmp.Integer, Value: 700}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := gosnmp.NotWritable
+			if version == gosnmp.Version1 {
+				want = gosnmp.NoSuchName
+			}
+			if result.Error != want || result.ErrorIndex != 1 {
+				t.Errorf("Set = %v at %d, want %v", result.Error, result.ErrorIndex, want)
+			}
+		})
+	}
+
+	// The wrong community is ignored.
+	if _, err := manager(t, a, gosnmp.Version2c, "private").Get([]string{".1.3.6.1.2.1.1.5.0"}); err == nil {
+		t.Error("answered the wrong community")
+	}
+}
+
+func TestTrap(t *testing.T) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	a, events := newTestAgent(t, receiver.LocalAddr().String())
+	// An uptime of a second, 100 ticks, fits in a byte.
+	a.started = time.Now().Add(-time.Second)
+
+	for _, active := range []bool{true, false} {
+		events.Publish(bus.AlarmTopic, bus.Alarm{State: 13, Text: "Alarm", Description: "Ignition failed", Active: active})
+
+		buf := make([]byte, 1500)
+		receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := receiver.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, err := gosnmp.Default.SnmpDecodePacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.PDUType != gosnmp.SNMPv2Trap || packet.Version != gosnmp.Version2c || packet.Community != "public" {
+			t.Fatalf("received %v %v %s", packet.PDUType, packet.Version, packet.Community)
+		}
+		if len(packet.Variables) != 5 {
+			t.Fatalf("%d variables", len(packet.Variables))
+		}
+		uptime := packet.Variables[0]
+		if uptime.Name != ".1.3.6.1.2.1.1.3.0" || uptime.Type != gosnmp.TimeTicks {
+			t.Errorf("first variable = %s %v, want sysUpTime", uptime.Name, uptime.Type)
+		}
+		trapOID := ".1.3.6.1.4.1.32473.1.2.0.1"
+		if !active {
+			trapOID = ".1.3.6.1.4.1.32473.1.2.0.2"
+		}
+		if v := packet.Variables[1]; v.Name != ".1.3.6.1.6.3.1.1.4.1.0" || v.Value != trapOID {
+			t.Errorf("snmpTrapOID = %s %v, want %s", v.Name, v.Value, trapOID)
+		}
+
+		// The whole packet, with the uptime and request ID received.
+		ticks := uptime.Value.(uint32)
+		if ticks < 100 || ticks > 127 {
+			t.Fatalf("uptime of %d ticks", ticks)
+		}
+		trap := "06 0c 2b06010401 81fd59 01 02 00 01"
+		if !active {
+			trap = "06 0c 2b06010401 81fd59 01 02 00 02"
+		}
+		want := "30 81 8f 02 01 01 04 06 7075626c6963 a7 81 81" +
+			"02 01" + hex.EncodeToString([]byte{byte(packet.RequestID)}) + "02 01 00 02 01 00" + "30 76" +
+			"30 0d 06 08 2b06010201010300 43 01" + hex.EncodeToString([]byte{byte(ticks)}) +
+			"30 1a 06 0a 2b060106030101040100" + trap +
+			"30 11 06 0c 2b06010401 81fd59 01 01 0d 00 02 01 0d" +
+			"30 15 06 0c 2b06010401 81fd59 01 01 0e 00 04 05 416c61726d" +
+			"30 1f 06 0c 2b06010401 81fd59 01 01 0f 00 04 0f 49676e6974696f6e206661696c6564"
+		if string(buf[:n]) != string(unhex(t, want)) {
+			t.Errorf("trap\n got % x\nwant % x", buf[:n], unhex(t, want))
+		}
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package snmp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The subset of BER used by SNMP: universal types, SNMPv2-SMI application
+// types, v2c exceptions and the PDU tags.
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+	tagGauge32     = 0x42
+	tagTimeTicks   = 0x43
+
+	tagNoSuchObject   = 0x80
+	tagNoSuchInstance = 0x81
+	tagEndOfMibView   = 0x82
+
+	pduGetRequest     = 0xa0
+	pduGetNextRequest = 0xa1
+	pduResponse       = 0xa2
+	pduSetRequest     = 0xa3
+	pduGetBulkRequest = 0xa5
+	pduTrapV2         = 0xa7
+)
+
+// OID is an object identifier.
+type OID []uint32
+
+func (o OID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Append returns a new OID with the given arcs appended.
+func (o OID) Append(arcs ...uint32) OID {
+	return append(append(OID{}, o...), arcs...)
+}
+
+// Compare orders OIDs lexicographically, as GetNext walks them.
+func (o OID) Compare(other OID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			if o[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(o) - len(other)
+}
+
+// element is a decoded TLV, or a value ready to be encoded.
+type element struct {
+	tag     byte
+	content []byte
+}
+
+func (e element) encode() []byte {
+	return encode(e.tag, e.content)
+}
+
+func (e element) int() (int64, error) {
+	if e.tag != tagInteger || len(e.content) == 0 || len(e.content) > 8 {
+		return 0, fmt.Errorf("expected an integer, got tag 0x%02x", e.tag)
+	}
+	v := int64(int8(e.content[0]))
+	for _, b := range e.content[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+func (e element) oid() (OID, error) {
+	if e.tag != tagOID || len(e.content) == 0 {
+		return nil, fmt.Errorf("expected an OID, got tag 0x%02x", e.tag)
+	}
+	first := e.content[0]
+	oid := OID{uint32(first / 40), uint32(first % 40)}
+	if first >= 80 {
+		oid = OID{2, uint32(first - 80)}
+	}
+	var n uint32
+	for i, b := range e.content[1:] {
+		n = n<<7 | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			oid = append(oid, n)
+			n = 0
+		} else if i == len(e.content)-2 {
+			return nil, fmt.Errorf("truncated OID")
+		}
+	}
+	return oid, nil
+}
+
+// children decodes the elements of a constructed element, such as a
+// sequence or a PDU.
+func (e element) children() ([]element, error) {
+	var elements []element
+	rest := e.content
+	for len(rest) > 0 {
+		var child element
+		var err error
+		child, rest, err = decode(rest)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, child)
+	}
+	return elements, nil
+}
+
+// decode reads a single TLV from the start of b, returning what follows it.
+func decode(b []byte) (element, []byte, error) {
+	if len(b) < 2 {
+		return element{}, nil, fmt.Errorf("truncated element")
+	}
+	tag := b[0]
+	length := int(b[1])
+	b = b[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(b) < n {
+			return element{}, nil, fmt.Errorf("invalid length")
+		}
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if len(b) < length {
+		return element{}, nil, fmt.Errorf("truncated element")
+	}
+	return element{tag: tag, content: b[:length]}, b[length:], nil
+}
+
+func encode(tag byte, content ...[]byte) []byte {
+	length := 0
+	for _, c := range content {
+		length += len(c)
+	}
+	b := []byte{tag}
+	switch {
+	case length < 0x80:
+		b = append(b, byte(length))
+	case length < 0x100:
+		b = append(b, 0x81, byte(length))
+	default:
+		b = append(b, 0x82, byte(length>>8), byte(length))
+	}
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func integer(v int64) element {
+	b := []byte{byte(v)}
+	for v > 0x7f || v < -0x80 {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return element{tag: tagInteger, content: b}
+}
+
+// unsigned encodes the application types that are unsigned 32 bit
+// integers, such as Gauge32 and TimeTicks.
+func unsigned(tag byte, v uint32) element {
+	e := integer(int64(v))
+	e.tag = tag
+	return e
+}
+
+func octets(s string) element {
+	return element{tag: tagOctetString, content: []byte(s)}
+}
+
+func objectID(oid OID) element {
+	if len(oid) < 2 {
+		return element{tag: tagOID, content: []byte{0}}
+	}
+	b := []byte{byte(oid[0]*40 + oid[1])}
+	for _, n := range oid[2:] {
+		var arc []byte
+		arc = append(arc, byte(n&0x7f))
+		for n >>= 7; n > 0; n >>= 7 {
+			arc = append([]byte{byte(n&0x7f | 0x80)}, arc...)
+		}
+		b = append(b, arc...)
+	}
+	return element{tag: tagOID, content: b}
+}
@@ -0,0 +1,392 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package sparkplug publishes the boiler as a Sparkplug B edge node, for
+// SCADA systems such as Ignition.
+package sparkplug
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/names"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	namespace = "spBv1.0"
+
+	bdSeqMetric   = "bdSeq"
+	rebirthMetric = "Node Control/Rebirth"
+
+	queueSize = 1024
+
+	// Changes arriving within batchWindow of each other, such as the
+	// values of one poll, are sent in a single NDATA.
+	batchWindow = 100 * time.Millisecond
+
+	maxReconnectDelay = 30 * time.Second
+)
+
+// metric is a metric announced in the last NBIRTH.
+type metric struct {
+	alias    uint64
+	dataType DataType
+}
+
+// Node publishes every value as a metric of an edge node. An NBIRTH
+// announces each metric with its alias and datatype, after which changes
+// are sent in NDATA by alias. A value that isn't in the NBIRTH, or changes
+// datatype, causes a rebirth, as does a Node Control/Rebirth command. The
+// NDEATH is the session's will, so that the host learns of the node
+// disappearing from the broker.
+type Node struct {
+	GroupID string
+	NodeID  string
+
+	uri     *url.URL
+	metrics *names.Names
+	queue   chan bus.Change
+
+	valuesMutex sync.Mutex
+	values      map[string]interface{}
+
+	mutex    sync.Mutex
+	client   paho.Client
+	sessions uint64
+	bdSeq    uint64
+	seq      uint64
+	born     map[string]metric
+	bornAt   time.Time
+	aliases  uint64
+	closed   bool
+}
+
+// NewNode creates a node for tcp://[<user>:<password>@]<host>:<port>/<group_id>[/<edge_node_id>].
+// The edge node id defaults to nbe_<serial>. Values are named as they are
+// published over MQTT, as category/key.
+func NewNode(uri *url.URL, serial string, metrics *names.Names) (*Node, error) {
+	groupID, nodeID, _ := strings.Cut(strings.Trim(uri.Path, "/"), "/")
+	if nodeID == "" {
+		nodeID = fmt.Sprintf("nbe_%s", serial)
+	}
+	for _, id := range []string{groupID, nodeID} {
+		if id == "" || strings.ContainsAny(id, "/+#") {
+			return nil, fmt.Errorf("invalid Sparkplug group or edge node id %q", id)
+		}
+	}
+	return &Node{
+		GroupID: groupID,
+		NodeID:  nodeID,
+		uri:     uri,
+		metrics: metrics,
+		queue:   make(chan bus.Change, queueSize),
+		values:  make(map[string]interface{}),
+	}, nil
+}
+
+func (n *Node) topic(messageType string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", namespace, n.GroupID, messageType, n.NodeID)
+}
+
+// Start sends changes to the node's metrics, and connects after delay,
+// once every category has been polled, so that the first NBIRTH announces
+// every metric.
+func (n *Node) Start(events *bus.Bus, delay time.Duration) {
+	events.OnChange(func(change bus.Change) {
+		if _, _, ok := convert(change.Value); !ok {
+			return
+		}
+		n.valuesMutex.Lock()
+		n.values[n.metricName(change.Category, change.Key)] = change.Value
+		n.valuesMutex.Unlock()
+
+		// Values seeded from the broker by a warm start haven't
+		// changed, and are in the NBIRTH anyway.
+		if change.Retained {
+			return
+		}
+		select {
+		case n.queue <- change:
+		default:
+			log.Warnf("Sparkplug queue is full, dropping %s.%s", change.Category, change.Key)
+		}
+	})
+
+	go func() {
+		time.Sleep(delay)
+		n.connect()
+		n.send()
+	}()
+}
+
+// connect starts a new session, retrying until it succeeds.
+func (n *Node) connect() {
+	delay := time.Second
+	for {
+		n.mutex.Lock()
+		if n.closed {
+			n.mutex.Unlock()
+			return
+		}
+		bdSeq := n.sessions % 256
+		n.sessions++
+		n.mutex.Unlock()
+
+		err := n.session(bdSeq)
+		if err == nil {
+			log.Infof("Sparkplug edge node %s/%s online (bdSeq %d)", n.GroupID, n.NodeID, bdSeq)
+			return
+		}
+		log.Errorf("Failed to start Sparkplug session with %s: %v, retrying in %s", n.uri.Host, err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// session connects with the NDEATH of bdSeq as the will, subscribes to
+// commands and publishes the NBIRTH. Every connection has a new bdSeq,
+// which its NBIRTH and NDEATH share.
+func (n *Node) session(bdSeq uint64) error {
+	death := Payload{
+		Timestamp: now(),
+		Metrics:   []Metric{{Name: bdSeqMetric, Timestamp: now(), DataType: UInt64, Value: bdSeq}},
+	}
+	opts := paho.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://%s", n.uri.Host))
+	opts.SetUsername(n.uri.User.Username())
+	password, _ := n.uri.User.Password()
+	opts.SetPassword(password)
+	opts.SetClientID(fmt.Sprintf("boiler-mate-%s-%s", n.GroupID, n.NodeID))
+	opts.SetKeepAlive(30 * time.Second)
+	opts.SetCleanSession(true)
+	// The will can't change between reconnects, so every connection is
+	// made by connect instead.
+	opts.SetAutoReconnect(false)
+	opts.SetBinaryWill(n.topic("NDEATH"), death.Marshal(), 1, false)
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		log.Errorf("Sparkplug connection lost: %v", err)
+		go n.connect()
+	})
+
+	client := paho.NewClient(opts)
+	if err := wait(client.Connect()); err != nil {
+		return err
+	}
+	if err := wait(client.Subscribe(n.topic("NCMD"), 1, n.handleCommand)); err != nil {
+		client.Disconnect(250)
+		return err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.client = client
+	n.bdSeq = bdSeq
+	if err := n.birth(); err != nil {
+		client.Disconnect(250)
+		n.client = nil
+		return fmt.Errorf("publishing NBIRTH: %v", err)
+	}
+	return nil
+}
+
+func wait(token paho.Token) error {
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("timed out")
+	}
+	return token.Error()
+}
+
+// birth publishes an NBIRTH announcing the latest of every value,
+// restarting the sequence. Changes from before it are not sent. It must be
+// called with the mutex held.
+func (n *Node) birth() error {
+	n.bornAt = time.Now()
+	ts := uint64(n.bornAt.UnixMilli())
+	n.seq = 0
+	n.born = make(map[string]metric)
+	n.aliases = 0
+
+	metrics := []Metric{
+		{Name: bdSeqMetric, Timestamp: ts, DataType: UInt64, Value: n.bdSeq},
+		{Name: rebirthMetric, Timestamp: ts, DataType: Boolean, Value: false},
+	}
+	n.valuesMutex.Lock()
+	keys := make([]string, 0, len(n.values))
+	for name := range n.values {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	for _, name := range keys {
+		dataType, value, _ := convert(n.values[name])
+		n.aliases++
+		n.born[name] = metric{alias: n.aliases, dataType: dataType}
+		metrics = append(metrics, Metric{Name: name, Alias: n.aliases, Timestamp: ts, DataType: dataType, Value: value})
+	}
+	n.valuesMutex.Unlock()
+
+	seq := n.seq
+	return n.publish("NBIRTH", Payload{Timestamp: ts, Metrics: metrics, Seq: &seq})
+}
+
+// rebirth publishes a new NBIRTH in the same session.
+func (n *Node) rebirth() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.client == nil || !n.client.IsConnected() {
+		return
+	}
+	if err := n.birth(); err != nil {
+		log.Errorf("Failed to publish Sparkplug NBIRTH: %v", err)
+	}
+}
+
+func (n *Node) handleCommand(_ paho.Client, message paho.Message) {
+	payload, err := Unmarshal(message.Payload())
+	if err != nil {
+		log.Warnf("Ignoring invalid Sparkplug NCMD: %v", err)
+		return
+	}
+	for _, m := range payload.Metrics {
+		if m.Name == rebirthMetric && m.Value == true {
+			log.Infof("Sparkplug host requested a rebirth")
+			n.rebirth()
+		}
+	}
+}
+
+// send publishes queued changes as NDATA, a batch at a time.
+func (n *Node) send() {
+	for change := range n.queue {
+		batch := []bus.Change{change}
+		timeout := time.After(batchWindow)
+	collect:
+		for {
+			select {
+			case change := <-n.queue:
+				batch = append(batch, change)
+			case <-timeout:
+				break collect
+			}
+		}
+		n.sendData(batch)
+	}
+}
+
+func (n *Node) sendData(changes []bus.Change) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.client == nil || !n.client.IsConnected() {
+		return
+	}
+
+	var metrics []Metric
+	for _, change := range changes {
+		if change.Timestamp.Before(n.bornAt) {
+			continue
+		}
+		dataType, value, _ := convert(change.Value)
+		name := n.metricName(change.Category, change.Key)
+		born, ok := n.born[name]
+		if !ok || born.dataType != dataType {
+			// The NBIRTH has the latest values, this change and
+			// the rest of the batch included.
+			log.Debugf("Sparkplug metric %s is new or changed type, rebirthing", name)
+			if err := n.birth(); err != nil {
+				log.Errorf("Failed to publish Sparkplug NBIRTH: %v", err)
+			}
+			return
+		}
+		metrics = append(metrics, Metric{Alias: born.alias, Timestamp: uint64(change.Timestamp.UnixMilli()), DataType: dataType, Value: value})
+	}
+	if len(metrics) == 0 {
+		return
+	}
+
+	n.seq = (n.seq + 1) % 256
+	seq := n.seq
+	if err := n.publish("NDATA", Payload{Timestamp: now(), Metrics: metrics, Seq: &seq}); err != nil {
+		log.Errorf("Failed to publish Sparkplug NDATA: %v", err)
+	}
+}
+
+func (n *Node) publish(messageType string, payload Payload) error {
+	return wait(n.client.Publish(n.topic(messageType), 0, false, payload.Marshal()))
+}
+
+// Close publishes the NDEATH, as the broker would if the connection were
+// lost, and disconnects.
+func (n *Node) Close() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.closed = true
+	if n.client == nil || !n.client.IsConnected() {
+		return
+	}
+	death := Payload{
+		Timestamp: now(),
+		Metrics:   []Metric{{Name: bdSeqMetric, Timestamp: now(), DataType: UInt64, Value: n.bdSeq}},
+	}
+	n.client.Publish(n.topic("NDEATH"), 1, false, death.Marshal()).WaitTimeout(3 * time.Second)
+	n.client.Disconnect(250)
+	n.client = nil
+}
+
+func (n *Node) metricName(category string, key string) string {
+	return n.metrics.Topic(category, key)
+}
+
+// convert returns the datatype and value of a metric. Numbers are always
+// doubles, as the controller reports whole numbers of values that are
+// otherwise fractional as integers.
+func convert(value interface{}) (DataType, interface{}, bool) {
+	switch v := value.(type) {
+	case int64:
+		return Double, float64(v), true
+	case nbe.RoundedFloat:
+		return Double, double(float64(v)), true
+	case float64:
+		return Double, double(v), true
+	case bool:
+		return Boolean, v, true
+	case string:
+		return String, v, true
+	}
+	return 0, nil, false
+}
+
+// double drops the noise of values the controller reports with float32
+// precision, so that 2.4 isn't sent as 2.4000000953674316.
+func double(v float64) float64 {
+	d, err := strconv.ParseFloat(strconv.FormatFloat(v, 'f', -1, 32), 64)
+	if err != nil {
+		return v
+	}
+	return d
+}
+
+func now() uint64 {
+	return uint64(time.Now().UnixMilli())
+}
@@ -0,0 +1,250 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sparkplug
+
+import (
+	"math"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/names"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/simulator"
+)
+
+func TestNewNode(t *testing.T) {
+	tests := []struct {
+		uri             string
+		groupID, nodeID string
+		ok              bool
+	}{
+		{"tcp://localhost:1883/Plant", "Plant", "nbe_1234", true},
+		{"tcp://localhost:1883/Plant/", "Plant", "nbe_1234", true},
+		{"tcp://localhost:1883/Plant/boiler", "Plant", "boiler", true},
+		{"tcp://localhost:1883/", "", "", false},
+		{"tcp://localhost:1883/Plant/boiler/1", "", "", false},
+		{"tcp://localhost:1883/Plant/boiler+", "", "", false},
+		{"tcp://localhost:1883/%23/boiler", "", "", false},
+	}
+	for _, tt := range tests {
+		uri, _ := url.Parse(tt.uri)
+		node, err := NewNode(uri, "1234", names.New(nil))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.uri, err)
+			continue
+		}
+		if err == nil && (node.GroupID != tt.groupID || node.NodeID != tt.nodeID) {
+			t.Errorf("%s: group %q, node %q", tt.uri, node.GroupID, node.NodeID)
+		}
+	}
+}
+
+type received struct {
+	topic   string
+	payload *Payload
+}
+
+// subscribe collects every Sparkplug message published to the broker at
+// addr.
+func subscribe(t *testing.T, addr string) (paho.Client, <-chan received) {
+	t.Helper()
+	messages := make(chan received, 16)
+	opts := paho.NewClientOptions()
+	opts.AddBroker("tcp://" + addr)
+	opts.SetClientID("host")
+	opts.SetAutoReconnect(false)
+	client := paho.NewClient(opts)
+	if err := wait(client.Connect()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	err := wait(client.Subscribe(namespace+"/#", 1, func(_ paho.Client, message paho.Message) {
+		payload, err := Unmarshal(message.Payload())
+		if err != nil {
+			t.Errorf("%s: %v", message.Topic(), err)
+			return
+		}
+		messages <- received{message.Topic(), payload}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, messages
+}
+
+func next(t *testing.T, messages <-chan received, topic string) *Payload {
+	t.Helper()
+	select {
+	case m := <-messages:
+		if m.topic != topic {
+			t.Fatalf("received %s, want %s", m.topic, topic)
+		}
+		return m.payload
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", topic)
+	}
+	return nil
+}
+
+// checkBirth checks an NBIRTH's bdSeq, sequence and metrics, by name,
+// alias, datatype and value.
+func checkBirth(t *testing.T, p *Payload, bdSeq uint64, want []Metric) {
+	t.Helper()
+	if p.Seq == nil || *p.Seq != 0 {
+		t.Errorf("NBIRTH seq %v, want 0", p.Seq)
+	}
+	want = append([]Metric{
+		{Name: bdSeqMetric, DataType: UInt64, Value: bdSeq},
+		{Name: rebirthMetric, DataType: Boolean, Value: false},
+	}, want...)
+	if len(p.Metrics) != len(want) {
+		t.Fatalf("NBIRTH has %+v, want %+v", p.Metrics, want)
+	}
+	for i, m := range p.Metrics {
+		if m.Timestamp != p.Timestamp {
+			t.Errorf("NBIRTH metric %s has timestamp %d, not %d", m.Name, m.Timestamp, p.Timestamp)
+		}
+		m.Timestamp = 0
+		if m != want[i] {
+			t.Errorf("NBIRTH metric %d is %+v, want %+v", i, m, want[i])
+		}
+	}
+}
+
+func TestNode(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := simulator.NewBroker()
+	go broker.Serve(listener)
+	defer broker.Close()
+	addr := listener.Addr().String()
+
+	host, messages := subscribe(t, addr)
+
+	uri, _ := url.Parse("tcp://" + addr + "/Plant/boiler")
+	node, err := NewNode(uri, "1234", names.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := bus.New()
+	node.Start(events, 50*time.Millisecond)
+
+	change := func(category, key string, value interface{}) {
+		events.Publish(bus.ChangeTopic, bus.Change{Category: category, Key: key, Value: value, Timestamp: time.Now()})
+	}
+	// Published before the NBIRTH, so they're only in it.
+	change("boiler", "temp", nbe.RoundedFloat(21.4))
+	change("operating_data", "power_kw", int64(12))
+	change("operating_data", "state_text", "Ignition")
+	change("operating_data", "unsupported", []int{1})
+
+	checkBirth(t, next(t, messages, "spBv1.0/Plant/NBIRTH/boiler"), 0, []Metric{
+		{Name: "boiler/temp", Alias: 1, DataType: Double, Value: 21.4},
+		{Name: "operating_data/power_kw", Alias: 2, DataType: Double, Value: 12.0},
+		{Name: "operating_data/state_text", Alias: 3, DataType: String, Value: "Ignition"},
+	})
+
+	// A retained value isn't sent.
+	events.Publish(bus.ChangeTopic, bus.Change{Category: "boiler", Key: "temp", Value: 30.0, Timestamp: time.Now(), Retained: true})
+	at := time.Now()
+	events.Publish(bus.ChangeTopic, bus.Change{Category: "operating_data", Key: "state_text", Value: "Power", Timestamp: at})
+	p := next(t, messages, "spBv1.0/Plant/NDATA/boiler")
+	want := Metric{Alias: 3, Timestamp: uint64(at.UnixMilli()), DataType: String, Value: "Power"}
+	if p.Seq == nil || *p.Seq != 1 || len(p.Metrics) != 1 || p.Metrics[0] != want {
+		t.Errorf("NDATA %+v, want seq 1 and %+v", p, want)
+	}
+
+	// Changes within the batch window share an NDATA.
+	change("boiler", "temp", nbe.RoundedFloat(21.5))
+	change("operating_data", "power_kw", int64(13))
+	p = next(t, messages, "spBv1.0/Plant/NDATA/boiler")
+	if p.Seq == nil || *p.Seq != 2 || len(p.Metrics) != 2 ||
+		p.Metrics[0].Alias != 1 || p.Metrics[0].Value != 21.5 ||
+		p.Metrics[1].Alias != 2 || p.Metrics[1].Value != 13.0 {
+		t.Errorf("NDATA %+v, want seq 2 and aliases 1 and 2", p)
+	}
+
+	// A new metric, or one that changes datatype, causes a rebirth.
+	change("boiler", "power", int64(50))
+	checkBirth(t, next(t, messages, "spBv1.0/Plant/NBIRTH/boiler"), 0, []Metric{
+		{Name: "boiler/power", Alias: 1, DataType: Double, Value: 50.0},
+		{Name: "boiler/temp", Alias: 2, DataType: Double, Value: 21.5},
+		{Name: "operating_data/power_kw", Alias: 3, DataType: Double, Value: 13.0},
+		{Name: "operating_data/state_text", Alias: 4, DataType: String, Value: "Power"},
+	})
+	change("operating_data", "state_text", true)
+	checkBirth(t, next(t, messages, "spBv1.0/Plant/NBIRTH/boiler"), 0, []Metric{
+		{Name: "boiler/power", Alias: 1, DataType: Double, Value: 50.0},
+		{Name: "boiler/temp", Alias: 2, DataType: Double, Value: 21.5},
+		{Name: "operating_data/power_kw", Alias: 3, DataType: Double, Value: 13.0},
+		{Name: "operating_data/state_text", Alias: 4, DataType: Boolean, Value: true},
+	})
+
+	// So does a rebirth command, but not a command to set it false.
+	command := func(value bool) {
+		t.Helper()
+		p := Payload{
+			Timestamp: now(),
+			Metrics:   []Metric{{Name: rebirthMetric, Timestamp: now(), DataType: Boolean, Value: value}},
+		}
+		if err := wait(host.Publish("spBv1.0/Plant/NCMD/boiler", 1, false, p.Marshal())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	command(false)
+	command(true)
+	// The host receives its own commands.
+	next(t, messages, "spBv1.0/Plant/NCMD/boiler")
+	next(t, messages, "spBv1.0/Plant/NCMD/boiler")
+	checkBirth(t, next(t, messages, "spBv1.0/Plant/NBIRTH/boiler"), 0, []Metric{
+		{Name: "boiler/power", Alias: 1, DataType: Double, Value: 50.0},
+		{Name: "boiler/temp", Alias: 2, DataType: Double, Value: 21.5},
+		{Name: "operating_data/power_kw", Alias: 3, DataType: Double, Value: 13.0},
+		{Name: "operating_data/state_text", Alias: 4, DataType: Boolean, Value: true},
+	})
+
+	node.Close()
+	p = next(t, messages, "spBv1.0/Plant/NDEATH/boiler")
+	want = Metric{Name: bdSeqMetric, Timestamp: p.Metrics[0].Timestamp, DataType: UInt64, Value: uint64(0)}
+	if p.Seq != nil || len(p.Metrics) != 1 || p.Metrics[0] != want {
+		t.Errorf("NDEATH %+v, want no seq and %+v", p, want)
+	}
+}
+
+func TestDouble(t *testing.T) {
+	tests := []struct {
+		in, want float64
+	}{
+		{float64(float32(2.4)), 2.4},
+		{float64(float32(-0.1)), -0.1},
+		{21.5, 21.5},
+		{0, 0},
+		{math.Inf(1), math.Inf(1)},
+	}
+	for _, tt := range tests {
+		if got := double(tt.in); got != tt.want {
+			t.Errorf("double(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
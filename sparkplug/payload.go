@@ -0,0 +1,197 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sparkplug
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DataType is a Sparkplug B metric datatype.
+type DataType uint32
+
+const (
+	Int64   DataType = 4
+	UInt64  DataType = 8
+	Double  DataType = 10
+	Boolean DataType = 11
+	String  DataType = 12
+)
+
+// Metric is a name, alias, or both, and a value of a datatype. Value is an
+// int64 or uint64 for the integer types, a float64 for Double, a bool for
+// Boolean and a string for String.
+type Metric struct {
+	Name      string
+	Alias     uint64
+	Timestamp uint64
+	DataType  DataType
+	Value     interface{}
+}
+
+// Payload is a Sparkplug B payload. Seq is left out of NDEATH payloads,
+// which are published before the session has a sequence.
+type Payload struct {
+	Timestamp uint64
+	Metrics   []Metric
+	Seq       *uint64
+}
+
+// Only the fields of org.eclipse.tahu.protobuf.Payload that an edge node
+// sends are encoded, by hand as remotewrite does, rather than generating
+// code from the .proto.
+const (
+	payloadTimestamp = 1
+	payloadMetrics   = 2
+	payloadSeq       = 3
+
+	metricName         = 1
+	metricAlias        = 2
+	metricTimestamp    = 3
+	metricDataType     = 4
+	metricLongValue    = 11
+	metricDoubleValue  = 13
+	metricBooleanValue = 14
+	metricStringValue  = 15
+)
+
+func (p Payload) Marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, payloadTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.Timestamp)
+	for _, m := range p.Metrics {
+		b = protowire.AppendTag(b, payloadMetrics, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.marshal())
+	}
+	if p.Seq != nil {
+		b = protowire.AppendTag(b, payloadSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, *p.Seq)
+	}
+	return b
+}
+
+func (m Metric) marshal() []byte {
+	var b []byte
+	if m.Name != "" {
+		b = protowire.AppendTag(b, metricName, protowire.BytesType)
+		b = protowire.AppendString(b, m.Name)
+	}
+	if m.Alias != 0 {
+		b = protowire.AppendTag(b, metricAlias, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Alias)
+	}
+	b = protowire.AppendTag(b, metricTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, m.Timestamp)
+	b = protowire.AppendTag(b, metricDataType, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.DataType))
+
+	switch v := m.Value.(type) {
+	case int64:
+		b = protowire.AppendTag(b, metricLongValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case uint64:
+		b = protowire.AppendTag(b, metricLongValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case float64:
+		b = protowire.AppendTag(b, metricDoubleValue, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		b = protowire.AppendTag(b, metricBooleanValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, metricStringValue, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+// Unmarshal decodes a payload, such as an NCMD, keeping the name, alias and
+// long, double, boolean and string values of its metrics.
+func Unmarshal(b []byte) (*Payload, error) {
+	var p Payload
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == payloadTimestamp && typ == protowire.VarintType:
+			p.Timestamp, _ = protowire.ConsumeVarint(v)
+		case num == payloadSeq && typ == protowire.VarintType:
+			seq, _ := protowire.ConsumeVarint(v)
+			p.Seq = &seq
+		case num == payloadMetrics && typ == protowire.BytesType:
+			data, _ := protowire.ConsumeBytes(v)
+			m, err := unmarshalMetric(data)
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, *m)
+		}
+		return nil
+	})
+	return &p, err
+}
+
+func unmarshalMetric(b []byte) (*Metric, error) {
+	var m Metric
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case metricName:
+			m.Name, _ = protowire.ConsumeString(v)
+		case metricAlias:
+			m.Alias, _ = protowire.ConsumeVarint(v)
+		case metricTimestamp:
+			m.Timestamp, _ = protowire.ConsumeVarint(v)
+		case metricDataType:
+			t, _ := protowire.ConsumeVarint(v)
+			m.DataType = DataType(t)
+		case metricLongValue:
+			m.Value, _ = protowire.ConsumeVarint(v)
+		case metricDoubleValue:
+			bits, _ := protowire.ConsumeFixed64(v)
+			m.Value = math.Float64frombits(bits)
+		case metricBooleanValue:
+			b, _ := protowire.ConsumeVarint(v)
+			m.Value = protowire.DecodeBool(b)
+		case metricStringValue:
+			m.Value, _ = protowire.ConsumeString(v)
+		}
+		return nil
+	})
+	return &m, err
+}
+
+// consumeFields calls fn with the number, type and encoded value of every
+// field in b.
+func consumeFields(b []byte, fn func(protowire.Number, protowire.Type, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return fmt.Errorf("invalid field %d: %v", num, protowire.ParseError(n))
+		}
+		if err := fn(num, typ, b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sparkplug
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ts is 2023-11-14T22:13:20Z, 80 d0 95 ff bc 31 as a varint.
+const ts = 1700000000000
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func seq(n uint64) *uint64 {
+	return &n
+}
+
+// The payloads a node publishes, encoded by hand from sparkplug_b.proto.
+var golden = []struct {
+	name    string
+	payload Payload
+	hex     string
+}{
+	{
+		name: "NDEATH",
+		payload: Payload{
+			Timestamp: ts,
+			Metrics:   []Metric{{Name: bdSeqMetric, Timestamp: ts, DataType: UInt64, Value: uint64(3)}},
+		},
+		hex: `08 80d095ffbc31
+			12 12
+				0a 05 6264536571
+				18 80d095ffbc31
+				20 08
+				58 03`,
+	},
+	{
+		name: "NBIRTH",
+		payload: Payload{
+			Timestamp: ts,
+			Metrics: []Metric{
+				{Name: bdSeqMetric, Timestamp: ts, DataType: UInt64, Value: uint64(0)},
+				{Name: rebirthMetric, Timestamp: ts, DataType: Boolean, Value: false},
+				{Name: "boiler/temp", Alias: 1, Timestamp: ts, DataType: Double, Value: 21.5},
+				{Name: "operating_data/state_text", Alias: 2, Timestamp: ts, DataType: String, Value: "Ignition"},
+			},
+			Seq: seq(0),
+		},
+		hex: `08 80d095ffbc31
+			12 12
+				0a 05 6264536571
+				18 80d095ffbc31
+				20 08
+				58 00
+			12 21
+				0a 14 4e6f646520436f6e74726f6c2f52656269727468
+				18 80d095ffbc31
+				20 0b
+				70 00
+			12 21
+				0a 0b 626f696c65722f74656d70
+				10 01
+				18 80d095ffbc31
+				20 0a
+				69 0000000000803540
+			12 30
+				0a 19 6f7065726174696e675f646174612f73746174655f74657874
+				10 02
+				18 80d095ffbc31
+				20 0c
+				7a 08 49676e6974696f6e
+			18 00`,
+	},
+	{
+		name: "NDATA",
+		payload: Payload{
+			Timestamp: ts + 1000,
+			Metrics:   []Metric{{Alias: 1, Timestamp: ts + 500, DataType: Double, Value: 22.0}},
+			Seq:       seq(1),
+		},
+		hex: `08 e8d795ffbc31
+			12 14
+				10 01
+				18 f4d395ffbc31
+				20 0a
+				69 0000000000003640
+			18 01`,
+	},
+	{
+		name: "Int64",
+		payload: Payload{
+			Metrics: []Metric{{Name: "m", DataType: Int64, Value: int64(-1)}},
+		},
+		hex: `08 00
+			12 12
+				0a 01 6d
+				18 00
+				20 04
+				58 ffffffffffffffffff01`,
+	},
+}
+
+func TestMarshal(t *testing.T) {
+	for _, tt := range golden {
+		want := decodeHex(t, tt.hex)
+		if got := tt.payload.Marshal(); !bytes.Equal(got, want) {
+			t.Errorf("%s: got\n% x\nwant\n% x", tt.name, got, want)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	for _, tt := range golden {
+		p, err := Unmarshal(decodeHex(t, tt.hex))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want := tt.payload
+		// Integers are decoded as uint64, whatever their datatype.
+		want.Metrics = append([]Metric(nil), want.Metrics...)
+		for i, m := range want.Metrics {
+			if v, ok := m.Value.(int64); ok {
+				want.Metrics[i].Value = uint64(v)
+			}
+		}
+		if !reflect.DeepEqual(*p, want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *p, want)
+		}
+	}
+}
+
+func TestUnmarshalCommand(t *testing.T) {
+	// A rebirth request as Ignition sends it, with a field that isn't
+	// decoded, is_null (7), ahead of the value.
+	p, err := Unmarshal(decodeHex(t, `08 80d095ffbc31
+		12 23
+			0a 14 4e6f646520436f6e74726f6c2f52656269727468
+			18 80d095ffbc31
+			20 0b
+			38 00
+			70 01`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metric{Name: rebirthMetric, Timestamp: ts, DataType: Boolean, Value: true}
+	if len(p.Metrics) != 1 || p.Metrics[0] != want {
+		t.Errorf("got %+v, want %+v", p.Metrics, want)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	for _, s := range []string{
+		"08",
+		"12 05 0a",
+		"12 02 0a 05",
+		"ff ff ff ff ff ff ff ff ff ff 01",
+	} {
+		if _, err := Unmarshal(decodeHex(t, s)); err == nil {
+			t.Errorf("%s: decoded an invalid payload", s)
+		}
+	}
+}
+
+// payloadDescriptor is the part of sparkplug_b.proto that a node sends,
+// with the field numbers and types of the published schema.
+func payloadDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ.Enum(),
+		}
+	}
+	value := func(f *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+		f.OneofIndex = proto.Int32(0)
+		return f
+	}
+	metrics := field("metrics", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	metrics.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	metrics.TypeName = proto.String(".org.eclipse.tahu.protobuf.Payload.Metric")
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("sparkplug_b.proto"),
+		Package: proto.String("org.eclipse.tahu.protobuf"),
+		Syntax:  proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Payload"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("timestamp", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT64),
+				metrics,
+				field("seq", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT64),
+				field("uuid", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("body", 5, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+			},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("Metric"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("alias", 2, descriptorpb.FieldDescriptorProto_TYPE_UINT64),
+					field("timestamp", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT64),
+					field("datatype", 4, descriptorpb.FieldDescriptorProto_TYPE_UINT32),
+					field("is_historical", 5, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					field("is_transient", 6, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					field("is_null", 7, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					value(field("int_value", 10, descriptorpb.FieldDescriptorProto_TYPE_UINT32)),
+					value(field("long_value", 11, descriptorpb.FieldDescriptorProto_TYPE_UINT64)),
+					value(field("float_value", 12, descriptorpb.FieldDescriptorProto_TYPE_FLOAT)),
+					value(field("double_value", 13, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE)),
+					value(field("boolean_value", 14, descriptorpb.FieldDescriptorProto_TYPE_BOOL)),
+					value(field("string_value", 15, descriptorpb.FieldDescriptorProto_TYPE_STRING)),
+					value(field("bytes_value", 16, descriptorpb.FieldDescriptorProto_TYPE_BYTES)),
+				},
+				OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("value")}},
+			}},
+		}},
+	}
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd.Messages().ByName("Payload")
+}
+
+// TestProtobuf decodes payloads with the protobuf library, against the
+// schema rather than the field numbers in payload.go.
+func TestProtobuf(t *testing.T) {
+	desc := payloadDescriptor(t)
+	fields := desc.Fields()
+	metricFields := fields.ByName("metrics").Message().Fields()
+
+	for _, tt := range golden {
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(tt.payload.Marshal(), msg); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := msg.Get(fields.ByName("timestamp")).Uint(); got != tt.payload.Timestamp {
+			t.Errorf("%s: timestamp %d, want %d", tt.name, got, tt.payload.Timestamp)
+		}
+		if has := msg.Has(fields.ByName("seq")); has != (tt.payload.Seq != nil) {
+			t.Errorf("%s: has seq %v", tt.name, has)
+		} else if has && msg.Get(fields.ByName("seq")).Uint() != *tt.payload.Seq {
+			t.Errorf("%s: seq %d, want %d", tt.name, msg.Get(fields.ByName("seq")).Uint(), *tt.payload.Seq)
+		}
+
+		list := msg.Get(fields.ByName("metrics")).List()
+		if list.Len() != len(tt.payload.Metrics) {
+			t.Errorf("%s: %d metrics, want %d", tt.name, list.Len(), len(tt.payload.Metrics))
+			continue
+		}
+		for i, want := range tt.payload.Metrics {
+			m := list.Get(i).Message()
+			got := Metric{
+				Name:      m.Get(metricFields.ByName("name")).String(),
+				Alias:     m.Get(metricFields.ByName("alias")).Uint(),
+				Timestamp: m.Get(metricFields.ByName("timestamp")).Uint(),
+				DataType:  DataType(m.Get(metricFields.ByName("datatype")).Uint()),
+			}
+			value := m.WhichOneof(metricFields.ByName("long_value").ContainingOneof())
+			if value == nil {
+				t.Errorf("%s: metric %d has no value", tt.name, i)
+				continue
+			}
+			switch value.Name() {
+			case "long_value":
+				v := m.Get(value).Uint()
+				if want.DataType == Int64 {
+					got.Value = int64(v)
+				} else {
+					got.Value = v
+				}
+			case "double_value":
+				got.Value = m.Get(value).Float()
+			case "boolean_value":
+				got.Value = m.Get(value).Bool()
+			case "string_value":
+				got.Value = m.Get(value).String()
+			default:
+				t.Errorf("%s: metric %d has %s", tt.name, i, value.Name())
+			}
+			if got != want {
+				t.Errorf("%s: metric %d is %+v, want %+v", tt.name, i, got, want)
+			}
+		}
+	}
+}
+
+// TestProtobufCommand decodes an NCMD encoded by the protobuf library.
+func TestProtobufCommand(t *testing.T) {
+	desc := payloadDescriptor(t)
+	fields := desc.Fields()
+	metricFields := fields.ByName("metrics").Message().Fields()
+
+	msg := dynamicpb.NewMessage(desc)
+	msg.Set(fields.ByName("timestamp"), protoreflect.ValueOfUint64(ts))
+	list := msg.Mutable(fields.ByName("metrics")).List()
+	for _, name := range []string{"other", rebirthMetric} {
+		m := list.NewElement().Message()
+		m.Set(metricFields.ByName("name"), protoreflect.ValueOfString(name))
+		m.Set(metricFields.ByName("timestamp"), protoreflect.ValueOfUint64(ts))
+		m.Set(metricFields.ByName("datatype"), protoreflect.ValueOfUint32(uint32(Boolean)))
+		m.Set(metricFields.ByName("is_null"), protoreflect.ValueOfBool(false))
+		m.Set(metricFields.ByName("boolean_value"), protoreflect.ValueOfBool(true))
+		list.Append(protoreflect.ValueOfMessage(m))
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Metric{
+		{Name: "other", Timestamp: ts, DataType: Boolean, Value: true},
+		{Name: rebirthMetric, Timestamp: ts, DataType: Boolean, Value: true},
+	}
+	if p.Timestamp != ts || p.Seq != nil || !reflect.DeepEqual(p.Metrics, want) {
+		t.Errorf("got %+v", *p)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPacketSize keeps datagrams under a typical Ethernet MTU.
+const maxPacketSize = 1432
+
+// Emitter periodically sends every numeric value to statsd as a gauge named
+// <prefix>.<serial>.<category>.<key>.
+type Emitter struct {
+	Address  string
+	Prefix   string
+	Serial   string
+	Interval time.Duration
+}
+
+// NewEmitter creates an emitter from a URI in the format
+// udp://<host>:<port>[/<prefix>].
+func NewEmitter(uri *url.URL, serial string, interval time.Duration) *Emitter {
+	prefix := strings.ReplaceAll(strings.Trim(uri.Path, "/"), "/", ".")
+	if prefix == "" {
+		prefix = "boiler_mate"
+	}
+	return &Emitter{
+		Address:  uri.Host,
+		Prefix:   prefix,
+		Serial:   serial,
+		Interval: interval,
+	}
+}
+
+func (e *Emitter) Start(monitors map[string]*monitor.Monitor) {
+	go func() {
+		ticker := time.NewTicker(e.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := e.flush(monitors); err != nil {
+				log.Errorf("Failed to send to statsd: %v", err)
+			}
+		}
+	}()
+}
+
+func (e *Emitter) flush(monitors map[string]*monitor.Monitor) error {
+	conn, err := net.Dial("udp", e.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	packet := new(bytes.Buffer)
+	send := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+
+	for category, m := range monitors {
+		for k, v := range m.Values() {
+			var value float64
+			switch t := v.(type) {
+			case nbe.RoundedFloat:
+				value = float64(t)
+			case int64:
+				value = float64(t)
+			default:
+				continue
+			}
+			line := fmt.Sprintf("%s.%s.%s.%s:%s|g", e.Prefix, e.Serial, category, k, strconv.FormatFloat(value, 'f', -1, 64))
+			if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+	return send()
+}
@@ -0,0 +1,125 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Controller traces the requests an nbe client makes and records metrics
+// about them, when passed to it with nbe.WithTelemetry.
+type Controller struct {
+	tracer trace.Tracer
+	meter  metric.Meter
+
+	requestDuration    metric.Float64Histogram
+	requestTimeouts    metric.Int64Counter
+	responseMismatches metric.Int64Counter
+	seqNoCollisions    metric.Int64Counter
+	socketRecoveries   metric.Int64Counter
+}
+
+var _ nbe.Telemetry = (*Controller)(nil)
+
+// NewController returns a Controller reporting through the global
+// providers installed by Setup.
+func NewController() *Controller {
+	const scope = "github.com/mlipscombe/boiler-mate/nbe"
+	c := &Controller{
+		tracer: otel.Tracer(scope),
+		meter:  otel.Meter(scope),
+	}
+	c.requestDuration, _ = c.meter.Float64Histogram("boiler_mate.nbe.request.duration",
+		metric.WithDescription("Time taken for the controller to answer a request."),
+		metric.WithUnit("s"))
+	c.requestTimeouts, _ = c.meter.Int64Counter("boiler_mate.nbe.request.timeouts",
+		metric.WithDescription("Requests that were not answered in time."))
+	c.responseMismatches, _ = c.meter.Int64Counter("boiler_mate.nbe.response.mismatches",
+		metric.WithDescription("Responses dropped because they did not match a waiting request."))
+	c.seqNoCollisions, _ = c.meter.Int64Counter("boiler_mate.nbe.seqno.collisions",
+		metric.WithDescription("Sequence numbers skipped because a request was still waiting on them."))
+	c.socketRecoveries, _ = c.meter.Int64Counter("boiler_mate.nbe.socket.recoveries",
+		metric.WithDescription("Times the socket to the controller was replaced after failing repeatedly."))
+	return c
+}
+
+// Request starts a span for request. The span ends when the response
+// arrives, so requests that are never answered are never exported.
+func (c *Controller) Request(request *nbe.NBERequest) func(response *nbe.NBEResponse, err error) {
+	start := time.Now()
+	function := attribute.Int("nbe.function", int(request.Function))
+	_, span := c.tracer.Start(context.Background(), "nbe.request", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(function))
+
+	return func(response *nbe.NBEResponse, err error) {
+		defer span.End()
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+		c.requestDuration.Record(context.Background(), time.Since(start).Seconds(), metric.WithAttributes(function))
+		span.SetAttributes(
+			attribute.Int("nbe.seqno", int(response.SeqNo)),
+			attribute.Int("nbe.status", int(response.Status)),
+		)
+	}
+}
+
+func (c *Controller) Timeout(function nbe.Function) {
+	c.requestTimeouts.Add(context.Background(), 1,
+		metric.WithAttributes(attribute.Int("nbe.function", int(function))))
+}
+
+func (c *Controller) Mismatch(reason string) {
+	c.responseMismatches.Add(context.Background(), 1, metric.WithAttributes(attribute.String("reason", reason)))
+}
+
+func (c *Controller) SeqNoCollision() {
+	c.seqNoCollisions.Add(context.Background(), 1)
+}
+
+func (c *Controller) SocketRecovery() {
+	c.socketRecoveries.Add(context.Background(), 1)
+}
+
+// Pending reports the requests waiting for a response, and how long the
+// oldest has been waiting.
+func (c *Controller) Pending(count func() int, oldest func() time.Duration) {
+	c.meter.Int64ObservableGauge("boiler_mate.nbe.requests.in_flight",
+		metric.WithDescription("Requests waiting for the controller to answer."),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(count()))
+			return nil
+		}))
+	c.meter.Float64ObservableGauge("boiler_mate.nbe.requests.oldest_age",
+		metric.WithDescription("How long the oldest request waiting for the controller to answer has been waiting."),
+		metric.WithUnit("s"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			o.Observe(oldest().Seconds())
+			return nil
+		}))
+}
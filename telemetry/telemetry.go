@@ -0,0 +1,145 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Provider exports traces and metrics over OTLP/HTTP. Once installed, the
+// instruments in the monitor and mqtt packages, and Controller, report
+// through it.
+type Provider struct {
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+}
+
+// Setup installs global OpenTelemetry providers exporting to a collector at
+// http[s]://[<token>@]<host>:<port>[/<path>]. The standard OTEL_EXPORTER_OTLP_*
+// environment variables are honoured for anything not set by the URI.
+func Setup(uri *url.URL, serial string, interval time.Duration) (*Provider, error) {
+	if uri.Scheme != "http" && uri.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %s", uri.Scheme)
+	}
+
+	headers := make(map[string]string)
+	if token := uri.User.Username(); token != "" {
+		headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	}
+	base := strings.TrimSuffix(uri.Path, "/")
+
+	traceOpts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(uri.Host),
+		otlptracehttp.WithURLPath(base + "/v1/traces"),
+		otlptracehttp.WithHeaders(headers),
+	}
+	metricOpts := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithEndpoint(uri.Host),
+		otlpmetrichttp.WithURLPath(base + "/v1/metrics"),
+		otlpmetrichttp.WithHeaders(headers),
+	}
+	if uri.Scheme == "http" {
+		traceOpts = append(traceOpts, otlptracehttp.WithInsecure())
+		metricOpts = append(metricOpts, otlpmetrichttp.WithInsecure())
+	}
+
+	ctx := context.Background()
+	traceExporter, err := otlptracehttp.New(ctx, traceOpts...)
+	if err != nil {
+		return nil, err
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx, metricOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("boiler-mate"),
+		attribute.String("boiler.serial", serial),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		tracerProvider: sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(traceExporter),
+			sdktrace.WithResource(res),
+		),
+		meterProvider: sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(interval))),
+			sdkmetric.WithResource(res),
+		),
+	}
+	otel.SetTracerProvider(p.tracerProvider)
+	otel.SetMeterProvider(p.meterProvider)
+	return p, nil
+}
+
+// ObserveMonitors exports every numeric value held by the monitors as the
+// boiler_mate.value gauge, labelled with its category and key.
+func (p *Provider) ObserveMonitors(monitors map[string]*monitor.Monitor) error {
+	meter := p.meterProvider.Meter("github.com/mlipscombe/boiler-mate/telemetry")
+	_, err := meter.Float64ObservableGauge("boiler_mate.value",
+		metric.WithDescription("Latest value reported by the controller."),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			for category, m := range monitors {
+				for k, v := range m.Values() {
+					var value float64
+					switch t := v.(type) {
+					case nbe.RoundedFloat:
+						value = float64(t)
+					case int64:
+						value = float64(t)
+					default:
+						continue
+					}
+					o.Observe(value, metric.WithAttributes(
+						attribute.String("category", category),
+						attribute.String("key", k),
+					))
+				}
+			}
+			return nil
+		}))
+	return err
+}
+
+// Shutdown flushes anything not yet exported.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if err := p.tracerProvider.Shutdown(ctx); err != nil {
+		return err
+	}
+	return p.meterProvider.Shutdown(ctx)
+}
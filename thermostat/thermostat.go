@@ -0,0 +1,175 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package thermostat
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/control"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Control laws.
+const (
+	// OnOff starts the boiler below target-hysteresis and stops it above
+	// target+hysteresis.
+	OnOff = "onoff"
+	// Proportional raises the boiler setpoint by gain degrees for every
+	// degree the room is below target, within min_setpoint and max_setpoint.
+	Proportional = "proportional"
+)
+
+// Config reads a room temperature from an external MQTT topic. Field picks
+// a value out of a JSON payload, e.g. "temperature" for zigbee2mqtt, and
+// may be empty if the payload is a bare number.
+type Config struct {
+	Topic        string  `yaml:"topic"`
+	Field        string  `yaml:"field"`
+	Mode         string  `yaml:"mode"`
+	Target       float64 `yaml:"target"`
+	Hysteresis   float64 `yaml:"hysteresis"`
+	SetpointKey  string  `yaml:"setpoint_key"`
+	BaseSetpoint float64 `yaml:"base_setpoint"`
+	Gain         float64 `yaml:"gain"`
+	MinSetpoint  float64 `yaml:"min_setpoint"`
+	MaxSetpoint  float64 `yaml:"max_setpoint"`
+}
+
+func (c *Config) Validate() error {
+	if c.Topic == "" {
+		return fmt.Errorf("no topic configured")
+	}
+	switch c.Mode {
+	case "", OnOff:
+		if c.Hysteresis < 0 {
+			return fmt.Errorf("hysteresis must not be negative")
+		}
+	case Proportional:
+		if c.Gain <= 0 {
+			return fmt.Errorf("gain must be positive")
+		}
+		if c.MaxSetpoint <= c.MinSetpoint {
+			return fmt.Errorf("max_setpoint must be above min_setpoint")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q, expected %s or %s", c.Mode, OnOff, Proportional)
+	}
+	return nil
+}
+
+// Thermostat turns the bridge into a basic room temperature controller.
+type Thermostat struct {
+	Config
+
+	writer     *control.Writer
+	mqttClient *mqtt.Client
+	last       string
+	mutex      sync.Mutex
+}
+
+func New(config Config, writer *control.Writer, mqttClient *mqtt.Client) *Thermostat {
+	if config.Mode == "" {
+		config.Mode = OnOff
+	}
+	if config.SetpointKey == "" {
+		config.SetpointKey = "boiler.temp"
+	}
+	return &Thermostat{
+		Config:     config,
+		writer:     writer,
+		mqttClient: mqttClient,
+	}
+}
+
+func (t *Thermostat) Start() error {
+	return t.mqttClient.SubscribeRaw(t.Topic, 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		temp, err := mqtt.ParseFloat(msg.Payload(), t.Field)
+		if err != nil {
+			log.Warnf("Ignoring room temperature from %s: %v", msg.Topic(), err)
+			return
+		}
+		t.update(temp)
+	})
+}
+
+func (t *Thermostat) update(temp float64) {
+	var key, value string
+	switch t.Mode {
+	case OnOff:
+		if temp < t.Target-t.Hysteresis {
+			key = "misc.start"
+		} else if temp > t.Target+t.Hysteresis {
+			key = "misc.stop"
+		} else {
+			return
+		}
+		value = "1"
+	case Proportional:
+		setpoint := t.BaseSetpoint + t.Gain*(t.Target-temp)
+		setpoint = math.Max(t.MinSetpoint, math.Min(t.MaxSetpoint, setpoint))
+		key = t.SetpointKey
+		value = strconv.FormatFloat(math.Round(setpoint), 'f', 0, 64)
+	}
+
+	go t.mqttClient.PublishMany("thermostat", map[string]interface{}{
+		"room_temp": temp,
+		"target":    t.Target,
+		"output":    fmt.Sprintf("%s=%s", key, value),
+	})
+
+	// Only write when the output changes, to spare the controller a write
+	// for every sensor reading.
+	action := fmt.Sprintf("%s=%s", key, value)
+	t.mutex.Lock()
+	if action == t.last {
+		t.mutex.Unlock()
+		return
+	}
+	t.last = action
+	t.mutex.Unlock()
+
+	log.Infof("Room temperature %.1f, target %.1f: setting %s", temp, t.Target, action)
+	// A failed write is retried with the next reading.
+	err := t.writer.SetResult("thermostat", key, []byte(value), func(response *nbe.NBEResponse, err error) {
+		if err == nil && response.Status == 0 {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("%v", response.Payload)
+		}
+		log.Errorf("Thermostat failed to set %s: %v", action, err)
+		t.mutex.Lock()
+		if t.last == action {
+			t.last = ""
+		}
+		t.mutex.Unlock()
+	})
+	if err != nil {
+		log.Errorf("Thermostat failed to set %s: %v", action, err)
+		t.mutex.Lock()
+		if t.last == action {
+			t.last = ""
+		}
+		t.mutex.Unlock()
+	}
+}
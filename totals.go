@@ -0,0 +1,92 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/consumption"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// publishTotals publishes the consumption of today, yesterday, this week
+// and this month as changes to the "consumption" category, whenever the
+// consumption data changes and at midnight, when the periods roll over.
+func publishTotals(events *bus.Bus, m *monitor.Monitor) {
+	var mutex sync.Mutex
+	published := make(bus.Published)
+
+	update := func() {
+		now := time.Now()
+		totals := consumption.Totals(consumption.Buckets(m.Values(), now), now)
+
+		values := make(map[string]interface{}, len(totals))
+		for key, kg := range totals {
+			values[key] = nbe.RoundedFloat(kg)
+		}
+		mutex.Lock()
+		changes := published.Changes("consumption", values, now)
+		mutex.Unlock()
+
+		for _, change := range changes {
+			events.Publish(bus.ChangeTopic, change)
+		}
+	}
+
+	events.OnChange(func(change bus.Change) {
+		if change.Category == m.Category {
+			update()
+		}
+	})
+
+	go func() {
+		for {
+			y, mo, d := time.Now().Date()
+			time.Sleep(time.Until(time.Date(y, mo, d+1, 0, 0, 0, 0, time.Local)))
+			update()
+		}
+	}()
+}
+
+// publishPerConsumption publishes what convert makes of the consumption
+// totals, such as what the pellets cost, as changes to category, whenever
+// the totals change.
+func publishPerConsumption(events *bus.Bus, category string, convert func(kg float64) float64) {
+	events.OnChange(func(change bus.Change) {
+		if change.Category != "consumption" {
+			return
+		}
+		kg, ok := change.Value.(nbe.RoundedFloat)
+		if !ok {
+			return
+		}
+		converted := bus.Change{
+			Category:  category,
+			Key:       change.Key,
+			Value:     nbe.RoundedFloat(convert(float64(kg))),
+			Timestamp: change.Timestamp,
+		}
+		if previous, ok := change.Previous.(nbe.RoundedFloat); ok {
+			converted.Previous = nbe.RoundedFloat(convert(float64(previous)))
+		}
+		events.Publish(bus.ChangeTopic, converted)
+	})
+}
@@ -0,0 +1,159 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// Terminal control sequences. Each frame is drawn over the last from the
+// top left, clearing what is left of each line, rather than clearing the
+// screen, so that it doesn't flicker.
+const (
+	ansiHome       = "\x1b[H"
+	ansiClearLine  = "\x1b[K"
+	ansiClearBelow = "\x1b[J"
+	ansiClear      = "\x1b[2J"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+	ansiBold       = "\x1b[1m"
+	ansiRed        = "\x1b[1;31m"
+	ansiDim        = "\x1b[2m"
+	ansiReset      = "\x1b[0m"
+)
+
+// runMonitor shows the controller's key operating data, refreshed in place,
+// until interrupted.
+func runMonitor(args []string) error {
+	var controllerUrlOpt, logLevel, language string
+	var interval time.Duration
+
+	flags := newCommandFlags("monitor", &controllerUrlOpt, &logLevel)
+	flags.DurationVar(&interval, "interval", 2*time.Second, "how often to refresh")
+	flags.StringVar(&language, "language", "en", "language of alarm descriptions")
+	flags.Parse(args)
+
+	if interval <= 0 {
+		return fmt.Errorf("invalid interval: %s", interval)
+	}
+
+	boiler, err := connectController(controllerUrlOpt, logLevel)
+	if err != nil {
+		return err
+	}
+	defer boiler.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	fmt.Print(ansiHideCursor + ansiClear)
+	defer fmt.Print(ansiShowCursor)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var values map[string]interface{}
+	var updated time.Time
+	for {
+		response, err := boiler.Get(nbe.GetOperatingDataFunction, "*")
+		if err == nil {
+			values = response.Payload
+			updated = time.Now()
+		}
+		os.Stdout.Write(renderMonitor(boiler, values, updated, err, language))
+
+		select {
+		case <-signals:
+			fmt.Println()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func renderMonitor(boiler nbe.Boiler, values map[string]interface{}, updated time.Time, readErr error, language string) []byte {
+	var buf bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&buf, format, args...)
+		buf.WriteString(ansiClearLine + "\n")
+	}
+	value := func(key string, unit string) string {
+		v, ok := values[key]
+		if !ok {
+			return "-"
+		}
+		return settingString(v) + unit
+	}
+	target := func(key string, unit string) string {
+		if _, ok := values[key]; !ok {
+			return ""
+		}
+		return fmt.Sprintf("%s(set %s)%s", ansiDim, value(key, unit), ansiReset)
+	}
+
+	buf.WriteString(ansiHome)
+	line("%sboiler-mate%s  controller %s (%s)", ansiBold, ansiReset, boiler.Serial(), boiler.Address())
+	line("")
+
+	state, hasState := values["state"].(int64)
+	substate, _ := values["substate"].(int64)
+	if hasState {
+		text := nbe.PowerStateText(state)
+		if sub := nbe.SubstateText(state, substate); sub != "" {
+			text += ", " + sub
+		}
+		line("  State        %s%s%s", ansiBold, text, ansiReset)
+	} else {
+		line("  State        -")
+	}
+	line("  Boiler       %-10s  %s", value("boiler_temp", " °C"), target("boiler_ref", " °C"))
+	line("  Return       %s", value("return_temp", " °C"))
+	line("  Hot water    %-10s  %s", value("dhw_temp", " °C"), target("dhw_ref", " °C"))
+	line("  Smoke        %s", value("smoke_temp", " °C"))
+	line("  Shaft        %s", value("shaft_temp", " °C"))
+	line("  Power        %-10s  %s", value("power_kw", " kW"), value("power_pct", " %"))
+	line("  Oxygen       %-10s  %s", value("oxygen", " %"), target("oxygen_ref", " %"))
+	line("  Photo        %s", value("photo_level", ""))
+	line("")
+
+	if hasState && nbe.AlarmStates[state] {
+		line("  %sALARM: %s%s", ansiRed, nbe.AlarmText(language, state), ansiReset)
+	} else {
+		line("  No alarms")
+	}
+	line("")
+
+	if readErr != nil {
+		line("  %sRead failed at %s: %v%s", ansiRed, time.Now().Format("15:04:05"), readErr, ansiReset)
+	}
+	if updated.IsZero() {
+		line("  %sWaiting for the controller, Ctrl-C to quit%s", ansiDim, ansiReset)
+	} else {
+		line("  %sUpdated %s, Ctrl-C to quit%s", ansiDim, updated.Format("15:04:05"), ansiReset)
+	}
+	buf.WriteString(ansiClearBelow)
+	return buf.Bytes()
+}
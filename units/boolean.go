@@ -0,0 +1,147 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package units
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// commands are 0/1 settings that trigger an action rather than switch
+// something on, and so are never treated as booleans.
+var commands = map[string]bool{
+	"misc.start":             true,
+	"misc.stop":              true,
+	"oxygen.start_calibrate": true,
+	"auger.start_calibrate":  true,
+	"vacuum.fill_now":        true,
+	"cleaning.start":         true,
+}
+
+// IsCommand reports whether category.key triggers an action when written,
+// such as misc.start, rather than holding a setting.
+func IsCommand(name string) bool {
+	return commands[name]
+}
+
+// builtinBooleans are values known to be on or off that have no range,
+// such as the state of the solar pumps.
+var builtinBooleans = []string{"sun.pump", "sun2.pump"}
+
+// Booleans are the settings that are switched on and off with 0 and 1,
+// which are published as ON and OFF. They are the settings whose range is
+// 0 to 1 in whole numbers, and any matching the configured patterns.
+type Booleans struct {
+	patterns []string
+	keys     map[string]bool
+	mutex    sync.RWMutex
+}
+
+func NewBooleans(patterns []string) *Booleans {
+	return &Booleans{
+		patterns: append(append([]string{}, builtinBooleans...), patterns...),
+		keys:     make(map[string]bool),
+	}
+}
+
+// ValidateBooleans checks that patterns are valid category.key patterns.
+func ValidateBooleans(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid key pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// Learn records the settings in schema that range from 0 to 1.
+func (b *Booleans) Learn(schema map[string]nbe.SettingDefinition) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for name, setting := range schema {
+		if setting.Min == 0 && setting.Max == 1 && setting.Decimals == 0 && !commands[name] {
+			b.keys[name] = true
+		}
+	}
+}
+
+// Is returns whether category.key is a boolean.
+func (b *Booleans) Is(category string, key string) bool {
+	if b == nil {
+		return false
+	}
+	name := category + "." + key
+	if commands[name] {
+		return false
+	}
+	b.mutex.RLock()
+	known := b.keys[name]
+	b.mutex.RUnlock()
+	if known {
+		return true
+	}
+	for _, pattern := range b.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys returns the category.key of every boolean learned from the schema.
+func (b *Booleans) Keys() []string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	keys := make([]string, 0, len(b.keys))
+	for name := range b.keys {
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+// formatBoolean publishes 0 as OFF and anything else as ON.
+func formatBoolean(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64:
+		if v == 0 {
+			return "OFF"
+		}
+		return "ON"
+	case nbe.RoundedFloat:
+		if v == 0 {
+			return "OFF"
+		}
+		return "ON"
+	}
+	return value
+}
+
+// parseBoolean accepts ON/OFF, true/false and 1/0, in any case.
+func parseBoolean(value []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(string(value))) {
+	case "on", "true", "1":
+		return []byte("1"), nil
+	case "off", "false", "0":
+		return []byte("0"), nil
+	}
+	return nil, fmt.Errorf("invalid value %q, expected ON or OFF", value)
+}
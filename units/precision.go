@@ -0,0 +1,158 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package units
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// Precisions maps category.key patterns, e.g. operating_data.oxygen or
+// consumption_data.*, to the number of decimal places to publish them with.
+type Precisions map[string]int
+
+func (p Precisions) Validate() error {
+	for pattern, decimals := range p {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid key pattern %q", pattern)
+		}
+		if decimals < 0 || decimals > 6 {
+			return fmt.Errorf("%s: decimals must be between 0 and 6", pattern)
+		}
+	}
+	return nil
+}
+
+// lookup returns the decimals of the most specific pattern matching name.
+func (p Precisions) lookup(name string) (int, bool) {
+	if decimals, ok := p[name]; ok {
+		return decimals, true
+	}
+	best := ""
+	for pattern := range p {
+		if ok, _ := path.Match(pattern, name); ok && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return 0, false
+	}
+	return p[best], true
+}
+
+// defaultPrecisions cover the operating data, which has no schema, and
+// settings on controllers that do not report their ranges.
+var defaultPrecisions = Precisions{
+	"operating_data.*_temp":                1,
+	"advanced_data.*_temp":                 1,
+	"sun.*_temp":                           1,
+	"sun2.*_temp":                          1,
+	"operating_data.oxygen":                1,
+	"operating_data.oxygen_ref":            1,
+	"operating_data.power_kw":              1,
+	"operating_data.power_pct":             0,
+	"operating_data.photo_level":           0,
+	"operating_data.combustion_efficiency": 1,
+	"hopper.content":                       0,
+	"consumption.*":                        1,
+	"energy.produced":                      1,
+	"ignitions.failure_rate":               1,
+	"fouling.*":                            1,
+	"cost.*":                               2,
+	"emissions.*":                          2,
+	"degree_days.*":                        1,
+	"consumption_per_degree_day.*":         2,
+}
+
+// Precision decides how many decimal places each value is published with.
+// Configured overrides come first, then the decimals in the setting schema
+// read from the controller, then the defaults.
+type Precision struct {
+	overrides Precisions
+	schema    map[string]int
+	mutex     sync.RWMutex
+}
+
+func NewPrecision(overrides Precisions) *Precision {
+	return &Precision{
+		overrides: overrides,
+		schema:    make(map[string]int),
+	}
+}
+
+// Learn records the decimals of every setting in schema.
+func (p *Precision) Learn(schema map[string]nbe.SettingDefinition) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for name, setting := range schema {
+		p.schema[name] = int(setting.Decimals)
+	}
+}
+
+// Decimals returns the number of decimal places category.key is published
+// with, and whether it is known.
+func (p *Precision) Decimals(category string, key string) (int, bool) {
+	name := category + "." + key
+	if decimals, ok := p.overrides.lookup(name); ok {
+		return decimals, true
+	}
+	p.mutex.RLock()
+	decimals, ok := p.schema[name]
+	p.mutex.RUnlock()
+	if ok {
+		return decimals, true
+	}
+	return defaultPrecisions.lookup(name)
+}
+
+// Round rounds a value of category.key to its decimal places. Lists of
+// numbers are rounded element by element, and values of unknown precision,
+// or that aren't numbers, are left alone.
+func (p *Precision) Round(category string, key string, value interface{}) interface{} {
+	if p == nil {
+		return value
+	}
+	decimals, ok := p.Decimals(category, key)
+	if !ok {
+		return value
+	}
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		return nbe.Decimal{Value: float64(v), Places: decimals}
+	case float64:
+		return nbe.Decimal{Value: v, Places: decimals}
+	case int64:
+		return nbe.Decimal{Value: float64(v), Places: decimals}
+	case string:
+		parts := strings.Split(v, ",")
+		for i, part := range parts {
+			f, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return value
+			}
+			parts[i] = strconv.FormatFloat(f, 'f', decimals, 64)
+		}
+		return strings.Join(parts, ",")
+	}
+	return value
+}
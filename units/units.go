@@ -0,0 +1,270 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package units converts values between the metric units the controller
+// uses and the units they are published in.
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mlipscombe/boiler-mate/labels"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// System is a system of units that values can be published in.
+type System string
+
+const (
+	Metric   System = "metric"
+	Imperial System = "imperial"
+)
+
+// Parse returns the system called name.
+func Parse(name string) (System, error) {
+	switch s := System(strings.ToLower(name)); s {
+	case Metric, Imperial:
+		return s, nil
+	case "":
+		return Metric, nil
+	}
+	return "", fmt.Errorf("unknown units %q, expected metric or imperial", name)
+}
+
+// Quantity is what a value measures, which decides how it is converted.
+type Quantity int
+
+const (
+	Other Quantity = iota
+	Temperature
+	TemperatureDifference
+	Mass
+	DegreeDays
+	MassPerDegreeDay
+)
+
+// quantities lists the settings that need converting. Operating data is
+// matched by name in QuantityOf.
+var quantities = map[string]Quantity{
+	"boiler.temp":               Temperature,
+	"boiler.diff_under":         TemperatureDifference,
+	"boiler.diff_over":          TemperatureDifference,
+	"hot_water.temp":            Temperature,
+	"hot_water.diff_under":      TemperatureDifference,
+	"hot_water.diff_over":       TemperatureDifference,
+	"hopper.content":            Mass,
+	"weather.room_temp":         Temperature,
+	"weather.offset":            TemperatureDifference,
+	"weather.flow_min":          Temperature,
+	"weather.flow_max":          Temperature,
+	"weather2.room_temp":        Temperature,
+	"weather2.offset":           TemperatureDifference,
+	"weather2.flow_min":         Temperature,
+	"weather2.flow_max":         Temperature,
+	"operating_data.boiler_ref": Temperature,
+	"operating_data.dhw_ref":    Temperature,
+
+	// Published by the fouling detector.
+	"fouling.recent_smoke_temp":   Temperature,
+	"fouling.baseline_smoke_temp": Temperature,
+	"fouling.smoke_temp_rise":     TemperatureDifference,
+}
+
+// QuantityOf returns what category.key measures. Operating, advanced and
+// solar data ending in _temp are temperatures, all consumption data,
+// totals and emissions are in kg, and degree days and the consumption per
+// degree day are in °C·d and kg/°C·d.
+func QuantityOf(category string, key string) Quantity {
+	if q, ok := quantities[category+"."+key]; ok {
+		return q
+	}
+	switch category {
+	case "operating_data", "advanced_data", "sun", "sun2":
+		if strings.HasSuffix(key, "_temp") {
+			return Temperature
+		}
+	case "consumption_data", "consumption", "emissions":
+		return Mass
+	case "degree_days":
+		return DegreeDays
+	case "consumption_per_degree_day":
+		return MassPerDegreeDay
+	}
+	return Other
+}
+
+// Unit returns what a metric unit is called in s.
+func (s System) Unit(metric string) string {
+	if s != Imperial {
+		return metric
+	}
+	switch metric {
+	case "°C":
+		return "°F"
+	case "kg":
+		return "lb"
+	case "°C·d":
+		return "°F·d"
+	case "kg/°C·d":
+		return "lb/°F·d"
+	}
+	return metric
+}
+
+// Number converts a metric number of quantity q to s.
+func (s System) Number(q Quantity, value float64) float64 {
+	if s != Imperial {
+		return value
+	}
+	switch q {
+	case Temperature:
+		return value*9/5 + 32
+	case TemperatureDifference, DegreeDays:
+		return value * 9 / 5
+	case Mass:
+		return value / 0.45359237
+	case MassPerDegreeDay:
+		return value / 0.45359237 * 5 / 9
+	}
+	return value
+}
+
+// numberBack converts a number of quantity q in s to metric.
+func (s System) numberBack(q Quantity, value float64) float64 {
+	if s != Imperial {
+		return value
+	}
+	switch q {
+	case Temperature:
+		return (value - 32) * 5 / 9
+	case TemperatureDifference, DegreeDays:
+		return value * 5 / 9
+	case Mass:
+		return value * 0.45359237
+	case MassPerDegreeDay:
+		return value * 0.45359237 * 9 / 5
+	}
+	return value
+}
+
+// Convert converts the value of category.key, as reported by the
+// controller, to s. Lists of numbers, as in consumption data, are converted
+// element by element, and anything that isn't a number is left alone.
+func (s System) Convert(category string, key string, value interface{}) interface{} {
+	q := QuantityOf(category, key)
+	if s != Imperial || q == Other {
+		return value
+	}
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		return nbe.RoundedFloat(s.Number(q, float64(v)))
+	case int64:
+		return nbe.RoundedFloat(s.Number(q, float64(v)))
+	case float64:
+		return nbe.RoundedFloat(s.Number(q, v))
+	case string:
+		parts := strings.Split(v, ",")
+		for i, part := range parts {
+			f, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return value
+			}
+			parts[i] = strconv.FormatFloat(s.Number(q, f), 'f', 2, 64)
+		}
+		return strings.Join(parts, ",")
+	}
+	return value
+}
+
+// ConvertValues converts every value in a category.
+func (s System) ConvertValues(category string, values map[string]interface{}) map[string]interface{} {
+	if s != Imperial {
+		return values
+	}
+	converted := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		converted[k] = s.Convert(category, k, v)
+	}
+	return converted
+}
+
+// ConvertBack converts a value written in s to what the controller
+// expects. Temperatures are rounded to whole degrees and weights to a tenth
+// of a kg, as that is all the controller accepts.
+func (s System) ConvertBack(category string, key string, value []byte) []byte {
+	q := QuantityOf(category, key)
+	if s != Imperial || q == Other {
+		return value
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+	if err != nil {
+		return value
+	}
+	metric := s.numberBack(q, f)
+	if q == Mass {
+		return []byte(strconv.FormatFloat(math.Round(metric*10)/10, 'f', -1, 64))
+	}
+	return []byte(strconv.FormatFloat(math.Round(metric), 'f', -1, 64))
+}
+
+// Formatter prepares values for publishing, publishing Booleans as ON and
+// OFF, values with Labels as their label, and converting anything else to
+// System and then rounding it to its Precision. The zero Formatter
+// publishes values as the controller reports them.
+type Formatter struct {
+	System    System
+	Precision *Precision
+	Booleans  *Booleans
+	Labels    *labels.Table
+}
+
+// Format converts and rounds the value of category.key.
+func (f Formatter) Format(category string, key string, value interface{}) interface{} {
+	if f.Booleans.Is(category, key) {
+		return formatBoolean(value)
+	}
+	if v, ok := value.(int64); ok {
+		if label, ok := f.Labels.Label(category, key, v); ok {
+			return label
+		}
+	}
+	return f.Precision.Round(category, key, f.System.Convert(category, key, value))
+}
+
+// Parse turns a value written for category.key back into what the
+// controller expects.
+func (f Formatter) Parse(category string, key string, value []byte) ([]byte, error) {
+	if f.Booleans.Is(category, key) {
+		return parseBoolean(value)
+	}
+	if v, ok := f.Labels.Value(category, key, strings.TrimSpace(string(value))); ok {
+		return []byte(strconv.FormatInt(v, 10)), nil
+	}
+	return f.System.ConvertBack(category, key, value), nil
+}
+
+// FormatValues formats every value in a category.
+func (f Formatter) FormatValues(category string, values map[string]interface{}) map[string]interface{} {
+	formatted := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		formatted[k] = f.Format(category, k, v)
+	}
+	return formatted
+}
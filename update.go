@@ -0,0 +1,179 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	releasesURL         = "https://api.github.com/repos/mlipscombe/boiler-mate/releases/latest"
+	updateTopic         = "update"
+	updateCheckInterval = 24 * time.Hour
+)
+
+type release struct {
+	TagName string `json:"tag_name"`
+	HTMLURL string `json:"html_url"`
+}
+
+// updateState is published on <prefix>/update/state in the form expected by
+// Home Assistant's update entity.
+type updateState struct {
+	InstalledVersion string `json:"installed_version"`
+	LatestVersion    string `json:"latest_version"`
+	ReleaseURL       string `json:"release_url,omitempty"`
+}
+
+// checkForUpdates looks up the latest GitHub release once a day, publishing
+// ON to <prefix>/update/available when it is newer than the running version.
+// Nothing is downloaded or installed.
+func checkForUpdates(mqttClient *mqtt.Client) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for {
+		latest, err := latestRelease(client)
+		if err != nil {
+			log.Warnf("Failed to check for updates: %v", err)
+		} else {
+			available := "OFF"
+			if newerVersion(latest.TagName, version) {
+				available = "ON"
+				log.Infof("boiler-mate %s is available (running %s): %s", latest.TagName, version, latest.HTMLURL)
+			}
+			err := mqttClient.PublishMany(updateTopic, map[string]interface{}{
+				"available": available,
+				"latest":    latest.TagName,
+				"state": updateState{
+					InstalledVersion: version,
+					LatestVersion:    latest.TagName,
+					ReleaseURL:       latest.HTMLURL,
+				},
+			})
+			if err != nil {
+				log.Errorf("Failed to publish update status: %v", err)
+			}
+		}
+		time.Sleep(updateCheckInterval)
+	}
+}
+
+func latestRelease(client *http.Client) (*release, error) {
+	req, err := http.NewRequest(http.MethodGet, releasesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", fmt.Sprintf("boiler-mate/%s", version))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	var r release
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	if r.TagName == "" {
+		return nil, fmt.Errorf("release has no tag")
+	}
+	return &r, nil
+}
+
+// newerVersion reports whether latest is a higher major.minor.patch than
+// current. Development builds, which have no version number, are never
+// considered out of date.
+func newerVersion(latest string, current string) bool {
+	l, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+	v = strings.TrimPrefix(v, "v")
+	v, _, _ = strings.Cut(v, "-")
+	v, _, _ = strings.Cut(v, "+")
+	fields := strings.Split(v, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return parts, false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// publishUpdateDiscovery adds an update entity, and an update available
+// binary sensor, to the boiler's Home Assistant device.
+func publishUpdateDiscovery(mqttClient *mqtt.Client, serial string) {
+	prefix := mqttClient.Prefix
+	dev := map[string]interface{}{
+		"ids": []string{fmt.Sprintf("nbe_%s", serial)},
+	}
+	entities := map[string]map[string]interface{}{
+		"update/boiler_mate": {
+			"name":            "boiler-mate",
+			"stat_t":          fmt.Sprintf("%s/update/state", prefix),
+			"entity_category": "diagnostic",
+		},
+		"binary_sensor/update_available": {
+			"name":            "boiler-mate Update Available",
+			"device_class":    "update",
+			"stat_t":          fmt.Sprintf("%s/update/available", prefix),
+			"entity_category": "diagnostic",
+		},
+	}
+	for k, e := range entities {
+		component, id, _ := strings.Cut(k, "/")
+		e["uniq_id"] = fmt.Sprintf("nbe_%s_%s", serial, id)
+		e["avty_t"] = fmt.Sprintf("%s/device/status", prefix)
+		e["dev"] = dev
+		err := mqttClient.PublishDiscovery(fmt.Sprintf("homeassistant/%s/nbe_%s/%s/config", component, serial, id), e)
+		if err != nil {
+			log.Errorf("Error publishing discovery message for %s: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// deriveVacuum adds the time of the next fill of the hopper, from the
+// countdown in minutes reported by the vacuum system, and whether it has an
+// error, to changes of the vacuum category.
+func deriveVacuum(key string, value interface{}, changeSet map[string]interface{}) {
+	v, ok := value.(int64)
+	if !ok {
+		return
+	}
+	switch key {
+	case "countdown":
+		changeSet["next_fill"] = countdownTime(v)
+	case "error":
+		active := "OFF"
+		if v != 0 {
+			active = "ON"
+		}
+		changeSet["error_active"] = active
+	}
+}
+
+// countdownTime returns the time a countdown in minutes ends, truncated so
+// that it doesn't change with every poll.
+func countdownTime(minutes int64) string {
+	return time.Now().Add(time.Duration(minutes) * time.Minute).Truncate(time.Minute).Format(time.RFC3339)
+}
@@ -0,0 +1,123 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+// Builds without them fall back to the VCS information embedded by go build.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && commit == "":
+			commit = s.Value
+		case s.Key == "vcs.time" && date == "":
+			date = s.Value
+		}
+	}
+}
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func currentVersion() versionInfo {
+	return versionInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		GoVersion: runtime.Version(),
+	}
+}
+
+func (v versionInfo) String() string {
+	s := fmt.Sprintf("boiler-mate %s", v.Version)
+	if v.Commit != "" {
+		s += fmt.Sprintf(" (commit %s", v.Commit)
+		if v.Date != "" {
+			s += fmt.Sprintf(", built %s", v.Date)
+		}
+		s += ")"
+	}
+	return fmt.Sprintf("%s %s/%s %s", s, runtime.GOOS, runtime.GOARCH, v.GoVersion)
+}
+
+// registerBuildInfo exports boiler_mate_build_info, which is always 1 and
+// carries the version in its labels.
+func registerBuildInfo() {
+	v := currentVersion()
+	info := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "boiler_mate",
+			Name:      "build_info",
+			Help:      "Version of boiler-mate that is running.",
+		},
+		[]string{"version", "commit", "date", "goversion"},
+	)
+	info.WithLabelValues(v.Version, v.Commit, v.Date, v.GoVersion).Set(1)
+	prometheus.MustRegister(info)
+}
+
+// withVersion adds a version object to the JSON returned by a health
+// handler, leaving its status code alone.
+func withVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+
+		body := rec.Body.Bytes()
+		var response map[string]interface{}
+		if err := json.Unmarshal(body, &response); err == nil {
+			response["version"] = currentVersion()
+			if b, err := json.Marshal(response); err == nil {
+				body = b
+			}
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+	})
+}
@@ -0,0 +1,108 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/names"
+	"github.com/mlipscombe/boiler-mate/units"
+	log "github.com/sirupsen/logrus"
+)
+
+// The broker sends retained messages as soon as a subscription is made, so
+// they are assumed to have all arrived once none has for retainedQuiet.
+const (
+	retainedQuiet = 500 * time.Millisecond
+	retainedWait  = 5 * time.Second
+)
+
+// readRetained returns the values retained under the prefix, keyed by topic
+// below the prefix.
+func readRetained(mqttClient *mqtt.Client) (map[string][]byte, error) {
+	retained := make(map[string][]byte)
+	var mutex sync.Mutex
+	done := false
+	arrived := make(chan struct{}, 1)
+
+	err := mqttClient.Subscribe("+/+", 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		if !msg.Retained() {
+			return
+		}
+		mutex.Lock()
+		if !done {
+			retained[strings.TrimPrefix(msg.Topic(), mqttClient.Prefix+"/")] = msg.Payload()
+		}
+		mutex.Unlock()
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.After(retainedWait)
+	for quiet := false; !quiet; {
+		select {
+		case <-arrived:
+		case <-time.After(retainedQuiet):
+			quiet = true
+		case <-deadline:
+			quiet = true
+		}
+	}
+	if err := mqttClient.Unsubscribe("+/+"); err != nil {
+		log.Warnf("Failed to unsubscribe from retained values: %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	done = true
+	return retained, nil
+}
+
+// warmStart seeds the monitors with the values retained on the broker from
+// before a restart, so that the first poll only publishes values that have
+// changed since, rather than every value again.
+func warmStart(mqttClient *mqtt.Client, monitors map[string]*monitor.Monitor, formatter units.Formatter, topics *names.Names) {
+	retained, err := readRetained(mqttClient)
+	if err != nil {
+		log.Errorf("Failed to read retained values for a warm start: %v", err)
+		return
+	}
+	log.Infof("Warm starting from %d retained values", len(retained))
+
+	for category, m := range monitors {
+		category := category
+		m.Retained = func(key string, value interface{}) bool {
+			published, ok := retained[topics.Topic(category, key)]
+			if !ok {
+				return false
+			}
+			payload, err := mqtt.Payload(formatter.Format(category, key, value))
+			return err == nil && bytes.Equal(payload, published)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// runWatch polls the controller and writes every change matching the
+// patterns to stdout as a line of JSON, until interrupted. The first poll
+// of each category writes every value, without a previous value.
+func runWatch(args []string) error {
+	var controllerUrlOpt, logLevel string
+	var interval time.Duration
+
+	flags := newCommandFlags("watch", &controllerUrlOpt, &logLevel)
+	flags.DurationVar(&interval, "interval", 5*time.Second, "how often to poll each category")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: boiler-mate watch [flags] [category.key|category.*|category]...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if interval <= 0 {
+		return fmt.Errorf("invalid interval: %s", interval)
+	}
+	patterns := flags.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"*.*"}
+	}
+	for i, pattern := range patterns {
+		if !strings.Contains(pattern, ".") {
+			pattern += ".*"
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", patterns[i])
+		}
+		patterns[i] = strings.ToLower(pattern)
+	}
+	matches := func(name string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Only the categories a pattern could match are polled.
+	functions := map[string]nbe.Function{}
+	for category, function := range dataFunctions {
+		functions[category] = function
+	}
+	for _, category := range nbe.Settings {
+		functions[category] = nbe.GetSetupFunction
+	}
+	var categories []string
+	for category := range functions {
+		for _, pattern := range patterns {
+			categoryPattern, _, _ := strings.Cut(pattern, ".")
+			if ok, _ := path.Match(categoryPattern, category); ok {
+				categories = append(categories, category)
+				break
+			}
+		}
+	}
+	if len(categories) == 0 {
+		return fmt.Errorf("no category matches %s", strings.Join(patterns, ", "))
+	}
+
+	boiler, err := connectController(controllerUrlOpt, logLevel)
+	if err != nil {
+		return err
+	}
+	defer boiler.Close()
+
+	var mutex sync.Mutex
+	encoder := json.NewEncoder(os.Stdout)
+	events := bus.New()
+	events.OnChange(func(change bus.Change) {
+		if !matches(change.Category + "." + change.Key) {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err := encoder.Encode(change); err != nil {
+			log.Errorf("Failed to write %s.%s: %v", change.Category, change.Key, err)
+		}
+	})
+
+	var monitors []*monitor.Monitor
+	for _, category := range categories {
+		poll := "*"
+		if functions[category] == nbe.GetSetupFunction {
+			poll = category + ".*"
+		}
+		monitors = append(monitors, monitor.NewMonitor(boiler, events, category, functions[category], poll, interval))
+	}
+	monitor.Stagger(monitors)
+	for _, m := range monitors {
+		m.Start()
+		defer m.Stop()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchdog
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Check is a component that the watchdog keeps an eye on. Stalled reports
+// an error if the component has stopped making progress, and Restart tries
+// to get it going again.
+type Check struct {
+	Name    string
+	Stalled func() error
+	Restart func() error
+}
+
+// Watchdog periodically runs its checks, restarting any component that has
+// stalled rather than leaving it serving stale data forever. A goroutine
+// dump is logged the first time a component is found stalled, to help work
+// out why.
+type Watchdog struct {
+	Interval time.Duration
+
+	checks   []Check
+	stalled  map[string]bool
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func New(interval time.Duration) *Watchdog {
+	return &Watchdog{
+		Interval: interval,
+		stalled:  make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Add registers a check. Checks must all be added before Start.
+func (w *Watchdog) Add(check Check) {
+	w.checks = append(w.checks, check)
+}
+
+func (w *Watchdog) Start() {
+	go func() {
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.run()
+			}
+		}
+	}()
+}
+
+func (w *Watchdog) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *Watchdog) run() {
+	for _, check := range w.checks {
+		err := check.Stalled()
+		if err == nil {
+			if w.stalled[check.Name] {
+				log.Infof("Watchdog: %s has recovered", check.Name)
+				delete(w.stalled, check.Name)
+			}
+			continue
+		}
+
+		log.Warnf("Watchdog: %s has stalled: %v", check.Name, err)
+		if !w.stalled[check.Name] {
+			w.stalled[check.Name] = true
+			var buf bytes.Buffer
+			if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err == nil {
+				log.Warnf("Watchdog: goroutines when %s stalled:\n%s", check.Name, buf.String())
+			}
+		}
+		if err := check.Restart(); err != nil {
+			log.Errorf("Watchdog: failed to restart %s: %v", check.Name, err)
+		} else {
+			log.Infof("Watchdog: restarted %s", check.Name)
+		}
+	}
+}
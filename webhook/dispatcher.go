@@ -0,0 +1,205 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const queueSize = 256
+
+type delivery struct {
+	hook  *hook
+	event Event
+}
+
+// Dispatcher turns the changes seen by the monitors into webhook events,
+// detecting state transitions, alarms and threshold crossings along the way.
+type Dispatcher struct {
+	Serial string
+
+	hooks    []*hook
+	client   *http.Client
+	previous map[string]interface{}
+	mutex    sync.Mutex
+	queue    chan delivery
+}
+
+func NewDispatcher(configs []Config, serial string) (*Dispatcher, error) {
+	d := &Dispatcher{
+		Serial:   serial,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		previous: make(map[string]interface{}),
+		queue:    make(chan delivery, queueSize),
+	}
+	for _, c := range configs {
+		h := &hook{Config: c}
+		if c.Template != "" {
+			t, err := parseTemplate(c.Template)
+			if err != nil {
+				return nil, err
+			}
+			h.template = t
+		}
+		d.hooks = append(d.hooks, h)
+	}
+	return d, nil
+}
+
+func (d *Dispatcher) Start(events *bus.Bus) {
+	events.OnChange(d.handle)
+	events.OnAlarm(d.handleAlarm)
+	events.OnConnectivity(d.handleConnectivity)
+
+	go func() {
+		for job := range d.queue {
+			logSend(d.client, job.hook, job.event)
+		}
+	}()
+}
+
+func (d *Dispatcher) handle(change bus.Change) {
+	name := fmt.Sprintf("%s.%s", change.Category, change.Key)
+
+	d.mutex.Lock()
+	previous, seen := d.previous[name]
+	d.previous[name] = change.Value
+	d.mutex.Unlock()
+
+	event := Event{
+		Serial:    d.Serial,
+		Timestamp: change.Timestamp,
+		Category:  change.Category,
+		Key:       change.Key,
+		Value:     change.Value,
+		Previous:  previous,
+	}
+
+	changed := event
+	changed.Type = ChangeEvent
+	changed.Text = fmt.Sprintf("%s changed to %v", name, change.Value)
+	d.Dispatch(changed)
+
+	if name == "operating_data.state" && seen {
+		cur, _ := change.Value.(int64)
+		prev, _ := previous.(int64)
+
+		state := event
+		state.Type = StateEvent
+		state.Text = fmt.Sprintf("State changed from %s to %s", nbe.PowerStateText(prev), nbe.PowerStateText(cur))
+		d.Dispatch(state)
+	}
+
+	if !seen {
+		return
+	}
+	cur, ok := toFloat(change.Value)
+	if !ok {
+		return
+	}
+	prev, ok := toFloat(previous)
+	if !ok {
+		return
+	}
+	for _, h := range d.hooks {
+		if !contains(h.Events, ThresholdEvent) {
+			continue
+		}
+		for _, t := range h.Thresholds {
+			if t.Key != name {
+				continue
+			}
+			crossed := event
+			crossed.Type = ThresholdEvent
+			if t.Above != nil && cur > *t.Above && prev <= *t.Above {
+				crossed.Text = fmt.Sprintf("%s rose above %v (%v)", name, *t.Above, change.Value)
+			} else if t.Below != nil && cur < *t.Below && prev >= *t.Below {
+				crossed.Text = fmt.Sprintf("%s fell below %v (%v)", name, *t.Below, change.Value)
+			} else {
+				continue
+			}
+			d.enqueue(h, crossed)
+		}
+	}
+}
+
+func (d *Dispatcher) handleAlarm(alarm bus.Alarm) {
+	event := Event{
+		Type:      AlarmEvent,
+		Serial:    d.Serial,
+		Timestamp: alarm.Timestamp,
+		Category:  "operating_data",
+		Key:       "state",
+		Value:     alarm.State,
+		Text:      fmt.Sprintf("Alarm: %s", alarm.Text),
+	}
+	if !alarm.Active {
+		event.Type = AlarmClearedEvent
+		event.Text = fmt.Sprintf("Alarm cleared: %s", alarm.Text)
+	}
+	d.Dispatch(event)
+}
+
+func (d *Dispatcher) handleConnectivity(c bus.Connectivity) {
+	event := Event{
+		Type:      ConnectivityEvent,
+		Serial:    d.Serial,
+		Timestamp: c.Timestamp,
+		Key:       c.Component,
+		Value:     c.Connected,
+		Text:      fmt.Sprintf("Connection to %s restored", c.Component),
+	}
+	if !c.Connected {
+		event.Text = fmt.Sprintf("Connection to %s lost: %s", c.Component, c.Error)
+	}
+	d.Dispatch(event)
+}
+
+// Dispatch queues an event for every hook subscribed to its type.
+func (d *Dispatcher) Dispatch(event Event) {
+	for _, h := range d.hooks {
+		if h.matches(event) {
+			d.enqueue(h, event)
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(h *hook, event Event) {
+	select {
+	case d.queue <- delivery{hook: h, event: event}:
+	default:
+		log.Warnf("Webhook queue is full, dropping %s event for %s", event.Type, h.URL)
+	}
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,195 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Event types that webhooks can subscribe to.
+const (
+	ChangeEvent       = "change"
+	StateEvent        = "state"
+	AlarmEvent        = "alarm"
+	AlarmClearedEvent = "alarm_cleared"
+	ThresholdEvent    = "threshold"
+	RuleEvent         = "rule"
+	ConnectivityEvent = "connectivity"
+)
+
+var eventTypes = []string{ChangeEvent, StateEvent, AlarmEvent, AlarmClearedEvent, ThresholdEvent, RuleEvent, ConnectivityEvent}
+
+// Threshold fires a threshold event when a key crosses above or below a
+// value.
+type Threshold struct {
+	Key   string   `yaml:"key"`
+	Above *float64 `yaml:"above"`
+	Below *float64 `yaml:"below"`
+}
+
+// Config is a single webhook. Keys are category.key patterns, e.g.
+// operating_data.* or boiler.temp, which restrict change events.
+type Config struct {
+	URL        string            `yaml:"url"`
+	Method     string            `yaml:"method"`
+	Headers    map[string]string `yaml:"headers"`
+	Events     []string          `yaml:"events"`
+	Keys       []string          `yaml:"keys"`
+	Thresholds []Threshold       `yaml:"thresholds"`
+	Template   string            `yaml:"template"`
+}
+
+func (c *Config) Validate() error {
+	if _, err := url.ParseRequestURI(c.URL); err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if len(c.Events) == 0 {
+		return fmt.Errorf("no events configured")
+	}
+	for _, e := range c.Events {
+		if !contains(eventTypes, e) {
+			return fmt.Errorf("unknown event %q, expected one of %s", e, strings.Join(eventTypes, ", "))
+		}
+	}
+	for _, k := range c.Keys {
+		if _, err := path.Match(k, ""); err != nil {
+			return fmt.Errorf("invalid key pattern %q", k)
+		}
+	}
+	for _, t := range c.Thresholds {
+		if t.Key == "" || (t.Above == nil && t.Below == nil) {
+			return fmt.Errorf("thresholds need a key and above or below")
+		}
+	}
+	if c.Template != "" {
+		if _, err := parseTemplate(c.Template); err != nil {
+			return fmt.Errorf("invalid template: %v", err)
+		}
+	}
+	return nil
+}
+
+// Event is passed to webhook templates, and sent as JSON if there is no
+// template.
+type Event struct {
+	Type      string      `json:"type"`
+	Serial    string      `json:"serial"`
+	Timestamp time.Time   `json:"timestamp"`
+	Category  string      `json:"category"`
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value"`
+	Previous  interface{} `json:"previous,omitempty"`
+	Text      string      `json:"text"`
+}
+
+type hook struct {
+	Config
+	template *template.Template
+}
+
+func (h *hook) matches(event Event) bool {
+	if !contains(h.Events, event.Type) {
+		return false
+	}
+	if event.Type != ChangeEvent || len(h.Keys) == 0 {
+		return true
+	}
+	name := fmt.Sprintf("%s.%s", event.Category, event.Key)
+	for _, pattern := range h.Keys {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hook) send(client *http.Client, event Event) error {
+	var body bytes.Buffer
+	if h.template != nil {
+		if err := h.template.Execute(&body, event); err != nil {
+			return err
+		}
+	} else if err := json.NewEncoder(&body).Encode(event); err != nil {
+		return err
+	}
+
+	method := h.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(strings.ToUpper(method), h.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "boiler-mate")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// logSend delivers an event to a hook, logging rather than returning errors
+// so that a broken endpoint never holds up the monitors.
+func logSend(client *http.Client, h *hook, event Event) {
+	if err := h.send(client, event); err != nil {
+		log.Errorf("Webhook %s failed for %s event: %v", h.URL, event.Type, err)
+		return
+	}
+	log.Debugf("Webhook %s sent %s event", h.URL, event.Type)
+}